@@ -0,0 +1,1291 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.12
+// 	protoc        (unknown)
+// source: agent.proto
+
+package agentpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type StartTestRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// server is the sparkyfish server to test against, as host[:port] or a
+	// ws://, wss:// or quic:// URL.  Defaults to the agent's server.
+	Server string `protobuf:"bytes,1,opt,name=server,proto3" json:"server,omitempty"`
+	// token is presented to the server, if it needs one.  Defaults to the
+	// agent's.
+	Token         string `protobuf:"bytes,2,opt,name=token,proto3" json:"token,omitempty"`
+	DownloadOnly  bool   `protobuf:"varint,3,opt,name=download_only,json=downloadOnly,proto3" json:"download_only,omitempty"`
+	UploadOnly    bool   `protobuf:"varint,4,opt,name=upload_only,json=uploadOnly,proto3" json:"upload_only,omitempty"`
+	Bidirectional bool   `protobuf:"varint,5,opt,name=bidirectional,proto3" json:"bidirectional,omitempty"`
+	Udp           bool   `protobuf:"varint,6,opt,name=udp,proto3" json:"udp,omitempty"`
+	// tags and note are recorded with the results
+	Tags          []string `protobuf:"bytes,7,rep,name=tags,proto3" json:"tags,omitempty"`
+	Note          string   `protobuf:"bytes,8,opt,name=note,proto3" json:"note,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StartTestRequest) Reset() {
+	*x = StartTestRequest{}
+	mi := &file_agent_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StartTestRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StartTestRequest) ProtoMessage() {}
+
+func (x *StartTestRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StartTestRequest.ProtoReflect.Descriptor instead.
+func (*StartTestRequest) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *StartTestRequest) GetServer() string {
+	if x != nil {
+		return x.Server
+	}
+	return ""
+}
+
+func (x *StartTestRequest) GetToken() string {
+	if x != nil {
+		return x.Token
+	}
+	return ""
+}
+
+func (x *StartTestRequest) GetDownloadOnly() bool {
+	if x != nil {
+		return x.DownloadOnly
+	}
+	return false
+}
+
+func (x *StartTestRequest) GetUploadOnly() bool {
+	if x != nil {
+		return x.UploadOnly
+	}
+	return false
+}
+
+func (x *StartTestRequest) GetBidirectional() bool {
+	if x != nil {
+		return x.Bidirectional
+	}
+	return false
+}
+
+func (x *StartTestRequest) GetUdp() bool {
+	if x != nil {
+		return x.Udp
+	}
+	return false
+}
+
+func (x *StartTestRequest) GetTags() []string {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
+func (x *StartTestRequest) GetNote() string {
+	if x != nil {
+		return x.Note
+	}
+	return ""
+}
+
+type StartTestResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	TestId        string                 `protobuf:"bytes,1,opt,name=test_id,json=testId,proto3" json:"test_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StartTestResponse) Reset() {
+	*x = StartTestResponse{}
+	mi := &file_agent_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StartTestResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StartTestResponse) ProtoMessage() {}
+
+func (x *StartTestResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StartTestResponse.ProtoReflect.Descriptor instead.
+func (*StartTestResponse) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *StartTestResponse) GetTestId() string {
+	if x != nil {
+		return x.TestId
+	}
+	return ""
+}
+
+type StreamResultsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	TestId        string                 `protobuf:"bytes,1,opt,name=test_id,json=testId,proto3" json:"test_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StreamResultsRequest) Reset() {
+	*x = StreamResultsRequest{}
+	mi := &file_agent_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StreamResultsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StreamResultsRequest) ProtoMessage() {}
+
+func (x *StreamResultsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StreamResultsRequest.ProtoReflect.Descriptor instead.
+func (*StreamResultsRequest) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *StreamResultsRequest) GetTestId() string {
+	if x != nil {
+		return x.TestId
+	}
+	return ""
+}
+
+// TestEvent is something that happened during a run
+type TestEvent struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// elapsed_seconds is the time since the run started
+	ElapsedSeconds float64 `protobuf:"fixed64,1,opt,name=elapsed_seconds,json=elapsedSeconds,proto3" json:"elapsed_seconds,omitempty"`
+	// Types that are valid to be assigned to Event:
+	//
+	//	*TestEvent_Stage
+	//	*TestEvent_Sample
+	//	*TestEvent_Ping
+	//	*TestEvent_Results
+	//	*TestEvent_Error
+	Event         isTestEvent_Event `protobuf_oneof:"event"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TestEvent) Reset() {
+	*x = TestEvent{}
+	mi := &file_agent_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TestEvent) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TestEvent) ProtoMessage() {}
+
+func (x *TestEvent) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TestEvent.ProtoReflect.Descriptor instead.
+func (*TestEvent) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *TestEvent) GetElapsedSeconds() float64 {
+	if x != nil {
+		return x.ElapsedSeconds
+	}
+	return 0
+}
+
+func (x *TestEvent) GetEvent() isTestEvent_Event {
+	if x != nil {
+		return x.Event
+	}
+	return nil
+}
+
+func (x *TestEvent) GetStage() *StageEvent {
+	if x != nil {
+		if x, ok := x.Event.(*TestEvent_Stage); ok {
+			return x.Stage
+		}
+	}
+	return nil
+}
+
+func (x *TestEvent) GetSample() *Sample {
+	if x != nil {
+		if x, ok := x.Event.(*TestEvent_Sample); ok {
+			return x.Sample
+		}
+	}
+	return nil
+}
+
+func (x *TestEvent) GetPing() *PingSample {
+	if x != nil {
+		if x, ok := x.Event.(*TestEvent_Ping); ok {
+			return x.Ping
+		}
+	}
+	return nil
+}
+
+func (x *TestEvent) GetResults() *Results {
+	if x != nil {
+		if x, ok := x.Event.(*TestEvent_Results); ok {
+			return x.Results
+		}
+	}
+	return nil
+}
+
+func (x *TestEvent) GetError() string {
+	if x != nil {
+		if x, ok := x.Event.(*TestEvent_Error); ok {
+			return x.Error
+		}
+	}
+	return ""
+}
+
+type isTestEvent_Event interface {
+	isTestEvent_Event()
+}
+
+type TestEvent_Stage struct {
+	Stage *StageEvent `protobuf:"bytes,2,opt,name=stage,proto3,oneof"`
+}
+
+type TestEvent_Sample struct {
+	Sample *Sample `protobuf:"bytes,3,opt,name=sample,proto3,oneof"`
+}
+
+type TestEvent_Ping struct {
+	Ping *PingSample `protobuf:"bytes,4,opt,name=ping,proto3,oneof"`
+}
+
+type TestEvent_Results struct {
+	Results *Results `protobuf:"bytes,5,opt,name=results,proto3,oneof"`
+}
+
+type TestEvent_Error struct {
+	// error is why the run failed
+	Error string `protobuf:"bytes,6,opt,name=error,proto3,oneof"`
+}
+
+func (*TestEvent_Stage) isTestEvent_Event() {}
+
+func (*TestEvent_Sample) isTestEvent_Event() {}
+
+func (*TestEvent_Ping) isTestEvent_Event() {}
+
+func (*TestEvent_Results) isTestEvent_Event() {}
+
+func (*TestEvent_Error) isTestEvent_Event() {}
+
+// StageEvent marks a stage of a run beginning or ending
+type StageEvent struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// stage is e.g. "ping test" or "download test"
+	Stage string `protobuf:"bytes,1,opt,name=stage,proto3" json:"stage,omitempty"`
+	Done  bool   `protobuf:"varint,2,opt,name=done,proto3" json:"done,omitempty"`
+	// error is why the stage failed, if it ended and did
+	Error         string `protobuf:"bytes,3,opt,name=error,proto3" json:"error,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StageEvent) Reset() {
+	*x = StageEvent{}
+	mi := &file_agent_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StageEvent) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StageEvent) ProtoMessage() {}
+
+func (x *StageEvent) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StageEvent.ProtoReflect.Descriptor instead.
+func (*StageEvent) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *StageEvent) GetStage() string {
+	if x != nil {
+		return x.Stage
+	}
+	return ""
+}
+
+func (x *StageEvent) GetDone() bool {
+	if x != nil {
+		return x.Done
+	}
+	return false
+}
+
+func (x *StageEvent) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+// Sample is a throughput measurement, taken every report interval
+type Sample struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// test is "download", "upload", "udp download" or "udp upload"
+	Test            string      `protobuf:"bytes,1,opt,name=test,proto3" json:"test,omitempty"`
+	Mbps            float64     `protobuf:"fixed64,2,opt,name=mbps,proto3" json:"mbps,omitempty"`
+	IntervalSeconds float64     `protobuf:"fixed64,3,opt,name=interval_seconds,json=intervalSeconds,proto3" json:"interval_seconds,omitempty"`
+	WarmUp          bool        `protobuf:"varint,4,opt,name=warm_up,json=warmUp,proto3" json:"warm_up,omitempty"`
+	Stalled         bool        `protobuf:"varint,5,opt,name=stalled,proto3" json:"stalled,omitempty"`
+	Stats           *Throughput `protobuf:"bytes,6,opt,name=stats,proto3" json:"stats,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *Sample) Reset() {
+	*x = Sample{}
+	mi := &file_agent_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Sample) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Sample) ProtoMessage() {}
+
+func (x *Sample) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Sample.ProtoReflect.Descriptor instead.
+func (*Sample) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *Sample) GetTest() string {
+	if x != nil {
+		return x.Test
+	}
+	return ""
+}
+
+func (x *Sample) GetMbps() float64 {
+	if x != nil {
+		return x.Mbps
+	}
+	return 0
+}
+
+func (x *Sample) GetIntervalSeconds() float64 {
+	if x != nil {
+		return x.IntervalSeconds
+	}
+	return 0
+}
+
+func (x *Sample) GetWarmUp() bool {
+	if x != nil {
+		return x.WarmUp
+	}
+	return false
+}
+
+func (x *Sample) GetStalled() bool {
+	if x != nil {
+		return x.Stalled
+	}
+	return false
+}
+
+func (x *Sample) GetStats() *Throughput {
+	if x != nil {
+		return x.Stats
+	}
+	return nil
+}
+
+// PingSample is a ping's round trip
+type PingSample struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	RttMs         float64                `protobuf:"fixed64,1,opt,name=rtt_ms,json=rttMs,proto3" json:"rtt_ms,omitempty"`
+	Stats         *Ping                  `protobuf:"bytes,2,opt,name=stats,proto3" json:"stats,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PingSample) Reset() {
+	*x = PingSample{}
+	mi := &file_agent_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PingSample) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PingSample) ProtoMessage() {}
+
+func (x *PingSample) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PingSample.ProtoReflect.Descriptor instead.
+func (*PingSample) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *PingSample) GetRttMs() float64 {
+	if x != nil {
+		return x.RttMs
+	}
+	return 0
+}
+
+func (x *PingSample) GetStats() *Ping {
+	if x != nil {
+		return x.Stats
+	}
+	return nil
+}
+
+type Ping struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	MinMs         float64                `protobuf:"fixed64,1,opt,name=min_ms,json=minMs,proto3" json:"min_ms,omitempty"`
+	AvgMs         float64                `protobuf:"fixed64,2,opt,name=avg_ms,json=avgMs,proto3" json:"avg_ms,omitempty"`
+	MaxMs         float64                `protobuf:"fixed64,3,opt,name=max_ms,json=maxMs,proto3" json:"max_ms,omitempty"`
+	StddevMs      float64                `protobuf:"fixed64,4,opt,name=stddev_ms,json=stddevMs,proto3" json:"stddev_ms,omitempty"`
+	JitterMs      float64                `protobuf:"fixed64,5,opt,name=jitter_ms,json=jitterMs,proto3" json:"jitter_ms,omitempty"`
+	Probes        int32                  `protobuf:"varint,6,opt,name=probes,proto3" json:"probes,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Ping) Reset() {
+	*x = Ping{}
+	mi := &file_agent_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Ping) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Ping) ProtoMessage() {}
+
+func (x *Ping) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Ping.ProtoReflect.Descriptor instead.
+func (*Ping) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *Ping) GetMinMs() float64 {
+	if x != nil {
+		return x.MinMs
+	}
+	return 0
+}
+
+func (x *Ping) GetAvgMs() float64 {
+	if x != nil {
+		return x.AvgMs
+	}
+	return 0
+}
+
+func (x *Ping) GetMaxMs() float64 {
+	if x != nil {
+		return x.MaxMs
+	}
+	return 0
+}
+
+func (x *Ping) GetStddevMs() float64 {
+	if x != nil {
+		return x.StddevMs
+	}
+	return 0
+}
+
+func (x *Ping) GetJitterMs() float64 {
+	if x != nil {
+		return x.JitterMs
+	}
+	return 0
+}
+
+func (x *Ping) GetProbes() int32 {
+	if x != nil {
+		return x.Probes
+	}
+	return 0
+}
+
+type Throughput struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	AvgMbps       float64                `protobuf:"fixed64,1,opt,name=avg_mbps,json=avgMbps,proto3" json:"avg_mbps,omitempty"`
+	MaxMbps       float64                `protobuf:"fixed64,2,opt,name=max_mbps,json=maxMbps,proto3" json:"max_mbps,omitempty"`
+	MinMbps       float64                `protobuf:"fixed64,3,opt,name=min_mbps,json=minMbps,proto3" json:"min_mbps,omitempty"`
+	MedianMbps    float64                `protobuf:"fixed64,4,opt,name=median_mbps,json=medianMbps,proto3" json:"median_mbps,omitempty"`
+	P5Mbps        float64                `protobuf:"fixed64,5,opt,name=p5_mbps,json=p5Mbps,proto3" json:"p5_mbps,omitempty"`
+	P95Mbps       float64                `protobuf:"fixed64,6,opt,name=p95_mbps,json=p95Mbps,proto3" json:"p95_mbps,omitempty"`
+	StddevMbps    float64                `protobuf:"fixed64,7,opt,name=stddev_mbps,json=stddevMbps,proto3" json:"stddev_mbps,omitempty"`
+	Bytes         int64                  `protobuf:"varint,8,opt,name=bytes,proto3" json:"bytes,omitempty"`
+	Skipped       bool                   `protobuf:"varint,9,opt,name=skipped,proto3" json:"skipped,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Throughput) Reset() {
+	*x = Throughput{}
+	mi := &file_agent_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Throughput) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Throughput) ProtoMessage() {}
+
+func (x *Throughput) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Throughput.ProtoReflect.Descriptor instead.
+func (*Throughput) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *Throughput) GetAvgMbps() float64 {
+	if x != nil {
+		return x.AvgMbps
+	}
+	return 0
+}
+
+func (x *Throughput) GetMaxMbps() float64 {
+	if x != nil {
+		return x.MaxMbps
+	}
+	return 0
+}
+
+func (x *Throughput) GetMinMbps() float64 {
+	if x != nil {
+		return x.MinMbps
+	}
+	return 0
+}
+
+func (x *Throughput) GetMedianMbps() float64 {
+	if x != nil {
+		return x.MedianMbps
+	}
+	return 0
+}
+
+func (x *Throughput) GetP5Mbps() float64 {
+	if x != nil {
+		return x.P5Mbps
+	}
+	return 0
+}
+
+func (x *Throughput) GetP95Mbps() float64 {
+	if x != nil {
+		return x.P95Mbps
+	}
+	return 0
+}
+
+func (x *Throughput) GetStddevMbps() float64 {
+	if x != nil {
+		return x.StddevMbps
+	}
+	return 0
+}
+
+func (x *Throughput) GetBytes() int64 {
+	if x != nil {
+		return x.Bytes
+	}
+	return 0
+}
+
+func (x *Throughput) GetSkipped() bool {
+	if x != nil {
+		return x.Skipped
+	}
+	return false
+}
+
+// Results are a run's results.  The headline numbers are broken out;
+// results_json holds all of them, as "sparkyfish-cli -json" prints them.
+type Results struct {
+	state           protoimpl.MessageState `protogen:"open.v1"`
+	Server          string                 `protobuf:"bytes,1,opt,name=server,proto3" json:"server,omitempty"`
+	StartTimeUnixMs int64                  `protobuf:"varint,2,opt,name=start_time_unix_ms,json=startTimeUnixMs,proto3" json:"start_time_unix_ms,omitempty"`
+	EndTimeUnixMs   int64                  `protobuf:"varint,3,opt,name=end_time_unix_ms,json=endTimeUnixMs,proto3" json:"end_time_unix_ms,omitempty"`
+	Ping            *Ping                  `protobuf:"bytes,4,opt,name=ping,proto3" json:"ping,omitempty"`
+	Download        *Throughput            `protobuf:"bytes,5,opt,name=download,proto3" json:"download,omitempty"`
+	Upload          *Throughput            `protobuf:"bytes,6,opt,name=upload,proto3" json:"upload,omitempty"`
+	Tags            []string               `protobuf:"bytes,7,rep,name=tags,proto3" json:"tags,omitempty"`
+	Note            string                 `protobuf:"bytes,8,opt,name=note,proto3" json:"note,omitempty"`
+	ResultsJson     string                 `protobuf:"bytes,9,opt,name=results_json,json=resultsJson,proto3" json:"results_json,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *Results) Reset() {
+	*x = Results{}
+	mi := &file_agent_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Results) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Results) ProtoMessage() {}
+
+func (x *Results) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Results.ProtoReflect.Descriptor instead.
+func (*Results) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *Results) GetServer() string {
+	if x != nil {
+		return x.Server
+	}
+	return ""
+}
+
+func (x *Results) GetStartTimeUnixMs() int64 {
+	if x != nil {
+		return x.StartTimeUnixMs
+	}
+	return 0
+}
+
+func (x *Results) GetEndTimeUnixMs() int64 {
+	if x != nil {
+		return x.EndTimeUnixMs
+	}
+	return 0
+}
+
+func (x *Results) GetPing() *Ping {
+	if x != nil {
+		return x.Ping
+	}
+	return nil
+}
+
+func (x *Results) GetDownload() *Throughput {
+	if x != nil {
+		return x.Download
+	}
+	return nil
+}
+
+func (x *Results) GetUpload() *Throughput {
+	if x != nil {
+		return x.Upload
+	}
+	return nil
+}
+
+func (x *Results) GetTags() []string {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
+func (x *Results) GetNote() string {
+	if x != nil {
+		return x.Note
+	}
+	return ""
+}
+
+func (x *Results) GetResultsJson() string {
+	if x != nil {
+		return x.ResultsJson
+	}
+	return ""
+}
+
+type ListServersRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListServersRequest) Reset() {
+	*x = ListServersRequest{}
+	mi := &file_agent_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListServersRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListServersRequest) ProtoMessage() {}
+
+func (x *ListServersRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListServersRequest.ProtoReflect.Descriptor instead.
+func (*ListServersRequest) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{10}
+}
+
+type ListServersResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Servers       []*Server              `protobuf:"bytes,1,rep,name=servers,proto3" json:"servers,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListServersResponse) Reset() {
+	*x = ListServersResponse{}
+	mi := &file_agent_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListServersResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListServersResponse) ProtoMessage() {}
+
+func (x *ListServersResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListServersResponse.ProtoReflect.Descriptor instead.
+func (*ListServersResponse) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *ListServersResponse) GetServers() []*Server {
+	if x != nil {
+		return x.Servers
+	}
+	return nil
+}
+
+type Server struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Addr          string                 `protobuf:"bytes,1,opt,name=addr,proto3" json:"addr,omitempty"`
+	Location      string                 `protobuf:"bytes,2,opt,name=location,proto3" json:"location,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Server) Reset() {
+	*x = Server{}
+	mi := &file_agent_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Server) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Server) ProtoMessage() {}
+
+func (x *Server) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Server.ProtoReflect.Descriptor instead.
+func (*Server) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *Server) GetAddr() string {
+	if x != nil {
+		return x.Addr
+	}
+	return ""
+}
+
+func (x *Server) GetLocation() string {
+	if x != nil {
+		return x.Location
+	}
+	return ""
+}
+
+type GetHistoryRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// server, if set, only returns runs against servers whose address
+	// contains it
+	Server string `protobuf:"bytes,1,opt,name=server,proto3" json:"server,omitempty"`
+	// tag, if set, only returns runs tagged with it
+	Tag string `protobuf:"bytes,2,opt,name=tag,proto3" json:"tag,omitempty"`
+	// since_unix_ms, if set, only returns runs since then
+	SinceUnixMs int64 `protobuf:"varint,3,opt,name=since_unix_ms,json=sinceUnixMs,proto3" json:"since_unix_ms,omitempty"`
+	// limit, if set, only returns the most recent runs
+	Limit         int32 `protobuf:"varint,4,opt,name=limit,proto3" json:"limit,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetHistoryRequest) Reset() {
+	*x = GetHistoryRequest{}
+	mi := &file_agent_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetHistoryRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetHistoryRequest) ProtoMessage() {}
+
+func (x *GetHistoryRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetHistoryRequest.ProtoReflect.Descriptor instead.
+func (*GetHistoryRequest) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *GetHistoryRequest) GetServer() string {
+	if x != nil {
+		return x.Server
+	}
+	return ""
+}
+
+func (x *GetHistoryRequest) GetTag() string {
+	if x != nil {
+		return x.Tag
+	}
+	return ""
+}
+
+func (x *GetHistoryRequest) GetSinceUnixMs() int64 {
+	if x != nil {
+		return x.SinceUnixMs
+	}
+	return 0
+}
+
+func (x *GetHistoryRequest) GetLimit() int32 {
+	if x != nil {
+		return x.Limit
+	}
+	return 0
+}
+
+type GetHistoryResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// runs are oldest first
+	Runs          []*Results `protobuf:"bytes,1,rep,name=runs,proto3" json:"runs,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetHistoryResponse) Reset() {
+	*x = GetHistoryResponse{}
+	mi := &file_agent_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetHistoryResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetHistoryResponse) ProtoMessage() {}
+
+func (x *GetHistoryResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_agent_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetHistoryResponse.ProtoReflect.Descriptor instead.
+func (*GetHistoryResponse) Descriptor() ([]byte, []int) {
+	return file_agent_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *GetHistoryResponse) GetRuns() []*Results {
+	if x != nil {
+		return x.Runs
+	}
+	return nil
+}
+
+var File_agent_proto protoreflect.FileDescriptor
+
+const file_agent_proto_rawDesc = "" +
+	"\n" +
+	"\vagent.proto\x12\rsparkyfish.v1\"\xe6\x01\n" +
+	"\x10StartTestRequest\x12\x16\n" +
+	"\x06server\x18\x01 \x01(\tR\x06server\x12\x14\n" +
+	"\x05token\x18\x02 \x01(\tR\x05token\x12#\n" +
+	"\rdownload_only\x18\x03 \x01(\bR\fdownloadOnly\x12\x1f\n" +
+	"\vupload_only\x18\x04 \x01(\bR\n" +
+	"uploadOnly\x12$\n" +
+	"\rbidirectional\x18\x05 \x01(\bR\rbidirectional\x12\x10\n" +
+	"\x03udp\x18\x06 \x01(\bR\x03udp\x12\x12\n" +
+	"\x04tags\x18\a \x03(\tR\x04tags\x12\x12\n" +
+	"\x04note\x18\b \x01(\tR\x04note\",\n" +
+	"\x11StartTestResponse\x12\x17\n" +
+	"\atest_id\x18\x01 \x01(\tR\x06testId\"/\n" +
+	"\x14StreamResultsRequest\x12\x17\n" +
+	"\atest_id\x18\x01 \x01(\tR\x06testId\"\x9e\x02\n" +
+	"\tTestEvent\x12'\n" +
+	"\x0felapsed_seconds\x18\x01 \x01(\x01R\x0eelapsedSeconds\x121\n" +
+	"\x05stage\x18\x02 \x01(\v2\x19.sparkyfish.v1.StageEventH\x00R\x05stage\x12/\n" +
+	"\x06sample\x18\x03 \x01(\v2\x15.sparkyfish.v1.SampleH\x00R\x06sample\x12/\n" +
+	"\x04ping\x18\x04 \x01(\v2\x19.sparkyfish.v1.PingSampleH\x00R\x04ping\x122\n" +
+	"\aresults\x18\x05 \x01(\v2\x16.sparkyfish.v1.ResultsH\x00R\aresults\x12\x16\n" +
+	"\x05error\x18\x06 \x01(\tH\x00R\x05errorB\a\n" +
+	"\x05event\"L\n" +
+	"\n" +
+	"StageEvent\x12\x14\n" +
+	"\x05stage\x18\x01 \x01(\tR\x05stage\x12\x12\n" +
+	"\x04done\x18\x02 \x01(\bR\x04done\x12\x14\n" +
+	"\x05error\x18\x03 \x01(\tR\x05error\"\xbf\x01\n" +
+	"\x06Sample\x12\x12\n" +
+	"\x04test\x18\x01 \x01(\tR\x04test\x12\x12\n" +
+	"\x04mbps\x18\x02 \x01(\x01R\x04mbps\x12)\n" +
+	"\x10interval_seconds\x18\x03 \x01(\x01R\x0fintervalSeconds\x12\x17\n" +
+	"\awarm_up\x18\x04 \x01(\bR\x06warmUp\x12\x18\n" +
+	"\astalled\x18\x05 \x01(\bR\astalled\x12/\n" +
+	"\x05stats\x18\x06 \x01(\v2\x19.sparkyfish.v1.ThroughputR\x05stats\"N\n" +
+	"\n" +
+	"PingSample\x12\x15\n" +
+	"\x06rtt_ms\x18\x01 \x01(\x01R\x05rttMs\x12)\n" +
+	"\x05stats\x18\x02 \x01(\v2\x13.sparkyfish.v1.PingR\x05stats\"\x9d\x01\n" +
+	"\x04Ping\x12\x15\n" +
+	"\x06min_ms\x18\x01 \x01(\x01R\x05minMs\x12\x15\n" +
+	"\x06avg_ms\x18\x02 \x01(\x01R\x05avgMs\x12\x15\n" +
+	"\x06max_ms\x18\x03 \x01(\x01R\x05maxMs\x12\x1b\n" +
+	"\tstddev_ms\x18\x04 \x01(\x01R\bstddevMs\x12\x1b\n" +
+	"\tjitter_ms\x18\x05 \x01(\x01R\bjitterMs\x12\x16\n" +
+	"\x06probes\x18\x06 \x01(\x05R\x06probes\"\x83\x02\n" +
+	"\n" +
+	"Throughput\x12\x19\n" +
+	"\bavg_mbps\x18\x01 \x01(\x01R\aavgMbps\x12\x19\n" +
+	"\bmax_mbps\x18\x02 \x01(\x01R\amaxMbps\x12\x19\n" +
+	"\bmin_mbps\x18\x03 \x01(\x01R\aminMbps\x12\x1f\n" +
+	"\vmedian_mbps\x18\x04 \x01(\x01R\n" +
+	"medianMbps\x12\x17\n" +
+	"\ap5_mbps\x18\x05 \x01(\x01R\x06p5Mbps\x12\x19\n" +
+	"\bp95_mbps\x18\x06 \x01(\x01R\ap95Mbps\x12\x1f\n" +
+	"\vstddev_mbps\x18\a \x01(\x01R\n" +
+	"stddevMbps\x12\x14\n" +
+	"\x05bytes\x18\b \x01(\x03R\x05bytes\x12\x18\n" +
+	"\askipped\x18\t \x01(\bR\askipped\"\xd5\x02\n" +
+	"\aResults\x12\x16\n" +
+	"\x06server\x18\x01 \x01(\tR\x06server\x12+\n" +
+	"\x12start_time_unix_ms\x18\x02 \x01(\x03R\x0fstartTimeUnixMs\x12'\n" +
+	"\x10end_time_unix_ms\x18\x03 \x01(\x03R\rendTimeUnixMs\x12'\n" +
+	"\x04ping\x18\x04 \x01(\v2\x13.sparkyfish.v1.PingR\x04ping\x125\n" +
+	"\bdownload\x18\x05 \x01(\v2\x19.sparkyfish.v1.ThroughputR\bdownload\x121\n" +
+	"\x06upload\x18\x06 \x01(\v2\x19.sparkyfish.v1.ThroughputR\x06upload\x12\x12\n" +
+	"\x04tags\x18\a \x03(\tR\x04tags\x12\x12\n" +
+	"\x04note\x18\b \x01(\tR\x04note\x12!\n" +
+	"\fresults_json\x18\t \x01(\tR\vresultsJson\"\x14\n" +
+	"\x12ListServersRequest\"F\n" +
+	"\x13ListServersResponse\x12/\n" +
+	"\aservers\x18\x01 \x03(\v2\x15.sparkyfish.v1.ServerR\aservers\"8\n" +
+	"\x06Server\x12\x12\n" +
+	"\x04addr\x18\x01 \x01(\tR\x04addr\x12\x1a\n" +
+	"\blocation\x18\x02 \x01(\tR\blocation\"w\n" +
+	"\x11GetHistoryRequest\x12\x16\n" +
+	"\x06server\x18\x01 \x01(\tR\x06server\x12\x10\n" +
+	"\x03tag\x18\x02 \x01(\tR\x03tag\x12\"\n" +
+	"\rsince_unix_ms\x18\x03 \x01(\x03R\vsinceUnixMs\x12\x14\n" +
+	"\x05limit\x18\x04 \x01(\x05R\x05limit\"@\n" +
+	"\x12GetHistoryResponse\x12*\n" +
+	"\x04runs\x18\x01 \x03(\v2\x16.sparkyfish.v1.ResultsR\x04runs2\xd2\x02\n" +
+	"\x05Agent\x12N\n" +
+	"\tStartTest\x12\x1f.sparkyfish.v1.StartTestRequest\x1a .sparkyfish.v1.StartTestResponse\x12P\n" +
+	"\rStreamResults\x12#.sparkyfish.v1.StreamResultsRequest\x1a\x18.sparkyfish.v1.TestEvent0\x01\x12T\n" +
+	"\vListServers\x12!.sparkyfish.v1.ListServersRequest\x1a\".sparkyfish.v1.ListServersResponse\x12Q\n" +
+	"\n" +
+	"GetHistory\x12 .sparkyfish.v1.GetHistoryRequest\x1a!.sparkyfish.v1.GetHistoryResponseB(Z&github.com/freinold/sparkyfish/agentpbb\x06proto3"
+
+var (
+	file_agent_proto_rawDescOnce sync.Once
+	file_agent_proto_rawDescData []byte
+)
+
+func file_agent_proto_rawDescGZIP() []byte {
+	file_agent_proto_rawDescOnce.Do(func() {
+		file_agent_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_agent_proto_rawDesc), len(file_agent_proto_rawDesc)))
+	})
+	return file_agent_proto_rawDescData
+}
+
+var file_agent_proto_msgTypes = make([]protoimpl.MessageInfo, 15)
+var file_agent_proto_goTypes = []any{
+	(*StartTestRequest)(nil),     // 0: sparkyfish.v1.StartTestRequest
+	(*StartTestResponse)(nil),    // 1: sparkyfish.v1.StartTestResponse
+	(*StreamResultsRequest)(nil), // 2: sparkyfish.v1.StreamResultsRequest
+	(*TestEvent)(nil),            // 3: sparkyfish.v1.TestEvent
+	(*StageEvent)(nil),           // 4: sparkyfish.v1.StageEvent
+	(*Sample)(nil),               // 5: sparkyfish.v1.Sample
+	(*PingSample)(nil),           // 6: sparkyfish.v1.PingSample
+	(*Ping)(nil),                 // 7: sparkyfish.v1.Ping
+	(*Throughput)(nil),           // 8: sparkyfish.v1.Throughput
+	(*Results)(nil),              // 9: sparkyfish.v1.Results
+	(*ListServersRequest)(nil),   // 10: sparkyfish.v1.ListServersRequest
+	(*ListServersResponse)(nil),  // 11: sparkyfish.v1.ListServersResponse
+	(*Server)(nil),               // 12: sparkyfish.v1.Server
+	(*GetHistoryRequest)(nil),    // 13: sparkyfish.v1.GetHistoryRequest
+	(*GetHistoryResponse)(nil),   // 14: sparkyfish.v1.GetHistoryResponse
+}
+var file_agent_proto_depIdxs = []int32{
+	4,  // 0: sparkyfish.v1.TestEvent.stage:type_name -> sparkyfish.v1.StageEvent
+	5,  // 1: sparkyfish.v1.TestEvent.sample:type_name -> sparkyfish.v1.Sample
+	6,  // 2: sparkyfish.v1.TestEvent.ping:type_name -> sparkyfish.v1.PingSample
+	9,  // 3: sparkyfish.v1.TestEvent.results:type_name -> sparkyfish.v1.Results
+	8,  // 4: sparkyfish.v1.Sample.stats:type_name -> sparkyfish.v1.Throughput
+	7,  // 5: sparkyfish.v1.PingSample.stats:type_name -> sparkyfish.v1.Ping
+	7,  // 6: sparkyfish.v1.Results.ping:type_name -> sparkyfish.v1.Ping
+	8,  // 7: sparkyfish.v1.Results.download:type_name -> sparkyfish.v1.Throughput
+	8,  // 8: sparkyfish.v1.Results.upload:type_name -> sparkyfish.v1.Throughput
+	12, // 9: sparkyfish.v1.ListServersResponse.servers:type_name -> sparkyfish.v1.Server
+	9,  // 10: sparkyfish.v1.GetHistoryResponse.runs:type_name -> sparkyfish.v1.Results
+	0,  // 11: sparkyfish.v1.Agent.StartTest:input_type -> sparkyfish.v1.StartTestRequest
+	2,  // 12: sparkyfish.v1.Agent.StreamResults:input_type -> sparkyfish.v1.StreamResultsRequest
+	10, // 13: sparkyfish.v1.Agent.ListServers:input_type -> sparkyfish.v1.ListServersRequest
+	13, // 14: sparkyfish.v1.Agent.GetHistory:input_type -> sparkyfish.v1.GetHistoryRequest
+	1,  // 15: sparkyfish.v1.Agent.StartTest:output_type -> sparkyfish.v1.StartTestResponse
+	3,  // 16: sparkyfish.v1.Agent.StreamResults:output_type -> sparkyfish.v1.TestEvent
+	11, // 17: sparkyfish.v1.Agent.ListServers:output_type -> sparkyfish.v1.ListServersResponse
+	14, // 18: sparkyfish.v1.Agent.GetHistory:output_type -> sparkyfish.v1.GetHistoryResponse
+	15, // [15:19] is the sub-list for method output_type
+	11, // [11:15] is the sub-list for method input_type
+	11, // [11:11] is the sub-list for extension type_name
+	11, // [11:11] is the sub-list for extension extendee
+	0,  // [0:11] is the sub-list for field type_name
+}
+
+func init() { file_agent_proto_init() }
+func file_agent_proto_init() {
+	if File_agent_proto != nil {
+		return
+	}
+	file_agent_proto_msgTypes[3].OneofWrappers = []any{
+		(*TestEvent_Stage)(nil),
+		(*TestEvent_Sample)(nil),
+		(*TestEvent_Ping)(nil),
+		(*TestEvent_Results)(nil),
+		(*TestEvent_Error)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_agent_proto_rawDesc), len(file_agent_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   15,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_agent_proto_goTypes,
+		DependencyIndexes: file_agent_proto_depIdxs,
+		MessageInfos:      file_agent_proto_msgTypes,
+	}.Build()
+	File_agent_proto = out.File
+	file_agent_proto_goTypes = nil
+	file_agent_proto_depIdxs = nil
+}
@@ -0,0 +1,7 @@
+// Package agentpb is the gRPC API of the sparkyfish agent, which
+// "sparkyfish-cli agent" runs, generated from agent.proto.  Fleet-management
+// tooling can use it to start tests, stream their measurements as they're
+// taken and fetch past results, without parsing sparkyfish-cli's output.
+package agentpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative agent.proto
@@ -0,0 +1,140 @@
+package sparkyfish
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// RunBidirectionalTest runs a download and an upload test at the same time,
+// over two connections.  OnThroughput is called for both tests as they run,
+// possibly from two goroutines at once.  If either connection drops, both
+// tests start over.
+func (c *Client) RunBidirectionalTest(ctx context.Context) (download ThroughputResult, upload ThroughputResult, err error) {
+	err = c.retry(ctx, func() (err error) {
+		download, upload, err = c.bidirectionalTest(ctx)
+		return err
+	})
+	return download, upload, err
+}
+
+// bidirectionalTest runs a single attempt at a bidirectional test
+func (c *Client) bidirectionalTest(ctx context.Context) (download ThroughputResult, upload ThroughputResult, err error) {
+	err = c.checkThroughputSettings()
+	if err != nil {
+		return download, upload, err
+	}
+
+	down, up, err := c.beginBidirectional(ctx)
+	if err != nil {
+		return download, upload, err
+	}
+	defer down.close()
+	defer up.close()
+
+	var wg sync.WaitGroup
+	var downErr, upErr error
+	var downTCP, upTCP *TCPStats
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		download, downErr = c.measure(Inbound, func(meter *byteMeter, events chan<- Event) error {
+			err := c.copyData(ctx, down, Inbound, c.MaxBytes, c.RateLimit, meter, events)
+			downTCP = readTCPStats(down.tcp)
+			return err
+		})
+	}()
+	go func() {
+		defer wg.Done()
+		upload, upErr = c.measure(Outbound, func(meter *byteMeter, events chan<- Event) error {
+			err := c.copyData(ctx, up, Outbound, c.MaxBytes, c.RateLimit, meter, events)
+			upTCP = readTCPStats(up.tcp)
+			return err
+		})
+	}()
+	wg.Wait()
+	download.TCP, upload.TCP = downTCP, upTCP
+	upload.CappedBy = up.capped
+	download.Stopped, upload.Stopped = down.stopped, up.stopped
+	if downErr != nil {
+		download.Stopped = stopReason(downErr)
+	}
+	if upErr != nil {
+		upload.Stopped = stopReason(upErr)
+	}
+
+	if downErr != nil {
+		return download, upload, fmt.Errorf("download: %w", downErr)
+	}
+	if upErr != nil {
+		return download, upload, fmt.Errorf("upload: %w", upErr)
+	}
+
+	return download, upload, nil
+}
+
+// beginBidirectional opens the two sessions for a bidirectional test.  The
+// first carries the download and the second the upload.  The server hands us
+// an ID on the first session that we present on the second, so that it can
+// pair them up and start both halves of the test at once.
+func (c *Client) beginBidirectional(ctx context.Context) (down *session, up *session, err error) {
+	down, err = c.beginSession(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !down.info.Supports(CapBidirectional) {
+		down.close()
+		return nil, nil, fmt.Errorf("server doesn't support bidirectional tests")
+	}
+
+	err = down.writeCommand("BID")
+	if err != nil {
+		down.close()
+		return nil, nil, err
+	}
+
+	id, err := down.readLine()
+	if err != nil {
+		down.close()
+		return nil, nil, err
+	}
+	if _, err := strconv.ParseUint(id, 16, 64); err != nil {
+		down.close()
+		return nil, nil, fmt.Errorf("invalid BID session ID from server: %v", id)
+	}
+
+	addr := c.addr
+	up, err = c.beginSession(ctx)
+	if err != nil {
+		down.close()
+		return nil, nil, err
+	}
+
+	// If a busy server sent the upload elsewhere, the download is at the
+	// wrong server, so we start again there
+	if c.addr != addr {
+		up.close()
+		down.close()
+		return c.beginBidirectional(ctx)
+	}
+
+	// The server answers OK once both halves are ready to go
+	err = up.writeCommand("BID " + id)
+	var response string
+	if err == nil {
+		response, err = up.readLine()
+	}
+	if err == nil && response != "OK" {
+		err = fmt.Errorf("invalid BID response from server")
+	}
+	if err != nil {
+		up.close()
+		down.close()
+		return nil, nil, err
+	}
+
+	return down, up, nil
+}
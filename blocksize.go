@@ -0,0 +1,45 @@
+package sparkyfish
+
+import "time"
+
+const (
+	minBlockBytes  int64 = 16 * 1024                  // size of the first block copied when the block size adapts
+	maxBlockBytes        = int64(MaxBlockSize) * 1024 // largest block that we'll copy
+	targetCopyTime       = 10 * time.Millisecond      // time that we'd like each block to take to copy
+)
+
+// blockSizer picks the size of each block copied during a TCP throughput
+// test, much as iperf does.  Blocks start small and double while they're
+// copied in well under targetCopyTime, then halve again if they start taking
+// much longer.  A fixed block size never changes.
+type blockSizer struct {
+	size  int64
+	fixed bool
+}
+
+func (c *Client) newBlockSizer() *blockSizer {
+	if c.BlockSize > 0 {
+		return &blockSizer{size: int64(c.BlockSize) * 1024, fixed: true}
+	}
+	return &blockSizer{size: minBlockBytes}
+}
+
+// adjust resizes our blocks based on how long the last one took to copy
+func (bs *blockSizer) adjust(took time.Duration) {
+	if bs.fixed {
+		return
+	}
+
+	switch {
+	case took < targetCopyTime/2 && bs.size < maxBlockBytes:
+		bs.size *= 2
+		if bs.size > maxBlockBytes {
+			bs.size = maxBlockBytes
+		}
+	case took > targetCopyTime*2 && bs.size > minBlockBytes:
+		bs.size /= 2
+		if bs.size < minBlockBytes {
+			bs.size = minBlockBytes
+		}
+	}
+}
@@ -0,0 +1,540 @@
+// Package sparkyfish implements a client for the sparkyfish speed test
+// protocol.  It's used by sparkyfish-cli, but it can also be embedded in other
+// programs that want to run speed tests without shelling out to the binary.
+//
+// See docs/PROTOCOL.md for a description of the protocol.
+package sparkyfish
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	ProtocolVersion      uint16 = 0x02   // Newest protocol version that we speak
+	DefaultPort                 = "7121" // Port that sparkyfish servers listen on by default
+	MaxBlockSize         int    = 4096   // largest size (KB) of each block of data copied to/from remote
+	throughputTestLength uint   = 10     // length of time to conduct each throughput test
+	maxPingTestLength    uint   = 10     // maximum time for ping test to complete
+	DefaultPings         int    = 20     // number of pings to attempt by default
+	MaxPings             int    = 30     // number of pings that servers will echo in a single test
+	MaxStreams           int    = 16     // largest number of connections that a throughput test may run over
+)
+
+const (
+	DefaultReportInterval = 500 * time.Millisecond // how often throughput is measured by default
+	MinReportInterval     = 100 * time.Millisecond // shortest report interval that may be chosen
+	MaxReportInterval     = 10 * time.Second       // longest report interval that may be chosen
+	DefaultWarmUp         = 2 * time.Second        // time at the start of each throughput test that's left out of the stats by default
+	DefaultStallTime      = 2 * time.Second        // time without any data moving that counts as a stall by default
+)
+
+// TestLength is how long each throughput test runs for
+const TestLength = time.Duration(throughputTestLength) * time.Second
+
+// MaxWarmUp is the length of a throughput test.  Warm-ups must be shorter.
+const MaxWarmUp = TestLength
+
+// Version is the version of sparkyfish.  Release builds set it with
+// -ldflags "-X github.com/freinold/sparkyfish.Version=<version>".
+var Version = "dev"
+
+// TestType is used to indicate the type of test being performed
+type TestType int
+
+const (
+	Outbound    TestType = iota // upload test
+	Inbound                     // download test
+	Echo                        // echo (ping) test
+	UDPOutbound                 // UDP upload test
+	UDPInbound                  // UDP download test
+)
+
+func (t TestType) String() string {
+	switch t {
+	case Outbound:
+		return "upload"
+	case Inbound:
+		return "download"
+	case Echo:
+		return "ping"
+	case UDPOutbound:
+		return "udp upload"
+	case UDPInbound:
+		return "udp download"
+	}
+	return fmt.Sprintf("TestType(%d)", int(t))
+}
+
+// Client runs tests against a single sparkyfish server.  A Client runs one
+// test at a time and must not be used by multiple goroutines at once.
+type Client struct {
+	// Network is the network used to reach the server: "tcp" (the default),
+	// "tcp4" or "tcp6".
+	Network string
+
+	// UDP makes Run perform its download and upload tests over UDP
+	UDP bool
+
+	// SkipDownload and SkipUpload make Run leave out the download or upload
+	// test
+	SkipDownload bool
+	SkipUpload   bool
+
+	// Bidirectional makes Run perform its download and upload tests at the
+	// same time.  It's ignored if either test is skipped.
+	Bidirectional bool
+
+	// UDPRate is the rate, in Mbit/s, at which datagrams are sent during UDP
+	// tests.  Defaults to DefaultUDPRate.
+	UDPRate int
+
+	// BlockSize fixes the size, in KB, of each block of data copied during
+	// TCP throughput tests.  It may not exceed MaxBlockSize.  If it's zero
+	// (the default), the blocks start small and grow as the data flows
+	// faster, so that slow links still report regularly and fast links don't
+	// waste CPU on lots of little copies.
+	BlockSize int
+
+	// ReportInterval is how often throughput is measured and passed to
+	// OnThroughput.  Defaults to DefaultReportInterval and must be between
+	// MinReportInterval and MaxReportInterval.
+	ReportInterval time.Duration
+
+	// WarmUp is the time at the start of each throughput test, while TCP is
+	// still ramping up, whose measurements are left out of Min, Max and Avg.
+	// NewClient sets it to DefaultWarmUp.  It must be shorter than the test.
+	WarmUp time.Duration
+
+	// StallTime is how long no data has to move during a throughput test
+	// for us to note a stall.  Defaults to DefaultStallTime.  Stalls are
+	// noticed at each report interval.
+	StallTime time.Duration
+
+	// Streams is the number of connections that each TCP download and upload
+	// test runs over at once, with their throughput added together.  It
+	// defaults to 1 and may not exceed MaxStreams.  Several streams can fill
+	// a link that limits each flow, or a long path that a single connection
+	// can't keep busy.  It doesn't apply to bidirectional tests.
+	Streams int
+
+	// Compressible makes our TCP download and upload tests send data that's
+	// easily compressed, instead of random data, to find out whether
+	// something along the path compresses it.  Downloads need a server
+	// that supports it.  It doesn't apply to bidirectional or UDP tests.
+	Compressible bool
+
+	// MaxBytes, if set, ends each TCP throughput test and UDP upload test
+	// early once it has transferred this many bytes.  The data used by a UDP
+	// download test is set by UDPRate instead.  With several streams, each
+	// gets an even share.
+	MaxBytes int64
+
+	// RateLimit, if set, paces TCP throughput tests to this many Mbit/s in
+	// each direction.  The rate of UDP tests is set by UDPRate instead.  With
+	// several streams, each gets an even share.
+	RateLimit float64
+
+	// Congestion, if set, is the TCP congestion control algorithm used by
+	// our connections to the server, e.g. "bbr" or "cubic".  It's only
+	// supported on Linux, and the kernel must have the algorithm available.
+	Congestion string
+
+	// Source, if set, is the local address that our connections to the
+	// server come from, for choosing an uplink on a multihomed host
+	Source net.IP
+
+	// Interface, if set, binds our connections to the server to this
+	// network interface, e.g. "eth1".  It's only supported on Linux.
+	Interface string
+
+	// DSCP, if set, marks the traffic on our connections to the server with
+	// this Differentiated Services code point, e.g. 46 for Expedited
+	// Forwarding.  See ParseDSCP.  It's only supported on Linux.
+	DSCP int
+
+	// Pings is the number of probes sent during a ping test.  Defaults to
+	// DefaultPings and may not exceed MaxPings.
+	Pings int
+
+	// Token is presented to the server before each test.  It's only needed
+	// for private servers that were started with an auth token.
+	Token string
+
+	// Dial, if set, opens our TCP connections to the server in our place,
+	// e.g. to tune them or to reach the server over some other transport.
+	// Our socket options and Source don't apply to its connections.  It
+	// isn't used over QUIC.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// TLSConfig, if set, is used for our connections to servers that we
+	// reach over wss:// or quic://, e.g. to present a client certificate to
+	// servers that want one, or to trust a private CA.  Its ServerName
+	// defaults to the server's hostname.  Without one, we don't verify the
+	// certificates of servers over QUIC, which needn't have real ones.
+	TLSConfig *tls.Config
+
+	// Tags and Note, if set, are recorded in the Results of our test runs,
+	// to tell them apart later, e.g. by where or why they were run
+	Tags []string
+	Note string
+
+	// CaptureEnvironment makes Run record the Environment that it ran in
+	// with its Results, such as our interface, Wi-Fi network and public
+	// address
+	CaptureEnvironment bool
+
+	// TimeDNS makes Run time how long it takes to look up the server's
+	// hostname with LookupTimes before connecting, and record it with its
+	// Results
+	TimeDNS bool
+
+	// Resolvers lists DNS servers, e.g. "1.1.1.1" or "[2620:fe::fe]:53",
+	// whose lookups LookupTimes compares with the system's resolver
+	Resolvers []string
+
+	// TracePath makes Run trace the route to the server with Traceroute
+	// before testing, and record it with its Results.  A trace that fails
+	// doesn't fail the run.
+	TracePath bool
+
+	// ProbeMTU makes Run find the path MTU to the server with RunMTUTest
+	// before testing, and record it with its Results.  A probe that fails
+	// doesn't fail the run.
+	ProbeMTU bool
+
+	// Retries is the number of times that a test is retried if we can't
+	// connect to the server or lose the connection partway through, with a
+	// longer wait before each retry.  NewClient sets it to DefaultRetries.
+	Retries int
+
+	// OnRedirect, if set, is called when a server that's too busy to test
+	// us sends us to another one, with the addresses of both.  We test
+	// against the other server from then on.
+	OnRedirect func(from, to string)
+
+	// OnRetry, if set, is called before each retry of a test that failed.
+	// Measurements that were passed to OnPing or OnThroughput before it
+	// don't count towards the retried test's results.
+	OnRetry func(Retry)
+
+	// OnPing, if set, is called as each ping comes back during a ping test
+	OnPing func(PingSample)
+
+	// OnThroughput, if set, is called at every report interval during a
+	// throughput test
+	OnThroughput func(Sample)
+
+	// OnStage, if set, is called as Run begins each of its stages.  The
+	// stage runs with the context that it returns, which must be ctx or
+	// one derived from it.  Cancelling that context while ctx isn't
+	// cancelled skips the ping, download, upload or bidirectional test
+	// that's running, and Run goes on to the next one.
+	OnStage func(ctx context.Context, stage Stage) context.Context
+
+	// OnStageDone, if set, is called as each of Run's stages ends, with the
+	// results so far and the error that the stage ended with, if any.  The
+	// stages before the ping test are optional, except for StageHello, so
+	// Run carries on after those fail.
+	OnStageDone func(stage Stage, r Results, err error)
+
+	// Logger, if set, is where we trace what we're doing at debug level:
+	// each connection as it opens and closes, every command that we send
+	// and line that the server sends back, and the counters of each
+	// throughput test at every report interval.  It's meant for bug
+	// reports, so it's a lot.  Nothing is logged if it's nil.
+	Logger *slog.Logger
+
+	addr  string
+	wsURL *url.URL // set if we reach the server over WebSocket
+	quic  bool     // set if we reach the server over QUIC
+
+	// retries is the number of times that we've retried a test
+	retries int
+
+	// sessions is the number of sessions that we've opened, which numbers
+	// them in our log
+	sessions uint64
+
+	// info is what the server told us about itself when we last said hello
+	info ServerInfo
+
+	// version is the protocol version that we use with this server.  We
+	// start with ProtocolVersion and fall back to older versions if the
+	// server doesn't support it.
+	version uint16
+}
+
+// NewClient creates a Client for the sparkyfish server at addr.  If addr
+// doesn't include a port, DefaultPort is used.  To reach the server over
+// WebSocket instead, addr may be a ws:// or wss:// URL, e.g.
+// "ws://example.com:7122/ws", and to reach it over QUIC, a quic:// one, e.g.
+// "quic://example.com", whose port defaults to DefaultQUICPort.
+func NewClient(addr string) (*Client, error) {
+	c := &Client{
+		Network:        "tcp",
+		Pings:          DefaultPings,
+		UDPRate:        DefaultUDPRate,
+		ReportInterval: DefaultReportInterval,
+		WarmUp:         DefaultWarmUp,
+		Retries:        DefaultRetries,
+		addr:           withDefaultPort(addr, DefaultPort),
+		version:        ProtocolVersion,
+	}
+
+	if strings.HasPrefix(addr, "ws://") || strings.HasPrefix(addr, "wss://") {
+		u, err := parseWebSocketURL(addr)
+		if err != nil {
+			return nil, err
+		}
+		c.wsURL = u
+		c.addr = u.Host
+	}
+	if strings.HasPrefix(addr, "quic://") {
+		host := strings.TrimSuffix(strings.TrimPrefix(addr, "quic://"), "/")
+		if host == "" {
+			return nil, fmt.Errorf("invalid QUIC URL: %v", addr)
+		}
+		c.quic = true
+		c.addr = withDefaultPort(host, DefaultQUICPort)
+	}
+
+	return c, nil
+}
+
+// Addr returns the host:port of the server that this Client tests against,
+// or its URL if we reach it over WebSocket or QUIC
+func (c *Client) Addr() string {
+	if c.wsURL != nil {
+		return c.wsURL.String()
+	}
+	if c.quic {
+		return "quic://" + c.addr
+	}
+	return c.addr
+}
+
+// Run performs a complete ping, download and upload test sequence, along
+// with whichever of the stages before it that our settings ask for.  See
+// OnStage and OnStageDone for following its progress.
+func (c *Client) Run(ctx context.Context) (Results, error) {
+	r := Results{Server: c.Addr(), StartTime: time.Now(), DSCP: c.DSCP, Tags: c.Tags, Note: c.Note}
+	retries := c.retries
+
+	if c.TimeDNS {
+		c.stage(ctx, StageDNS, &r, func(ctx context.Context) error {
+			dns, err := c.LookupTimes(ctx)
+			if err == nil {
+				r.DNS = &dns
+			}
+			return err
+		})
+	}
+
+	var info ServerInfo
+	err := c.stage(ctx, StageHello, &r, func(ctx context.Context) (err error) {
+		info, err = c.Hello(ctx)
+		if err == nil {
+			r.Server = c.Addr()
+			r.Family = info.Family
+			r.Connect = &info.Timings
+		}
+		return err
+	})
+	if err != nil {
+		return r, err
+	}
+
+	// Not every server can tell us about itself, and that's OK
+	if info.Version > 0 && info.Supports(CapInfo) {
+		c.stage(ctx, StageInfo, &r, func(ctx context.Context) error {
+			st, err := c.Info(ctx)
+			if err == nil {
+				r.Status = &st
+			}
+			return err
+		})
+	}
+	if c.CaptureEnvironment {
+		c.stage(ctx, StageEnvironment, &r, func(ctx context.Context) error {
+			env := c.Environment(ctx, r.Status)
+			r.Environment = &env
+			return nil
+		})
+	}
+	if c.TracePath {
+		c.stage(ctx, StageTraceroute, &r, func(ctx context.Context) error {
+			tr, err := c.Traceroute(ctx)
+			if err == nil {
+				r.Traceroute = &tr
+			}
+			return err
+		})
+	}
+	if c.ProbeMTU {
+		c.stage(ctx, StageMTU, &r, func(ctx context.Context) error {
+			mr, err := c.RunMTUTest(ctx)
+			if err == nil {
+				r.MTU = &mr
+			}
+			return err
+		})
+	}
+
+	err = c.stage(ctx, StagePing, &r, func(ctx context.Context) (err error) {
+		r.Ping, err = c.RunPingTest(ctx)
+		return err
+	})
+	if err != nil {
+		return r, err
+	}
+
+	download, upload := Inbound, Outbound
+	if c.UDP {
+		download, upload = UDPInbound, UDPOutbound
+	}
+
+	if c.Bidirectional && !c.SkipDownload && !c.SkipUpload {
+		if c.UDP {
+			return r, fmt.Errorf("bidirectional tests can't be run over UDP")
+		}
+		r.Bidirectional = true
+		err = c.stage(ctx, StageBidirectional, &r, func(ctx context.Context) (err error) {
+			r.Download, r.Upload, err = c.RunBidirectionalTest(ctx)
+			return err
+		})
+		if err != nil {
+			return r, err
+		}
+		r.EndTime = time.Now()
+		r.Retries = c.retries - retries
+		return r, nil
+	}
+
+	if c.streams() > 1 {
+		r.Streams = c.streams()
+	}
+	r.Compressible = c.Compressible
+
+	if c.SkipDownload {
+		r.Download.Skipped = true
+	} else {
+		err = c.stage(ctx, StageDownload, &r, func(ctx context.Context) (err error) {
+			r.Download, err = c.runThroughputTest(ctx, download)
+			return err
+		})
+		if err != nil {
+			return r, err
+		}
+	}
+
+	if c.SkipUpload {
+		r.Upload.Skipped = true
+	} else {
+		err = c.stage(ctx, StageUpload, &r, func(ctx context.Context) (err error) {
+			r.Upload, err = c.runThroughputTest(ctx, upload)
+			return err
+		})
+		if err != nil {
+			return r, err
+		}
+	}
+
+	r.EndTime = time.Now()
+	r.Retries = c.retries - retries
+
+	return r, nil
+}
+
+// ServerInfo returns what the server told us about itself the last time
+// that we said hello to it, e.g. during a Run.  It's the zero ServerInfo if
+// we haven't yet.
+func (c *Client) ServerInfo() ServerInfo {
+	return c.info
+}
+
+// reportInterval returns how often throughput is measured
+func (c *Client) reportInterval() time.Duration {
+	if c.ReportInterval == 0 {
+		return DefaultReportInterval
+	}
+	return c.ReportInterval
+}
+
+// stallTime returns how long no data has to move for a stall
+func (c *Client) stallTime() time.Duration {
+	if c.StallTime == 0 {
+		return DefaultStallTime
+	}
+	return c.StallTime
+}
+
+// checkThroughputSettings makes sure that our block size and report interval
+// are within range
+func (c *Client) checkThroughputSettings() error {
+	if c.BlockSize < 0 || c.BlockSize > MaxBlockSize {
+		return fmt.Errorf("block size must be between 0 (adaptive) and %v KB", MaxBlockSize)
+	}
+	if ri := c.reportInterval(); ri < MinReportInterval || ri > MaxReportInterval {
+		return fmt.Errorf("report interval must be between %v and %v", MinReportInterval, MaxReportInterval)
+	}
+	if c.RateLimit < 0 {
+		return fmt.Errorf("rate limit can't be negative")
+	}
+	if c.StallTime < 0 {
+		return fmt.Errorf("stall time can't be negative")
+	}
+	if c.WarmUp < 0 || c.WarmUp >= MaxWarmUp {
+		return fmt.Errorf("warm-up must be shorter than %v", MaxWarmUp)
+	}
+	if c.Streams < 0 || c.Streams > MaxStreams {
+		return fmt.Errorf("streams must be between 1 and %v", MaxStreams)
+	}
+	return nil
+}
+
+// streams returns the number of connections that TCP throughput tests run
+// over
+func (c *Client) streams() int {
+	if c.Streams == 0 {
+		return 1
+	}
+	return c.Streams
+}
+
+// network returns the network used to reach the server
+func (c *Client) network() string {
+	if c.Network == "" {
+		return "tcp"
+	}
+	return c.Network
+}
+
+// dialer returns a net.Dialer for connecting to the server over network, which
+// sets our socket options and binds to our source address, if we have one
+func (c *Client) dialer(network string) *net.Dialer {
+	d := &net.Dialer{Control: c.control}
+	if c.Source != nil {
+		if strings.HasPrefix(network, "udp") {
+			d.LocalAddr = &net.UDPAddr{IP: c.Source}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: c.Source}
+		}
+	}
+	return d
+}
+
+// withDefaultPort appends port to dest if dest doesn't already specify one.
+// IPv6 literals may be given with or without brackets.
+func withDefaultPort(dest string, port string) string {
+	if _, _, err := net.SplitHostPort(dest); err == nil {
+		return dest
+	}
+	return net.JoinHostPort(strings.Trim(dest, "[]"), port)
+}
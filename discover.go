@@ -0,0 +1,75 @@
+package sparkyfish
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/mdns"
+)
+
+// MDNSService is the service type that sparkyfish servers advertise over
+// mDNS/DNS-SD
+const MDNSService = "_sparkyfish._tcp"
+
+// Discover looks for sparkyfish servers advertising themselves on the local
+// network, waiting up to timeout for them to answer
+func Discover(ctx context.Context, timeout time.Duration) ([]Candidate, error) {
+	var candidates []Candidate
+
+	entries := make(chan *mdns.ServiceEntry, 32)
+	queryDone := make(chan error, 1)
+
+	params := mdns.DefaultParams(MDNSService)
+	params.Entries = entries
+	params.Timeout = timeout
+
+	go func() {
+		queryDone <- mdns.Query(params)
+		close(entries)
+	}()
+
+	seen := make(map[string]bool)
+	for {
+		select {
+		case e, ok := <-entries:
+			if !ok {
+				return candidates, <-queryDone
+			}
+
+			c, ok := candidateFromEntry(e)
+			if ok && !seen[c.Addr] {
+				seen[c.Addr] = true
+				candidates = append(candidates, c)
+			}
+		case <-ctx.Done():
+			return candidates, ctx.Err()
+		}
+	}
+}
+
+// candidateFromEntry turns a DNS-SD service entry into a Candidate,
+// preferring its IPv4 address if it has one
+func candidateFromEntry(e *mdns.ServiceEntry) (Candidate, bool) {
+	var ip net.IP
+
+	switch {
+	case e.AddrV4 != nil:
+		ip = e.AddrV4
+	case e.AddrV6 != nil:
+		ip = e.AddrV6
+	default:
+		return Candidate{}, false
+	}
+
+	c := Candidate{Addr: net.JoinHostPort(ip.String(), strconv.Itoa(e.Port))}
+	for _, field := range e.InfoFields {
+		if strings.HasPrefix(field, "location=") {
+			c.Location = sanitize(strings.TrimPrefix(field, "location="))
+		}
+	}
+
+	return c, true
+}
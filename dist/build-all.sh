@@ -15,20 +15,28 @@ do
   do
     echo "----> Building for ${plat}/amd64"
     if [ "$plat" = "windows" ]; then
-      GOOS=$plat GOARCH=amd64 go build -o ${PROG_WITH_TAG}-win64.exe
+      GOOS=$plat GOARCH=amd64 go build -ldflags "-X github.com/freinold/sparkyfish.Version=${TAG}" -o ${PROG_WITH_TAG}-win64.exe
       echo "Compressing..."
       zip -9 ${PROG_WITH_TAG}-win64.zip ${PROG_WITH_TAG}-win64.exe
       mv ${PROG_WITH_TAG}-win64.zip ../binaries/${prog}/
       rm ${PROG_WITH_TAG}-win64.exe
     else
        OUT="${PROG_WITH_TAG}-${plat}-amd64"
-       GOOS=$plat GOARCH=amd64 go build -o $OUT
+       GOOS=$plat GOARCH=amd64 go build -ldflags "-X github.com/freinold/sparkyfish.Version=${TAG}" -o $OUT
        echo "Compressing..."
        gzip -f $OUT
        mv ${OUT}.gz ../binaries/${prog}/
     fi
   done
 
+  # Build Windows/ARM
+  echo "----> Building for windows/arm64"
+  GOOS=windows GOARCH=arm64 go build -ldflags "-X github.com/freinold/sparkyfish.Version=${TAG}" -o ${PROG_WITH_TAG}-winarm64.exe
+  echo "Compressing..."
+  zip -9 ${PROG_WITH_TAG}-winarm64.zip ${PROG_WITH_TAG}-winarm64.exe
+  mv ${PROG_WITH_TAG}-winarm64.zip ../binaries/${prog}/
+  rm ${PROG_WITH_TAG}-winarm64.exe
+
   # Build Linux/ARM
   echo "----> Building for linux/arm"
   OUT="${PROG_WITH_TAG}-linux-arm"
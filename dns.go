@@ -0,0 +1,131 @@
+package sparkyfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// dnsTimeout is how long we give each resolver to look up the server
+const dnsTimeout = 5 * time.Second
+
+// DNSLookup is the time that one resolver took to look up the server's
+// hostname
+type DNSLookup struct {
+	// Resolver is "system", for the resolver that the host is set up to
+	// use, or the address of a DNS server that we asked directly
+	Resolver string `json:"resolver"`
+
+	// Time is how long the lookup took, in milliseconds
+	Time float64 `json:"time_ms"`
+
+	// Addresses are the server's addresses that the resolver gave us, and
+	// Error says why it didn't give us any
+	Addresses []string `json:"addresses,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// DNSResult is how long it took to look up the server's hostname, as found
+// by LookupTimes
+type DNSResult struct {
+	Host string `json:"host"`
+
+	// Lookups starts with the system's resolver, followed by the client's
+	// Resolvers in order
+	Lookups []DNSLookup `json:"lookups"`
+}
+
+// System returns the lookup by the system's resolver
+func (d DNSResult) System() DNSLookup {
+	return d.Lookups[0]
+}
+
+// LookupTimes times how long it takes to look up the server's hostname, with
+// the system's resolver and then with each of our Resolvers.  Slow DNS makes
+// everything that we do online feel slow, even on a fast link.  The system's
+// resolver may have the answer cached, in which case it's quick no matter
+// how slow the DNS servers behind it are, and names in the hosts file are
+// found there whichever resolver we ask.  Our Source, Interface and DSCP
+// apply to the queries that we send to our Resolvers.
+func (c *Client) LookupTimes(ctx context.Context) (DNSResult, error) {
+	host := hostOnly(c.addr)
+	if net.ParseIP(host) != nil {
+		return DNSResult{}, fmt.Errorf("%v is an address, so there's no hostname to look up", host)
+	}
+
+	resolvers := []*net.Resolver{net.DefaultResolver}
+	names := []string{"system"}
+	for _, addr := range c.Resolvers {
+		server, err := resolverAddr(addr)
+		if err != nil {
+			return DNSResult{}, err
+		}
+		resolvers = append(resolvers, &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return c.dialer(network).DialContext(ctx, network, server)
+			},
+		})
+		names = append(names, addr)
+	}
+
+	// One at a time, so that they don't get in each other's way
+	d := DNSResult{Host: host}
+	for i, r := range resolvers {
+		if ctx.Err() != nil {
+			return d, ctx.Err()
+		}
+		d.Lookups = append(d.Lookups, c.timeLookup(ctx, r, names[i], host))
+	}
+	return d, nil
+}
+
+// timeLookup times how long resolver, known as name, takes to look up host
+func (c *Client) timeLookup(ctx context.Context, resolver *net.Resolver, name, host string) DNSLookup {
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+
+	l := DNSLookup{Resolver: name}
+	start := time.Now()
+	ips, err := resolver.LookupIP(ctx, strings.Replace(c.network(), "tcp", "ip", 1), host)
+	l.Time = time.Since(start).Seconds() * 1000
+	if err != nil {
+		// The error names the system's DNS server, even if we asked
+		// another, so we keep just what went wrong
+		l.Error = err.Error()
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			l.Error = dnsErr.Err
+		}
+		return l
+	}
+	for _, ip := range ips {
+		l.Addresses = append(l.Addresses, ip.String())
+	}
+	return l
+}
+
+// resolverAddr returns the host:port of the DNS server at addr, which is an
+// IP address, with or without a port
+func resolverAddr(addr string) (string, error) {
+	server := withDefaultPort(addr, "53")
+	if net.ParseIP(hostOnly(server)) == nil {
+		return "", fmt.Errorf("DNS server %q must be an IP address", addr)
+	}
+	return server, nil
+}
+
+// CheckResolvers makes sure that each of resolvers is the address of a DNS
+// server that we can use in a Client's Resolvers
+func CheckResolvers(resolvers []string) error {
+	for _, addr := range resolvers {
+		_, err := resolverAddr(addr)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package sparkyfish
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MaxDSCP is the largest DSCP value that fits in the 6 bits of the IP header
+// that it occupies
+const MaxDSCP = 63
+
+// dscpNames are the standard names for DSCP values (RFC 4594, RFC 5865 and
+// RFC 8622)
+var dscpNames = map[string]int{
+	"DF": 0, "BE": 0, "LE": 1,
+	"CS0": 0, "CS1": 8, "CS2": 16, "CS3": 24, "CS4": 32, "CS5": 40, "CS6": 48, "CS7": 56,
+	"AF11": 10, "AF12": 12, "AF13": 14,
+	"AF21": 18, "AF22": 20, "AF23": 22,
+	"AF31": 26, "AF32": 28, "AF33": 30,
+	"AF41": 34, "AF42": 36, "AF43": 38,
+	"VA": 44, "EF": 46,
+}
+
+// ParseDSCP parses a DSCP value, given either by name (e.g. "EF" or "AF41")
+// or as a number between 0 and MaxDSCP
+func ParseDSCP(s string) (int, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if dscp, ok := dscpNames[s]; ok {
+		return dscp, nil
+	}
+
+	dscp, err := strconv.ParseUint(s, 0, 8)
+	if err != nil || dscp > MaxDSCP {
+		return 0, fmt.Errorf("invalid DSCP value %q", s)
+	}
+	return int(dscp), nil
+}
+
+// DSCPName returns the standard name of a DSCP value along with the value
+// itself, e.g. "EF (46)", or just the value if it doesn't have a name
+func DSCPName(dscp int) string {
+	// The default marking goes by several names
+	if dscp == 0 {
+		return "DF (0)"
+	}
+	for name, value := range dscpNames {
+		if value == dscp {
+			return fmt.Sprintf("%v (%v)", name, dscp)
+		}
+	}
+	return strconv.Itoa(dscp)
+}
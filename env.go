@@ -0,0 +1,167 @@
+package sparkyfish
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// Environment describes the host that a test ran from and how it reached
+// the server, so that results can be told apart later on, e.g. runs over
+// Wi-Fi from runs over Ethernet.  Any of it may be missing, as not every
+// platform lets us find it out.
+type Environment struct {
+	Hostname string `json:"hostname,omitempty"`
+
+	// OS is the operating system and architecture, e.g. "linux/amd64",
+	// followed by the name of the release if we know it
+	OS string `json:"os"`
+
+	// Interface is the network interface that our traffic to the server
+	// left by, and LocalAddress our address on it
+	Interface    string `json:"interface,omitempty"`
+	LocalAddress string `json:"local_address,omitempty"`
+
+	// LinkSpeed is the interface's link speed in Mbit/s, if it reports one
+	LinkSpeed int `json:"link_speed_mbps,omitempty"`
+
+	// Wireless is set if the interface is a Wi-Fi one.  SSID and Signal, in
+	// dBm, describe the network that it's connected to.
+	Wireless bool   `json:"wireless,omitempty"`
+	SSID     string `json:"ssid,omitempty"`
+	Signal   int    `json:"signal_dbm,omitempty"`
+
+	// Gateway is the default gateway's address
+	Gateway string `json:"gateway,omitempty"`
+
+	// PublicAddress is our address as the server saw it, which is our
+	// public address if we're behind NAT, and ASN and ASOrg are the
+	// autonomous system that it belongs to, according to the server
+	PublicAddress string `json:"public_address,omitempty"`
+	ASN           uint32 `json:"asn,omitempty"`
+	ASOrg         string `json:"as_org,omitempty"`
+}
+
+// Connection summarizes how we were connected, e.g. `wlan0, Wi-Fi "home",
+// -52 dBm` or "eth0, 1000 Mbit/s"
+func (env Environment) Connection() string {
+	if env.Interface == "" {
+		return "unknown"
+	}
+	parts := []string{env.Interface}
+	switch {
+	case env.Wireless && env.SSID != "":
+		parts = append(parts, fmt.Sprintf("Wi-Fi %q", env.SSID))
+	case env.Wireless:
+		parts = append(parts, "Wi-Fi")
+	case env.LinkSpeed > 0:
+		parts = append(parts, fmt.Sprintf("%v Mbit/s", env.LinkSpeed))
+	}
+	if env.Signal != 0 {
+		parts = append(parts, fmt.Sprintf("%v dBm", env.Signal))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Environment finds out what it can about the host that we're running on
+// and the way that we reach the server, without sending it anything.  The
+// public address and ASN are taken from st, the server's INFO response, if
+// we have one.
+func (c *Client) Environment(ctx context.Context, st *ServerStatus) Environment {
+	env := Environment{OS: runtime.GOOS + "/" + runtime.GOARCH}
+	env.Hostname, _ = os.Hostname()
+	if release := osRelease(); release != "" {
+		env.OS += ", " + release
+	}
+
+	env.Interface = c.Interface
+	local := c.localIP(ctx)
+	if local != nil {
+		env.LocalAddress = local.String()
+		if env.Interface == "" {
+			env.Interface = interfaceWithIP(local)
+		}
+	}
+	if env.Interface != "" {
+		env.addLinkInfo(ctx)
+	}
+
+	if st != nil {
+		env.PublicAddress = st.ClientAddress
+		if st.ClientLocation != nil {
+			env.ASN, env.ASOrg = st.ClientLocation.ASN, st.ClientLocation.ASOrg
+		}
+	}
+	return env
+}
+
+// localIP returns the address that our connections to the server come
+// from.  Unless we're told which to use, we let the kernel pick one by
+// "connecting" a UDP socket to the server, which doesn't send anything.
+func (c *Client) localIP(ctx context.Context) net.IP {
+	if c.Source != nil {
+		return c.Source
+	}
+	if c.Interface != "" {
+		return firstIP(c.Interface)
+	}
+
+	network := strings.Replace(c.network(), "tcp", "udp", 1)
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, c.addr)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return addrIP(conn.LocalAddr())
+}
+
+// interfaceWithIP returns the name of the network interface that has ip, or
+// "" if none has it
+func interfaceWithIP(ip net.IP) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipn, ok := addr.(*net.IPNet); ok && ipn.IP.Equal(ip) {
+				return iface.Name
+			}
+		}
+	}
+	return ""
+}
+
+// firstIP returns the first address of the network interface called name
+func firstIP(name string) net.IP {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil
+	}
+	addrs, err := iface.Addrs()
+	if err != nil || len(addrs) == 0 {
+		return nil
+	}
+	if ipn, ok := addrs[0].(*net.IPNet); ok {
+		return ipn.IP
+	}
+	return nil
+}
+
+// addrIP returns the IP address of addr, or nil if there isn't one
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package sparkyfish
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// osRelease returns the name of the Linux distribution, e.g. "Debian
+// GNU/Linux 12 (bookworm)"
+func osRelease() string {
+	b, err := os.ReadFile("/etc/os-release")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if v, ok := strings.CutPrefix(line, "PRETTY_NAME="); ok {
+			return strings.Trim(v, `"'`)
+		}
+	}
+	return ""
+}
+
+// addLinkInfo finds out what it can about env's interface from sysfs and
+// procfs.  The SSID isn't in either, so we ask iw or iwgetid for it, if
+// they're installed.
+func (env *Environment) addLinkInfo(ctx context.Context) {
+	sys := filepath.Join("/sys/class/net", env.Interface)
+
+	// Virtual interfaces, and ones without a link, don't have a speed
+	if b, err := os.ReadFile(filepath.Join(sys, "speed")); err == nil {
+		speed, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err == nil && speed > 0 {
+			env.LinkSpeed = speed
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(sys, "wireless")); err == nil {
+		env.Wireless = true
+		env.Signal = wirelessSignal(env.Interface)
+		env.SSID = wirelessSSID(ctx, env.Interface)
+	}
+
+	env.Gateway = defaultGateway(env.Interface)
+}
+
+// wirelessSignal returns the signal level of the Wi-Fi interface iface in
+// dBm, from /proc/net/wireless, or 0 if we don't know it
+func wirelessSignal(iface string) int {
+	f, err := os.Open("/proc/net/wireless")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	// After two header lines, each interface has a line like
+	//   wlan0: 0000   56.  -54.  -256        0      0      0      0      0        0
+	// with its link quality, signal level and noise level
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 4 || fields[0] != iface+":" {
+			continue
+		}
+		level, err := strconv.ParseFloat(strings.TrimSuffix(fields[3], "."), 64)
+		if err != nil {
+			return 0
+		}
+		return int(level)
+	}
+	return 0
+}
+
+// wirelessSSID returns the SSID of the network that the Wi-Fi interface
+// iface is connected to, or "" if we can't find out
+func wirelessSSID(ctx context.Context, iface string) string {
+	out, err := exec.CommandContext(ctx, "iw", "dev", iface, "link").Output()
+	if err == nil {
+		for _, line := range strings.Split(string(out), "\n") {
+			if ssid, ok := strings.CutPrefix(strings.TrimSpace(line), "SSID: "); ok {
+				return ssid
+			}
+		}
+	}
+
+	out, err = exec.CommandContext(ctx, "iwgetid", "-r", iface).Output()
+	if err == nil {
+		return strings.TrimSpace(string(out))
+	}
+	return ""
+}
+
+// defaultGateway returns the IPv4 default gateway, preferring one through
+// iface, from /proc/net/route
+func defaultGateway(iface string) string {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	// After a header line, each route has a line like
+	//   eth0	00000000	0102A8C0	0003	0	0	100	00000000	0	0	0
+	// with its interface, destination and gateway, in little-endian hex
+	var gateway string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		b, err := hex.DecodeString(fields[2])
+		if err != nil || len(b) != 4 {
+			continue
+		}
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(b))
+		if fields[0] == iface {
+			return ip.String()
+		}
+		if gateway == "" {
+			gateway = ip.String()
+		}
+	}
+	return gateway
+}
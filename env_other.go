@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package sparkyfish
+
+import "context"
+
+// osRelease returns "", as we only know where to look for the name of the
+// release on Linux
+func osRelease() string {
+	return ""
+}
+
+// addLinkInfo does nothing, as we only know how to find out about
+// interfaces on Linux
+func (env *Environment) addLinkInfo(ctx context.Context) {}
@@ -0,0 +1,104 @@
+package sparkyfish
+
+import (
+	"fmt"
+	"time"
+)
+
+// EventKind says what happened at an Event
+type EventKind string
+
+const (
+	EventStall        EventKind = "stall"         // no data moved for the client's StallTime
+	EventRetransmits  EventKind = "retransmits"   // a burst of TCP retransmits, from the kernel's stats
+	EventStreamJoined EventKind = "stream_joined" // one of a multi-stream test's streams started moving data
+	EventStreamLeft   EventKind = "stream_left"   // one of a multi-stream test's streams stopped early
+)
+
+// Event is something that happened during a throughput test that helps to
+// explain its throughput, such as a stall or a burst of retransmits.  A
+// test's events make a timeline that can be laid over its chart.
+type Event struct {
+	// At is when it happened, in seconds since the start of the test
+	At float64 `json:"at_s"`
+
+	Kind EventKind `json:"kind"`
+
+	// Detail says more about it, e.g. "stream 2" or "14 segments"
+	Detail string `json:"detail,omitempty"`
+}
+
+const (
+	// retransmitBurst is how many segments have to be retransmitted within
+	// a report interval for it to count as a burst
+	retransmitBurst = 10
+
+	// eventBuffer is how many events can be waiting for the throughput
+	// measurer before we start dropping them
+	eventBuffer = 64
+)
+
+// emit passes e to the throughput measurer, which notes when it got there.
+// An event isn't worth holding up the test for, so if the measurer has
+// fallen behind, it's dropped.
+func emit(events chan<- Event, e Event) {
+	select {
+	case events <- e:
+	default:
+	}
+}
+
+// streamDetail names the stream of a multi-stream test that s carries, or
+// returns "" if the test only has the one
+func streamDetail(s *session) string {
+	if s.stream == 0 {
+		return ""
+	}
+	return fmt.Sprintf("stream %v", s.stream)
+}
+
+// watchRetransmits reads the kernel's stats for s's connection at every
+// report interval, and emits an event whenever it has retransmitted
+// retransmitBurst segments or more since the last time.  It stops when stop
+// is called.
+func (c *Client) watchRetransmits(s *session, events chan<- Event) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+
+		last := readTCPStats(s.tcp)
+		if last == nil {
+			return
+		}
+
+		tick := time.NewTicker(c.reportInterval())
+		defer tick.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-tick.C:
+			}
+
+			ts := readTCPStats(s.tcp)
+			if ts == nil {
+				return
+			}
+			if n := ts.Retransmits - last.Retransmits; n >= retransmitBurst {
+				detail := fmt.Sprintf("%v segments", n)
+				if sd := streamDetail(s); sd != "" {
+					detail = sd + ", " + detail
+				}
+				emit(events, Event{Kind: EventRetransmits, Detail: detail})
+			}
+			last = ts
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+	}
+}
@@ -0,0 +1,71 @@
+package sparkyfish
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// GeoLocation is where an IP address is, according to a server's GeoIP
+// databases.  Any of it may be missing.
+type GeoLocation struct {
+	// Country is the ISO 3166-1 code of the country, e.g. "DE"
+	Country string `json:"country,omitempty"`
+	City    string `json:"city,omitempty"`
+
+	// ASN is the number of the autonomous system that announces the
+	// address, and ASOrg the organization that it belongs to
+	ASN   uint32 `json:"asn,omitempty"`
+	ASOrg string `json:"as_org,omitempty"`
+}
+
+// IsZero reports whether nothing is known about the location
+func (gl GeoLocation) IsZero() bool {
+	return gl == GeoLocation{}
+}
+
+func (gl GeoLocation) String() string {
+	var parts []string
+	switch {
+	case gl.City != "" && gl.Country != "":
+		parts = append(parts, gl.City+", "+gl.Country)
+	case gl.Country != "":
+		parts = append(parts, gl.Country)
+	}
+	if gl.ASN != 0 {
+		as := fmt.Sprintf("AS%v", gl.ASN)
+		if gl.ASOrg != "" {
+			as += " " + gl.ASOrg
+		}
+		parts = append(parts, as)
+	}
+	if len(parts) == 0 {
+		return "unknown"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// setGeoField sets the field of gl that an INFO key names, once its prefix
+// ("server-" or "client-") has been stripped.  It reports whether key was
+// one of them.
+func (gl *GeoLocation) setGeoField(key, value string) bool {
+	switch key {
+	case "country":
+		gl.Country = value
+	case "city":
+		gl.City = value
+	case "asn":
+		// The number, followed by the organization
+		fields := strings.SplitN(value, " ", 2)
+		n, err := strconv.ParseUint(fields[0], 10, 32)
+		if err == nil {
+			gl.ASN = uint32(n)
+		}
+		if len(fields) == 2 {
+			gl.ASOrg = fields[1]
+		}
+	default:
+		return false
+	}
+	return true
+}
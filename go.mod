@@ -1,12 +1,24 @@
 module github.com/freinold/sparkyfish
 
-go 1.12
+go 1.26.0
+
+require (
+	github.com/gizak/termui/v3 v3.1.0
+	github.com/hashicorp/mdns v1.0.5
+	github.com/quic-go/quic-go v0.63.0
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/crypto v0.54.0
+	golang.org/x/net v0.57.0
+	golang.org/x/sys v0.47.0
+	google.golang.org/grpc v1.84.0
+	google.golang.org/protobuf v1.36.12
+)
 
 require (
-	github.com/dustin/randbo v0.0.0-20140428231429-7f1b564ca724
-	github.com/maruel/panicparse v1.3.0 // indirect
 	github.com/mattn/go-runewidth v0.0.7 // indirect
+	github.com/miekg/dns v1.1.41 // indirect
 	github.com/mitchellh/go-wordwrap v1.0.0 // indirect
 	github.com/nsf/termbox-go v0.0.0-20191229070316-58d4fcbce2a7 // indirect
-	gopkg.in/gizak/termui.v2 v2.3.0
+	golang.org/x/text v0.40.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20260706201446-f0a921348800 // indirect
 )
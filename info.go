@@ -0,0 +1,131 @@
+package sparkyfish
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServerStatus describes a server in more detail than its HELO response, as
+// reported by the INFO command
+type ServerStatus struct {
+	// Version is the version of the server software
+	Version string `json:"version"`
+
+	// Protocol is the newest protocol version that the server speaks
+	Protocol uint16 `json:"protocol"`
+
+	Location string `json:"location,omitempty"`
+
+	// MaxDuration is the longest that the server will run a throughput test
+	MaxDuration time.Duration `json:"max_duration_ns"`
+
+	// MaxBytes is the most data that the server will send or receive over
+	// a connection in a throughput test, or zero if there's no limit
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+
+	// Features lists the server's capabilities (see CapUDP and friends)
+	Features []string `json:"features"`
+
+	// ActiveConnections is the number of connections that the server is
+	// handling, including ours
+	ActiveConnections int `json:"active_connections"`
+
+	// MaxConnections is the most connections that the server will handle
+	// at once, or zero if there's no limit
+	MaxConnections int `json:"max_connections"`
+
+	// ServerLocation and ClientLocation are where the server and we are,
+	// according to the server's GeoIP databases, if it has any
+	ServerLocation *GeoLocation `json:"server_location,omitempty"`
+	ClientLocation *GeoLocation `json:"client_location,omitempty"`
+
+	// ClientAddress is our address as the server sees it, which is our
+	// public address if we're behind NAT
+	ClientAddress string `json:"client_address,omitempty"`
+}
+
+// Info asks the server to describe itself with the INFO command
+func (c *Client) Info(ctx context.Context) (ServerStatus, error) {
+	var st ServerStatus
+
+	s, err := c.beginSession(ctx)
+	if err != nil {
+		return st, err
+	}
+	defer s.close()
+
+	if !s.info.Supports(CapInfo) {
+		return st, fmt.Errorf("server doesn't support the INFO command")
+	}
+
+	err = s.writeCommand("INFO")
+	if err != nil {
+		return st, err
+	}
+
+	// The server responds with one "key value" line per field and an END
+	// line.  We skip any keys that we don't recognize.
+	for {
+		line, err := s.readLine()
+		if err != nil {
+			return st, err
+		}
+		if line == "END" {
+			return st, nil
+		}
+
+		var value string
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) == 2 {
+			value = sanitize(fields[1])
+		}
+
+		switch fields[0] {
+		case "version":
+			st.Version = value
+		case "protocol":
+			v, _ := strconv.ParseUint(value, 10, 16)
+			st.Protocol = uint16(v)
+		case "location":
+			st.Location = value
+		case "max-duration":
+			secs, _ := strconv.Atoi(value)
+			st.MaxDuration = time.Duration(secs) * time.Second
+		case "max-bytes":
+			st.MaxBytes, _ = strconv.ParseInt(value, 10, 64)
+		case "features":
+			st.Features = strings.Fields(value)
+		case "load":
+			fmt.Sscanf(value, "%d/%d", &st.ActiveConnections, &st.MaxConnections)
+		case "client-address":
+			st.ClientAddress = value
+		default:
+			st.setLocationField(fields[0], value)
+		}
+	}
+}
+
+// setLocationField sets the field of ServerLocation or ClientLocation that an
+// INFO key names, if it names one
+func (st *ServerStatus) setLocationField(key, value string) {
+	var loc **GeoLocation
+	switch {
+	case strings.HasPrefix(key, "server-"):
+		loc = &st.ServerLocation
+	case strings.HasPrefix(key, "client-"):
+		loc = &st.ClientLocation
+	default:
+		return
+	}
+
+	var gl GeoLocation
+	if *loc != nil {
+		gl = **loc
+	}
+	if gl.setGeoField(key[len("server-"):], value) {
+		*loc = &gl
+	}
+}
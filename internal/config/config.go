@@ -0,0 +1,246 @@
+// Package config reads the config files of sparkyfish-cli and
+// sparkyfish-server, which set the defaults of their flags.
+package config
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Config holds the settings from a config file.  The file is a small subset
+// of YAML: mappings of keys to plain or quoted scalars, nested by
+// indentation, with # comments.  Quoted scalars can't contain escapes or
+// their own quote character.  Lists, flow collections, block scalars and the
+// rest of YAML are rejected rather than misread.  For example:
+//
+//	server: speedtest.example.com:7121
+//	pings: 20
+//	csv: /var/log/sparkyfish.csv
+//	alert-below-download: 100mbps
+//
+// With Apply, each key sets the flag with the same name, unless it's also
+// given on the command line.
+type Config struct {
+	// Values are the plain settings, by key
+	Values map[string]string
+
+	// Sections are the nested mappings, by key
+	Sections map[string]*Config
+}
+
+// New returns an empty Config
+func New() *Config {
+	return &Config{Values: make(map[string]string), Sections: make(map[string]*Config)}
+}
+
+// Load reads the config file at path.  A missing file is only an error if
+// mustExist is set; otherwise, it's an empty config.
+func Load(path string, mustExist bool) (*Config, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) && !mustExist {
+		return New(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %v: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// Parse parses a config file
+func Parse(r io.Reader) (*Config, error) {
+	root := New()
+
+	// stack holds the sections that enclose the current line, with their
+	// indentation
+	type level struct {
+		indent int
+		cfg    *Config
+	}
+	stack := []level{{-1, root}}
+	var opened *Config // a section whose first key we're waiting for
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := stripComment(scanner.Text())
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if strings.Contains(line, "\t") {
+			return nil, fmt.Errorf("line %v: indent with spaces, not tabs", n)
+		}
+
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		line = strings.TrimSpace(line)
+
+		if opened != nil {
+			if indent <= stack[len(stack)-1].indent {
+				return nil, fmt.Errorf("line %v: expected the keys of the section above", n)
+			}
+			stack = append(stack, level{indent, opened})
+			opened = nil
+		}
+		if stack[0].indent < 0 {
+			stack[0].indent = indent
+		}
+		for indent < stack[len(stack)-1].indent && len(stack) > 1 {
+			stack = stack[:len(stack)-1]
+		}
+		if indent != stack[len(stack)-1].indent {
+			return nil, fmt.Errorf("line %v: inconsistent indentation", n)
+		}
+		cfg := stack[len(stack)-1].cfg
+
+		if strings.HasPrefix(line, "- ") || line == "-" {
+			return nil, fmt.Errorf("line %v: lists aren't supported", n)
+		}
+		i := strings.Index(line, ":")
+		if i < 1 {
+			return nil, fmt.Errorf("line %v: expected key: value", n)
+		}
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if _, ok := cfg.Values[key]; ok {
+			return nil, fmt.Errorf("line %v: %v is set twice", n, key)
+		}
+		if _, ok := cfg.Sections[key]; ok {
+			return nil, fmt.Errorf("line %v: %v is set twice", n, key)
+		}
+
+		if value == "" {
+			opened = New()
+			cfg.Sections[key] = opened
+			continue
+		}
+
+		value, err := unquote(value)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", n, err)
+		}
+		cfg.Values[key] = value
+	}
+
+	return root, scanner.Err()
+}
+
+// stripComment removes a # comment from the end of line, if it isn't inside
+// quotes
+func stripComment(line string) string {
+	var quote rune
+	for i, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' '):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// unquote strips the quotes from a quoted scalar, and rejects the kinds of
+// value that YAML would read as something other than a plain string
+func unquote(value string) (string, error) {
+	switch value[0] {
+	case '[', '{':
+		return "", fmt.Errorf("lists and flow collections aren't supported")
+	case '|', '>':
+		return "", fmt.Errorf("block scalars aren't supported")
+	case '&', '*', '!':
+		return "", fmt.Errorf("anchors, aliases and tags aren't supported")
+	case '"', '\'':
+	default:
+		return value, nil
+	}
+
+	if len(value) < 2 || value[len(value)-1] != value[0] {
+		return "", fmt.Errorf("unterminated quote")
+	}
+	inner := value[1 : len(value)-1]
+	if strings.ContainsRune(inner, rune(value[0])) {
+		return "", fmt.Errorf("quotes inside quoted strings aren't supported")
+	}
+	if value[0] == '"' && strings.Contains(inner, "\\") {
+		return "", fmt.Errorf("escapes aren't supported; use single quotes for backslashes")
+	}
+	return inner, nil
+}
+
+// Apply sets each flag in fs that cfg has a value for, unless it's in
+// cmdline, the flags that were given on the command line.  Keys in skip
+// aren't flags, and are left alone.
+func (cfg *Config) Apply(fs *flag.FlagSet, cmdline map[string]bool, skip ...string) error {
+	// Go through the keys in order, so that errors are predictable
+	var keys []string
+	for key := range cfg.Values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if contains(skip, key) {
+			continue
+		}
+		if fs.Lookup(key) == nil {
+			return fmt.Errorf("unknown setting %v", key)
+		}
+		if cmdline[key] {
+			continue
+		}
+
+		err := fs.Set(key, YAMLBool(cfg.Values[key]))
+		if err != nil {
+			return fmt.Errorf("invalid %v: %v", key, err)
+		}
+	}
+
+	for key := range cfg.Sections {
+		if !contains(skip, key) {
+			return fmt.Errorf("unknown section %v", key)
+		}
+	}
+	return nil
+}
+
+// SetFlags returns the names of the flags in fs that have been set
+func SetFlags(fs *flag.FlagSet) map[string]bool {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
+
+// YAMLBool translates YAML's other ways of writing booleans into ones that
+// the flag package understands.  Anything else is returned as it is.
+func YAMLBool(value string) string {
+	switch value {
+	case "yes", "on":
+		return "true"
+	case "no", "off":
+		return "false"
+	}
+	return value
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,183 @@
+package config
+
+import (
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       string
+		values   map[string]string
+		sections map[string]map[string]string
+	}{
+		{
+			name:   "plain scalars",
+			in:     "server: speedtest.example.com:7121\npings: 20\nalert-below-download: 100mbps\n",
+			values: map[string]string{"server": "speedtest.example.com:7121", "pings": "20", "alert-below-download": "100mbps"},
+		},
+		{
+			name:   "colons in values",
+			in:     "server: ws://example.com:7122/ws\nwebhook: https://example.com/hook?a=b\n",
+			values: map[string]string{"server": "ws://example.com:7122/ws", "webhook": "https://example.com/hook?a=b"},
+		},
+		{
+			name:   "quoted scalars",
+			in:     "note: \"on the train\"\ncsv: '/tmp/a b.csv'\nempty: \"\"\nbackslash: 'C:\\logs'\n",
+			values: map[string]string{"note": "on the train", "csv": "/tmp/a b.csv", "empty": "", "backslash": `C:\logs`},
+		},
+		{
+			name:   "comments",
+			in:     "# a comment\npings: 20 # trailing comment\n\n   # indented comment\nnote: \"# not a comment\"\nurl: http://example.com/#anchor\n",
+			values: map[string]string{"pings": "20", "note": "# not a comment", "url": "http://example.com/#anchor"},
+		},
+		{
+			name:   "sections",
+			in:     "pings: 20\nprofiles:\n  office:\n    server: office.example.com\n    pings: 10\n  home:\n    server: home.example.com\ncsv: /tmp/x.csv\n",
+			values: map[string]string{"pings": "20", "csv": "/tmp/x.csv"},
+			sections: map[string]map[string]string{
+				"profiles/office": {"server": "office.example.com", "pings": "10"},
+				"profiles/home":   {"server": "home.example.com"},
+			},
+		},
+		{
+			name:     "empty section at the end",
+			in:       "pings: 20\nprofiles:\n",
+			values:   map[string]string{"pings": "20"},
+			sections: map[string]map[string]string{"profiles": {}},
+		},
+		{
+			name:   "indented throughout",
+			in:     "  pings: 20\n  csv: /tmp/x.csv\n",
+			values: map[string]string{"pings": "20", "csv": "/tmp/x.csv"},
+		},
+		{
+			name:   "empty file",
+			in:     "",
+			values: map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := Parse(strings.NewReader(tt.in))
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if !reflect.DeepEqual(cfg.Values, tt.values) {
+				t.Errorf("values are %v, want %v", cfg.Values, tt.values)
+			}
+			for path, want := range tt.sections {
+				sec := cfg
+				for _, key := range strings.Split(path, "/") {
+					sec = sec.Sections[key]
+					if sec == nil {
+						t.Fatalf("no section %v", path)
+					}
+				}
+				if !reflect.DeepEqual(sec.Values, want) {
+					t.Errorf("section %v is %v, want %v", path, sec.Values, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	tests := []struct {
+		name, in, err string
+	}{
+		{"tabs", "profiles:\n\toffice: x\n", "line 2: indent with spaces"},
+		{"list", "servers:\n  - a\n  - b\n", "line 2: lists aren't supported"},
+		{"flow sequence", "tag: [home, wifi]\n", "line 1: lists and flow collections"},
+		{"flow mapping", "profiles: {office: x}\n", "line 1: lists and flow collections"},
+		{"literal block", "note: |\n  two\n  lines\n", "line 1: block scalars"},
+		{"folded block", "note: >-\n  text\n", "line 1: block scalars"},
+		{"anchor", "server: &s example.com\n", "line 1: anchors"},
+		{"alias", "server: *s\n", "line 1: anchors"},
+		{"tag", "pings: !!int 20\n", "line 1: anchors"},
+		{"unterminated double quote", "note: \"on the train\n", "line 1: unterminated quote"},
+		{"unterminated single quote", "note: 'on the train\n", "line 1: unterminated quote"},
+		{"lone quote", "note: \"\n", "line 1: unterminated quote"},
+		{"text after the quote", "note: \"a\" b\n", "line 1: unterminated quote"},
+		{"quote inside quotes", "note: \"a\"b\"\n", "line 1: quotes inside"},
+		{"doubled single quote", "note: 'it''s'\n", "line 1: quotes inside"},
+		{"escape", "csv: \"C:\\logs\"\n", "line 1: escapes aren't supported"},
+		{"no key", ": value\n", "line 1: expected key: value"},
+		{"no colon", "pings 20\n", "line 1: expected key: value"},
+		{"document marker", "---\npings: 20\n", "line 1: expected key: value"},
+		{"duplicate key", "pings: 20\npings: 10\n", "line 2: pings is set twice"},
+		{"duplicate section", "profiles:\n  a: b\nprofiles:\n  c: d\n", "line 3: profiles is set twice"},
+		{"value and section", "profiles: x\nprofiles:\n  a: b\n", "line 2: profiles is set twice"},
+		{"section without keys", "profiles:\npings: 20\n", "line 2: expected the keys of the section above"},
+		{"inconsistent indentation", "profiles:\n    a: b\n  c: d\n", "line 3: inconsistent indentation"},
+		{"deeper than its siblings", "pings: 20\n  csv: x\n", "line 2: inconsistent indentation"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tt.in))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Parse returned %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	newFlags := func() (*flag.FlagSet, *int, *bool, *string) {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		return fs, fs.Int("pings", 20, ""), fs.Bool("udp", false, ""), fs.String("csv", "", "")
+	}
+
+	cfg, err := Parse(strings.NewReader("pings: 10\nudp: yes\ncsv: /tmp/x.csv\nprofiles:\n  a:\n    pings: 5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The command line wins over the config file
+	fs, pings, udp, csv := newFlags()
+	fs.Parse([]string{"-csv", "/tmp/y.csv"})
+	err = cfg.Apply(fs, SetFlags(fs), "profiles")
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if *pings != 10 || !*udp || *csv != "/tmp/y.csv" {
+		t.Errorf("Apply set pings %v, udp %v, csv %v", *pings, *udp, *csv)
+	}
+
+	// Sections have to be skipped, since they aren't flags
+	fs, _, _, _ = newFlags()
+	err = cfg.Apply(fs, nil)
+	if err == nil || !strings.Contains(err.Error(), "unknown section profiles") {
+		t.Errorf("Apply without skipping the section returned %v", err)
+	}
+
+	tests := []struct {
+		in, err string
+	}{
+		{"color: blue\n", "unknown setting color"},
+		{"pings: lots\n", "invalid pings"},
+		{"udp: maybe\n", "invalid udp"},
+	}
+	for _, tt := range tests {
+		cfg, err := Parse(strings.NewReader(tt.in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs, _, _, _ := newFlags()
+		err = cfg.Apply(fs, nil)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("applying %q returned %v, want an error containing %q", tt.in, err, tt.err)
+		}
+	}
+}
+
+func TestYAMLBool(t *testing.T) {
+	for in, want := range map[string]string{"yes": "true", "on": "true", "no": "false", "off": "false", "true": "true", "1": "1", "Yes": "Yes"} {
+		if got := YAMLBool(in); got != want {
+			t.Errorf("YAMLBool(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+// Package neterr sorts the errors that connections fail with by their cause,
+// for the client and the server alike.  The system calls' error numbers
+// differ between platforms: Windows has its own for resets and aborts, which
+// syscall.ECONNRESET and syscall.EPIPE never match.
+package neterr
+
+import (
+	"errors"
+	"syscall"
+)
+
+// IsConnReset reports whether err is the other end resetting the connection
+func IsConnReset(err error) bool {
+	return isAny(err, connReset)
+}
+
+// IsBrokenPipe reports whether err is a write to a connection that the other
+// end has already closed
+func IsBrokenPipe(err error) bool {
+	return isAny(err, brokenPipe)
+}
+
+func isAny(err error, errnos []syscall.Errno) bool {
+	for _, errno := range errnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
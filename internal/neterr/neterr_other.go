@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package neterr
+
+import "syscall"
+
+var (
+	connReset  = []syscall.Errno{syscall.ECONNRESET}
+	brokenPipe = []syscall.Errno{syscall.EPIPE}
+)
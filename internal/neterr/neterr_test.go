@@ -0,0 +1,39 @@
+package neterr
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+)
+
+// opError wraps errno as a failed write on a TCP connection
+func opError(errno error) error {
+	return &net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", errno)}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name                  string
+		err                   error
+		wantReset, wantBroken bool
+	}{
+		{"reset", opError(connReset[0]), true, false},
+		{"wrapped reset", fmt.Errorf("upload: %w", opError(connReset[0])), true, false},
+		{"broken pipe", opError(brokenPipe[0]), false, true},
+		{"wrapped broken pipe", fmt.Errorf("upload: %w", opError(brokenPipe[0])), false, true},
+		{"EOF", io.EOF, false, false},
+		{"other", errors.New("connection reset by peer"), false, false},
+		{"nil", nil, false, false},
+	}
+	for _, tt := range tests {
+		if got := IsConnReset(tt.err); got != tt.wantReset {
+			t.Errorf("%v: IsConnReset = %v, want %v", tt.name, got, tt.wantReset)
+		}
+		if got := IsBrokenPipe(tt.err); got != tt.wantBroken {
+			t.Errorf("%v: IsBrokenPipe = %v, want %v", tt.name, got, tt.wantBroken)
+		}
+	}
+}
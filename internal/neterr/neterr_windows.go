@@ -0,0 +1,20 @@
+//go:build windows
+// +build windows
+
+package neterr
+
+import "syscall"
+
+// wsaeshutdown is WSAESHUTDOWN, a send after the socket was shut down, which
+// syscall doesn't name
+const wsaeshutdown syscall.Errno = 10058
+
+var (
+	// Overlapped reads and writes report a reset as the network name
+	// having been deleted, rather than with WSAECONNRESET
+	connReset = []syscall.Errno{syscall.WSAECONNRESET, syscall.ERROR_NETNAME_DELETED}
+
+	// Windows aborts the connection when we write to one that the other
+	// end has closed, where Unix raises EPIPE
+	brokenPipe = []syscall.Errno{syscall.WSAECONNABORTED, wsaeshutdown, syscall.ERROR_BROKEN_PIPE}
+)
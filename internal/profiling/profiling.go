@@ -0,0 +1,50 @@
+// Package profiling serves Go's profiles and runtime metrics for
+// sparkyfish-cli's and sparkyfish-server's -pprof flag, so that performance
+// problems, such as GC pauses that cause dips in throughput or goroutines
+// that leak, can be looked into on the machines that they happen on.
+package profiling
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+)
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+}
+
+// Handler returns an http.Handler for net/http/pprof's profiles, at
+// /debug/pprof/, and expvar's variables, at /debug/vars.  Both packages also
+// register themselves with http.DefaultServeMux, which we never serve.  The
+// command line is left out of both, since it can hold tokens.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/pprof/cmdline", http.NotFound)
+	mux.HandleFunc("/debug/vars", vars)
+	return mux
+}
+
+// vars writes expvar's variables as a JSON object, as expvar.Handler does,
+// but without the command line
+func vars(w http.ResponseWriter, r *http.Request) {
+	values := make(map[string]json.RawMessage)
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key != "cmdline" {
+			values[kv.Key] = json.RawMessage(kv.Value.String())
+		}
+	})
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(values)
+}
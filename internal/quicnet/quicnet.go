@@ -0,0 +1,281 @@
+// Package quicnet carries sparkyfish's test protocol over QUIC, for the client
+// and the server alike.  Each test connection is a QUIC connection with a
+// single bidirectional stream, which Conn wraps up as a net.Conn, so that the
+// protocol runs over it just as it does over TCP.
+package quicnet
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// ALPN is the application protocol that the client and server agree on in
+// their TLS handshake
+const ALPN = "sparkyfish"
+
+// linger is how long a closed Conn waits for the other end to read what we
+// sent before the QUIC connection is torn down.  Closing a QUIC connection
+// drops anything that hasn't been acknowledged yet, unlike closing a TCP
+// socket.
+const linger = 2 * time.Second
+
+// config is the QUIC config of our connections.  Each carries one stream,
+// and the stream's flow control window is allowed to grow as large as the
+// connection's, so that fast links aren't held back by it.
+func config() *quic.Config {
+	return &quic.Config{
+		MaxIncomingStreams:         1,
+		MaxIncomingUniStreams:      -1,
+		MaxStreamReceiveWindow:     32 << 20,
+		MaxConnectionReceiveWindow: 32 << 20,
+		KeepAlivePeriod:            10 * time.Second,
+	}
+}
+
+// Conn is a test connection over QUIC: the one stream of a QUIC connection
+type Conn struct {
+	*quic.Stream
+	conn  *quic.Conn
+	close sync.Once
+}
+
+func newConn(conn *quic.Conn, stream *quic.Stream) *Conn {
+	return &Conn{Stream: stream, conn: conn}
+}
+
+// Read reads from the stream.  Once the other end has hung up, it returns
+// io.EOF, as a TCP connection would.
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.Stream.Read(b)
+	return n, hungUp(err)
+}
+
+// Write writes to the stream.  Once the other end has hung up, it returns
+// io.EOF.
+func (c *Conn) Write(b []byte) (int, error) {
+	n, err := c.Stream.Write(b)
+	return n, hungUp(err)
+}
+
+// hungUp returns io.EOF for err if it's the other end closing the stream or
+// the connection without an error, or err if it isn't
+func hungUp(err error) error {
+	var se *quic.StreamError
+	if errors.As(err, &se) && se.Remote && se.ErrorCode == 0 {
+		return io.EOF
+	}
+	var ae *quic.ApplicationError
+	if errors.As(err, &ae) && ae.Remote && ae.ErrorCode == 0 {
+		return io.EOF
+	}
+	return err
+}
+
+// Close finishes our side of the stream and stops reading the other's.  The
+// QUIC connection is closed once the other end has closed it too, or after
+// a short linger, so that what we've written still reaches it.
+func (c *Conn) Close() error {
+	c.close.Do(func() {
+		c.Stream.Close()
+		c.Stream.CancelRead(0)
+		go func() {
+			t := time.NewTimer(linger)
+			defer t.Stop()
+			select {
+			case <-c.conn.Context().Done():
+			case <-t.C:
+			}
+			c.conn.CloseWithError(0, "")
+		}()
+	})
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// TLS returns the state of the connection's TLS handshake
+func (c *Conn) TLS() *tls.ConnectionState {
+	state := c.conn.ConnectionState().TLS
+	return &state
+}
+
+// Dial opens a test connection to the server at addr over pc, which is
+// closed along with the connection.  tlsConfig must not be nil; ALPN is added
+// to its NextProtos.
+func Dial(ctx context.Context, pc net.PacketConn, addr net.Addr, tlsConfig *tls.Config) (*Conn, error) {
+	tc := tlsConfig.Clone()
+	tc.NextProtos = []string{ALPN}
+
+	tr := &quic.Transport{Conn: pc}
+	conn, err := tr.Dial(ctx, addr, tc, config())
+	if err != nil {
+		tr.Close()
+		pc.Close()
+		return nil, &net.OpError{Op: "dial", Net: "quic", Addr: addr, Err: err}
+	}
+	go func() {
+		<-conn.Context().Done()
+		tr.Close()
+		pc.Close()
+	}()
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, &net.OpError{Op: "dial", Net: "quic", Addr: addr, Err: err}
+	}
+	return newConn(conn, stream), nil
+}
+
+// Listener accepts test connections over QUIC.  It's a net.Listener, whose
+// connections are each a *Conn.
+type Listener struct {
+	pc       net.PacketConn
+	tr       *quic.Transport
+	ln       *quic.Listener
+	conns    chan *Conn
+	ctx      context.Context
+	cancel   context.CancelFunc
+	accepted chan struct{}  // closed once we've stopped accepting connections
+	live     sync.WaitGroup // the QUIC connections that are still open
+	close    sync.Once
+}
+
+// Listen accepts test connections on pc.  If tlsConfig is nil, we present a
+// self-signed certificate, as QUIC can't go without TLS; otherwise ALPN is
+// added to its NextProtos.
+func Listen(pc net.PacketConn, tlsConfig *tls.Config) (*Listener, error) {
+	var tc *tls.Config
+	if tlsConfig != nil {
+		tc = tlsConfig.Clone()
+	} else {
+		cert, err := selfSigned()
+		if err != nil {
+			return nil, err
+		}
+		tc = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	tc.NextProtos = []string{ALPN}
+
+	tr := &quic.Transport{Conn: pc}
+	ln, err := tr.Listen(tc, config())
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &Listener{pc: pc, tr: tr, ln: ln, conns: make(chan *Conn), ctx: ctx, cancel: cancel, accepted: make(chan struct{})}
+	go l.accept()
+	return l, nil
+}
+
+// accept accepts QUIC connections, and passes each on to Accept once its
+// client has opened its stream.  Clients that don't open one promptly are
+// dropped.
+func (l *Listener) accept() {
+	defer close(l.accepted)
+	for {
+		conn, err := l.ln.Accept(l.ctx)
+		if err != nil {
+			return
+		}
+		l.live.Add(1)
+		go func() {
+			<-conn.Context().Done()
+			l.live.Done()
+		}()
+
+		go func() {
+			ctx, cancel := context.WithTimeout(l.ctx, 10*time.Second)
+			defer cancel()
+			stream, err := conn.AcceptStream(ctx)
+			if err != nil {
+				conn.CloseWithError(0, "")
+				return
+			}
+			select {
+			case l.conns <- newConn(conn, stream):
+			case <-l.ctx.Done():
+				conn.CloseWithError(0, "")
+			}
+		}()
+	}
+}
+
+// Accept waits for the next test connection
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.ctx.Done():
+		return nil, &net.OpError{Op: "accept", Net: "quic", Addr: l.Addr(), Err: net.ErrClosed}
+	}
+}
+
+// Close stops accepting connections.  Those already accepted carry on, and
+// the socket is closed once they're all done, as QUIC needs it to reach
+// their clients.
+func (l *Listener) Close() error {
+	var err error
+	l.close.Do(func() {
+		l.cancel()
+		err = l.ln.Close()
+		go func() {
+			<-l.accepted
+			l.live.Wait()
+			l.tr.Close()
+			l.pc.Close()
+		}()
+	})
+	return err
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// selfSigned returns a certificate that's good for a year, for servers
+// without one of their own.  Clients can't verify it, but they don't verify
+// anything about servers over plain TCP either.
+func selfSigned() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "sparkyfish"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
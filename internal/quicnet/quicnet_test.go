@@ -0,0 +1,98 @@
+package quicnet
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestTransfer sends a download's worth of data from the server and checks
+// that the client gets all of it, and then io.EOF, although the server closes
+// its end as soon as it has written the last of it
+func TestTransfer(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := Listen(pc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	data := bytes.Repeat([]byte("sparkyfish"), 400_000)
+	served := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			served <- err
+			return
+		}
+		defer conn.Close()
+
+		helo := make([]byte, 6)
+		_, err = io.ReadFull(conn, helo)
+		if err == nil && string(helo) != "HELO2\n" {
+			err = errors.New("server read " + string(helo))
+		}
+		if err == nil {
+			_, err = conn.Write(data)
+		}
+		served <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cpc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := Dial(ctx, cpc, l.Addr(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	_, err = conn.Write([]byte("HELO2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("reading: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("got %v bytes, want %v", len(got), len(data))
+	}
+	if err := <-served; err != nil {
+		t.Errorf("serving: %v", err)
+	}
+
+	if conn.TLS().NegotiatedProtocol != ALPN {
+		t.Errorf("negotiated %q, want %q", conn.TLS().NegotiatedProtocol, ALPN)
+	}
+}
+
+func TestAcceptAfterClose(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := Listen(pc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	l.Close()
+
+	_, err = l.Accept()
+	if !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept after Close returned %v, want net.ErrClosed", err)
+	}
+}
@@ -0,0 +1,59 @@
+package sparkyfish
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The kinds of limit that servers may cut throughput tests short at
+const (
+	LimitSeconds = "seconds"
+	LimitBytes   = "bytes"
+)
+
+// ServerLimit is a limit that the server cut a throughput test short at.
+// Servers that advertise CapLimits tell us when they do.
+type ServerLimit struct {
+	// Kind is LimitSeconds or LimitBytes
+	Kind  string `json:"kind"`
+	Value int64  `json:"value"`
+}
+
+func (sl ServerLimit) String() string {
+	return fmt.Sprintf("%v %v", sl.Value, sl.Kind)
+}
+
+// errCapped stops the progress reports of an upload that the server cut short
+// at one of its limits
+var errCapped = errors.New("test capped by server")
+
+// parseCapped parses the fields of a CAPPED notice, which follow the word
+// CAPPED itself
+func parseCapped(fields []string) (*ServerLimit, error) {
+	if len(fields) == 2 && (fields[0] == LimitSeconds || fields[0] == LimitBytes) {
+		value, err := strconv.ParseInt(fields[1], 10, 64)
+		if err == nil && value > 0 {
+			return &ServerLimit{Kind: fields[0], Value: value}, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid CAPPED notice from server")
+}
+
+// checkCapped reads the server's CAPPED notice from s, if it's sent one, and
+// keeps it in s.capped.  It reports whether there was one.  Servers send them
+// over the connection of an upload that they cut short.
+func (s *session) checkCapped() bool {
+	b, err := s.reader.Peek(len("CAPPED "))
+	if err != nil || string(b) != "CAPPED " {
+		return false
+	}
+
+	line, err := s.readLine()
+	if err != nil {
+		return false
+	}
+	s.capped, err = parseCapped(strings.Fields(line)[1:])
+	return err == nil
+}
@@ -0,0 +1,43 @@
+package sparkyfish
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+)
+
+// discardHandler drops everything, for clients without a Logger
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+var discardLogger = slog.New(discardHandler{})
+
+// logger returns where we log to: our Logger, or nowhere
+func (c *Client) logger() *slog.Logger {
+	if c.Logger == nil {
+		return discardLogger
+	}
+	return c.Logger
+}
+
+// sessionLogger returns a logger for a new session with the server at addr.
+// Everything that it logs carries the session's number, so that the lines
+// about one connection can be picked out from the rest.
+func (c *Client) sessionLogger(addr string) *slog.Logger {
+	id := atomic.AddUint64(&c.sessions, 1)
+	return c.logger().With("session", id, "server", addr)
+}
+
+// redactCommand hides the token in an AUTH command, so that traces can be
+// shared
+func redactCommand(cmd string) string {
+	if strings.HasPrefix(cmd, "AUTH ") {
+		return "AUTH <redacted>"
+	}
+	return cmd
+}
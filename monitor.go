@@ -0,0 +1,144 @@
+package sparkyfish
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// monitorTimeout is how long MonitorLatency waits for a probe to come back
+// before counting it as lost
+const monitorTimeout = 2 * time.Second
+
+// LatencyProbe is passed to the callback of MonitorLatency as each probe
+// comes back or is lost
+type LatencyProbe struct {
+	Seq  int           // sequence number of the probe, starting at 1
+	Time time.Time     // when the probe was sent
+	RTT  time.Duration // round-trip time, if the probe came back
+	Lost bool          // set if the probe didn't come back
+	Err  error         // why the probe was lost
+
+	// Losses is the number of probes that have been lost so far, out of Seq
+	Losses int
+}
+
+// MonitorLatency sends a probe to the server every interval until ctx is
+// cancelled, calling onProbe with the outcome of each.  Servers only echo
+// MaxPings probes per session, so we reconnect as needed.  A probe that isn't
+// answered within a couple of seconds, or that can't be sent because the
+// server is unreachable, is counted as lost and we keep going.  The only
+// errors returned are those that stop us from reaching the server at all on
+// the first attempt.
+func (c *Client) MonitorLatency(ctx context.Context, interval time.Duration, onProbe func(LatencyProbe)) error {
+	if interval <= 0 {
+		return fmt.Errorf("probe interval must be positive")
+	}
+
+	m := &monitor{client: c}
+	defer m.close()
+
+	// Make sure that we can reach the server before we start counting losses
+	err := m.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	var lp LatencyProbe
+	for {
+		lp.Seq++
+		lp.Time = time.Now()
+		lp.RTT, lp.Err = m.probe(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		lp.Lost = lp.Err != nil
+		if lp.Lost {
+			lp.Losses++
+		}
+
+		if onProbe != nil {
+			onProbe(lp)
+		}
+
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// monitor holds the echo session that MonitorLatency sends its probes over
+type monitor struct {
+	client *Client
+	s      *session
+	probes int // number of probes sent over s
+}
+
+// connect opens a fresh echo session
+func (m *monitor) connect(ctx context.Context) error {
+	s, err := m.client.beginSession(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = s.writeCommand("ECO")
+	if err != nil {
+		s.close()
+		return err
+	}
+
+	m.s, m.probes = s, 0
+	return nil
+}
+
+// probe sends a single probe and waits for it to come back.  If anything goes
+// wrong, the session is closed and a new one is opened for the next probe.
+func (m *monitor) probe(ctx context.Context) (time.Duration, error) {
+	if m.s == nil || m.probes == MaxPings {
+		m.close()
+		err := m.connect(ctx)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// Our probes cycle through the printable characters, like RunPingTest's
+	probe := byte(33 + m.probes%94)
+	m.probes++
+
+	m.s.conn.SetDeadline(time.Now().Add(monitorTimeout))
+
+	startTime := time.Now()
+
+	var echoed byte
+	_, err := m.s.conn.Write([]byte{probe})
+	if err == nil && m.probes == 1 {
+		err = m.s.checkRejection()
+	}
+	if err == nil {
+		echoed, err = m.s.reader.ReadByte()
+	}
+	if err == nil && echoed != probe {
+		err = fmt.Errorf("probe came back out of order")
+	}
+	if err != nil {
+		m.close()
+		return 0, err
+	}
+
+	return time.Since(startTime), nil
+}
+
+// close hangs up the current echo session, if there is one
+func (m *monitor) close() {
+	if m.s != nil {
+		m.s.close()
+		m.s = nil
+	}
+}
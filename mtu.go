@@ -0,0 +1,302 @@
+package sparkyfish
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// MTU probes are datagrams that the server answers, as long as they get
+// there.  They're laid out like the datagrams of the UDP tests.
+const (
+	DatagramProbe    byte = 'P' // sent by the client during MTU, padded to the size that it's probing
+	DatagramProbeAck byte = 'A' // the server's answer to a probe, followed by the probe's size (4 bytes)
+
+	// MTUProbeAckLen is the size of the server's answers to MTU probes
+	MTUProbeAckLen = DatagramHeaderLen + 4
+)
+
+const (
+	// mtuProbeTimeout is how long we wait for the server to answer each
+	// probe, and mtuProbeTries how many times we send it before we decide
+	// that it's too big to get through
+	mtuProbeTimeout = time.Second
+	mtuProbeTries   = 2
+
+	// minMTU4 and minMTU6 are the smallest MTUs that IPv4 and IPv6 paths
+	// must carry, and maxMTU the biggest packet that either can send
+	minMTU4 = 576
+	minMTU6 = 1280
+	maxMTU  = 65535
+
+	// mtuFragmentExtra is how much bigger than the path MTU we make the
+	// probe that checks whether fragments get through
+	mtuFragmentExtra = 1000
+)
+
+// MTUResult is the path MTU to the server, as found by RunMTUTest
+type MTUResult struct {
+	// MTU is the size of the biggest packet, IP and UDP headers and all,
+	// that got to the server without being fragmented
+	MTU int `json:"mtu"`
+
+	// LinkMTU is the MTU of the route that our packets leave by, as far as
+	// the kernel knows, which is as big as the path MTU can be.  Over the
+	// loopback interface, it's bigger than any packet.
+	LinkMTU int `json:"link_mtu"`
+
+	// FragmentsBlocked is set if packets too big for the path didn't get
+	// through once they were fragmented
+	FragmentsBlocked bool `json:"fragments_blocked,omitempty"`
+
+	// Probes is the number of probes that we sent
+	Probes int `json:"probes"`
+}
+
+// ethernetMTU is the MTU of most links.  A path MTU below it means that
+// something along the way, such as a tunnel or VPN, carries less.
+const ethernetMTU = 1500
+
+// mtuHints are the usual suspects for a path MTU below ethernetMTU, by the
+// path MTU that they leave
+var mtuHints = map[int]string{
+	1492: "PPPoE",
+	1480: "6in4 tunnels",
+	1476: "GRE tunnels",
+	1420: "WireGuard",
+	1400: "VPNs and IPsec",
+}
+
+// Warnings describes anything about the path MTU that's likely to cause
+// trouble.  TCP usually copes with a path MTU below ethernetMTU, but anything
+// that gets it wrong stalls or slows down, which is a common cause of poor
+// throughput over VPNs.
+func (m MTUResult) Warnings() []string {
+	var warnings []string
+	if m.MTU < ethernetMTU {
+		if hint, ok := mtuHints[m.MTU]; ok {
+			warnings = append(warnings, fmt.Sprintf("The path MTU is %v bytes, typical of %v", m.MTU, hint))
+		} else {
+			warnings = append(warnings, fmt.Sprintf("The path MTU is %v bytes, less than Ethernet's %v", m.MTU, ethernetMTU))
+		}
+	}
+	if m.FragmentsBlocked {
+		warnings = append(warnings, "Packets too big for the path don't get through in fragments")
+	}
+	return warnings
+}
+
+// RunMTUTest finds the path MTU to the server by sending it probes of
+// different sizes that mustn't be fragmented, and noting which ones it
+// answers.  It then checks that bigger packets get through in fragments.
+// It needs a server that supports CapMTU, and is only supported on Linux.
+func (c *Client) RunMTUTest(ctx context.Context) (MTUResult, error) {
+	// Our probes wouldn't find their way through a WebSocket endpoint
+	if c.wsURL != nil {
+		return MTUResult{}, fmt.Errorf("MTU probes can't be sent over WebSocket")
+	}
+	// Nor would they over QUIC, which servers answer on a port of its own
+	if c.quic {
+		return MTUResult{}, fmt.Errorf("MTU probes can't be sent over QUIC")
+	}
+
+	s, err := c.beginSession(ctx)
+	if err != nil {
+		return MTUResult{}, err
+	}
+	defer s.close()
+
+	if !s.info.Supports(CapMTU) {
+		return MTUResult{}, fmt.Errorf("server doesn't answer MTU probes")
+	}
+
+	err = s.writeCommand("MTU")
+	if err != nil {
+		return MTUResult{}, err
+	}
+
+	// The server responds with the session ID that our probes must carry
+	idLine, err := s.readLine()
+	if err != nil {
+		return MTUResult{}, err
+	}
+	id, err := strconv.ParseUint(idLine, 16, 64)
+	if err != nil {
+		return MTUResult{}, fmt.Errorf("invalid MTU session ID from server: %v", idLine)
+	}
+
+	// Probes go to the same address and port that we reached over TCP
+	network := strings.Replace(c.network(), "tcp", "udp", 1)
+	conn, err := c.dialer(network).DialContext(ctx, network, s.conn.RemoteAddr().String())
+	if err != nil {
+		return MTUResult{}, err
+	}
+	defer conn.Close()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-s.done:
+		}
+	}()
+
+	p := &mtuProber{conn: conn.(*net.UDPConn), id: id, ipv6: addrIP(s.conn.RemoteAddr()).To4() == nil}
+	mr, err := p.run()
+	if err != nil {
+		if ctx.Err() != nil {
+			return mr, ctx.Err()
+		}
+		return mr, err
+	}
+
+	// We're done, and the server can hang up
+	s.writeCommand("FIN")
+	return mr, nil
+}
+
+// mtuProber sends MTU probes to the server and waits for its answers
+type mtuProber struct {
+	conn *net.UDPConn
+	id   uint64
+	ipv6 bool
+
+	seq    uint64
+	probes int
+}
+
+// run finds the path MTU.  If the biggest packet that our link can send gets
+// through, that's it, and otherwise we search for the biggest that does.
+func (p *mtuProber) run() (MTUResult, error) {
+	var mr MTUResult
+
+	linkMTU, err := routeMTU(p.conn, p.ipv6)
+	if err != nil {
+		return mr, err
+	}
+	mr.LinkMTU = linkMTU
+
+	err = setDontFragment(p.conn, p.ipv6, true)
+	if err != nil {
+		return mr, err
+	}
+
+	lo, hi := minMTU4, linkMTU
+	if p.ipv6 {
+		lo = minMTU6
+	}
+	if hi > maxMTU {
+		hi = maxMTU
+	}
+
+	ok, err := p.probe(hi)
+	if err != nil {
+		return mr, err
+	}
+	if ok {
+		mr.MTU = hi
+	} else {
+		ok, err = p.probe(lo)
+		if err != nil {
+			return mr, err
+		}
+		if !ok {
+			return mr, fmt.Errorf("none of our MTU probes got through; something may be blocking UDP")
+		}
+		for hi-lo > 1 {
+			mid := (lo + hi) / 2
+			ok, err = p.probe(mid)
+			if err != nil {
+				return mr, err
+			}
+			if ok {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+		mr.MTU = lo
+	}
+
+	// A packet that's bigger than the path MTU has to be fragmented, by
+	// us or by a router along the way
+	if mr.MTU+mtuFragmentExtra <= maxMTU {
+		err = setDontFragment(p.conn, p.ipv6, false)
+		if err != nil {
+			return mr, err
+		}
+		ok, err = p.probe(mr.MTU + mtuFragmentExtra)
+		if err != nil {
+			return mr, err
+		}
+		mr.FragmentsBlocked = !ok
+	}
+
+	mr.Probes = p.probes
+	return mr, nil
+}
+
+// probe reports whether a packet of size bytes, headers and all, gets to the
+// server
+func (p *mtuProber) probe(size int) (bool, error) {
+	overhead := 20 + 8 // IPv4 and UDP headers
+	if p.ipv6 {
+		overhead = 40 + 8
+	}
+
+	datagram := make([]byte, size-overhead)
+	datagram[0] = DatagramProbe
+	binary.BigEndian.PutUint64(datagram[1:9], p.id)
+
+	for try := 0; try < mtuProbeTries; try++ {
+		// Each try gets a sequence number of its own, so that a late
+		// answer to an earlier one doesn't count
+		p.seq++
+		p.probes++
+		binary.BigEndian.PutUint64(datagram[9:17], p.seq)
+
+		_, err := p.conn.Write(datagram)
+		if errors.Is(err, syscall.EMSGSIZE) {
+			// Too big for our own link
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		ok, err := p.awaitAck(p.seq)
+		if ok || err != nil {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// awaitAck waits for the server to answer the probe numbered seq
+func (p *mtuProber) awaitAck(seq uint64) (bool, error) {
+	p.conn.SetReadDeadline(time.Now().Add(mtuProbeTimeout))
+
+	buf := make([]byte, 64)
+	for {
+		n, err := p.conn.Read(buf)
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() || errors.Is(err, syscall.EMSGSIZE) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if n < MTUProbeAckLen || buf[0] != DatagramProbeAck || binary.BigEndian.Uint64(buf[1:9]) != p.id {
+			continue
+		}
+		if binary.BigEndian.Uint64(buf[9:17]) == seq {
+			return true, nil
+		}
+	}
+}
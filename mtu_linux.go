@@ -0,0 +1,57 @@
+package sparkyfish
+
+import (
+	"net"
+	"syscall"
+)
+
+// setDontFragment makes conn send its packets with the don't fragment bit set,
+// even if they're bigger than the kernel thinks that the path can carry, or
+// lets the kernel and routers along the way fragment them instead
+func setDontFragment(conn *net.UDPConn, ipv6 bool, df bool) error {
+	level, opt, val := syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE
+	if !df {
+		val = syscall.IP_PMTUDISC_DONT
+	}
+	if ipv6 {
+		level, opt, val = syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE
+		if !df {
+			val = syscall.IPV6_PMTUDISC_DONT
+		}
+	}
+
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), level, opt, val)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// routeMTU returns the MTU of the route that conn's packets leave by
+func routeMTU(conn *net.UDPConn, ipv6 bool) (int, error) {
+	level, opt := syscall.IPPROTO_IP, syscall.IP_MTU
+	if ipv6 {
+		level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_MTU
+	}
+
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var mtu int
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		mtu, serr = syscall.GetsockoptInt(int(fd), level, opt)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return mtu, serr
+}
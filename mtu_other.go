@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package sparkyfish
+
+import (
+	"fmt"
+	"net"
+)
+
+// setDontFragment returns an error, as we only know how to send packets that
+// mustn't be fragmented on Linux
+func setDontFragment(conn *net.UDPConn, ipv6 bool, df bool) error {
+	return fmt.Errorf("MTU probing is only supported on Linux")
+}
+
+// routeMTU returns an error, as we only know how to ask Linux for the MTU
+func routeMTU(conn *net.UDPConn, ipv6 bool) (int, error) {
+	return 0, fmt.Errorf("MTU probing is only supported on Linux")
+}
@@ -0,0 +1,61 @@
+package sparkyfish
+
+import (
+	"context"
+	"time"
+)
+
+// pacedBurst is the time's worth of data that a paced test may send or
+// receive at once
+const pacedBurst = 50 * time.Millisecond
+
+// tokenBucket paces a throughput test to a fixed rate.  Tokens are bytes,
+// which accumulate at rate per second, up to a burst's worth.
+type tokenBucket struct {
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket creates a tokenBucket that paces a test to mbps, as measured
+// by measureThroughput
+func newTokenBucket(mbps float64) *tokenBucket {
+	rate := mbps * 1024 * 1000 / 8
+	burst := rate * pacedBurst.Seconds()
+	if burst < float64(minBlockBytes) {
+		burst = float64(minBlockBytes)
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// maxBlock returns the largest block that may be copied at once
+func (tb *tokenBucket) maxBlock() int64 {
+	return int64(tb.burst)
+}
+
+// wait blocks until n bytes may be copied or ctx is cancelled
+func (tb *tokenBucket) wait(ctx context.Context, n int64) error {
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+
+	tb.tokens -= float64(n)
+	if tb.tokens >= 0 {
+		return nil
+	}
+
+	// We're in debt, so wait until we've paid it off
+	timer := time.NewTimer(time.Duration(-tb.tokens / tb.rate * float64(time.Second)))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,200 @@
+package sparkyfish
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"math/bits"
+	"sync"
+)
+
+// payloadChunk is the size of the buffers that test data is generated into
+const payloadChunk = 64 * 1024
+
+// payloadBuffers holds the buffers that Payload.CopyN generates data into,
+// so that copying a block doesn't cost an allocation
+var payloadBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, payloadChunk)
+		return &b
+	},
+}
+
+// compressiblePattern is the text that compressible payloads repeat
+var compressiblePattern = bytes.Repeat([]byte("sparkyfish speed test "), payloadChunk/22+1)
+
+// Payload is an endless stream of data for throughput tests.  By default,
+// it's a ChaCha keystream under a random key, which can't be compressed or
+// predicted, so WAN optimizers and compressing middleboxes along the path
+// can't make the link look any faster than it is.  A compressible Payload
+// repeats a short text instead, to find out whether they do.
+//
+// A Payload must not be used by multiple goroutines at once.
+type Payload struct {
+	compressible bool
+	cipher       chacha
+
+	// The unread part of the last keystream block, or of the pattern
+	block [64]byte
+	off   int
+}
+
+// NewPayload creates a Payload, which is compressible if compressible is set
+func NewPayload(compressible bool) *Payload {
+	p := &Payload{compressible: compressible, off: len(compressiblePattern)}
+	if !compressible {
+		var seed [40]byte
+		rand.Read(seed[:])
+		p.cipher.init(seed[:32], seed[32:])
+		p.off = len(p.block)
+	}
+	return p
+}
+
+// Read fills b with the next len(b) bytes of the stream.  It never fails.
+func (p *Payload) Read(b []byte) (int, error) {
+	if p.compressible {
+		return p.readPattern(b), nil
+	}
+
+	n := 0
+
+	// Finish off the last block, then generate whole blocks straight into b
+	if p.off < len(p.block) {
+		n = copy(b, p.block[p.off:])
+		p.off += n
+	}
+	for len(b)-n >= len(p.block) {
+		p.cipher.keystream(b[n : n+len(p.block)])
+		n += len(p.block)
+	}
+	if n < len(b) {
+		p.cipher.keystream(p.block[:])
+		p.off = copy(b[n:], p.block[:])
+		n += p.off
+	}
+
+	return n, nil
+}
+
+// readPattern fills b from the repeating pattern of a compressible Payload
+func (p *Payload) readPattern(b []byte) int {
+	n := 0
+	for n < len(b) {
+		if p.off >= len(compressiblePattern) {
+			p.off = 0
+		}
+		c := copy(b[n:], compressiblePattern[p.off:])
+		p.off += c
+		n += c
+	}
+	return n
+}
+
+// CopyN writes the next n bytes of the stream to w.  It returns the number of
+// bytes written and the first error that w returned, if any.
+func (p *Payload) CopyN(w io.Writer, n int64) (int64, error) {
+	buf := payloadBuffers.Get().(*[]byte)
+	defer payloadBuffers.Put(buf)
+
+	var written int64
+	for written < n {
+		chunk := *buf
+		if n-written < int64(len(chunk)) {
+			chunk = chunk[:n-written]
+		}
+		p.Read(chunk)
+
+		nw, err := w.Write(chunk)
+		written += int64(nw)
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// chachaDoubleRounds is the number of double rounds that chacha runs per
+// block.  ChaCha20 runs 10; we run 4, which makes ChaCha8, as in Go's
+// math/rand/v2.  The data only has to be unpredictable, not secret, and the
+// full 20 rounds would hold a single stream to about 4 Gbit/s on a typical
+// core, where ChaCha8 manages more than twice that.
+const chachaDoubleRounds = 4
+
+// chacha generates the ChaCha20 keystream, as described by Bernstein, with a
+// 64-bit block counter and nonce, but with chachaDoubleRounds.  We only need
+// the keystream, so it doesn't bother with encryption.
+type chacha struct {
+	state [16]uint32
+}
+
+func (c *chacha) init(key, nonce []byte) {
+	c.state[0], c.state[1], c.state[2], c.state[3] = 0x61707865, 0x3320646e, 0x79622d32, 0x6b206574
+	for i := 0; i < 8; i++ {
+		c.state[4+i] = binary.LittleEndian.Uint32(key[4*i:])
+	}
+	c.state[12], c.state[13] = 0, 0
+	c.state[14] = binary.LittleEndian.Uint32(nonce[0:])
+	c.state[15] = binary.LittleEndian.Uint32(nonce[4:])
+}
+
+// keystream writes the next 64-byte block of the keystream to out
+func (c *chacha) keystream(out []byte) {
+	s := &c.state
+	x0, x1, x2, x3 := s[0], s[1], s[2], s[3]
+	x4, x5, x6, x7 := s[4], s[5], s[6], s[7]
+	x8, x9, x10, x11 := s[8], s[9], s[10], s[11]
+	x12, x13, x14, x15 := s[12], s[13], s[14], s[15]
+
+	for i := 0; i < chachaDoubleRounds; i++ {
+		// Columns
+		x0, x4, x8, x12 = quarterRound(x0, x4, x8, x12)
+		x1, x5, x9, x13 = quarterRound(x1, x5, x9, x13)
+		x2, x6, x10, x14 = quarterRound(x2, x6, x10, x14)
+		x3, x7, x11, x15 = quarterRound(x3, x7, x11, x15)
+
+		// Diagonals
+		x0, x5, x10, x15 = quarterRound(x0, x5, x10, x15)
+		x1, x6, x11, x12 = quarterRound(x1, x6, x11, x12)
+		x2, x7, x8, x13 = quarterRound(x2, x7, x8, x13)
+		x3, x4, x9, x14 = quarterRound(x3, x4, x9, x14)
+	}
+
+	_ = out[63]
+	binary.LittleEndian.PutUint32(out[0:], x0+s[0])
+	binary.LittleEndian.PutUint32(out[4:], x1+s[1])
+	binary.LittleEndian.PutUint32(out[8:], x2+s[2])
+	binary.LittleEndian.PutUint32(out[12:], x3+s[3])
+	binary.LittleEndian.PutUint32(out[16:], x4+s[4])
+	binary.LittleEndian.PutUint32(out[20:], x5+s[5])
+	binary.LittleEndian.PutUint32(out[24:], x6+s[6])
+	binary.LittleEndian.PutUint32(out[28:], x7+s[7])
+	binary.LittleEndian.PutUint32(out[32:], x8+s[8])
+	binary.LittleEndian.PutUint32(out[36:], x9+s[9])
+	binary.LittleEndian.PutUint32(out[40:], x10+s[10])
+	binary.LittleEndian.PutUint32(out[44:], x11+s[11])
+	binary.LittleEndian.PutUint32(out[48:], x12+s[12])
+	binary.LittleEndian.PutUint32(out[52:], x13+s[13])
+	binary.LittleEndian.PutUint32(out[56:], x14+s[14])
+	binary.LittleEndian.PutUint32(out[60:], x15+s[15])
+
+	// The block counter is 64 bits, so it won't wrap during a test
+	s[12]++
+	if s[12] == 0 {
+		s[13]++
+	}
+}
+
+func quarterRound(a, b, c, d uint32) (uint32, uint32, uint32, uint32) {
+	a += b
+	d = bits.RotateLeft32(d^a, 16)
+	c += d
+	b = bits.RotateLeft32(b^c, 12)
+	a += b
+	d = bits.RotateLeft32(d^a, 8)
+	c += d
+	b = bits.RotateLeft32(b^c, 7)
+	return a, b, c, d
+}
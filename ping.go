@@ -0,0 +1,188 @@
+package sparkyfish
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"time"
+)
+
+// PingResult holds latency measurements, in milliseconds
+type PingResult struct {
+	Current float64 `json:"current_ms"`
+	Min     float64 `json:"min_ms"`
+	Max     float64 `json:"max_ms"`
+	Avg     float64 `json:"avg_ms"`
+	StdDev  float64 `json:"stddev_ms"`
+	Jitter  float64 `json:"jitter_ms"`
+
+	// Probes is the number of pings that came back
+	Probes int `json:"probes"`
+}
+
+// PingSample is passed to Client.OnPing as each ping comes back
+type PingSample struct {
+	RTT   time.Duration
+	Stats PingResult // stats for the test so far
+}
+
+type pingHistory []int64
+
+// RunPingTest runs an echo (ping) test against the server.  Each probe is a
+// single byte, sent once the echo of the last one is back.  Since they share
+// a TCP stream, they can't come back out of order or go missing; a lost
+// packet shows up as a longer round trip instead.
+func (c *Client) RunPingTest(ctx context.Context) (PingResult, error) {
+	var pr PingResult
+	err := c.retry(ctx, func() (err error) {
+		pr, err = c.pingTest(ctx)
+		return err
+	})
+	return pr, err
+}
+
+// pingTest runs a single attempt at a ping test
+func (c *Client) pingTest(ctx context.Context) (PingResult, error) {
+	var pr PingResult
+	var latencyHist pingHistory
+
+	pings := c.Pings
+	if pings == 0 {
+		pings = DefaultPings
+	}
+	if pings < 1 || pings > MaxPings {
+		return pr, fmt.Errorf("number of pings must be between 1 and %v", MaxPings)
+	}
+
+	s, err := c.beginSession(ctx)
+	if err != nil {
+		return pr, err
+	}
+	defer s.close()
+
+	// Send the ECO command to the remote server, requesting an echo test
+	// (remote receives and echoes back).
+	err = s.writeCommand("ECO")
+	if err != nil {
+		return pr, err
+	}
+
+	// We never want to run the ping test beyond maxPingTestLength seconds
+	s.conn.SetDeadline(time.Now().Add(time.Duration(maxPingTestLength) * time.Second))
+
+	for i := 0; i < pings; i++ {
+		var echoed byte
+
+		// Our probes cycle through the printable characters
+		probe := byte(33 + i%94)
+
+		startTime := time.Now()
+
+		_, err = s.conn.Write([]byte{probe})
+		if err == nil && i == 0 {
+			// Our first probe is never 'E', so we can tell an echo apart
+			// from an ERR response
+			err = s.checkRejection()
+		}
+		if err == nil {
+			echoed, err = s.reader.ReadByte()
+		}
+		if err == nil && echoed != probe {
+			// TCP doesn't reorder, so the server is broken
+			return pr, fmt.Errorf("server echoed %q to our probe %q", echoed, probe)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return pr, ctx.Err()
+			}
+			// If we've been pinging for maxPingTestLength, call it quits
+			// and report what we have so far
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && len(latencyHist) > 0 {
+				break
+			}
+			return pr, err
+		}
+
+		pt := time.Since(startTime)
+
+		s.log.Debug("ping", "probe", i+1, "rtt", pt)
+
+		// Add this ping (in microseconds) to our ping history and recompute our stats
+		latencyHist = append(latencyHist, pt.Nanoseconds()/1000)
+		pr = latencyHist.stats()
+
+		if c.OnPing != nil {
+			c.OnPing(PingSample{RTT: pt, Stats: pr})
+		}
+	}
+
+	return pr, nil
+}
+
+// stats computes our latency stats from the ping history
+func (h *pingHistory) stats() PingResult {
+	ptMin, ptMax := h.minMax()
+
+	return PingResult{
+		Current: float64((*h)[len(*h)-1]) / 1000,
+		Min:     float64(ptMin) / 1000,
+		Max:     float64(ptMax) / 1000,
+		Avg:     h.mean() / 1000,
+		StdDev:  h.stdDev() / 1000,
+		Jitter:  h.jitter() / 1000,
+		Probes:  len(*h),
+	}
+}
+
+// mean generates a statistical mean of our historical ping times
+func (h *pingHistory) mean() float64 {
+	var sum uint64
+	for _, t := range *h {
+		sum = sum + uint64(t)
+	}
+
+	return float64(sum / uint64(len(*h)))
+}
+
+// variance calculates the variance of our historical ping times
+func (h *pingHistory) variance() float64 {
+	var sqDevSum float64
+
+	mean := h.mean()
+
+	for _, t := range *h {
+		sqDevSum = sqDevSum + math.Pow((float64(t)-mean), 2)
+	}
+	return sqDevSum / float64(len(*h))
+}
+
+// stdDev calculates the standard deviation of our historical ping times
+func (h *pingHistory) stdDev() float64 {
+	return math.Sqrt(h.variance())
+}
+
+// jitter calculates the mean deviation between consecutive ping times
+func (h *pingHistory) jitter() float64 {
+	var devSum float64
+
+	if len(*h) < 2 {
+		return 0
+	}
+
+	for i := 1; i < len(*h); i++ {
+		devSum = devSum + math.Abs(float64((*h)[i]-(*h)[i-1]))
+	}
+	return devSum / float64(len(*h)-1)
+}
+
+// minMax returns the lowest and highest of our historical ping times
+func (h *pingHistory) minMax() (int, int) {
+	var hist []int
+	for _, v := range *h {
+		hist = append(hist, int(v))
+	}
+	sort.Ints(hist)
+	return hist[0], hist[len(hist)-1]
+}
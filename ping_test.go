@@ -0,0 +1,25 @@
+package sparkyfish
+
+import "testing"
+
+func TestPingHistoryStats(t *testing.T) {
+	tests := []struct {
+		name string
+		hist pingHistory // in microseconds
+		want PingResult  // in milliseconds
+	}{
+		{"one probe", pingHistory{1500}, PingResult{Current: 1.5, Min: 1.5, Max: 1.5, Avg: 1.5, Probes: 1}},
+		{"steady", pingHistory{1000, 1000, 1000}, PingResult{Current: 1, Min: 1, Max: 1, Avg: 1, Probes: 3}},
+		{"varying", pingHistory{1000, 3000, 2000}, PingResult{Current: 2, Min: 1, Max: 3, Avg: 2, StdDev: 0.816496580927726, Jitter: 1.5, Probes: 3}},
+		{"alternating", pingHistory{4000, 1000, 4000, 1000}, PingResult{Current: 1, Min: 1, Max: 4, Avg: 2.5, StdDev: 1.5, Jitter: 3, Probes: 4}},
+		{"spike", pingHistory{1000, 1000, 9000, 1000}, PingResult{Current: 1, Min: 1, Max: 9, Avg: 3, StdDev: 3.4641016151377544, Jitter: 16.0 / 3, Probes: 4}},
+	}
+	for _, tt := range tests {
+		got := tt.hist.stats()
+		if got.Probes != tt.want.Probes ||
+			!approxEqual(got.Current, tt.want.Current) || !approxEqual(got.Min, tt.want.Min) || !approxEqual(got.Max, tt.want.Max) ||
+			!approxEqual(got.Avg, tt.want.Avg) || !approxEqual(got.StdDev, tt.want.StdDev) || !approxEqual(got.Jitter, tt.want.Jitter) {
+			t.Errorf("%v: stats() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package sparkyfish
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// minProgressInterval is the shortest interval that servers report the
+// progress of an upload test at
+const minProgressInterval = 10 * time.Millisecond
+
+// progressDrainTime is how long we wait, at the end of an upload test, for
+// the server to report the last of what we sent.  Servers read uploads for
+// two seconds longer than we send them.
+const progressDrainTime = 2 * time.Second
+
+// progressInterval returns how often we ask the server to report the progress
+// of our upload tests.  The reports are much more frequent than our own
+// measurements, so that each measurement takes in about the same number of
+// them.
+func progressInterval(reportInterval time.Duration) time.Duration {
+	interval := reportInterval / 20
+	if interval < minProgressInterval {
+		return minProgressInterval
+	}
+	return interval
+}
+
+// progressCommand returns the command that starts an upload test on s.
+// Servers that support it are asked to report the progress of the test, and
+// s.progress is set.
+func (c *Client) progressCommand(s *session) string {
+	if s.info.Version == 0 || !s.info.Supports(CapProgress) {
+		return "RCV"
+	}
+	s.progress = true
+	return fmt.Sprintf("RCV PROGRESS %d", progressInterval(c.reportInterval())/time.Millisecond)
+}
+
+// watchProgress reads the server's progress reports during an upload test on
+// s, adding the bytes that the server has received since its last report to
+// meter.  This measures our upload as the server received it, rather
+// than as we wrote it into our socket buffer, which fills up much faster than
+// the link can drain it at the start of a test.
+//
+// It returns a function that stops watching and returns the error that
+// stopped the reports, if they stopped before we did.  An ERR response from
+// the server is returned that way, as is errCapped if the server cut the test
+// short.  The function may be called more than
+// once.
+func (s *session) watchProgress(meter *byteMeter) (stop func() error) {
+	done := make(chan error, 1)
+	go func() {
+		err := s.readProgress(meter)
+
+		// The server has stopped reading our upload, so stop sending it
+		if err == errCapped {
+			s.conn.SetWriteDeadline(time.Now())
+		}
+		done <- err
+	}()
+
+	var err error
+	var stopped bool
+	return func() error {
+		if !stopped {
+			// Interrupt the read that's waiting for the next report
+			s.conn.SetReadDeadline(time.Now())
+			err = <-done
+			stopped = true
+
+			// We timed the read out ourselves
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				err = nil
+			}
+		}
+		return err
+	}
+}
+
+// readProgress reads progress reports from s until it fails, keeping the
+// latest count in s.received
+func (s *session) readProgress(meter *byteMeter) error {
+	for {
+		line, err := s.readLine()
+		if err != nil {
+			return err
+		}
+
+		// The server tells us if it cuts our upload short
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == "CAPPED" {
+			s.capped, err = parseCapped(fields[1:])
+			if err != nil {
+				return err
+			}
+			return errCapped
+		}
+
+		if len(fields) != 2 || fields[0] != "RCVD" {
+			return fmt.Errorf("invalid progress report from server")
+		}
+		n, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || n < s.received {
+			return fmt.Errorf("invalid progress report from server")
+		}
+
+		if n > s.received {
+			meter.add(n - s.received)
+			atomic.StoreInt64(&s.received, n)
+		}
+	}
+}
+
+// awaitReceived waits, until timeout, for the server's progress reports on s
+// to catch up with the sent bytes of our upload, so that we compare what we
+// sent with all that the server went on to receive of it, rather than with a
+// report from before the last of it arrived
+func (s *session) awaitReceived(sent int64, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&s.received) < sent && time.Now().Before(deadline) {
+		time.Sleep(minProgressInterval)
+	}
+}
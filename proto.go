@@ -0,0 +1,450 @@
+package sparkyfish
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/freinold/sparkyfish/internal/quicnet"
+)
+
+// Capabilities that servers can advertise in their HELO response.  Clients
+// shouldn't ask a server for anything that it doesn't advertise.
+const (
+	CapUDP           = "udp"          // UDP tests (USND and URCV)
+	CapAuth          = "auth"         // the server requires an AUTH token
+	CapTLS           = "tls"          // the server accepts TLS connections
+	CapMultiStream   = "multistream"  // tests may run over several parallel connections
+	CapDuration      = "duration"     // clients may choose the length of throughput tests
+	CapInfo          = "info"         // the server answers the INFO command
+	CapBidirectional = "bidir"        // the server runs bidirectional tests (BID)
+	CapProgress      = "progress"     // the server reports what it has received during uploads (RCV PROGRESS)
+	CapTally         = "tally"        // the server tallies what it sends during downloads (SND TALLY and TALLY)
+	CapCompressible  = "compressible" // the server sends compressible data on request (SND COMPRESSIBLE)
+	CapLimits        = "limits"       // the server tells us when it cuts a test short at one of its limits (CAPPED)
+	CapNoop          = "noop"         // the server answers the NOOP command
+	CapMTU           = "mtu"          // the server answers MTU probes (MTU)
+)
+
+// ServerInfo describes the server, as reported in its HELO response
+type ServerInfo struct {
+	Cname    string `json:"cname"`
+	Location string `json:"location,omitempty"`
+	Family   string `json:"family"`
+
+	// Version is the protocol version that was negotiated with the server
+	Version uint16 `json:"protocol_version"`
+
+	// Capabilities lists the optional features that the server supports.
+	// Servers that speak protocol version 0 don't advertise any.
+	Capabilities []string `json:"capabilities"`
+
+	// Timings is how long it took to connect to the server and say hello
+	Timings ConnectTimings `json:"timings"`
+}
+
+// Supports reports whether the server advertised capability.  Servers that
+// speak protocol version 0 can't advertise anything, so we assume that they
+// support everything and let the server turn us down if it doesn't.
+func (si ServerInfo) Supports(capability string) bool {
+	if si.Version == 0 {
+		return true
+	}
+	for _, c := range si.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// serverError is an ERR response from the server
+type serverError string
+
+func (e serverError) Error() string {
+	return "server error: " + string(e)
+}
+
+// errVersionNotSupported is sent by servers that don't speak the protocol
+// version that we asked for
+const errVersionNotSupported = serverError("Protocol version not supported")
+
+// maxRedirects is the most REDIRECT responses that we follow in a row
+const maxRedirects = 3
+
+// redirectError is a REDIRECT response from a server that's too busy to test
+// us, naming the server that we should try instead
+type redirectError string
+
+func (e redirectError) Error() string {
+	return "server redirected us to " + string(e)
+}
+
+// session is a single connection to a sparkyfish server.  Every test runs in
+// its own session.
+type session struct {
+	conn   net.Conn
+	tcp    net.Conn // the underlying TCP connection, for WebSocket sessions
+	reader *bufio.Reader
+	info   ServerInfo
+	done   chan struct{}
+
+	// progress is set if the server reports the bytes that it has received
+	// during our upload test, the latest of which is received
+	progress bool
+	received int64
+
+	// tally is the ID of the server's count of what it sent during our
+	// download test, if it's keeping one
+	tally string
+
+	// copied is the number of bytes that we've sent or received during a
+	// throughput test
+	copied int64
+
+	// capped is the limit that the server cut our test short at, if it
+	// told us that it did
+	capped *ServerLimit
+
+	// stopped is why our throughput test stopped before its time was up,
+	// if it did
+	stopped StopReason
+
+	// endedCopy is set if we ended our throughput test's copy ourselves,
+	// at MaxBytes, before its time was up
+	endedCopy bool
+
+	// stream is the number of the stream that we carry, from 1, if we're
+	// one of several in a multi-stream test
+	stream int
+
+	// log is where we trace the session, never nil
+	log *slog.Logger
+}
+
+// Hello connects to the server, performs the HELO exchange and hangs up.  It's
+// a cheap way to find out if a server is up and what it has to say about itself.
+func (c *Client) Hello(ctx context.Context) (ServerInfo, error) {
+	var s *session
+	err := c.retry(ctx, func() (err error) {
+		s, err = c.beginSession(ctx)
+		return err
+	})
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	s.close()
+
+	c.info = s.info
+	return s.info, nil
+}
+
+// beginSession connects to the server and signs on with the newest protocol
+// version that the server speaks.  If the server sends us to another one,
+// we go there instead.
+func (c *Client) beginSession(ctx context.Context) (*session, error) {
+	redirects := 0
+	for {
+		s, err := c.dialSession(ctx, c.version)
+
+		var redirect redirectError
+		switch {
+		case err == errVersionNotSupported && c.version > 0:
+			// Older servers hang up on versions that they don't
+			// know, so we try again with the one before.  We stick
+			// with it from then on.
+			c.version--
+			c.logger().Debug("server doesn't speak our protocol version; falling back", "version", c.version)
+		case errors.As(err, &redirect) && redirects < maxRedirects:
+			// We stick with the server that we were sent to from
+			// then on, too
+			redirects++
+			from := c.addr
+			c.addr = withDefaultPort(string(redirect), DefaultPort)
+			c.version = ProtocolVersion
+			c.logger().Debug("redirected", "from", from, "to", c.addr)
+			if c.OnRedirect != nil {
+				c.OnRedirect(from, c.addr)
+			}
+		default:
+			return s, err
+		}
+	}
+}
+
+// dialSession connects to the server and signs on with protocol version
+func (c *Client) dialSession(ctx context.Context, version uint16) (*session, error) {
+	dial := c.dialer(c.network()).DialContext
+	if c.Dial != nil {
+		dial = c.Dial
+	}
+	log := c.sessionLogger(c.addr)
+	log.Debug("connecting", "network", c.network(), "version", version)
+
+	var trace connectTrace
+	var timings ConnectTimings
+	var conn net.Conn
+	var err error
+	start := time.Now()
+	if c.quic {
+		conn, err = c.dialQUIC(ctx, &timings)
+	} else {
+		conn, err = dial(trace.context(ctx), c.network(), c.addr)
+		timings = trace.timings()
+	}
+	if err != nil {
+		log.Debug("couldn't connect", "err", err)
+		return nil, err
+	}
+	log.Debug("connected", "local", conn.LocalAddr(), "remote", conn.RemoteAddr(), "dns_ms", timings.DNS, "connect_ms", timings.Connect)
+
+	s := &session{conn: conn, tcp: conn, done: make(chan struct{}), log: log}
+
+	// Hang up if our context is cancelled mid-session.  This unblocks any
+	// reads or writes in progress.
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-s.done:
+		}
+	}()
+
+	// Over WebSocket, the test protocol runs inside the WebSocket once the
+	// handshake is done
+	if c.wsURL != nil {
+		s.conn, err = c.upgrade(conn, &timings)
+		if err != nil {
+			log.Debug("WebSocket upgrade failed", "err", err)
+			close(s.done)
+			conn.Close()
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+	}
+
+	// Create a bufio.Reader for our connection
+	s.reader = bufio.NewReader(s.conn)
+
+	helloStart := time.Now()
+	err = s.hello(c.addr, version)
+	if err == nil && c.Token != "" {
+		err = s.auth(c.Token)
+	}
+	timings.Hello = milliseconds(time.Since(helloStart))
+	timings.Total = milliseconds(time.Since(start))
+	s.info.Timings = timings
+	if err == nil && c.Token == "" && s.info.Version > 0 && s.info.Supports(CapAuth) {
+		err = fmt.Errorf("server requires a token")
+	}
+	if err != nil {
+		log.Debug("couldn't sign on", "err", err)
+		s.close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	log.Debug("signed on", "version", s.info.Version, "hello_ms", timings.Hello)
+
+	return s, nil
+}
+
+// hello performs the HELO exchange with the server at addr, using protocol
+// version
+func (s *session) hello(addr string, version uint16) error {
+	// Record which address family we actually ended up using
+	s.info.Family = family(s.tcp.RemoteAddr())
+	s.info.Version = version
+
+	// First command is always HELO, immediately followed by a single-digit protocol version
+	// e.g. "HELO1".
+	err := s.writeCommand(fmt.Sprint("HELO", version))
+	if err != nil {
+		return err
+	}
+
+	// In response to our HELO, the server will respond like this:
+	//   HELO\n
+	//   canonicalName\n
+	//   location\n
+	//   CAPS capability capability...\n
+	// where canonicalName is the server's canonical hostname,
+	// location is the physical location of the server and the
+	// CAPS line (protocol version 1 and up) lists the server's
+	// capabilities.  With protocol version 2 and up, a server
+	// that's too busy may respond with REDIRECT host:port instead.
+
+	// First, we check for the HELO response
+	response, err := s.readLine()
+	if err != nil {
+		return err
+	}
+
+	if version >= 2 && strings.HasPrefix(response, "REDIRECT ") {
+		to := sanitize(strings.TrimSpace(strings.TrimPrefix(response, "REDIRECT ")))
+		if to == "" {
+			return fmt.Errorf("invalid HELO response from server")
+		}
+		if s.conn != s.tcp {
+			return fmt.Errorf("server redirected us to %v, which we can't reach over WebSocket", to)
+		}
+		if _, ok := s.conn.(*quicnet.Conn); ok {
+			return fmt.Errorf("server redirected us to %v, which we can't reach over QUIC", to)
+		}
+		return redirectError(to)
+	}
+
+	if response != "HELO" {
+		return fmt.Errorf("invalid HELO response from server")
+	}
+
+	// Next, we check to see if the server provided a cname
+	cname, err := s.readLine()
+	if err != nil {
+		return err
+	}
+
+	if cname == "none" {
+		// If a cname was not provided, we'll just use the hostname that the
+		// test was run against
+		cname, _, _ = net.SplitHostPort(addr)
+	}
+
+	s.info.Cname = sanitize(cname)
+
+	// Finally we check to see if the server provided a location
+	location, err := s.readLine()
+	if err != nil {
+		return err
+	}
+
+	if location != "none" {
+		s.info.Location = sanitize(location)
+	}
+
+	if version == 0 {
+		return nil
+	}
+
+	caps, err := s.readLine()
+	if err != nil {
+		return err
+	}
+
+	fields := strings.Fields(caps)
+	if len(fields) == 0 || fields[0] != "CAPS" {
+		return fmt.Errorf("invalid HELO response from server")
+	}
+	s.info.Capabilities = []string{}
+	for _, c := range fields[1:] {
+		s.info.Capabilities = append(s.info.Capabilities, sanitize(c))
+	}
+
+	return nil
+}
+
+// auth presents our token to the server
+func (s *session) auth(token string) error {
+	err := s.writeCommand("AUTH " + token)
+	if err != nil {
+		return err
+	}
+
+	response, err := s.readLine()
+	if err != nil {
+		return err
+	}
+	if response != "OK" {
+		return fmt.Errorf("invalid AUTH response from server")
+	}
+
+	return nil
+}
+
+// checkRejection returns the server's error if it answered our test command
+// with an ERR response instead of starting the test, which is what happens if
+// we didn't authenticate to a private server.  It must be called before any
+// of the test's data has been read.
+func (s *session) checkRejection() error {
+	b, err := s.reader.Peek(1)
+	if err != nil || b[0] != 'E' {
+		return nil
+	}
+
+	b, err = s.reader.Peek(4)
+	if err != nil || string(b) != "ERR:" {
+		return nil
+	}
+
+	_, err = s.readLine()
+	return err
+}
+
+// readLine reads a single line from the server.  ERR responses are returned
+// as errors.
+func (s *session) readLine() (string, error) {
+	line, err := s.reader.ReadString('\n')
+	if err != nil {
+		s.log.Debug("read failed", "err", err)
+		return "", err
+	}
+	line = strings.TrimSpace(line)
+	s.log.Debug("received", "line", line)
+
+	if strings.HasPrefix(line, "ERR:") {
+		return "", serverError(sanitize(line[4:]))
+	}
+
+	return line, nil
+}
+
+func (s *session) writeCommand(cmd string) error {
+	str := fmt.Sprintf("%v\r\n", cmd)
+	_, err := s.conn.Write([]byte(str))
+	if err != nil {
+		s.log.Debug("write failed", "command", redactCommand(cmd), "err", err)
+		return err
+	}
+	s.log.Debug("sent", "command", redactCommand(cmd))
+	return nil
+}
+
+func (s *session) close() error {
+	s.log.Debug("closing", "copied", s.copied, "stopped", s.stopped)
+	close(s.done)
+	return s.conn.Close()
+}
+
+// family returns the address family ("ipv4" or "ipv6") of addr
+func family(addr net.Addr) string {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+
+	if tcpAddr.IP.To4() != nil {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+func sanitize(str string) string {
+	b := make([]byte, len(str))
+	var bi int
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		if c >= 32 && c < 127 {
+			b[bi] = c
+			bi++
+		}
+	}
+	return string(b[:bi])
+}
@@ -0,0 +1,69 @@
+package sparkyfish
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/freinold/sparkyfish/internal/quicnet"
+)
+
+// DefaultQUICPort is the UDP port that servers answer tests over QUIC on by
+// convention.  It differs from DefaultPort, whose datagrams are for UDP tests.
+const DefaultQUICPort = "7123"
+
+// dialQUIC opens a test connection to the server over QUIC.  The time that
+// the lookup and the QUIC handshake take is noted in timings.
+//
+// Unless we have a TLSConfig, we don't verify the server's certificate, which
+// servers without one of their own make up, as we don't authenticate servers
+// over plain TCP either.
+func (c *Client) dialQUIC(ctx context.Context, timings *ConnectTimings) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(c.addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %v", c.addr)
+	}
+
+	network := strings.Replace(c.network(), "tcp", "udp", 1)
+	start := time.Now()
+	ips, err := net.DefaultResolver.LookupIP(ctx, strings.Replace(network, "udp", "ip", 1), host)
+	if err != nil {
+		return nil, err
+	}
+	timings.DNS = milliseconds(time.Since(start))
+	raddr := &net.UDPAddr{IP: ips[0], Port: port}
+
+	var laddr string
+	if c.Source != nil {
+		laddr = net.JoinHostPort(c.Source.String(), "0")
+	}
+	lc := net.ListenConfig{Control: c.control}
+	pc, err := lc.ListenPacket(ctx, network, laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	tc := &tls.Config{InsecureSkipVerify: true}
+	if c.TLSConfig != nil {
+		tc = c.TLSConfig.Clone()
+	}
+	if tc.ServerName == "" {
+		tc.ServerName = host
+	}
+
+	start = time.Now()
+	conn, err := quicnet.Dial(ctx, pc, raddr, tc)
+	if err != nil {
+		return nil, err
+	}
+	timings.QUIC = milliseconds(time.Since(start))
+	return conn, nil
+}
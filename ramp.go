@@ -0,0 +1,67 @@
+package sparkyfish
+
+import (
+	"context"
+	"fmt"
+)
+
+// DefaultRampSteps are the stream counts that a ramp test steps through by
+// default
+var DefaultRampSteps = []int{1, 2, 4, 8}
+
+// RampStep holds the results of one step of a ramp test
+type RampStep struct {
+	Streams  int              `json:"streams"`
+	Download ThroughputResult `json:"download"`
+	Upload   ThroughputResult `json:"upload"`
+}
+
+// RunRampTest repeats the download and upload tests over each number of
+// streams in steps, in order, and returns the results of each step.  If the
+// throughput grows with the number of streams, something along the path is
+// limiting each flow; if it stays flat, we've hit the link's total capacity.
+// SkipDownload and SkipUpload are honoured, but UDP tests can't be ramped.
+func (c *Client) RunRampTest(ctx context.Context, steps []int) ([]RampStep, error) {
+	if c.UDP {
+		return nil, fmt.Errorf("ramp tests can't be run over UDP")
+	}
+	for _, n := range steps {
+		if n < 1 || n > MaxStreams {
+			return nil, fmt.Errorf("streams must be between 1 and %v", MaxStreams)
+		}
+	}
+
+	// Each step runs with its own number of streams
+	defer func(streams int) {
+		c.Streams = streams
+	}(c.Streams)
+
+	var results []RampStep
+	for _, n := range steps {
+		c.Streams = n
+		step := RampStep{Streams: n}
+
+		var err error
+		if c.SkipDownload {
+			step.Download.Skipped = true
+		} else {
+			step.Download, err = c.RunDownloadTest(ctx)
+			if err != nil {
+				return results, fmt.Errorf("download over %v stream(s): %v", n, err)
+			}
+		}
+
+		if c.SkipUpload {
+			step.Upload.Skipped = true
+		} else {
+			step.Upload, err = c.RunUploadTest(ctx)
+			if err != nil {
+				return results, fmt.Errorf("upload over %v stream(s): %v", n, err)
+			}
+		}
+
+		results = append(results, step)
+	}
+
+	return results, nil
+}
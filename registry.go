@@ -0,0 +1,70 @@
+package sparkyfish
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RegistryPath is where registries list the servers that have registered with
+// them, with GET, and take registrations, with POST
+const RegistryPath = "/api/v1/servers"
+
+// registryClient is what we fetch registries' lists with
+var registryClient = &http.Client{Timeout: 10 * time.Second}
+
+// RegisteredServer is a server that a registry lists.  Servers register by
+// POSTing one, and renew their registration while they're running, which
+// keeps their load up to date.
+type RegisteredServer struct {
+	Candidate
+
+	// Version is the version of the server software
+	Version string `json:"version,omitempty"`
+
+	// ActiveConnections is the number of connections that the server was
+	// handling when it last registered
+	ActiveConnections int `json:"active_connections"`
+
+	// MaxConnections is the most connections that the server will handle
+	// at once, or zero if there's no limit
+	MaxConnections int `json:"max_connections"`
+
+	// LastSeen is when the server last registered.  Registries set it.
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// Full reports whether the server was handling as many connections as it
+// will when it last registered
+func (rs RegisteredServer) Full() bool {
+	return rs.MaxConnections > 0 && rs.ActiveConnections >= rs.MaxConnections
+}
+
+// FetchRegistry fetches the servers listed by the registry at registryURL,
+// e.g. "https://registry.example.com"
+func FetchRegistry(ctx context.Context, registryURL string) ([]RegisteredServer, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(registryURL, "/")+RegistryPath, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := registryClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("registry responded with %v", resp.Status)
+	}
+
+	var servers []RegisteredServer
+	err = json.NewDecoder(resp.Body).Decode(&servers)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response from registry: %v", err)
+	}
+	return servers, nil
+}
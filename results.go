@@ -0,0 +1,61 @@
+package sparkyfish
+
+import (
+	"time"
+)
+
+// Results holds the outcome of a complete test sequence
+type Results struct {
+	Server    string           `json:"server"`
+	Family    string           `json:"family"`
+	StartTime time.Time        `json:"start_time"`
+	EndTime   time.Time        `json:"end_time"`
+	Ping      PingResult       `json:"ping"`
+	Download  ThroughputResult `json:"download"`
+	Upload    ThroughputResult `json:"upload"`
+
+	// Bidirectional is set if the download and upload tests ran at the same
+	// time
+	Bidirectional bool `json:"bidirectional,omitempty"`
+
+	// Streams is the number of connections that the download and upload
+	// tests ran over, if it was more than one
+	Streams int `json:"streams,omitempty"`
+
+	// Compressible is set if the download and upload tests sent
+	// compressible data
+	Compressible bool `json:"compressible,omitempty"`
+
+	// DSCP is the DSCP value that our traffic was marked with, if any
+	DSCP int `json:"dscp,omitempty"`
+
+	// Status is the server's INFO response, if it supports the INFO command
+	Status *ServerStatus `json:"server_status,omitempty"`
+
+	// Tags and Note are the client's Tags and Note, e.g. the location,
+	// SSID or experiment that the run was part of
+	Tags []string `json:"tags,omitempty"`
+	Note string   `json:"note,omitempty"`
+
+	// Environment describes the host that the tests ran from and how it
+	// was connected, if the client captured it
+	Environment *Environment `json:"environment,omitempty"`
+
+	// Connect breaks down how long it took to connect to the server and
+	// say hello, the first time that we did
+	Connect *ConnectTimings `json:"connect,omitempty"`
+
+	// DNS is how long it took to look up the server's hostname, if the
+	// client timed it
+	DNS *DNSResult `json:"dns,omitempty"`
+
+	// MTU is the path MTU to the server, if the client probed it
+	MTU *MTUResult `json:"mtu,omitempty"`
+
+	// Retries is the number of times that a test was retried because we
+	// couldn't connect to the server or lost the connection
+	Retries int `json:"retries,omitempty"`
+
+	// Traceroute is the path to the server, if the client traced it
+	Traceroute *TracerouteResult `json:"traceroute,omitempty"`
+}
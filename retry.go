@@ -0,0 +1,83 @@
+package sparkyfish
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/freinold/sparkyfish/internal/neterr"
+)
+
+const (
+	DefaultRetries  = 2                // number of times that a test is retried by default
+	RetryBackoff    = time.Second      // how long we wait before our first retry
+	MaxRetryBackoff = 30 * time.Second // longest that we wait between retries
+)
+
+// Retry is passed to Client.OnRetry when a test failed in a way that trying
+// again might fix, just before we wait to try again
+type Retry struct {
+	Err     error         // why the test failed
+	Attempt int           // which retry this is, from 1 to the client's Retries
+	Wait    time.Duration // how long we wait before retrying
+}
+
+// retry runs test, and runs it again if we couldn't connect to the server or
+// lost the connection, up to c.Retries times.  We wait RetryBackoff before the
+// first retry, twice as long before the next, and so on up to
+// MaxRetryBackoff, to give the network or the server time to recover.
+// Retried tests start over, so measurements from before the retry don't count
+// towards their results.
+func (c *Client) retry(ctx context.Context, test func() error) error {
+	wait := RetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := test()
+		if err == nil || attempt > c.Retries || ctx.Err() != nil || !retryable(err) {
+			if err != nil {
+				c.logger().Debug("test failed", "attempts", attempt, "err", err)
+			}
+			return err
+		}
+
+		c.retries++
+		c.logger().Debug("retrying", "attempt", attempt, "of", c.Retries, "wait", wait, "err", err)
+		if c.OnRetry != nil {
+			c.OnRetry(Retry{Err: err, Attempt: attempt, Wait: wait})
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+
+		wait *= 2
+		if wait > MaxRetryBackoff {
+			wait = MaxRetryBackoff
+		}
+	}
+}
+
+// retryable reports whether err is a network failure, such as a refused or
+// dropped connection, that may well go away if we try again.  Anything that
+// the server told us, such as that our token is wrong, won't.
+func retryable(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return !dnsErr.IsNotFound
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		neterr.IsConnReset(err)
+}
+
+// RetryCount returns the number of times that this Client has retried a test
+// since it was created.  The difference between two calls is the number of
+// retries in between.
+func (c *Client) RetryCount() int {
+	return c.retries
+}
@@ -0,0 +1,132 @@
+package sparkyfish
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	probePings   = 5               // number of pings sent to each candidate by FindNearest
+	probeTimeout = 5 * time.Second // time allowed for each candidate to answer its pings
+)
+
+// Candidate is a server that FindNearest can choose from
+type Candidate struct {
+	Addr     string `json:"addr"`
+	Location string `json:"location,omitempty"`
+}
+
+// PublicServers lists the public sparkyfish servers.  See
+// docs/PUBLIC-SERVERS.md for more about them.
+var PublicServers = []Candidate{
+	{Addr: "us-seattle.sparkyfish.chrissnell.com", Location: "Seattle, WA"},
+	{Addr: "us-ashburn.sparkyfish.chrissnell.com", Location: "Ashburn, VA"},
+	{Addr: "sparky.ga.hamwan.net", Location: "Atlanta, GA"},
+	{Addr: "eu-netherlands.sparkyfish.chrissnell.com", Location: "Amsterdam, NL"},
+	{Addr: "eu-germany.sparkyfish.com", Location: "Gunzenhausen, DE"},
+}
+
+// ReadServerList reads a list of candidates from r.  Each line holds a
+// host[:port], optionally followed by the server's location.  Blank lines and
+// lines beginning with # are ignored.
+func ReadServerList(r io.Reader) ([]Candidate, error) {
+	var candidates []Candidate
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, " ", 2)
+		c := Candidate{Addr: fields[0]}
+		if len(fields) == 2 {
+			c.Location = strings.TrimSpace(fields[1])
+		}
+		candidates = append(candidates, c)
+	}
+
+	return candidates, scanner.Err()
+}
+
+// ProbeResult is the outcome of pinging a Candidate
+type ProbeResult struct {
+	Candidate
+	RTT time.Duration // average round-trip time
+	Err error         // set if the candidate couldn't be pinged
+}
+
+// FindNearest pings each of candidates in parallel over network ("tcp",
+// "tcp4" or "tcp6") and returns the one with the lowest average round-trip
+// time.  onProbe, if set, is called from a single goroutine as each result
+// comes in.
+func FindNearest(ctx context.Context, network string, candidates []Candidate, onProbe func(ProbeResult)) (ProbeResult, error) {
+	if len(candidates) == 0 {
+		return ProbeResult{}, fmt.Errorf("no servers to choose from")
+	}
+
+	results := make(chan ProbeResult)
+	for _, cand := range candidates {
+		go func(cand Candidate) {
+			results <- probe(ctx, network, cand)
+		}(cand)
+	}
+
+	var probed []ProbeResult
+	for range candidates {
+		pr := <-results
+		probed = append(probed, pr)
+		if onProbe != nil {
+			onProbe(pr)
+		}
+	}
+
+	if ctx.Err() != nil {
+		return ProbeResult{}, ctx.Err()
+	}
+
+	SortProbeResults(probed)
+	if probed[0].Err != nil {
+		return ProbeResult{}, fmt.Errorf("none of the %v servers could be reached", len(candidates))
+	}
+
+	return probed[0], nil
+}
+
+// SortProbeResults sorts results by round-trip time, with the candidates that
+// couldn't be reached at the end
+func SortProbeResults(results []ProbeResult) {
+	sort.SliceStable(results, func(i, j int) bool {
+		if (results[i].Err == nil) != (results[j].Err == nil) {
+			return results[i].Err == nil
+		}
+		return results[i].RTT < results[j].RTT
+	})
+}
+
+// probe runs a short ping test against cand
+func probe(ctx context.Context, network string, cand Candidate) ProbeResult {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	// Ping tests don't need any random data, so we skip NewClient
+	c := &Client{
+		Network: network,
+		Pings:   probePings,
+		addr:    withDefaultPort(cand.Addr, DefaultPort),
+		version: ProtocolVersion,
+	}
+
+	pr, err := c.RunPingTest(ctx)
+	if err != nil {
+		return ProbeResult{Candidate: cand, Err: err}
+	}
+
+	return ProbeResult{Candidate: cand, RTT: time.Duration(pr.Avg * float64(time.Millisecond))}
+}
@@ -0,0 +1,84 @@
+package sparkyfish
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// SharePath is where share services take results to share, with POST, and
+// hand them back by ID, with GET
+const SharePath = "/api/v1/results"
+
+// SharedResults is a share service's answer to results that it has taken
+type SharedResults struct {
+	// ID identifies the results at the share service
+	ID string `json:"id"`
+
+	// URL is the address of the page that shows the results
+	URL string `json:"url"`
+}
+
+// ShareResults sends r to the share service at shareURL, e.g.
+// "https://share.example.com", presenting token as a bearer token if it's
+// set, and returns where they can be seen.  Anyone with the URL can see the
+// results, so they're sent WithoutPersonalData unless personal is set.
+func ShareResults(ctx context.Context, shareURL, token string, r Results, personal bool) (SharedResults, error) {
+	if !personal {
+		r = r.WithoutPersonalData()
+	}
+	body, err := json.Marshal(r)
+	if err != nil {
+		return SharedResults{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(shareURL, "/")+SharePath, bytes.NewReader(body))
+	if err != nil {
+		return SharedResults{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return SharedResults{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return SharedResults{}, fmt.Errorf("share service responded with %v", resp.Status)
+	}
+
+	var sr SharedResults
+	err = json.NewDecoder(resp.Body).Decode(&sr)
+	if err != nil {
+		return SharedResults{}, fmt.Errorf("invalid response from share service: %v", err)
+	}
+	return sr, nil
+}
+
+// WithoutPersonalData returns a copy of r without what it says about the
+// person who ran the tests: their Environment, their address and city as the
+// server saw them, and the Traceroute, whose first hops are their own
+// network.  Their country and ISP are kept, since they're what makes results
+// worth comparing.
+func (r Results) WithoutPersonalData() Results {
+	r.Environment = nil
+	r.Traceroute = nil
+	if r.Status != nil {
+		st := *r.Status
+		st.ClientAddress = ""
+		if st.ClientLocation != nil {
+			loc := *st.ClientLocation
+			loc.City = ""
+			st.ClientLocation = &loc
+		}
+		r.Status = &st
+	}
+	return r
+}
@@ -0,0 +1,53 @@
+package sparkyfish
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// control sets our socket options on each connection to the server before
+// it's dialled
+func (c *Client) control(network, address string, rc syscall.RawConn) error {
+	var serr error
+	err := rc.Control(func(fd uintptr) {
+		serr = c.setSockopts(int(fd), network)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+func (c *Client) setSockopts(fd int, network string) error {
+	if c.Interface != "" {
+		err := syscall.BindToDevice(fd, c.Interface)
+		if err != nil {
+			return fmt.Errorf("unable to bind to interface %v: %v", c.Interface, err)
+		}
+	}
+
+	if c.DSCP != 0 {
+		// The DSCP takes up the top 6 bits of the TOS or traffic class byte
+		var err error
+		if c.DSCP < 0 || c.DSCP > MaxDSCP {
+			err = fmt.Errorf("must be between 0 and %v", MaxDSCP)
+		} else if strings.HasSuffix(network, "6") {
+			err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, c.DSCP<<2)
+		} else {
+			err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS, c.DSCP<<2)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to set DSCP %v: %v", c.DSCP, err)
+		}
+	}
+
+	if c.Congestion != "" && strings.HasPrefix(network, "tcp") {
+		err := syscall.SetsockoptString(fd, syscall.IPPROTO_TCP, syscall.TCP_CONGESTION, c.Congestion)
+		if err != nil {
+			return fmt.Errorf("unable to use congestion control %q: %v", c.Congestion, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package sparkyfish
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// control sets our socket options on each connection to the server before
+// it's dialled.  The only ones that we know how to set are Linux's.
+func (c *Client) control(network, address string, rc syscall.RawConn) error {
+	if c.Interface != "" {
+		return fmt.Errorf("binding to an interface is only supported on Linux; try a source address instead")
+	}
+	if c.DSCP != 0 {
+		return fmt.Errorf("DSCP marking is only supported on Linux")
+	}
+	if c.Congestion != "" {
+		return fmt.Errorf("congestion control selection is only supported on Linux")
+	}
+	return nil
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/freinold/sparkyfish"
+	"github.com/freinold/sparkyfish/agentpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// defaultAgentAddr is where the agent listens by default
+const defaultAgentAddr = "localhost:7190"
+
+// maxAgentRuns is the number of runs whose events the agent keeps, for
+// StreamResults to replay
+const maxAgentRuns = 16
+
+// agentCommand implements "sparkyfish-cli agent", which runs tests when it's
+// asked to over gRPC (see agentpb), until it's killed
+func agentCommand(args []string) error {
+	fs := flag.NewFlagSet("agent", flag.ContinueOnError)
+	listen := fs.String("listen", defaultAgentAddr, "IP:Port to serve the gRPC API on")
+	authToken := fs.String("auth-token", "", "Token that callers have to present as a bearer token; needed unless -listen is on loopback (default: $SPARKYFISH_AGENT_TOKEN)")
+	tlsCert := fs.String("tls-cert", "", "Certificate (PEM) to serve the API over TLS with, with -tls-key [optional]")
+	tlsKey := fs.String("tls-key", "", "Private key (PEM) of -tls-cert [optional]")
+	token := fs.String("token", "", "Token to present to private servers, unless the caller gives one (default: $SPARKYFISH_TOKEN)")
+	serverList := fs.String("servers", "", "Servers for ListServers: host[:port],host[:port]... or a file listing one host[:port] [location] per line (default: the public servers)")
+	registryURL := fs.String("registry", "", "List the servers of the sparkyfish registry at this URL for ListServers, instead of -servers")
+	historyPath := fs.String("history", defaultHistoryPath(), "Database that the results of every run are added to, and GetHistory reads")
+	noHistory := fs.Bool("no-history", false, "Don't add the results to the history database")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:", os.Args[0], "agent [options] [<default sparkyfish server hostname/IP>[:port]]")
+		fmt.Fprintln(os.Stderr, "\nThe agent serves the gRPC API in agentpb/agent.proto, which starts tests and streams their measurements.")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	if *authToken == "" {
+		*authToken = os.Getenv("SPARKYFISH_AGENT_TOKEN")
+	}
+	if *token == "" {
+		*token = os.Getenv("SPARKYFISH_TOKEN")
+	}
+	if *serverList != "" && *registryURL != "" {
+		fatal(exitUsage, "-servers and -registry are mutually exclusive")
+	}
+
+	// The agent connects to whatever servers it's asked to, so it mustn't
+	// be open to all
+	if *authToken == "" && !loopbackAddr(*listen) {
+		fatal(exitUsage, "-auth-token is needed to serve the API beyond loopback")
+	}
+
+	var opts []grpc.ServerOption
+	if *tlsCert != "" || *tlsKey != "" {
+		if *tlsCert == "" || *tlsKey == "" {
+			fatal(exitUsage, "-tls-cert and -tls-key go together")
+		}
+		creds, err := credentials.NewServerTLSFromFile(*tlsCert, *tlsKey)
+		if err != nil {
+			return fmt.Errorf("error loading -tls-cert: %v", err)
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+
+	a := &agent{server: fs.Arg(0), token: *token, registry: *registryURL, runs: make(map[string]*agentRun)}
+	if !*noHistory {
+		a.history = newHistory(*historyPath)
+	}
+	a.servers = sparkyfish.PublicServers
+	if *serverList != "" {
+		var err error
+		a.servers, err = loadServers(*serverList)
+		if err != nil {
+			fatal(exitUsage, err)
+		}
+	}
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fatal(exitUsage, err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	a.ctx = ctx
+
+	auth := bearerAuth(*authToken)
+	opts = append(opts, grpc.UnaryInterceptor(auth.unary), grpc.StreamInterceptor(auth.stream))
+	gs := grpc.NewServer(opts...)
+	agentpb.RegisterAgentServer(gs, a)
+	go func() {
+		<-ctx.Done()
+		gs.Stop()
+	}()
+
+	log.Printf("Serving the agent API on %v", listener.Addr())
+	err = gs.Serve(listener)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// loopbackAddr reports whether addr, an IP:Port to listen on, only listens
+// on loopback
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// bearerAuth checks that gRPC callers present its token as a bearer token in
+// their "authorization" metadata.  An empty token lets anyone in.
+type bearerAuth string
+
+func (token bearerAuth) check(ctx context.Context) error {
+	if token == "" {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		if subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(v, "Bearer ")), []byte(token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "invalid token")
+}
+
+func (token bearerAuth) unary(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := token.check(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (token bearerAuth) stream(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := token.check(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// agent implements the agentpb.AgentServer API
+type agent struct {
+	agentpb.UnimplementedAgentServer
+
+	ctx      context.Context // our lifetime, which runs are cancelled with
+	server   string          // the server to test against if the caller doesn't say
+	token    string
+	servers  []sparkyfish.Candidate
+	registry string
+	history  *history
+
+	mu      sync.Mutex
+	running bool
+	runs    map[string]*agentRun
+	order   []string // the IDs of runs, oldest first
+}
+
+// agentRun is a run that the agent has started, and the events that it has
+// gone through so far
+type agentRun struct {
+	start time.Time
+
+	mu      sync.Mutex
+	events  []*agentpb.TestEvent
+	done    bool
+	changed chan struct{} // closed, and replaced, as each event is added
+}
+
+// add adds event to the run's events, or the last, if done is set
+func (run *agentRun) add(event *agentpb.TestEvent, done bool) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+
+	event.ElapsedSeconds = time.Since(run.start).Seconds()
+	run.events = append(run.events, event)
+	run.done = done
+	close(run.changed)
+	run.changed = make(chan struct{})
+}
+
+// since returns the run's events after the first n, whether it's done, and a
+// channel that's closed when there are more
+func (run *agentRun) since(n int) ([]*agentpb.TestEvent, bool, <-chan struct{}) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	return run.events[n:], run.done, run.changed
+}
+
+func (a *agent) StartTest(ctx context.Context, req *agentpb.StartTestRequest) (*agentpb.StartTestResponse, error) {
+	addr := req.Server
+	if addr == "" {
+		addr = a.server
+	}
+	if addr == "" {
+		return nil, status.Error(codes.InvalidArgument, "no server given, and the agent doesn't have one")
+	}
+	if req.DownloadOnly && req.UploadOnly {
+		return nil, status.Error(codes.InvalidArgument, "download_only and upload_only can't both be set")
+	}
+
+	client, err := sparkyfish.NewClient(addr)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	client.Token = req.Token
+	if client.Token == "" {
+		client.Token = a.token
+	}
+	client.UDP = req.Udp
+	client.SkipUpload = req.DownloadOnly
+	client.SkipDownload = req.UploadOnly
+	client.Bidirectional = req.Bidirectional
+	client.Tags = req.Tags
+	client.Note = req.Note
+
+	id := make([]byte, 8)
+	_, err = rand.Read(id)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	run := &agentRun{start: time.Now(), changed: make(chan struct{})}
+
+	// Runs side by side would skew each other's results
+	a.mu.Lock()
+	if a.running {
+		a.mu.Unlock()
+		return nil, status.Error(codes.Aborted, "a test is already running")
+	}
+	a.running = true
+	testID := hex.EncodeToString(id)
+	a.runs[testID] = run
+	a.order = append(a.order, testID)
+	if len(a.order) > maxAgentRuns {
+		delete(a.runs, a.order[0])
+		a.order = a.order[1:]
+	}
+	a.mu.Unlock()
+
+	log.Printf("Starting test %v against %v", testID, client.Addr())
+	go a.run(client, run)
+	return &agentpb.StartTestResponse{TestId: testID}, nil
+}
+
+// run runs the tests with client, noting what happens in run
+func (a *agent) run(client *sparkyfish.Client, run *agentRun) {
+	defer func() {
+		a.mu.Lock()
+		a.running = false
+		a.mu.Unlock()
+	}()
+
+	client.OnStage = func(ctx context.Context, stage sparkyfish.Stage) context.Context {
+		run.add(&agentpb.TestEvent{Event: &agentpb.TestEvent_Stage{Stage: &agentpb.StageEvent{Stage: stage.String()}}}, false)
+		return ctx
+	}
+	client.OnStageDone = func(stage sparkyfish.Stage, r sparkyfish.Results, err error) {
+		se := &agentpb.StageEvent{Stage: stage.String(), Done: true}
+		if err != nil {
+			se.Error = err.Error()
+		}
+		run.add(&agentpb.TestEvent{Event: &agentpb.TestEvent_Stage{Stage: se}}, false)
+	}
+	client.OnPing = func(ps sparkyfish.PingSample) {
+		run.add(&agentpb.TestEvent{Event: &agentpb.TestEvent_Ping{Ping: &agentpb.PingSample{
+			RttMs: float64(ps.RTT) / float64(time.Millisecond),
+			Stats: pingProto(ps.Stats),
+		}}}, false)
+	}
+	client.OnThroughput = func(s sparkyfish.Sample) {
+		run.add(&agentpb.TestEvent{Event: &agentpb.TestEvent_Sample{Sample: &agentpb.Sample{
+			Test:            s.TestType.String(),
+			Mbps:            s.Mbps,
+			IntervalSeconds: s.Elapsed.Seconds(),
+			WarmUp:          s.WarmUp,
+			Stalled:         s.Stalled,
+			Stats:           throughputProto(s.Stats),
+		}}}, false)
+	}
+
+	r, err := client.Run(a.ctx)
+	if err != nil {
+		log.Printf("Test against %v failed: %v", client.Addr(), err)
+		run.add(&agentpb.TestEvent{Event: &agentpb.TestEvent_Error{Error: err.Error()}}, true)
+		return
+	}
+
+	err = a.history.add(r)
+	if err != nil {
+		log.Println("error recording results in history:", err)
+	}
+	run.add(&agentpb.TestEvent{Event: &agentpb.TestEvent_Results{Results: resultsProto(r)}}, true)
+}
+
+func (a *agent) StreamResults(req *agentpb.StreamResultsRequest, stream agentpb.Agent_StreamResultsServer) error {
+	a.mu.Lock()
+	run := a.runs[req.TestId]
+	a.mu.Unlock()
+	if run == nil {
+		return status.Errorf(codes.NotFound, "no test %q", req.TestId)
+	}
+
+	var sent int
+	for {
+		events, done, changed := run.since(sent)
+		for _, event := range events {
+			err := stream.Send(event)
+			if err != nil {
+				return err
+			}
+		}
+		sent += len(events)
+		if done {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+func (a *agent) ListServers(ctx context.Context, req *agentpb.ListServersRequest) (*agentpb.ListServersResponse, error) {
+	candidates := a.servers
+	if a.registry != "" {
+		var err error
+		candidates, err = loadRegistry(ctx, a.registry)
+		if err != nil {
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
+	}
+
+	resp := &agentpb.ListServersResponse{}
+	for _, c := range candidates {
+		resp.Servers = append(resp.Servers, &agentpb.Server{Addr: c.Addr, Location: c.Location})
+	}
+	return resp, nil
+}
+
+func (a *agent) GetHistory(ctx context.Context, req *agentpb.GetHistoryRequest) (*agentpb.GetHistoryResponse, error) {
+	f := historyFilter{server: req.Server, tag: req.Tag, limit: int(req.Limit)}
+	if req.SinceUnixMs > 0 {
+		f.since = time.UnixMilli(req.SinceUnixMs)
+	}
+	records, err := a.history.list(f)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	resp := &agentpb.GetHistoryResponse{}
+	for _, r := range records {
+		resp.Runs = append(resp.Runs, resultsProto(r))
+	}
+	return resp, nil
+}
+
+func pingProto(p sparkyfish.PingResult) *agentpb.Ping {
+	return &agentpb.Ping{MinMs: p.Min, AvgMs: p.Avg, MaxMs: p.Max, StddevMs: p.StdDev, JitterMs: p.Jitter, Probes: int32(p.Probes)}
+}
+
+func throughputProto(tr sparkyfish.ThroughputResult) *agentpb.Throughput {
+	return &agentpb.Throughput{
+		AvgMbps:    tr.Avg,
+		MaxMbps:    tr.Max,
+		MinMbps:    tr.Min,
+		MedianMbps: tr.Median,
+		P5Mbps:     tr.P5,
+		P95Mbps:    tr.P95,
+		StddevMbps: tr.StdDev,
+		Bytes:      tr.Bytes,
+		Skipped:    tr.Skipped,
+	}
+}
+
+// resultsProto breaks out r's headline numbers, with the rest in its JSON
+func resultsProto(r sparkyfish.Results) *agentpb.Results {
+	rj, _ := json.Marshal(r)
+	return &agentpb.Results{
+		Server:          r.Server,
+		StartTimeUnixMs: r.StartTime.UnixMilli(),
+		EndTimeUnixMs:   r.EndTime.UnixMilli(),
+		Ping:            pingProto(r.Ping),
+		Download:        throughputProto(r.Download),
+		Upload:          throughputProto(r.Upload),
+		Tags:            r.Tags,
+		Note:            r.Note,
+		ResultsJson:     string(rj),
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/freinold/sparkyfish"
+	"github.com/freinold/sparkyfish/agentpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// startAgent serves a over an in-memory connection, checking callers for
+// token, and returns a client for it
+func startAgent(t *testing.T, a *agent, token string) agentpb.AgentClient {
+	t.Helper()
+
+	listener := bufconn.Listen(1 << 20)
+	auth := bearerAuth(token)
+	gs := grpc.NewServer(grpc.UnaryInterceptor(auth.unary), grpc.StreamInterceptor(auth.stream))
+	agentpb.RegisterAgentServer(gs, a)
+	go gs.Serve(listener)
+	t.Cleanup(gs.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///agent",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return agentpb.NewAgentClient(conn)
+}
+
+func TestAgentStreamResults(t *testing.T) {
+	run := &agentRun{start: time.Now(), changed: make(chan struct{})}
+	a := &agent{runs: map[string]*agentRun{"run": run}}
+	client := startAgent(t, a, "")
+
+	// Events from before the stream starts are replayed, and the rest
+	// follow as they happen
+	run.add(&agentpb.TestEvent{Event: &agentpb.TestEvent_Stage{Stage: &agentpb.StageEvent{Stage: "ping test"}}}, false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := client.StreamResults(ctx, &agentpb.StreamResultsRequest{TestId: "run"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		run.add(&agentpb.TestEvent{Event: &agentpb.TestEvent_Sample{Sample: &agentpb.Sample{Test: "download", Mbps: 100}}}, false)
+		run.add(&agentpb.TestEvent{Event: &agentpb.TestEvent_Results{Results: resultsProto(sparkyfish.Results{Server: "example.com:7121"})}}, true)
+	}()
+
+	var got []*agentpb.TestEvent
+	for {
+		event, err := stream.Recv()
+		if err != nil {
+			if len(got) != 3 {
+				t.Fatalf("stream ended with %v after %v events, want 3", err, len(got))
+			}
+			break
+		}
+		got = append(got, event)
+	}
+	if got[0].GetStage().GetStage() != "ping test" || got[1].GetSample().GetMbps() != 100 || got[2].GetResults().GetServer() != "example.com:7121" {
+		t.Errorf("got events %v", got)
+	}
+
+	stream, err = client.StreamResults(ctx, &agentpb.StreamResultsRequest{TestId: "nope"})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("streaming an unknown run returned %v, want NotFound", err)
+	}
+}
+
+func TestAgentAuth(t *testing.T) {
+	a := &agent{servers: []sparkyfish.Candidate{{Addr: "example.com", Location: "Here"}}}
+	client := startAgent(t, a, "secret")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, tt := range []struct {
+		name string
+		md   metadata.MD
+		want codes.Code
+	}{
+		{"no token", nil, codes.Unauthenticated},
+		{"wrong token", metadata.Pairs("authorization", "Bearer wrong"), codes.Unauthenticated},
+		{"token", metadata.Pairs("authorization", "Bearer secret"), codes.OK},
+	} {
+		resp, err := client.ListServers(metadata.NewOutgoingContext(ctx, tt.md), &agentpb.ListServersRequest{})
+		if status.Code(err) != tt.want {
+			t.Errorf("%v: ListServers returned %v, want %v", tt.name, err, tt.want)
+			continue
+		}
+		if err == nil && (len(resp.Servers) != 1 || resp.Servers[0].Addr != "example.com") {
+			t.Errorf("%v: ListServers returned %v", tt.name, resp.Servers)
+		}
+	}
+}
+
+func TestAgentStartTestBusy(t *testing.T) {
+	a := &agent{server: "example.com", runs: make(map[string]*agentRun), running: true}
+	client := startAgent(t, a, "")
+
+	_, err := client.StartTest(context.Background(), &agentpb.StartTestRequest{})
+	if status.Code(err) != codes.Aborted {
+		t.Errorf("StartTest during a run returned %v, want Aborted", err)
+	}
+	_, err = client.StartTest(context.Background(), &agentpb.StartTestRequest{DownloadOnly: true, UploadOnly: true})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("StartTest with download_only and upload_only returned %v, want InvalidArgument", err)
+	}
+}
+
+func TestLoopbackAddr(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"localhost:7190": true,
+		"127.0.0.1:7190": true,
+		"[::1]:7190":     true,
+		":7190":          false,
+		"0.0.0.0:7190":   false,
+		"192.0.2.1:7190": false,
+		"nonsense":       false,
+	} {
+		if got := loopbackAddr(addr); got != want {
+			t.Errorf("loopbackAddr(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/freinold/sparkyfish"
+)
+
+// discoveryTimeout is how long -discover waits for servers to answer
+const discoveryTimeout = 3 * time.Second
+
+// serverPicker chooses the nearest of a list of candidate servers for -auto
+type serverPicker struct {
+	candidates []sparkyfish.Candidate
+	network    string
+	newClient  func(addr string) (*sparkyfish.Client, error)
+
+	// registry, if set, is the URL of the registry that the candidates
+	// came from, which we fetch them from again before each pick, so that
+	// long-running monitors keep up with it
+	registry string
+}
+
+// loadServerList reads the candidate servers listed in the file at path
+func loadServerList(path string) ([]sparkyfish.Candidate, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	candidates, err := sparkyfish.ReadServerList(f)
+	if err != nil {
+		return nil, fmt.Errorf("error reading server list: %v", err)
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no servers listed in %v", path)
+	}
+
+	return candidates, nil
+}
+
+// loadServers resolves the servers given with -servers: either the name of a
+// file listing them, or a comma-separated list of host[:port]
+func loadServers(spec string) ([]sparkyfish.Candidate, error) {
+	if _, err := os.Stat(spec); err == nil && !strings.Contains(spec, ",") {
+		return loadServerList(spec)
+	}
+
+	var candidates []sparkyfish.Candidate
+	for _, addr := range strings.Split(spec, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr != "" {
+			candidates = append(candidates, sparkyfish.Candidate{Addr: addr})
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no servers listed in -servers")
+	}
+	return candidates, nil
+}
+
+// loadRegistry fetches the servers listed by the registry at url, leaving out
+// the ones that are already as busy as they'll get
+func loadRegistry(ctx context.Context, url string) ([]sparkyfish.Candidate, error) {
+	servers, err := sparkyfish.FetchRegistry(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching servers from registry: %v", err)
+	}
+
+	var candidates []sparkyfish.Candidate
+	for _, rs := range servers {
+		if !rs.Full() {
+			candidates = append(candidates, rs.Candidate)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("the registry at %v has no servers with room for a test", url)
+	}
+	return candidates, nil
+}
+
+// discoverServers looks for servers on the local network
+func discoverServers(ctx context.Context) ([]sparkyfish.Candidate, error) {
+	fmt.Fprintln(os.Stderr, "Looking for sparkyfish servers on the local network...")
+
+	// The mDNS library chats to the standard logger, which nobody needs to see
+	log.SetOutput(ioutil.Discard)
+	candidates, err := sparkyfish.Discover(ctx, discoveryTimeout)
+	log.SetOutput(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no sparkyfish servers found on the local network (are they running with -mdns?)")
+	}
+
+	return candidates, nil
+}
+
+// chooseServer asks the user which of candidates to test against.  If
+// there's only one, there's nothing to ask.
+func chooseServer(candidates []sparkyfish.Candidate) (sparkyfish.Candidate, error) {
+	var choices []string
+	for _, c := range candidates {
+		if c.Location != "" {
+			choices = append(choices, fmt.Sprintf("%v (%v)", c.Addr, c.Location))
+		} else {
+			choices = append(choices, c.Addr)
+		}
+	}
+
+	i, err := choose("Test which server?", choices)
+	if err != nil {
+		return sparkyfish.Candidate{}, fmt.Errorf("no server chosen")
+	}
+	return candidates[i], nil
+}
+
+// choose asks the user to pick one of choices, returning its index.  If
+// there's only one, there's nothing to ask.
+func choose(prompt string, choices []string) (int, error) {
+	if len(choices) == 1 {
+		return 0, nil
+	}
+
+	for i, c := range choices {
+		fmt.Fprintf(os.Stderr, "%3v) %v\n", i+1, c)
+	}
+
+	for {
+		var choice int
+
+		fmt.Fprintf(os.Stderr, "%v [1-%v] ", prompt, len(choices))
+		_, err := fmt.Scanln(&choice)
+		if err == io.EOF {
+			return 0, err
+		}
+		if err == nil && choice >= 1 && choice <= len(choices) {
+			return choice - 1, nil
+		}
+	}
+}
+
+// pick pings every candidate and returns a client for the nearest one.
+// onProbe, if set, is called with the results so far, best first, as each
+// candidate answers.
+func (sp *serverPicker) pick(ctx context.Context, onProbe func([]sparkyfish.ProbeResult)) (*sparkyfish.Client, error) {
+	var probed []sparkyfish.ProbeResult
+
+	// If the registry's out of reach, what it told us last time will do
+	if sp.registry != "" {
+		candidates, err := loadRegistry(ctx, sp.registry)
+		if err == nil {
+			sp.candidates = candidates
+		}
+	}
+
+	nearest, err := sparkyfish.FindNearest(ctx, sp.network, sp.candidates, func(pr sparkyfish.ProbeResult) {
+		probed = append(probed, pr)
+		sparkyfish.SortProbeResults(probed)
+		if onProbe != nil {
+			onProbe(probed)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return sp.newClient(nearest.Addr)
+}
+
+// selectServer picks the nearest server for our tests, showing the
+// candidates in the server status widget as they answer
+func (sc *sparkyClient) selectServer(ctx context.Context) error {
+	sc.wr.SetTitle("statusbox", msg(" Finding Nearest Server "))
+	sc.wr.SetText("statusbox", fmt.Sprintf("Pinging %v servers...", len(sc.picker.candidates)))
+	sc.wr.Hide("statsSummary")
+	sc.wr.Show("statusbox")
+	sc.wr.Render()
+
+	client, err := sc.picker.pick(ctx, func(probed []sparkyfish.ProbeResult) {
+		sc.wr.SetText("statusbox", probeText(probed, 5))
+		sc.wr.Render()
+	})
+	if err != nil {
+		return fmt.Errorf("unable to pick a server: %v", err)
+	}
+
+	sc.setClient(client)
+
+	if sc.headless {
+		fmt.Fprintln(os.Stderr, "Selected", client.Addr())
+	}
+
+	// Now that we know which server we're testing, we can compare it
+	// against its own history
+	if sc.historyPanel != nil {
+		sc.historyPanel.load(sc.history, sc.serverHostname, sc.historyRuns)
+		sc.updateHistoryPanel(sparkyfish.ThroughputResult{}, sparkyfish.ThroughputResult{})
+	}
+
+	return nil
+}
+
+// probeText renders the first max probe results, one per line
+func probeText(probed []sparkyfish.ProbeResult, max int) string {
+	var lines []string
+
+	for i, pr := range probed {
+		if i == max {
+			break
+		}
+
+		name := pr.Addr
+		if pr.Location != "" {
+			name = name + " (" + pr.Location + ")"
+		}
+		if len(name) > 44 {
+			name = name[:43]
+		}
+
+		if pr.Err != nil {
+			lines = append(lines, fmt.Sprintf("%-44v  failed", name))
+		} else {
+			lines = append(lines, fmt.Sprintf("%-44v  %.1f ms", name, float64(pr.RTT.Nanoseconds())/1000000))
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
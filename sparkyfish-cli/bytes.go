@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// byteUnits are the suffixes that we understand in amounts of data, largest
+// first
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"GB", 1024 * 1024 * 1024},
+	{"MB", 1024 * 1024},
+	{"KB", 1024},
+	{"B", 1},
+}
+
+// formatBytes renders n as a human-readable amount of data, e.g. "1.4 GB"
+func formatBytes(n int64) string {
+	for _, u := range byteUnits {
+		if n >= u.size && u.size > 1 {
+			return formatNumber(float64(n)/float64(u.size), 1) + " " + u.suffix
+		}
+	}
+	return fmt.Sprintf("%v B", n)
+}
+
+// byteSize is a flag.Value for amounts of data, like "500MB" or "1.5G".  A
+// bare number is a count of bytes.
+type byteSize int64
+
+func (b *byteSize) String() string {
+	if *b == 0 {
+		return "0"
+	}
+	return formatBytes(int64(*b))
+}
+
+func (b *byteSize) Set(s string) error {
+	s = strings.ToUpper(strings.TrimSpace(s))
+
+	size := int64(1)
+	for _, u := range byteUnits {
+		trimmed := strings.TrimSuffix(s, u.suffix)
+		if trimmed == s && u.size > 1 {
+			// Let the B be left off, e.g. "500M"
+			trimmed = strings.TrimSuffix(s, u.suffix[:1])
+		}
+		if trimmed != s {
+			s, size = strings.TrimSpace(trimmed), u.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid amount of data")
+	}
+
+	*b = byteSize(n * float64(size))
+	return nil
+}
+
+// rateUnits are the suffixes that we understand in rates, in Mbit/s
+var rateUnits = []struct {
+	suffix string
+	mbps   float64
+}{
+	{"GBPS", 1000},
+	{"MBPS", 1},
+	{"KBPS", 0.001},
+	{"G", 1000},
+	{"M", 1},
+	{"K", 0.001},
+}
+
+// bitRate is a flag.Value for rates, like "50mbps" or "1.5G".  A bare number
+// is in Mbit/s.
+type bitRate float64
+
+func (r *bitRate) String() string {
+	return strconv.FormatFloat(float64(*r), 'f', -1, 64)
+}
+
+func (r *bitRate) Set(s string) error {
+	s = strings.ToUpper(strings.TrimSpace(s))
+
+	mbps := 1.0
+	for _, u := range rateUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s, mbps = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.mbps
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid rate")
+	}
+
+	*r = bitRate(n * mbps)
+	return nil
+}
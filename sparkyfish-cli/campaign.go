@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/freinold/sparkyfish"
+)
+
+// campaignResult is the outcome of testing one of the servers in a campaign
+type campaignResult struct {
+	Server  string              `json:"server"`
+	Error   string              `json:"error,omitempty"`
+	Results *sparkyfish.Results `json:"results,omitempty"`
+}
+
+// runCampaign runs the full test suite against each of clients in turn and
+// prints a table comparing the results, or a JSON array of them with
+// jsonOutput.  The results are also added to hist and sent to sinks.  It
+// returns our exit status.
+func runCampaign(ctx context.Context, clients []*sparkyfish.Client, hist *history, sinks sinkList, jsonOutput bool) int {
+	var results []campaignResult
+	status := exitOK
+
+	for i, client := range clients {
+		log.Printf("Testing %v (%v of %v)", client.Addr(), i+1, len(clients))
+
+		sinks.attach(client)
+		r, err := client.Run(ctx)
+		if ctx.Err() != nil {
+			fatal(exitAborted, "tests cancelled")
+		}
+		if err != nil {
+			log.Printf("test run against %v failed: %v", client.Addr(), err)
+			results = append(results, campaignResult{Server: client.Addr(), Error: err.Error()})
+			status = exitAborted
+			continue
+		}
+
+		err = hist.add(r)
+		if err != nil {
+			log.Println("error recording results in history:", err)
+		}
+		sinks.results(r, true)
+
+		results = append(results, campaignResult{Server: r.Server, Results: &r})
+	}
+
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(results)
+	} else {
+		printComparison(os.Stdout, results)
+	}
+	return status
+}
+
+// printComparison writes a table comparing the results of a campaign to w
+func printComparison(w io.Writer, results []campaignResult) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERVER\tFAMILY\tPING (ms)\tJITTER (ms)\tDOWNLOAD (Mbit/s)\tUPLOAD (Mbit/s)")
+
+	for _, cr := range results {
+		if cr.Results == nil {
+			fmt.Fprintf(tw, "%v\tfailed: %v\n", cr.Server, cr.Error)
+			continue
+		}
+
+		r := cr.Results
+		fmt.Fprintf(tw, "%v\t%v\t%.2f\t%.2f\t%v\t%v\n", cr.Server, r.Family, r.Ping.Avg, r.Ping.Jitter,
+			comparisonThroughput(r.Download), comparisonThroughput(r.Upload))
+	}
+
+	tw.Flush()
+}
+
+// comparisonThroughput renders a throughput result for printComparison
+func comparisonThroughput(tr sparkyfish.ThroughputResult) string {
+	if tr.Skipped {
+		return "skipped"
+	}
+	return fmt.Sprintf("%.1f (max %.1f)", tr.Avg, tr.Max)
+}
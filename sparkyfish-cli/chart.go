@@ -0,0 +1,173 @@
+package main
+
+import (
+	"image"
+	"runtime"
+	"strconv"
+
+	"github.com/freinold/sparkyfish"
+	"github.com/gizak/termui/v3"
+)
+
+// chartLabelWidth is the room to the left of a lineChart's Y axis for its
+// labels
+const chartLabelWidth = 6
+
+// chartSeries is one line on a lineChart
+type chartSeries struct {
+	Data  []float64
+	Style termui.Style
+}
+
+// lineChart charts one or more series of measurements on the same axes, from
+// zero up to the highest of them.  Each column of the chart holds two
+// measurements, drawn as braille dots, or, where braille won't do, one drawn
+// as Dot.  Where series cross, the last one drawn takes the cell's color.
+// Marks are drawn along the time axis, and DataLabels, if there are any,
+// beneath it.  When there are more measurements than fit, the latest are
+// shown.
+type lineChart struct {
+	termui.Block
+	Series     []chartSeries
+	DataLabels []string
+	Marks      []chartMark
+	AxesStyle  termui.Style
+	Dot        rune
+}
+
+// newLineChart returns a lineChart with a series in each of styles
+func newLineChart(styles ...termui.Style) *lineChart {
+	lc := &lineChart{Block: *termui.NewBlock(), AxesStyle: colors.axes}
+	for _, s := range styles {
+		lc.Series = append(lc.Series, chartSeries{Style: s})
+	}
+	// Windows Command Prompt doesn't support braille with the default font
+	if runtime.GOOS == "windows" {
+		lc.Dot = '+'
+	}
+	return lc
+}
+
+// brailleDots are the bits of each dot in a braille character, by column and
+// then by row from the top
+var brailleDots = [2][4]rune{{0x01, 0x02, 0x04, 0x40}, {0x08, 0x10, 0x20, 0x80}}
+
+// perColumn returns the number of measurements in each column of the chart
+func (lc *lineChart) perColumn() int {
+	if lc.Dot != 0 {
+		return 1
+	}
+	return 2
+}
+
+// plotArea returns where the chart's measurements are plotted: right of the
+// Y axis and its labels, and above the time axis and its labels
+func (lc *lineChart) plotArea() image.Rectangle {
+	return image.Rect(lc.Inner.Min.X+chartLabelWidth+1, lc.Inner.Min.Y, lc.Inner.Max.X, lc.Inner.Max.Y-2)
+}
+
+// points returns the number of measurements that fit across the chart
+func (lc *lineChart) points() int {
+	plot := lc.plotArea()
+	if plot.Dx() < 1 {
+		return 0
+	}
+	return plot.Dx() * lc.perColumn()
+}
+
+func (lc *lineChart) Draw(buf *termui.Buffer) {
+	lc.Block.Draw(buf)
+
+	plot := lc.plotArea()
+	if plot.Dx() < 1 || plot.Dy() < 1 {
+		return
+	}
+
+	// The Y axis runs from zero up to the highest measurement, and the
+	// time axis along the bottom
+	max := 0.0
+	for _, s := range lc.Series {
+		for _, v := range s.Data {
+			if v > max {
+				max = v
+			}
+		}
+	}
+	if max > 0 {
+		buf.SetString(axisLabel(max), lc.AxesStyle, image.Pt(lc.Inner.Min.X, plot.Min.Y))
+	}
+	buf.SetString("0", lc.AxesStyle, image.Pt(lc.Inner.Min.X, plot.Max.Y))
+	for y := plot.Min.Y; y < plot.Max.Y; y++ {
+		buf.SetCell(termui.NewCell(termui.VERTICAL_DASH, lc.AxesStyle), image.Pt(plot.Min.X-1, y))
+	}
+	buf.SetCell(termui.NewCell(termui.BOTTOM_LEFT, lc.AxesStyle), image.Pt(plot.Min.X-1, plot.Max.Y))
+	for x := plot.Min.X; x < plot.Max.X; x++ {
+		buf.SetCell(termui.NewCell(termui.HORIZONTAL_DASH, lc.AxesStyle), image.Pt(x, plot.Max.Y))
+	}
+
+	perColumn := lc.perColumn()
+	if max > 0 {
+		levels := plot.Dy()
+		if lc.Dot == 0 {
+			levels *= 4
+		}
+		for _, s := range lc.Series {
+			data := s.Data
+			if len(data) > plot.Dx()*perColumn {
+				data = data[len(data)-plot.Dx()*perColumn:]
+			}
+
+			for i, v := range data {
+				level := int(v/max*float64(levels-1) + 0.5)
+				if lc.Dot != 0 {
+					buf.SetCell(termui.NewCell(lc.Dot, s.Style), image.Pt(plot.Min.X+i, plot.Max.Y-1-level))
+					continue
+				}
+
+				p := image.Pt(plot.Min.X+i/2, plot.Max.Y-1-level/4)
+				ch := buf.GetCell(p).Rune
+				if ch < 0x2800 || ch > 0x28ff {
+					ch = 0x2800
+				}
+				ch |= brailleDots[i%2][3-level%4]
+				buf.SetCell(termui.NewCell(ch, s.Style), p)
+			}
+		}
+	}
+
+	for _, m := range lc.Marks {
+		x := plot.Min.X + m.point/perColumn
+		if x >= plot.Max.X {
+			continue
+		}
+		style := colors.alert
+		if m.kind == sparkyfish.EventStreamJoined {
+			style = colors.label
+		}
+		buf.SetCell(termui.NewCell(eventMarkers[m.kind], style), image.Pt(x, plot.Max.Y))
+	}
+
+	// Labels along the time axis are spaced out so that they don't run
+	// into each other
+	next := plot.Min.X
+	for i, label := range lc.DataLabels {
+		x := plot.Min.X + i/perColumn
+		if x < next || x+len(label) > plot.Max.X {
+			continue
+		}
+		buf.SetString(label, lc.AxesStyle, image.Pt(x, plot.Max.Y+1))
+		next = x + len(label) + 2
+	}
+}
+
+// axisLabel renders v, the top of a chart's Y axis, to fit beside it
+func axisLabel(v float64) string {
+	label := strconv.FormatFloat(v, 'f', 0, 64)
+	if v < 10 {
+		label = strconv.FormatFloat(v, 'f', 1, 64)
+	}
+	if len(label) > chartLabelWidth {
+		label = label[:chartLabelWidth]
+	}
+	return label
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/freinold/sparkyfish"
+)
+
+// chartTitleHeight is the room above each chart in a chart file for its title
+const chartTitleHeight = 24
+
+// chartFileSink draws the throughput and latency of each test run as charts
+// in an image file, SVG or PNG going by path's extension, replacing the last
+// run's.  It doesn't need the terminal UI, so it works in every mode.
+type chartFileSink struct {
+	path     string
+	interval time.Duration // how often throughput is measured
+
+	mu            sync.Mutex
+	dl, ul, pings []timedValue
+}
+
+// timedValue is a measurement waiting to be charted
+type timedValue struct {
+	time  time.Time
+	value float64
+}
+
+// chartPanel is one of the charts in a chart file
+type chartPanel struct {
+	title          string
+	data           []float64
+	step           float64 // how far apart the points are on the x axis
+	xLabel, yLabel string
+	color          string
+	skipped        bool
+}
+
+func newChartFileSink(path string, interval time.Duration) (*chartFileSink, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != ".svg" && ext != ".png" {
+		return nil, fmt.Errorf("unable to draw charts in %q; -chart must end in .svg or .png", path)
+	}
+	return &chartFileSink{path: path, interval: interval}, nil
+}
+
+func (cs *chartFileSink) sample(server string, s sparkyfish.Sample) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if len(cs.dl)+len(cs.ul) >= maxPendingSamples {
+		return
+	}
+	tv := timedValue{time.Now(), s.Mbps}
+	if sampleDirection(s) == "upload" {
+		cs.ul = append(cs.ul, tv)
+	} else {
+		cs.dl = append(cs.dl, tv)
+	}
+}
+
+func (cs *chartFileSink) ping(server string, ps sparkyfish.PingSample) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if len(cs.pings) >= maxPendingSamples {
+		return
+	}
+	cs.pings = append(cs.pings, timedValue{time.Now(), float64(ps.RTT.Microseconds()) / 1000})
+}
+
+func (cs *chartFileSink) results(r sparkyfish.Results) error {
+	cs.mu.Lock()
+	dl, ul, pings := cs.dl, cs.ul, cs.pings
+	cs.dl, cs.ul, cs.pings = nil, nil, nil
+	cs.mu.Unlock()
+
+	// Leave out anything left over from an earlier run that failed
+	since := func(tvs []timedValue) []float64 {
+		var data []float64
+		for _, tv := range tvs {
+			if !tv.time.Before(r.StartTime) {
+				data = append(data, tv.value)
+			}
+		}
+		return data
+	}
+
+	interval := cs.interval
+	if interval == 0 {
+		interval = sparkyfish.DefaultReportInterval
+	}
+	panels := []chartPanel{
+		{title: "Download (Mbit/s)", data: since(dl), step: interval.Seconds(), xLabel: "seconds", yLabel: "Mbit/s",
+			color: reportDownloadColor, skipped: r.Download.Skipped},
+		{title: "Upload (Mbit/s)", data: since(ul), step: interval.Seconds(), xLabel: "seconds", yLabel: "Mbit/s",
+			color: reportUploadColor, skipped: r.Upload.Skipped},
+		{title: "Latency (ms)", data: since(pings), step: 1, xLabel: "ping", yLabel: "ms",
+			color: reportLatencyColor},
+	}
+	heading := fmt.Sprintf("sparkyfish: %v, %v", r.Server, r.EndTime.Format("2006-01-02 15:04:05"))
+
+	f, err := os.Create(cs.path)
+	if err != nil {
+		return fmt.Errorf("error writing charts to %v: %v", cs.path, err)
+	}
+	defer f.Close()
+
+	if strings.ToLower(filepath.Ext(cs.path)) == ".png" {
+		err = png.Encode(f, drawPNGCharts(heading, panels))
+	} else {
+		_, err = f.WriteString(drawSVGCharts(heading, panels))
+	}
+	if err != nil {
+		return fmt.Errorf("error writing charts to %v: %v", cs.path, err)
+	}
+	return f.Close()
+}
+
+// drawSVGCharts draws panels one above the other in an SVG document, under
+// heading
+func drawSVGCharts(heading string, panels []chartPanel) string {
+	height := chartTitleHeight + len(panels)*(chartTitleHeight+reportChartHeight)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%v" height="%v" viewBox="0 0 %[1]v %[2]v" font-family="sans-serif">`,
+		reportChartWidth, height)
+	fmt.Fprintf(&b, `<rect width="100%%" height="100%%" fill="#fff"/>`)
+	fmt.Fprintf(&b, `<text x="8" y="18" font-size="14" font-weight="bold">%v</text>`, escapeSVG(heading))
+
+	y := chartTitleHeight
+	for _, p := range panels {
+		fmt.Fprintf(&b, `<text x="%v" y="%v" font-size="13">%v</text>`, reportMarginLeft, y+18, escapeSVG(panelTitle(p)))
+		y += chartTitleHeight
+		if p.skipped {
+			y += reportChartHeight
+			continue
+		}
+		fmt.Fprintf(&b, `<g transform="translate(0,%v)">%v</g>`, y, svgChart(p.data, p.step, p.xLabel, p.yLabel, p.color))
+		y += reportChartHeight
+	}
+
+	b.WriteString(`</svg>`)
+	return b.String()
+}
+
+// escapeSVG escapes s for the text of an SVG element
+func escapeSVG(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// panelTitle returns the title that p is drawn under
+func panelTitle(p chartPanel) string {
+	if p.skipped {
+		return p.title + ": skipped"
+	}
+	return p.title
+}
+
+// drawPNGCharts draws panels one above the other in an image, under heading.
+// It draws the same charts as drawSVGCharts, with a small bitmap font, so
+// that no fonts need to be installed.
+func drawPNGCharts(heading string, panels []chartPanel) *image.RGBA {
+	height := chartTitleHeight + len(panels)*(chartTitleHeight+reportChartHeight)
+	img := image.NewRGBA(image.Rect(0, 0, reportChartWidth, height))
+	fillRect(img, img.Bounds(), color.RGBA{0xff, 0xff, 0xff, 0xff})
+
+	black := color.RGBA{0x22, 0x22, 0x22, 0xff}
+	drawText(img, 8, 6, heading, black, 2)
+
+	y := chartTitleHeight
+	for _, p := range panels {
+		drawText(img, reportMarginLeft, y+8, panelTitle(p), black, 2)
+		y += chartTitleHeight
+		if !p.skipped {
+			drawPNGChart(img, y, p)
+		}
+		y += reportChartHeight
+	}
+	return img
+}
+
+// drawPNGChart draws p into img, with its top at y0, laid out like svgChart.
+// The y axis goes uncaptioned, as p's title gives its unit.
+func drawPNGChart(img *image.RGBA, y0 int, p chartPanel) {
+	const (
+		plotWidth  = reportChartWidth - reportMarginLeft - reportMarginRight
+		plotHeight = reportChartHeight - reportMarginTop - reportMarginBot
+	)
+	grey := color.RGBA{0xdd, 0xdd, 0xdd, 0xff}
+	text := color.RGBA{0x44, 0x44, 0x44, 0xff}
+
+	if len(p.data) == 0 {
+		msg := "No measurements"
+		drawText(img, (reportChartWidth-bitmapTextWidth(msg, 1))/2, y0+reportChartHeight/2, msg, text, 1)
+		return
+	}
+
+	top := niceCeil(maxOf(p.data))
+	x := func(i int) int {
+		if len(p.data) == 1 {
+			return reportMarginLeft
+		}
+		return reportMarginLeft + i*plotWidth/(len(p.data)-1)
+	}
+	y := func(v float64) int {
+		return y0 + reportMarginTop + plotHeight - int(v/top*plotHeight)
+	}
+
+	// Gridlines, with the y axis's labels
+	for i := 0; i <= 4; i++ {
+		v := top * float64(i) / 4
+		drawLine(img, reportMarginLeft, y(v), reportMarginLeft+plotWidth, y(v), grey)
+		label := trimFloat(v)
+		drawText(img, reportMarginLeft-6-bitmapTextWidth(label, 1), y(v)-3, label, text, 1)
+	}
+
+	// The x axis's labels, at most about one every 80 pixels, and its caption
+	every := (len(p.data)*80 + plotWidth - 1) / plotWidth
+	for i := 0; i < len(p.data); i += every {
+		label := trimFloat(float64(i+1) * p.step)
+		drawText(img, x(i)-bitmapTextWidth(label, 1)/2, y0+reportMarginTop+plotHeight+8, label, text, 1)
+	}
+	drawText(img, reportMarginLeft+(plotWidth-bitmapTextWidth(p.xLabel, 1))/2, y0+reportChartHeight-10, p.xLabel, text, 1)
+
+	// The data itself, two pixels thick
+	c := parseHexColor(p.color)
+	for i := 1; i < len(p.data); i++ {
+		drawLine(img, x(i-1), y(p.data[i-1]), x(i), y(p.data[i]), c)
+		drawLine(img, x(i-1), y(p.data[i-1])+1, x(i), y(p.data[i])+1, c)
+	}
+	if len(p.data) == 1 {
+		fillRect(img, image.Rect(x(0)-2, y(p.data[0])-2, x(0)+3, y(p.data[0])+3), c)
+	}
+}
+
+// parseHexColor parses a color like "#1f77b4"
+func parseHexColor(s string) color.RGBA {
+	v, _ := strconv.ParseUint(strings.TrimPrefix(s, "#"), 16, 32)
+	return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 0xff}
+}
+
+func fillRect(img *image.RGBA, r image.Rectangle, c color.RGBA) {
+	r = r.Intersect(img.Bounds())
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			img.SetRGBA(x, y, c)
+		}
+	}
+}
+
+// drawLine draws a line from (x0, y0) to (x1, y1), with Bresenham's algorithm
+func drawLine(img *image.RGBA, x0, y0, x1, y1 int, c color.RGBA) {
+	dx, dy := abs(x1-x0), -abs(y1-y0)
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+
+	err := dx + dy
+	for {
+		if (image.Point{x0, y0}).In(img.Bounds()) {
+			img.SetRGBA(x0, y0, c)
+		}
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		e2 := 2 * err
+		if e2 >= dy {
+			err += dy
+			x0 += sx
+		}
+		if e2 <= dx {
+			err += dx
+			y0 += sy
+		}
+	}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// bitmapTextWidth returns the width in pixels of s, drawn by drawText at scale
+func bitmapTextWidth(s string, scale int) int {
+	return (len([]rune(s))*6 - 1) * scale
+}
+
+// drawText draws s with its top left corner at (x, y) in our bitmap font,
+// scale pixels to each of the font's dots.  It only has capital letters, so
+// s is drawn in capitals.
+func drawText(img *image.RGBA, x, y int, s string, c color.RGBA, scale int) {
+	for _, r := range strings.ToUpper(s) {
+		glyph, ok := font5x7[r]
+		if !ok {
+			glyph = font5x7['?']
+		}
+		for row, bits := range strings.Fields(glyph) {
+			for col, bit := range bits {
+				if bit == '#' {
+					fillRect(img, image.Rect(x+col*scale, y+row*scale, x+(col+1)*scale, y+(row+1)*scale), c)
+				}
+			}
+		}
+		x += 6 * scale
+	}
+}
+
+// font5x7 is a bitmap font of five by seven dots, enough for our charts'
+// labels, server names and times.  Each glyph is its rows of dots, top to
+// bottom, with # for ink.
+var font5x7 = map[rune]string{
+	' ': "..... ..... ..... ..... ..... ..... .....",
+	'0': ".###. #...# #..## #.#.# ##..# #...# .###.",
+	'1': "..#.. .##.. ..#.. ..#.. ..#.. ..#.. .###.",
+	'2': ".###. #...# ....# ...#. ..#.. .#... #####",
+	'3': "##### ...#. ..#.. ...#. ....# #...# .###.",
+	'4': "...#. ..##. .#.#. #..#. ##### ...#. ...#.",
+	'5': "##### #.... ####. ....# ....# #...# .###.",
+	'6': "..##. .#... #.... ####. #...# #...# .###.",
+	'7': "##### ....# ...#. ..#.. .#... .#... .#...",
+	'8': ".###. #...# #...# .###. #...# #...# .###.",
+	'9': ".###. #...# #...# .#### ....# ...#. .##..",
+	'A': ".###. #...# #...# ##### #...# #...# #...#",
+	'B': "####. #...# #...# ####. #...# #...# ####.",
+	'C': ".###. #...# #.... #.... #.... #...# .###.",
+	'D': "###.. #..#. #...# #...# #...# #..#. ###..",
+	'E': "##### #.... #.... ####. #.... #.... #####",
+	'F': "##### #.... #.... ####. #.... #.... #....",
+	'G': ".###. #...# #.... #.### #...# #...# .####",
+	'H': "#...# #...# #...# ##### #...# #...# #...#",
+	'I': ".###. ..#.. ..#.. ..#.. ..#.. ..#.. .###.",
+	'J': "..### ...#. ...#. ...#. ...#. #..#. .##..",
+	'K': "#...# #..#. #.#.. ##... #.#.. #..#. #...#",
+	'L': "#.... #.... #.... #.... #.... #.... #####",
+	'M': "#...# ##.## #.#.# #.#.# #...# #...# #...#",
+	'N': "#...# #...# ##..# #.#.# #..## #...# #...#",
+	'O': ".###. #...# #...# #...# #...# #...# .###.",
+	'P': "####. #...# #...# ####. #.... #.... #....",
+	'Q': ".###. #...# #...# #...# #.#.# #..#. .##.#",
+	'R': "####. #...# #...# ####. #.#.. #..#. #...#",
+	'S': ".#### #.... #.... .###. ....# ....# ####.",
+	'T': "##### ..#.. ..#.. ..#.. ..#.. ..#.. ..#..",
+	'U': "#...# #...# #...# #...# #...# #...# .###.",
+	'V': "#...# #...# #...# #...# #...# .#.#. ..#..",
+	'W': "#...# #...# #...# #.#.# #.#.# #.#.# .#.#.",
+	'X': "#...# #...# .#.#. ..#.. .#.#. #...# #...#",
+	'Y': "#...# #...# .#.#. ..#.. ..#.. ..#.. ..#..",
+	'Z': "##### ....# ...#. ..#.. .#... #.... #####",
+	'.': "..... ..... ..... ..... ..... .##.. .##..",
+	',': "..... ..... ..... ..... .##.. ..#.. .#...",
+	':': "..... .##.. .##.. ..... .##.. .##.. .....",
+	'-': "..... ..... ..... ##### ..... ..... .....",
+	'_': "..... ..... ..... ..... ..... ..... #####",
+	'/': "..... ....# ...#. ..#.. .#... #.... .....",
+	'(': "...#. ..#.. .#... .#... .#... ..#.. ...#.",
+	')': ".#... ..#.. ...#. ...#. ...#. ..#.. .#...",
+	'[': ".###. .#... .#... .#... .#... .#... .###.",
+	']': ".###. ...#. ...#. ...#. ...#. ...#. .###.",
+	'%': "##..# ##.#. ...#. ..#.. .#... .#.## #..##",
+	'?': ".###. #...# ....# ...#. ..#.. ..... ..#..",
+}
@@ -0,0 +1,106 @@
+package main
+
+// chartWindow picks which of a throughput test's measurements a chart shows.
+// We keep every measurement, and the window shows the latest of them that fit
+// on the chart, averaging zoom of them into each point.  Zooming out fits more
+// of the test on the chart at a lower resolution.  By default, we zoom out
+// just far enough to fit the whole test, so that the chart only scrolls if
+// the test runs long.
+type chartWindow struct {
+	points   int // points that fit on the chart
+	expected int // measurements that we expect in a whole test
+	zoom     int // measurements averaged into each point
+	paused   bool
+}
+
+func newChartWindow(points, expected int) *chartWindow {
+	if points < 1 {
+		points = 1
+	}
+	cw := &chartWindow{points: points, expected: expected}
+	cw.zoom = cw.fit(expected)
+	return cw
+}
+
+// resize fits the window to a chart that holds points points, zooming back
+// out far enough to fit a whole test
+func (cw *chartWindow) resize(points int) {
+	if points < 1 {
+		points = 1
+	}
+	cw.points = points
+	cw.zoom = cw.fit(cw.expected)
+}
+
+// fit returns the smallest zoom that fits n measurements on the chart.
+// Zooms are powers of two, so that zooming in and out steps evenly.
+func (cw *chartWindow) fit(n int) int {
+	zoom := 1
+	for cw.points*zoom < n {
+		zoom *= 2
+	}
+	return zoom
+}
+
+// zoomIn shows half as many measurements at twice the resolution, down to
+// one measurement per point
+func (cw *chartWindow) zoomIn() {
+	if cw.zoom > 1 {
+		cw.zoom /= 2
+	}
+}
+
+// zoomOut shows twice as many of the n measurements that we have, until
+// they, or a whole test's worth, all fit
+func (cw *chartWindow) zoomOut(n int) {
+	if n < cw.expected {
+		n = cw.expected
+	}
+	if cw.zoom < cw.fit(n) {
+		cw.zoom *= 2
+	}
+}
+
+// view returns the points to chart for data
+func (cw *chartWindow) view(data []float64) []float64 {
+	if n := cw.points * cw.zoom; len(data) > n {
+		data = data[len(data)-n:]
+	}
+	if len(data) == 0 {
+		return []float64{0}
+	}
+
+	// Points are averaged from the end, so that the latest measurement
+	// always lands in the last one
+	points := make([]float64, 0, len(data)/cw.zoom+1)
+	for end := len(data); end > 0; end -= cw.zoom {
+		start := end - cw.zoom
+		if start < 0 {
+			start = 0
+		}
+		var sum float64
+		for _, v := range data[start:end] {
+			sum += v
+		}
+		points = append(points, sum/float64(end-start))
+	}
+	for i, j := 0, len(points)-1; i < j; i, j = i+1, j-1 {
+		points[i], points[j] = points[j], points[i]
+	}
+	return points
+}
+
+// point returns which of the points that view charts for data, which holds
+// n measurements, measurement k is averaged into, or -1 if it's outside the
+// window
+func (cw *chartWindow) point(n, k int) int {
+	if w := cw.points * cw.zoom; n > w {
+		k -= n - w
+		n = w
+	}
+	if k < 0 || k >= n {
+		return -1
+	}
+	points := (n + cw.zoom - 1) / cw.zoom
+	return points - 1 - (n-1-k)/cw.zoom
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/freinold/sparkyfish"
+)
+
+// Exit statuses for monitoring plugins, as understood by Nagios and Icinga
+const (
+	checkOK       = 0
+	checkWarning  = 1
+	checkCritical = 2
+	checkUnknown  = 3
+)
+
+var checkStatusNames = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+// thresholdFlag is a flag.Value for a set of alertThresholds, given as
+// "download,upload,ping", e.g. "100mbps,10mbps,50".  Rates take the same
+// units as -limit, ping is in ms, and any of them can be left empty.
+type thresholdFlag alertThresholds
+
+func (tf *thresholdFlag) String() string {
+	if *tf == (thresholdFlag{}) {
+		return ""
+	}
+	return fmt.Sprintf("%v,%v,%v", tf.minDownload, tf.minUpload, tf.maxPing)
+}
+
+func (tf *thresholdFlag) Set(s string) error {
+	parts := strings.Split(s, ",")
+	if len(parts) > 3 {
+		return fmt.Errorf("expected download,upload,ping")
+	}
+
+	var dl, ul bitRate
+	var ping float64
+	var err error
+	for i, part := range parts {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		switch i {
+		case 0:
+			err = dl.Set(part)
+		case 1:
+			err = ul.Set(part)
+		case 2:
+			ping, err = strconv.ParseFloat(strings.TrimSuffix(part, "ms"), 64)
+			if err != nil || ping < 0 {
+				err = fmt.Errorf("invalid ping time")
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	*tf = thresholdFlag{minDownload: float64(dl), minUpload: float64(ul), maxPing: ping}
+	return nil
+}
+
+// runCheck runs the full test suite against client once, as a Nagios/Icinga
+// plugin.  It prints a status line with perfdata and returns the exit status.
+// The results are also added to hist and sent to sinks.
+func runCheck(ctx context.Context, client *sparkyfish.Client, warn, crit alertThresholds, hist *history, sinks sinkList) int {
+	r, err := client.Run(ctx)
+	if err != nil {
+		fmt.Printf("SPARKYFISH CRITICAL - test against %v failed: %v\n", client.Addr(), err)
+		return checkCritical
+	}
+
+	err = hist.add(r)
+	if err != nil {
+		log.Println("error recording results in history:", err)
+	}
+	sinks.results(r, true)
+
+	status := checkOK
+	breaches := warn.check(r)
+	if critical := crit.check(r); len(critical) > 0 {
+		status, breaches = checkCritical, critical
+	} else if len(breaches) > 0 {
+		status = checkWarning
+	}
+
+	summary := []string{r.Server}
+	if len(breaches) > 0 {
+		summary = append(summary, breachText(breaches))
+	} else {
+		if !r.Download.Skipped {
+			summary = append(summary, fmt.Sprintf("download %.1f Mbit/s", r.Download.Avg))
+		}
+		if !r.Upload.Skipped {
+			summary = append(summary, fmt.Sprintf("upload %.1f Mbit/s", r.Upload.Avg))
+		}
+		summary = append(summary, fmt.Sprintf("ping %.2f ms", r.Ping.Avg))
+	}
+
+	fmt.Printf("SPARKYFISH %v - %v | %v\n", checkStatusNames[status], strings.Join(summary, ", "), checkPerfdata(r, warn, crit))
+	return status
+}
+
+// checkPerfdata renders the results as plugin perfdata.  Throughput is in
+// Mbit/s, which has no unit of measure of its own, so it's left without one.
+func checkPerfdata(r sparkyfish.Results, warn, crit alertThresholds) string {
+	var perf []string
+	if !r.Download.Skipped {
+		perf = append(perf, fmt.Sprintf("download=%.3f;%v;%v;0", r.Download.Avg,
+			checkRange(warn.minDownload, true), checkRange(crit.minDownload, true)))
+	}
+	if !r.Upload.Skipped {
+		perf = append(perf, fmt.Sprintf("upload=%.3f;%v;%v;0", r.Upload.Avg,
+			checkRange(warn.minUpload, true), checkRange(crit.minUpload, true)))
+	}
+	perf = append(perf, fmt.Sprintf("ping=%.3fms;%v;%v;0", r.Ping.Avg,
+		checkRange(warn.maxPing, false), checkRange(crit.maxPing, false)))
+	perf = append(perf, fmt.Sprintf("jitter=%.3fms;;;0", r.Ping.Jitter))
+	return strings.Join(perf, " ")
+}
+
+// checkRange renders a threshold in the plugin range format.  A minimum
+// alerts on anything below it, a maximum on anything above it.
+func checkRange(threshold float64, minimum bool) string {
+	switch {
+	case threshold == 0:
+		return ""
+	case minimum:
+		return strconv.FormatFloat(threshold, 'f', -1, 64) + ":"
+	default:
+		return strconv.FormatFloat(threshold, 'f', -1, 64)
+	}
+}
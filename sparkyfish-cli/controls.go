@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/freinold/sparkyfish"
+)
+
+// runControl lets the user steer the tests from the keyboard while they run:
+// skipping the test that's running, or starting the whole run over
+type runControl struct {
+	mu          sync.Mutex
+	cancelRun   context.CancelFunc // cancels the run in progress, if any
+	cancelPhase context.CancelFunc // cancels the test in progress, if any
+	skipped     bool
+}
+
+// startRun returns a context for a run of the tests, which is cancelled if
+// the user asks to start over
+func (rc *runControl) startRun(ctx context.Context) context.Context {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	ctx, rc.cancelRun = context.WithCancel(ctx)
+	return ctx
+}
+
+// endRun marks the run as over and reports whether the user started over
+func (rc *runControl) endRun() (restarted bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.cancelRun == nil {
+		return true
+	}
+	rc.cancelRun()
+	rc.cancelRun = nil
+	return false
+}
+
+// restart cancels the run in progress.  It reports whether there was one.
+func (rc *runControl) restart() bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.cancelRun == nil {
+		return false
+	}
+	rc.cancelRun()
+	rc.cancelRun = nil
+	return true
+}
+
+// startPhase returns a context for a single test, which is cancelled if the
+// user asks to skip it
+func (rc *runControl) startPhase(ctx context.Context) context.Context {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	ctx, rc.cancelPhase = context.WithCancel(ctx)
+	rc.skipped = false
+	return ctx
+}
+
+// endPhase marks the test as over and reports whether the user skipped it
+func (rc *runControl) endPhase() bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.cancelPhase != nil {
+		rc.cancelPhase()
+		rc.cancelPhase = nil
+	}
+	return rc.skipped
+}
+
+// skip cancels the test in progress, if any
+func (rc *runControl) skip() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.cancelPhase != nil {
+		rc.cancelPhase()
+		rc.cancelPhase = nil
+		rc.skipped = true
+	}
+}
+
+// exportResults saves the results so far, including the stats of the test
+// that's running, to a JSON file in the current directory, and says where on
+// the banner
+func (sc *sparkyClient) exportResults() {
+	name := "sparkyfish-" + time.Now().Format("20060102-150405") + ".json"
+
+	msg := "Saved the results to " + name
+	err := writeJSONFile(name, sc.resultsSoFar())
+	if err != nil {
+		msg = fmt.Sprintf("Unable to save the results: %v", err)
+	}
+	sc.flashBanner(msg)
+}
+
+// writeJSONFile writes r to the file name as JSON
+func writeJSONFile(name string, r sparkyfish.Results) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	err = writeJSON(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// bannerFlash is the message that flashBanner is showing, if any, and what
+// was on the banner before it
+type bannerFlash struct {
+	mu     sync.Mutex
+	msg    string
+	hidden string
+}
+
+// flashBanner shows msg on the banner for a few seconds, then puts back
+// whatever was there.  If it's flashing another message, what that one hid
+// is what goes back.
+func (sc *sparkyClient) flashBanner(msg string) {
+	sc.flash.mu.Lock()
+	if text := sc.wr.Text("bannerbox"); sc.flash.msg == "" || text != sc.flash.msg {
+		sc.flash.hidden = text
+	}
+	sc.flash.msg = msg
+	old := sc.flash.hidden
+	sc.wr.SetText("bannerbox", msg)
+	sc.flash.mu.Unlock()
+	sc.wr.Render()
+
+	time.AfterFunc(5*time.Second, func() {
+		sc.flash.mu.Lock()
+		defer sc.flash.mu.Unlock()
+		if sc.wr.Text("bannerbox") == msg {
+			sc.wr.SetText("bannerbox", old)
+			sc.flash.msg = ""
+			sc.wr.Render()
+		}
+	})
+}
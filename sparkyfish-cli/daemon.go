@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/freinold/sparkyfish"
+)
+
+// runDaemon runs the full test suite against client every interval until ctx
+// is cancelled.  Each result is printed to stdout, added to hist and sent to
+// sinks.
+func runDaemon(ctx context.Context, client *sparkyfish.Client, interval time.Duration, hist *history, sinks sinkList, jsonOutput bool) {
+	log.Printf("Testing %v every %v", client.Addr(), interval)
+
+	runEvery(ctx, interval, func() {
+		r, err := client.Run(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Println("test run failed:", err)
+			return
+		}
+
+		if jsonOutput {
+			json.NewEncoder(os.Stdout).Encode(r)
+		} else {
+			fmt.Println(oneLineSummary(r))
+		}
+
+		err = hist.add(r)
+		if err != nil {
+			log.Println("error recording results in history:", err)
+		}
+		sinks.results(r, true)
+	})
+}
+
+// runEvery calls fn immediately and then every interval until ctx is
+// cancelled.  If fn takes longer than interval, the next call happens as soon
+// as it returns.
+func runEvery(ctx context.Context, interval time.Duration, fn func()) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		fn()
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/freinold/sparkyfish"
+)
+
+// dnsText renders the time that each resolver took to look up the server as
+// a header and a line per resolver
+func dnsText(d sparkyfish.DNSResult) []string {
+	lines := []string{fmt.Sprintf(msg("Looking up %v"), d.Host), msg("RESOLVER                  MS  ANSWER")}
+	for _, l := range d.Lookups {
+		answer := strings.Join(l.Addresses, ", ")
+		if l.Error != "" {
+			answer = l.Error
+		}
+		lines = append(lines, fmt.Sprintf("%-20v %7v  %v", l.Resolver, formatNumber(l.Time, 2), answer))
+	}
+	return lines
+}
+
+// dnsSettingsText sums up the lookups in one line for the help overlay, e.g.
+// "12.34 ms (1.1.1.1: 8.10 ms, 9.9.9.9: failed)"
+func dnsSettingsText(d sparkyfish.DNSResult) string {
+	lookupText := func(l sparkyfish.DNSLookup) string {
+		if l.Error != "" {
+			return "failed"
+		}
+		return formatNumber(l.Time, 2) + " ms"
+	}
+
+	text := lookupText(d.System())
+	var others []string
+	for _, l := range d.Lookups[1:] {
+		others = append(others, l.Resolver+": "+lookupText(l))
+	}
+	if len(others) > 0 {
+		text += " (" + strings.Join(others, ", ") + ")"
+	}
+	return text
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/freinold/sparkyfish"
+)
+
+// eventMarkers are the characters that mark each kind of event along the
+// time axis of our charts
+var eventMarkers = map[sparkyfish.EventKind]rune{
+	sparkyfish.EventStall:        'S',
+	sparkyfish.EventRetransmits:  'R',
+	sparkyfish.EventStreamJoined: '+',
+	sparkyfish.EventStreamLeft:   '-',
+}
+
+// eventNames are what we call each kind of event in our summaries
+var eventNames = map[sparkyfish.EventKind]string{
+	sparkyfish.EventStall:        "stall",
+	sparkyfish.EventRetransmits:  "retransmits",
+	sparkyfish.EventStreamJoined: "stream joined",
+	sparkyfish.EventStreamLeft:   "stream left",
+}
+
+// eventText renders an event as the time into the test that it happened and
+// what it was, e.g. "00:09 retransmits (14 segments)"
+func eventText(e sparkyfish.Event) string {
+	name, ok := eventNames[e.Kind]
+	if !ok {
+		name = string(e.Kind)
+	}
+	text := stallOffset(e.At) + " " + msg(name)
+	if e.Detail != "" {
+		text += " (" + e.Detail + ")"
+	}
+	return text
+}
+
+// eventsText lists the events of the download and upload tests, a line each,
+// e.g. "Download 00:09 retransmits (14 segments)"
+func eventsText(r sparkyfish.Results) []string {
+	var lines []string
+	for _, e := range r.Download.Events {
+		lines = append(lines, msg("Download")+" "+eventText(e))
+	}
+	for _, e := range r.Upload.Events {
+		lines = append(lines, msg("Upload")+" "+eventText(e))
+	}
+	return lines
+}
+
+// eventsSummaryText sums up a test's events in one line
+func eventsSummaryText(events []sparkyfish.Event) string {
+	var parts []string
+	for _, e := range events {
+		parts = append(parts, eventText(e))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// eventLegend says what the markers of the kinds of event in events stand
+// for, e.g. "S stall  R retransmits"
+func eventLegend(events []sparkyfish.Event) string {
+	var parts []string
+	for _, kind := range []sparkyfish.EventKind{sparkyfish.EventStall, sparkyfish.EventRetransmits, sparkyfish.EventStreamJoined, sparkyfish.EventStreamLeft} {
+		for _, e := range events {
+			if e.Kind == kind {
+				parts = append(parts, fmt.Sprintf("%c %v", eventMarkers[kind], msg(eventNames[kind])))
+				break
+			}
+		}
+	}
+	return strings.Join(parts, "  ")
+}
+
+// eventIndex returns which of a test's measurements, taken every interval,
+// covers the time that an event happened at, in seconds into the test
+func eventIndex(at float64, interval time.Duration) int {
+	return int(at / interval.Seconds())
+}
+
+// chartMark is an event, marked on the time axis of a chart under the point
+// that it happened during
+type chartMark struct {
+	point int
+	kind  sparkyfish.EventKind
+}
+
+// windowMarks marks the events that fall within cw's window onto a test's
+// first n measurements, which were taken every interval
+func windowMarks(cw *chartWindow, events []sparkyfish.Event, interval time.Duration, n int) []chartMark {
+	var marks []chartMark
+	for _, e := range events {
+		if p := cw.point(n, eventIndex(e.At, interval)); p >= 0 {
+			marks = append(marks, chartMark{p, e.Kind})
+		}
+	}
+	return marks
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"sync"
+)
+
+// Exit statuses, so that scripts can tell a server that's down from a
+// connection that's just slow
+const (
+	exitOK            = 0
+	exitConnectFailed = 1 // unable to reach or sign on with the server
+	exitAborted       = 2 // a test failed partway through, or was cancelled
+	exitBreach        = 3 // the tests ran, but breached an -alert threshold
+	exitUsage         = 4 // invalid options, or nothing to test against
+	exitError         = 5 // something else went wrong, e.g. a file couldn't be read or written
+)
+
+// connectError is an error from connecting to the server, rather than from
+// the tests themselves
+type connectError struct {
+	error
+}
+
+// exitCode returns the exit status for tests that failed with err
+func exitCode(err error) int {
+	if _, ok := err.(connectError); ok {
+		return exitConnectFailed
+	}
+	return exitAborted
+}
+
+// parseFlags parses a subcommand's args with fs, exiting as the main command
+// line does if they're invalid or help was asked for, rather than with the
+// flag package's status 2, which is our exitAborted
+func parseFlags(fs *flag.FlagSet, args []string) {
+	err := fs.Parse(args)
+	if err == flag.ErrHelp {
+		os.Exit(exitOK)
+	}
+	if err != nil {
+		os.Exit(exitUsage)
+	}
+}
+
+// fatal logs v and exits with status code
+func fatal(code int, v ...interface{}) {
+	log.Println(v...)
+	exit(code)
+}
+
+// exitHooks are called with our exit status as we exit, e.g. to tell the
+// service manager that we've stopped, which deferred calls can't do once
+// os.Exit has been called
+var exitHooks struct {
+	mu    sync.Mutex
+	hooks []func(code int)
+}
+
+// atExit has f called with our exit status when we exit through exit or
+// fatal, or when main returns
+func atExit(f func(code int)) {
+	exitHooks.mu.Lock()
+	defer exitHooks.mu.Unlock()
+	exitHooks.hooks = append(exitHooks.hooks, f)
+}
+
+// runExitHooks calls our exit hooks with status code, in the order that they
+// were added.  Each is called once, however often we try to exit.
+func runExitHooks(code int) {
+	exitHooks.mu.Lock()
+	defer exitHooks.mu.Unlock()
+	for _, f := range exitHooks.hooks {
+		f(code)
+	}
+	exitHooks.hooks = nil
+}
+
+// exit calls our exit hooks and exits with status code
+func exit(code int) {
+	runExitHooks(code)
+	os.Exit(code)
+}
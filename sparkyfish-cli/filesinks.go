@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/freinold/sparkyfish"
+)
+
+// jsonFileSink appends the results of each test run to a file, as one JSON
+// document per line
+type jsonFileSink struct {
+	path string
+}
+
+func (js *jsonFileSink) sample(server string, s sparkyfish.Sample) {}
+
+func (js *jsonFileSink) results(r sparkyfish.Results) error {
+	f, err := os.OpenFile(js.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("error writing results to %v: %v", js.path, err)
+	}
+	defer f.Close()
+
+	err = json.NewEncoder(f).Encode(r)
+	if err != nil {
+		return fmt.Errorf("error writing results to %v: %v", js.path, err)
+	}
+	return f.Close()
+}
+
+// csvHeader names the columns written by csvSink.  It must stay stable, as
+// we append to files written by earlier versions of sparkyfish-cli: columns
+// may only be added at the end.
+var csvHeader = []string{
+	"time", "server", "family",
+	"ping_min_ms", "ping_avg_ms", "ping_max_ms", "jitter_ms",
+	"download_avg_mbps", "download_max_mbps", "download_median_mbps", "download_p5_mbps", "download_p95_mbps", "download_stddev_mbps", "download_bytes",
+	"upload_avg_mbps", "upload_max_mbps", "upload_median_mbps", "upload_p5_mbps", "upload_p95_mbps", "upload_stddev_mbps", "upload_bytes",
+	"tags", "note",
+	"hostname", "interface", "link_speed_mbps", "ssid", "signal_dbm", "gateway", "public_address", "asn",
+	"dns_ms", "path_mtu",
+}
+
+// csvSampleHeader names the columns written by csvSink to its samples file
+var csvSampleHeader = []string{"run_time", "time", "server", "direction", "mbps", "warm_up"}
+
+// csvSink appends the results of each test run to a CSV file, one row per
+// run.  With withSamples, each throughput measurement is also appended to a
+// second file alongside it, e.g. results-samples.csv for results.csv.  Rows
+// in the two files can be matched up by the run's time.
+type csvSink struct {
+	path        string
+	samplesPath string
+
+	mu      sync.Mutex
+	samples []csvSample
+}
+
+// csvSample is a throughput measurement waiting to be written out
+type csvSample struct {
+	time      time.Time
+	server    string
+	direction string
+	mbps      float64
+	warmUp    bool
+}
+
+func newCSVSink(path string, withSamples bool) *csvSink {
+	cs := &csvSink{path: path}
+	if withSamples {
+		ext := filepath.Ext(path)
+		cs.samplesPath = strings.TrimSuffix(path, ext) + "-samples" + ext
+	}
+	return cs
+}
+
+func (cs *csvSink) sample(server string, s sparkyfish.Sample) {
+	if cs.samplesPath == "" {
+		return
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if len(cs.samples) >= maxPendingSamples {
+		return
+	}
+	cs.samples = append(cs.samples, csvSample{time.Now(), server, sampleDirection(s), s.Mbps, s.WarmUp})
+}
+
+func (cs *csvSink) results(r sparkyfish.Results) error {
+	runTime := r.EndTime.Format(time.RFC3339)
+
+	row := []string{runTime, r.Server, r.Family,
+		csvFloat(r.Ping.Min), csvFloat(r.Ping.Avg), csvFloat(r.Ping.Max), csvFloat(r.Ping.Jitter)}
+	row = append(row, csvThroughput(r.Download)...)
+	row = append(row, csvThroughput(r.Upload)...)
+	row = append(row, strings.Join(r.Tags, ","), r.Note)
+	row = append(row, csvEnvironment(r.Environment)...)
+	row = append(row, csvDNS(r.DNS), csvMTU(r.MTU))
+
+	err := appendCSV(cs.path, csvHeader, [][]string{row})
+	if err != nil || cs.samplesPath == "" {
+		return err
+	}
+
+	cs.mu.Lock()
+	samples := cs.samples
+	cs.samples = nil
+	cs.mu.Unlock()
+
+	// Leave out anything left over from an earlier run that failed
+	var rows [][]string
+	for _, s := range samples {
+		if s.time.Before(r.StartTime) {
+			continue
+		}
+		rows = append(rows, []string{runTime, s.time.Format(time.RFC3339Nano), s.server, s.direction,
+			csvFloat(s.mbps), strconv.FormatBool(s.warmUp)})
+	}
+	return appendCSV(cs.samplesPath, csvSampleHeader, rows)
+}
+
+// appendCSV appends rows to the CSV file at path, starting it with header if
+// it's new.  An existing file must have the same header, so that we never mix
+// up the columns of two different formats, or one that an earlier version
+// wrote, without the columns that have been added since.  Those are left out
+// of its rows.
+func appendCSV(path string, header []string, rows [][]string) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("error writing results to %v: %v", path, err)
+	}
+	defer f.Close()
+
+	cw := csv.NewWriter(f)
+	existing, err := csv.NewReader(f).Read()
+	switch {
+	case err == io.EOF:
+		cw.Write(header)
+	case err != nil:
+		return fmt.Errorf("error reading %v: %v", path, err)
+	case len(existing) < len(header) && strings.Join(existing, ",") == strings.Join(header[:len(existing)], ","):
+		for i := range rows {
+			rows[i] = rows[i][:len(existing)]
+		}
+	case strings.Join(existing, ",") != strings.Join(header, ","):
+		return fmt.Errorf("not writing results to %v: it has a different header, from another program or version", path)
+	}
+
+	cw.WriteAll(rows)
+	err = cw.Error()
+	if err != nil {
+		return fmt.Errorf("error writing results to %v: %v", path, err)
+	}
+	return f.Close()
+}
+
+// csvEnvironment returns the columns for env, which are empty if the client
+// didn't capture it, or doesn't know them
+func csvEnvironment(env *sparkyfish.Environment) []string {
+	if env == nil {
+		return make([]string, 8)
+	}
+	optional := func(v int64) string {
+		if v == 0 {
+			return ""
+		}
+		return strconv.FormatInt(v, 10)
+	}
+	return []string{env.Hostname, env.Interface, optional(int64(env.LinkSpeed)), env.SSID,
+		optional(int64(env.Signal)), env.Gateway, env.PublicAddress, optional(int64(env.ASN))}
+}
+
+// csvDNS returns the time that the system's resolver took to look up the
+// server, or "" if we didn't time it or the lookup failed
+func csvDNS(d *sparkyfish.DNSResult) string {
+	if d == nil || d.System().Error != "" {
+		return ""
+	}
+	return csvFloat(d.System().Time)
+}
+
+// csvMTU returns the path MTU, or "" if we didn't probe it
+func csvMTU(mr *sparkyfish.MTUResult) string {
+	if mr == nil {
+		return ""
+	}
+	return strconv.Itoa(mr.MTU)
+}
+
+// csvThroughput returns the columns for a throughput test.  They're left
+// empty if it was skipped.
+func csvThroughput(tr sparkyfish.ThroughputResult) []string {
+	if tr.Skipped {
+		return make([]string, 7)
+	}
+	return []string{csvFloat(tr.Avg), csvFloat(tr.Max), csvFloat(tr.Median), csvFloat(tr.P5), csvFloat(tr.P95),
+		csvFloat(tr.StdDev), strconv.FormatInt(tr.Bytes, 10)}
+}
+
+func csvFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', 3, 64)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/freinold/sparkyfish"
+)
+
+// helpKeys lists our keys and what they do
+const helpKeys = `KEYS
+ ?      show or hide this help
+ q      quit, cancelling any tests in progress
+ r      run the tests again
+ s      skip the test that's running
+ e      save the results so far to a JSON file
+ p      pause the throughput graphs
+ + -    zoom the throughput graphs in and out
+ h      compare with past runs against this server
+ a      advanced TCP stats
+ t      the route to the server, with -traceroute
+ v      review the whole run, once it's done
+ ← →    page through the review`
+
+// welcomeText greets the user the first time that sparkyfish-cli runs
+const welcomeText = "Welcome to sparkyfish!  The tests are running behind this\nscreen; press ? to watch them."
+
+// helpOverlay lists our keys and the settings of this run over the rest of
+// the screen.  It's shown by itself the first time that sparkyfish-cli runs,
+// to welcome the user.
+type helpOverlay struct {
+	mu      sync.Mutex
+	shown   bool
+	welcome bool
+}
+
+// addHelpWidgets builds the help overlay, hidden until the user asks for it
+// unless we're welcoming them
+func (sc *sparkyClient) addHelpWidgets() {
+	overlay := newTextBox("", colors.text, 0, 2, 60, 27)
+	overlay.Title = msg(" Help ")
+	overlay.BorderStyle = colors.helpFg
+
+	sc.wr.Add("helpoverlay", overlay)
+	sc.wr.Raise("helpoverlay")
+	sc.updateHelp()
+	if !sc.help.isShown() {
+		sc.wr.Hide("helpoverlay")
+	}
+}
+
+// toggleHelp shows or hides the help overlay
+func (sc *sparkyClient) toggleHelp() {
+	h := sc.help
+
+	h.mu.Lock()
+	h.shown = !h.shown
+	h.welcome = false
+	shown := h.shown
+	h.mu.Unlock()
+
+	if shown {
+		sc.updateHelp()
+		sc.wr.Show("helpoverlay")
+	} else {
+		sc.wr.Hide("helpoverlay")
+	}
+
+	sc.wr.Clear()
+	sc.wr.Render()
+}
+
+// updateHelp fills in the help overlay with our keys and the settings of this
+// run
+func (sc *sparkyClient) updateHelp() {
+	h := sc.help
+	h.mu.Lock()
+	welcome := h.welcome
+	h.mu.Unlock()
+
+	var text string
+	if welcome {
+		text = msg(welcomeText) + "\n\n"
+	}
+	r := sc.currentResults()
+	text += msg(helpKeys) + "\n\n" + msg("THIS RUN") + "\n" + settingsText(sc.client, sc.info, r.DNS, r.MTU)
+
+	sc.wr.SetText("helpoverlay", text)
+}
+
+func (h *helpOverlay) isShown() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.shown
+}
+
+// settingsText describes how client runs its tests, and the server that it
+// runs them against, which said hello with info, took dns to look up if we
+// timed it and has a path MTU of mtu if we probed it.  A nil client hasn't
+// picked a server yet.
+func settingsText(client *sparkyfish.Client, info sparkyfish.ServerInfo, dns *sparkyfish.DNSResult, mtu *sparkyfish.MTUResult) string {
+	if client == nil {
+		return " Server:    picked automatically once the tests begin"
+	}
+
+	transport := "TCP, no TLS"
+	switch addr := client.Addr(); {
+	case strings.HasPrefix(addr, "wss://"):
+		transport = "WebSocket over TLS"
+	case strings.HasPrefix(addr, "ws://"):
+		transport = "WebSocket, no TLS"
+	case strings.HasPrefix(addr, "quic://"):
+		transport = "QUIC"
+	}
+	protocol := "not connected yet"
+	if info.Cname != "" {
+		protocol = fmt.Sprintf("protocol v%v", info.Version)
+	}
+
+	tests := "download, then upload"
+	switch {
+	case client.SkipDownload && client.SkipUpload:
+		tests = "no throughput tests"
+	case client.SkipDownload:
+		tests = "upload only"
+	case client.SkipUpload:
+		tests = "download only"
+	case client.Bidirectional:
+		tests = "download and upload at once"
+	}
+	if client.UDP {
+		tests += fmt.Sprintf(", over UDP at %v Mbit/s", client.UDPRate)
+	}
+
+	streams := "1 stream"
+	if client.Streams > 1 {
+		streams = fmt.Sprintf("%v streams", client.Streams)
+	}
+	blocks := "adaptive blocks"
+	if client.BlockSize > 0 {
+		blocks = fmt.Sprintf("%v KB blocks", client.BlockSize)
+	}
+
+	text := fmt.Sprintf(" Server:    %v (%v, %v)\n Tests:     %v pings, %v, %v each\n Streams:   %v, %v\n Reporting: every %v, leaving out the first %v",
+		client.Addr(), protocol, transport, client.Pings, tests, sparkyfish.TestLength, streams, blocks, client.ReportInterval, client.WarmUp)
+	if info.Cname != "" {
+		text += "\n Connect:   " + connectText(info.Timings)
+	}
+	if dns != nil {
+		text += "\n DNS:       " + dnsSettingsText(*dns)
+	}
+	if mtu != nil {
+		text += "\n Path MTU:  " + mtuText(*mtu)
+	}
+	return text
+}
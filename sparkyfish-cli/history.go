@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/freinold/sparkyfish"
+	bolt "go.etcd.io/bbolt"
+)
+
+// resultsBucket holds one record per completed test sequence, keyed by the
+// time the sequence finished so that they sort chronologically
+var resultsBucket = []byte("results")
+
+// history is a local database of completed tests.  The database is only held
+// open while it's being used, so a daemon and a "history" command can share it.
+type history struct {
+	path string
+}
+
+// historyFilter selects records from the history database
+type historyFilter struct {
+	server string
+	tag    string
+	since  time.Time
+	limit  int
+}
+
+func newHistory(path string) *history {
+	return &history{path: path}
+}
+
+// open opens the history database, creating it if needed
+func (h *history) open(readOnly bool) (*bolt.DB, error) {
+	if !readOnly {
+		err := os.MkdirAll(filepath.Dir(h.path), 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return bolt.Open(h.path, 0644, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: readOnly})
+}
+
+// isNew reports whether the history database has yet to be created, i.e.
+// whether we've never recorded a run.  A nil history is never new.
+func (h *history) isNew() bool {
+	if h == nil {
+		return false
+	}
+	_, err := os.Stat(h.path)
+	return os.IsNotExist(err)
+}
+
+// add stores a completed test sequence.  A nil history stores nothing.
+func (h *history) add(r sparkyfish.Results) error {
+	if h == nil {
+		return nil
+	}
+
+	db, err := h.open(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	value, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(resultsBucket)
+		if err != nil {
+			return err
+		}
+
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(r.EndTime.UnixNano()))
+
+		return b.Put(key, value)
+	})
+}
+
+// list returns the records that match f, oldest first.  A nil history has
+// no records.
+func (h *history) list(f historyFilter) ([]sparkyfish.Results, error) {
+	var records []sparkyfish.Results
+
+	if h == nil {
+		return nil, nil
+	}
+
+	if _, err := os.Stat(h.path); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	db, err := h.open(true)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(resultsBucket)
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+
+		// Walk backwards from the newest record so that the limit applies
+		// to the most recent runs
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var r sparkyfish.Results
+
+			if f.limit > 0 && len(records) >= f.limit {
+				break
+			}
+
+			if time.Unix(0, int64(binary.BigEndian.Uint64(k))).Before(f.since) {
+				break
+			}
+
+			err := json.Unmarshal(v, &r)
+			if err != nil {
+				return err
+			}
+
+			if f.server != "" && !strings.Contains(r.Server, f.server) {
+				continue
+			}
+			if f.tag != "" && !hasTag(r, f.tag) {
+				continue
+			}
+
+			records = append(records, r)
+		}
+
+		return nil
+	})
+
+	// Put the records back in chronological order
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+
+	return records, err
+}
+
+// defaultHistoryPath returns the path of the history database in the user's
+// home directory, or in the current directory if we can't find one
+func defaultHistoryPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "sparkyfish-history.db"
+	}
+	return filepath.Join(home, ".sparkyfish", "history.db")
+}
+
+// historyCommand implements "sparkyfish-cli history", which lists past runs
+func historyCommand(args []string) error {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	path := fs.String("history", defaultHistoryPath(), "Path of the history database")
+	server := fs.String("server", "", "Only list runs against servers whose host:port contains this string")
+	tag := fs.String("tag", "", "Only list runs that were tagged with this tag")
+	since := fs.Duration("since", 0, "Only list runs from the last duration (e.g. 24h)")
+	limit := fs.Int("limit", 0, "Only list the most recent N runs")
+	jsonOutput := fs.Bool("json", false, "List the runs as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:", os.Args[0], "history [options]")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	f := historyFilter{server: *server, tag: *tag, limit: *limit}
+	if *since > 0 {
+		f.since = time.Now().Add(-*since)
+	}
+
+	records, err := newHistory(*path).list(f)
+	if err != nil {
+		return err
+	}
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if records == nil {
+			records = []sparkyfish.Results{}
+		}
+		return enc.Encode(records)
+	}
+
+	return printHistory(os.Stdout, records)
+}
+
+// printHistory writes records to w as a table
+func printHistory(w io.Writer, records []sparkyfish.Results) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "TIME\tSERVER\tDOWN AVG\tDOWN MAX\tUP AVG\tUP MAX\tPING\tJITTER\tTAGS\tNOTE")
+	for _, r := range records {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%.2f\t%.2f\t%v\t%v\n",
+			r.EndTime.Local().Format("2006-01-02 15:04:05"), r.Server,
+			historyThroughput(r.Download), historyThroughput(r.Upload), r.Ping.Avg, r.Ping.Jitter,
+			strings.Join(r.Tags, ","), r.Note)
+	}
+
+	return tw.Flush()
+}
+
+// historyThroughput renders the avg and max columns for a throughput result
+func historyThroughput(tr sparkyfish.ThroughputResult) string {
+	if tr.Skipped {
+		return "-\t-"
+	}
+	return fmt.Sprintf("%.1f\t%.1f", tr.Avg, tr.Max)
+}
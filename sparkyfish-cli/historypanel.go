@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/freinold/sparkyfish"
+)
+
+// historyAveragePeriod is how far back we look when comparing the live run
+// against the history database
+const historyAveragePeriod = 30 * 24 * time.Hour
+
+// historyPanel charts past runs against the same server alongside the live
+// run.  It takes the place of the throughput graphs while it's shown.
+type historyPanel struct {
+	mu      sync.Mutex
+	shown   bool
+	pastDL  []float64
+	pastUL  []float64
+	avgDL   float64
+	avgUL   float64
+	periodN int
+}
+
+// load fetches the most recent runs against server from h, along with their
+// average speeds over historyAveragePeriod.  Errors are ignored; the panel
+// just ends up empty.
+func (hp *historyPanel) load(h *history, server string, runs int) {
+	period, _ := h.list(historyFilter{server: server, since: time.Now().Add(-historyAveragePeriod)})
+	recent, _ := h.list(historyFilter{server: server, limit: runs})
+
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+
+	// Runs that skipped a test don't count towards its average
+	var nDL, nUL int
+	hp.avgDL, hp.avgUL, hp.periodN = 0, 0, len(period)
+	for _, r := range period {
+		if !r.Download.Skipped {
+			hp.avgDL += r.Download.Avg
+			nDL++
+		}
+		if !r.Upload.Skipped {
+			hp.avgUL += r.Upload.Avg
+			nUL++
+		}
+	}
+	if nDL > 0 {
+		hp.avgDL /= float64(nDL)
+	}
+	if nUL > 0 {
+		hp.avgUL /= float64(nUL)
+	}
+
+	hp.pastDL, hp.pastUL = nil, nil
+	for _, r := range recent {
+		if !r.Download.Skipped {
+			hp.pastDL = append(hp.pastDL, r.Download.Avg)
+		}
+		if !r.Upload.Skipped {
+			hp.pastUL = append(hp.pastUL, r.Upload.Avg)
+		}
+	}
+}
+
+// addHistoryWidgets builds the history panel widgets, hidden until the user
+// asks for them
+func (sc *sparkyClient) addHistoryWidgets() {
+	histDL := newLineChart(colors.history)
+	histDL.PaddingTop = 1
+	histDL.SetRect(0, 6, 30, 14)
+
+	histUL := newLineChart(colors.history)
+	histUL.PaddingTop = 1
+	histUL.SetRect(30, 6, 60, 14)
+
+	histSummary := newTextBox("", colors.text, 0, 14, 60, 4)
+
+	sc.wr.Add("histdl", histDL)
+	sc.wr.Add("histul", histUL)
+	sc.wr.Add("histsummary", histSummary)
+
+	// The panel may already have been toggled on while we were starting up
+	sc.historyPanel.mu.Lock()
+	if !sc.historyPanel.shown {
+		sc.wr.Hide("histdl")
+		sc.wr.Hide("histul")
+		sc.wr.Hide("histsummary")
+	}
+	sc.historyPanel.mu.Unlock()
+
+	sc.updateHistoryPanel(sparkyfish.ThroughputResult{}, sparkyfish.ThroughputResult{})
+}
+
+// updateHistoryPanel adds the live run's averages to the end of the history
+// charts and compares them against our 30-day averages
+func (sc *sparkyClient) updateHistoryPanel(dl, ul sparkyfish.ThroughputResult) {
+	hp := sc.historyPanel
+
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+
+	// Once a test has started, the live run is the last point on its chart
+	dlData, ulData := withLive(hp.pastDL, dl.Avg), withLive(hp.pastUL, ul.Avg)
+	dlUnit, ulUnit := unitFor(maxOf(dlData)), unitFor(maxOf(ulData))
+
+	sc.wr.SetTitle("histdl", fmt.Sprintf(msg(" Down (%v), last %v runs"), dlUnit.name, len(hp.pastDL)))
+	sc.wr.SetData("histdl", dlUnit.scale(dlData))
+
+	sc.wr.SetTitle("histul", fmt.Sprintf(msg(" Up (%v), last %v runs"), ulUnit.name, len(hp.pastUL)))
+	sc.wr.SetData("histul", ulUnit.scale(ulData))
+
+	if hp.periodN == 0 {
+		sc.wr.SetTitle("histsummary", msg(" 30-day Average "))
+		sc.wr.SetText("histsummary", msg("No runs against this server in the last 30 days"))
+		return
+	}
+	sc.wr.SetTitle("histsummary", fmt.Sprintf(msg(" 30-day Average (%v runs) "), hp.periodN))
+	sc.wr.SetText("histsummary", fmt.Sprintf(msg("Down: %v, this run %v\nUp: %v, this run %v"),
+		formatRate(hp.avgDL), comparisonText(dl.Avg, hp.avgDL), formatRate(hp.avgUL), comparisonText(ul.Avg, hp.avgUL)))
+}
+
+// toggleHistoryPanel swaps the throughput graphs for the history panel and
+// back.  Showing it hides the TCP stats, review and route panels, which live
+// in the same spot.
+func (sc *sparkyClient) toggleHistoryPanel() {
+	hp := sc.historyPanel
+
+	if !hp.isShown() && sc.tcpPanel.isShown() {
+		sc.toggleTCPPanel()
+	}
+	if !hp.isShown() && sc.review.isShown() {
+		sc.toggleReview()
+	}
+	if !hp.isShown() && sc.routePanel.isShown() {
+		sc.toggleRoutePanel()
+	}
+
+	hp.mu.Lock()
+	hp.shown = !hp.shown
+	shown := hp.shown
+	hp.mu.Unlock()
+
+	for _, name := range []string{"histdl", "histul", "histsummary"} {
+		if shown {
+			sc.wr.Show(name)
+		} else {
+			sc.wr.Hide(name)
+		}
+	}
+	for _, name := range []string{"dlgraph", "ulgraph"} {
+		if shown {
+			sc.wr.Hide(name)
+		} else {
+			sc.wr.Show(name)
+		}
+	}
+
+	sc.wr.Clear()
+	sc.wr.Render()
+}
+
+func (hp *historyPanel) isShown() bool {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+	return hp.shown
+}
+
+// withLive returns a copy of past with the live reading appended, unless
+// there's no live reading yet
+func withLive(past []float64, live float64) []float64 {
+	data := append([]float64{}, past...)
+	if live > 0 || len(data) == 0 {
+		data = append(data, live)
+	}
+	return data
+}
+
+// comparisonText describes how far live is above or below avg
+func comparisonText(live, avg float64) string {
+	if live == 0 {
+		return "--"
+	}
+	if avg == 0 {
+		return formatRate(live)
+	}
+	change := formatNumber((live-avg)/avg*100, 1)
+	if live >= avg {
+		change = "+" + change
+	}
+	return fmt.Sprintf("%v (%v%%)", formatRate(live), change)
+}
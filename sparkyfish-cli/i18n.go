@@ -0,0 +1,342 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// locale is a language that the terminal UI can be shown in
+type locale struct {
+	decimal   string // the decimal separator
+	thousands string // the thousands separator
+
+	// messages translates our labels from English, keyed by their English
+	// text.  Anything missing is shown in English.
+	messages map[string]string
+}
+
+// lang is the locale that the terminal UI is shown in
+var lang = locales["en"]
+
+// useLang shows the terminal UI in the language called name, e.g. "de".  If
+// name is empty, we go by the user's environment, falling back to English for
+// languages that we don't speak.
+func useLang(name string) error {
+	if name == "" {
+		l, ok := locales[envLang()]
+		if ok {
+			lang = l
+		}
+		return nil
+	}
+
+	l, ok := locales[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("unknown language %q; -lang must be en, de, fr or es", name)
+	}
+	lang = l
+	return nil
+}
+
+// envLang returns the language that the user's environment asks for, e.g.
+// "de" for LANG=de_DE.UTF-8, going by the same variables as gettext
+func envLang() string {
+	for _, v := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		value := os.Getenv(v)
+		if value == "" {
+			continue
+		}
+		// e.g. de_DE.UTF-8@euro
+		value = strings.ToLower(value)
+		if i := strings.IndexAny(value, "_.@"); i >= 0 {
+			value = value[:i]
+		}
+		return value
+	}
+	return ""
+}
+
+// msg returns the translation of the English text s, which may be a format
+// string, for our language
+func msg(s string) string {
+	if t, ok := lang.messages[s]; ok {
+		return t
+	}
+	return s
+}
+
+// formatNumber renders v with digits decimal places, with our language's
+// decimal and thousands separators
+func formatNumber(v float64, digits int) string {
+	s := strconv.FormatFloat(v, 'f', digits, 64)
+
+	var sign string
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+	whole, frac, _ := strings.Cut(s, ".")
+
+	// Group the whole part in threes, from the right
+	var b strings.Builder
+	for i, c := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteString(lang.thousands)
+		}
+		b.WriteRune(c)
+	}
+
+	s = sign + b.String()
+	if frac != "" {
+		s += lang.decimal + frac
+	}
+	return s
+}
+
+// locales are the languages that we speak
+var locales = map[string]locale{
+	// English keeps to the plain numbers that we've always shown, which
+	// scripts may read
+	"en": {decimal: "."},
+	"de": {decimal: ",", thousands: ".", messages: messagesDE},
+	"fr": {decimal: ",", thousands: " ", messages: messagesFR},
+	"es": {decimal: ",", thousands: ".", messages: messagesES},
+}
+
+// messagesDE translates our labels into German
+var messagesDE = map[string]string{
+	" Download Speed (%v)":       " Download-Geschwindigkeit (%v)",
+	" Upload Speed (%v)":         " Upload-Geschwindigkeit (%v)",
+	" [paused]":                  " [angehalten]",
+	"Latency":                    "Latenz",
+	"Min/Avg/Max\n%v/%v/%v ms":   "Min/Mittel/Max\n%v/%v/%v ms",
+	"Jitter/σ\n%v/%v ms":         "Jitter/σ\n%v/%v ms",
+	" Throughput Summary ":       " Durchsatz ",
+	" Test Progress ":            " Fortschritt ",
+	" Server Info ":              " Server-Info ",
+	" Error ":                    " Fehler ",
+	" Advanced Stats ":           " Erweiterte Statistik ",
+	" Finding Nearest Server ":   " Suche nächsten Server ",
+	" Help ":                     " Hilfe ",
+	" Review ":                   " Rückblick ",
+	" Review: %v warning(s) ":    " Rückblick: %v Warnung(en) ",
+	"DOWNLOAD":                   "DOWNLOAD",
+	"UPLOAD":                     "UPLOAD",
+	"LATENCY":                    "LATENZ",
+	"Download":                   "Download",
+	"Upload":                     "Upload",
+	" (skipped)":                 " (übersprungen)",
+	"(warming up)":               "(Aufwärmphase)",
+	"(raw avg: %v)":              "(Rohmittel: %v)",
+	statsFormat:                  "Aktuell: %v  Max: %v  Mittel: %v\nMedian: %v  p5/p95: %v/%v  σ: %v",
+	" Down (%v), last %v runs":   " Down (%v), letzte %v Läufe",
+	" Up (%v), last %v runs":     " Up (%v), letzte %v Läufe",
+	" 30-day Average ":           " 30-Tage-Mittel ",
+	" 30-day Average (%v runs) ": " 30-Tage-Mittel (%v Läufe) ",
+	"No runs against this server in the last 30 days": "Keine Läufe gegen diesen Server in den letzten 30 Tagen",
+	"Down: %v, this run %v\nUp: %v, this run %v":      "Down: %v, dieser Lauf %v\nUp: %v, dieser Lauf %v",
+	" %v (%v), %v measurements  [%v/%v] ":             " %v (%v), %v Messungen  [%v/%v] ",
+	"%v\n\nPress [r] to retry or [q] to quit":         "%v\n\n[r] für einen neuen Versuch, [q] zum Beenden",
+	"Testing from %v": "Test von %v aus",
+	helpText:          " [q]Ende [?]Hilfe [h]Verlauf [a]Details [r]Neu [s]Weiter [p]Pause [+/-]Zoom [e]xport",
+	reviewHelp:        " [q]Ende [h]Verlauf [a]Details [v]Graphen [←/→]Seite [r]Neu [e]xport",
+	helpKeys:          "TASTEN\n ?      diese Hilfe zeigen oder verbergen\n q      beenden und laufende Tests abbrechen\n r      die Tests neu starten\n s      den laufenden Test überspringen\n e      die bisherigen Ergebnisse als JSON speichern\n p      die Durchsatz-Graphen anhalten\n + -    in die Graphen hinein- und herauszoomen\n h      mit früheren Läufen gegen diesen Server vergleichen\n a      erweiterte TCP-Statistik\n t      die Route zum Server, mit -traceroute\n v      der ganze Lauf im Rückblick, sobald er fertig ist\n ← →    durch den Rückblick blättern",
+	"THIS RUN":        "DIESER LAUF",
+	welcomeText:       "Willkommen bei sparkyfish!  Die Tests laufen hinter diesem\nFenster; drücke ?, um zuzusehen.",
+
+	// The route panel
+	" Route ":            " Route ",
+	" Route (%v) ":       " Route (%v) ",
+	"    (%v more hops)": "    (%v weitere Hops)",
+	"TTL  HOST                                    LOSS   AVG MS": "TTL  HOST                                    VERL.   Ø MS",
+	"(no answer)":                     "(keine Antwort)",
+	"     (the server didn't answer)": "     (der Server hat nicht geantwortet)",
+	"Run with -traceroute to trace the route to the server\nbefore the tests.": "Mit -traceroute wird vor den Tests die Route zum\nServer ermittelt.",
+	"Tracing the route to the server...":                                       "Ermittle die Route zum Server...",
+	"ROUTE":                                                                    "ROUTE",
+
+	// DNS lookups
+	"Looking up %v":                        "Namensauflösung für %v",
+	"RESOLVER                  MS  ANSWER": "RESOLVER                  MS  ANTWORT",
+	"DNS":                                  "DNS",
+
+	// Connect timings
+	"TIMINGS": "ZEITEN",
+
+	// Retries
+	"Retrying in %v (%v of %v): %v": "Neuer Versuch in %v (%v von %v): %v",
+
+	// Stalls
+	"STALLS":                          "STOCKUNGEN",
+	"Download stalled at %v":          "Download stockte bei %v",
+	"Upload stalled at %v":            "Upload stockte bei %v",
+	"Download stalled at %v for %v s": "Download stockte bei %v für %v s",
+	"Upload stalled at %v for %v s":   "Upload stockte bei %v für %v s",
+
+	// Events
+	"EVENTS":        "EREIGNISSE",
+	"Events: %v":    "Ereignisse: %v",
+	"stall":         "Stockung",
+	"retransmits":   "Neuübertragungen",
+	"stream joined": "Stream hinzugekommen",
+	"stream left":   "Stream weggefallen",
+}
+
+// messagesFR translates our labels into French
+var messagesFR = map[string]string{
+	" Download Speed (%v)":       " Débit descendant (%v)",
+	" Upload Speed (%v)":         " Débit montant (%v)",
+	" [paused]":                  " [en pause]",
+	"Latency":                    "Latence",
+	"Min/Avg/Max\n%v/%v/%v ms":   "Min/Moy/Max\n%v/%v/%v ms",
+	"Jitter/σ\n%v/%v ms":         "Gigue/σ\n%v/%v ms",
+	" Throughput Summary ":       " Résumé du débit ",
+	" Test Progress ":            " Progression ",
+	" Server Info ":              " Infos serveur ",
+	" Error ":                    " Erreur ",
+	" Advanced Stats ":           " Statistiques avancées ",
+	" Finding Nearest Server ":   " Recherche du serveur le plus proche ",
+	" Help ":                     " Aide ",
+	" Review ":                   " Bilan ",
+	" Review: %v warning(s) ":    " Bilan : %v avertissement(s) ",
+	"DOWNLOAD":                   "DESCENDANT",
+	"UPLOAD":                     "MONTANT",
+	"LATENCY":                    "LATENCE",
+	"Download":                   "Descendant",
+	"Upload":                     "Montant",
+	" (skipped)":                 " (ignoré)",
+	"(warming up)":               "(mise en route)",
+	"(raw avg: %v)":              "(moy. brute : %v)",
+	statsFormat:                  "Actuel : %v  Max : %v  Moy : %v\nMédiane : %v  p5/p95 : %v/%v  σ : %v",
+	" Down (%v), last %v runs":   " Desc. (%v), %v derniers tests",
+	" Up (%v), last %v runs":     " Mont. (%v), %v derniers tests",
+	" 30-day Average ":           " Moyenne sur 30 jours ",
+	" 30-day Average (%v runs) ": " Moyenne sur 30 jours (%v tests) ",
+	"No runs against this server in the last 30 days": "Aucun test vers ce serveur depuis 30 jours",
+	"Down: %v, this run %v\nUp: %v, this run %v":      "Desc. : %v, ce test %v\nMont. : %v, ce test %v",
+	" %v (%v), %v measurements  [%v/%v] ":             " %v (%v), %v mesures  [%v/%v] ",
+	"%v\n\nPress [r] to retry or [q] to quit":         "%v\n\n[r] pour réessayer, [q] pour quitter",
+	"Testing from %v": "Test depuis %v",
+	helpText:          " [q]uitter [?]aide [h]istorique [a]vancé [r]elancer [s]auter [p]ause [+/-]zoom [e]xporter",
+	reviewHelp:        " [q]uitter [h]istorique [a]vancé [v]graphes [←/→]page [r]elancer [e]xporter",
+	helpKeys:          "TOUCHES\n ?      afficher ou masquer cette aide\n q      quitter, en annulant les tests en cours\n r      relancer les tests\n s      sauter le test en cours\n e      enregistrer les résultats obtenus en JSON\n p      mettre les graphes de débit en pause\n + -    zoomer sur les graphes de débit\n h      comparer aux tests précédents vers ce serveur\n a      statistiques TCP avancées\n t      la route vers le serveur, avec -traceroute\n v      le bilan du test complet, une fois terminé\n ← →    parcourir le bilan",
+	"THIS RUN":        "CE TEST",
+	welcomeText:       "Bienvenue dans sparkyfish !  Les tests tournent derrière\ncet écran ; appuyez sur ? pour les suivre.",
+
+	// The route panel
+	" Route ":            " Route ",
+	" Route (%v) ":       " Route (%v) ",
+	"    (%v more hops)": "    (%v sauts de plus)",
+	"TTL  HOST                                    LOSS   AVG MS": "TTL  HÔTE                                    PERTE  MOY MS",
+	"(no answer)":                     "(pas de réponse)",
+	"     (the server didn't answer)": "     (le serveur n'a pas répondu)",
+	"Run with -traceroute to trace the route to the server\nbefore the tests.": "Lancez avec -traceroute pour tracer la route vers le\nserveur avant les tests.",
+	"Tracing the route to the server...":                                       "Traçage de la route vers le serveur...",
+	"ROUTE":                                                                    "ROUTE",
+
+	// DNS lookups
+	"Looking up %v":                        "Résolution de %v",
+	"RESOLVER                  MS  ANSWER": "RÉSOLVEUR                 MS  RÉPONSE",
+	"DNS":                                  "DNS",
+
+	// Connect timings
+	"TIMINGS": "TEMPS",
+
+	// Retries
+	"Retrying in %v (%v of %v): %v": "Nouvel essai dans %v (%v sur %v) : %v",
+
+	// Stalls
+	"STALLS":                          "BLOCAGES",
+	"Download stalled at %v":          "Téléchargement bloqué à %v",
+	"Upload stalled at %v":            "Envoi bloqué à %v",
+	"Download stalled at %v for %v s": "Téléchargement bloqué à %v pendant %v s",
+	"Upload stalled at %v for %v s":   "Envoi bloqué à %v pendant %v s",
+
+	// Events
+	"EVENTS":        "ÉVÉNEMENTS",
+	"Events: %v":    "Événements : %v",
+	"stall":         "blocage",
+	"retransmits":   "retransmissions",
+	"stream joined": "flux arrivé",
+	"stream left":   "flux parti",
+}
+
+// messagesES translates our labels into Spanish
+var messagesES = map[string]string{
+	" Download Speed (%v)":       " Velocidad de bajada (%v)",
+	" Upload Speed (%v)":         " Velocidad de subida (%v)",
+	" [paused]":                  " [en pausa]",
+	"Latency":                    "Latencia",
+	"Min/Avg/Max\n%v/%v/%v ms":   "Mín/Media/Máx\n%v/%v/%v ms",
+	"Jitter/σ\n%v/%v ms":         "Jitter/σ\n%v/%v ms",
+	" Throughput Summary ":       " Resumen de velocidad ",
+	" Test Progress ":            " Progreso ",
+	" Server Info ":              " Información del servidor ",
+	" Error ":                    " Error ",
+	" Advanced Stats ":           " Estadísticas avanzadas ",
+	" Finding Nearest Server ":   " Buscando el servidor más cercano ",
+	" Help ":                     " Ayuda ",
+	" Review ":                   " Repaso ",
+	" Review: %v warning(s) ":    " Repaso: %v aviso(s) ",
+	"DOWNLOAD":                   "BAJADA",
+	"UPLOAD":                     "SUBIDA",
+	"LATENCY":                    "LATENCIA",
+	"Download":                   "Bajada",
+	"Upload":                     "Subida",
+	" (skipped)":                 " (omitida)",
+	"(warming up)":               "(calentando)",
+	"(raw avg: %v)":              "(media bruta: %v)",
+	statsFormat:                  "Actual: %v  Máx: %v  Media: %v\nMediana: %v  p5/p95: %v/%v  σ: %v",
+	" Down (%v), last %v runs":   " Bajada (%v), últimas %v pruebas",
+	" Up (%v), last %v runs":     " Subida (%v), últimas %v pruebas",
+	" 30-day Average ":           " Media de 30 días ",
+	" 30-day Average (%v runs) ": " Media de 30 días (%v pruebas) ",
+	"No runs against this server in the last 30 days": "Ninguna prueba con este servidor en los últimos 30 días",
+	"Down: %v, this run %v\nUp: %v, this run %v":      "Bajada: %v, esta prueba %v\nSubida: %v, esta prueba %v",
+	" %v (%v), %v measurements  [%v/%v] ":             " %v (%v), %v mediciones  [%v/%v] ",
+	"%v\n\nPress [r] to retry or [q] to quit":         "%v\n\n[r] para reintentar, [q] para salir",
+	"Testing from %v": "Probando desde %v",
+	helpText:          " [q]salir [?]ayuda [h]istorial [a]vanzado [r]epetir [s]altar [p]ausa [+/-]zoom [e]xportar",
+	reviewHelp:        " [q]salir [h]istorial [a]vanzado [v]gráficas [←/→]página [r]epetir [e]xportar",
+	helpKeys:          "TECLAS\n ?      mostrar u ocultar esta ayuda\n q      salir, cancelando las pruebas en curso\n r      repetir las pruebas\n s      saltar la prueba en curso\n e      guardar los resultados hasta ahora en JSON\n p      pausar las gráficas de velocidad\n + -    acercar y alejar las gráficas de velocidad\n h      comparar con pruebas anteriores con este servidor\n a      estadísticas TCP avanzadas\n t      la ruta al servidor, con -traceroute\n v      repasar la prueba completa, una vez terminada\n ← →    pasar las páginas del repaso",
+	"THIS RUN":        "ESTA PRUEBA",
+	welcomeText:       "¡Bienvenido a sparkyfish!  Las pruebas se ejecutan detrás\nde esta pantalla; pulsa ? para verlas.",
+
+	// The route panel
+	" Route ":            " Ruta ",
+	" Route (%v) ":       " Ruta (%v) ",
+	"    (%v more hops)": "    (%v saltos más)",
+	"TTL  HOST                                    LOSS   AVG MS": "TTL  HOST                                    PÉRD.  PROM MS",
+	"(no answer)":                     "(sin respuesta)",
+	"     (the server didn't answer)": "     (el servidor no respondió)",
+	"Run with -traceroute to trace the route to the server\nbefore the tests.": "Ejecute con -traceroute para trazar la ruta al servidor\nantes de las pruebas.",
+	"Tracing the route to the server...":                                       "Trazando la ruta al servidor...",
+	"ROUTE":                                                                    "RUTA",
+
+	// DNS lookups
+	"Looking up %v":                        "Resolviendo %v",
+	"RESOLVER                  MS  ANSWER": "RESOLUTOR                 MS  RESPUESTA",
+	"DNS":                                  "DNS",
+
+	// Connect timings
+	"TIMINGS": "TIEMPOS",
+
+	// Retries
+	"Retrying in %v (%v of %v): %v": "Reintentando en %v (%v de %v): %v",
+
+	// Stalls
+	"STALLS":                          "BLOQUEOS",
+	"Download stalled at %v":          "Bajada detenida en %v",
+	"Upload stalled at %v":            "Subida detenida en %v",
+	"Download stalled at %v for %v s": "Bajada detenida en %v durante %v s",
+	"Upload stalled at %v for %v s":   "Subida detenida en %v durante %v s",
+
+	// Events
+	"EVENTS":        "EVENTOS",
+	"Events: %v":    "Eventos: %v",
+	"stall":         "bloqueo",
+	"retransmits":   "retransmisiones",
+	"stream joined": "flujo añadido",
+	"stream left":   "flujo perdido",
+}
@@ -0,0 +1,61 @@
+package main
+
+// The widths of our widgets, in columns.  The graphs share the terminal's
+// width, so that they can show as much of each test as possible, and the
+// boxes of text beneath them take up to boxWidth.
+const (
+	minGraphWidth = 30
+	boxWidth      = 60
+)
+
+// graphWidth returns the width of each of the two graphs that sit side by side
+// in a terminal columns wide
+func graphWidth(columns int) int {
+	if columns/2 > minGraphWidth {
+		return columns / 2
+	}
+	return minGraphWidth
+}
+
+// textWidth returns the width of the boxes of text in a terminal columns wide.
+// They shrink with narrow terminals rather than run off the edge.
+func textWidth(columns int) int {
+	if columns > 0 && columns < boxWidth {
+		return columns
+	}
+	return boxWidth
+}
+
+// layout fits our widgets to a terminal columns wide.  Widgets that we haven't
+// built are left alone.
+func (sc *sparkyClient) layout(columns int) {
+	gw, tw := graphWidth(columns), textWidth(columns)
+
+	for _, name := range []string{"dlgraph", "histdl"} {
+		sc.wr.Place(name, 0, gw)
+	}
+	for _, name := range []string{"ulgraph", "histul"} {
+		sc.wr.Place(name, gw, gw)
+	}
+	for _, name := range []string{"reviewchart", "helpbox"} {
+		sc.wr.Place(name, 0, gw*2)
+	}
+	for _, name := range []string{"titlebox", "bannerbox", "statsSummary", "statusbox", "errorbox", "progress", "histsummary", "tcpstats", "route", "reviewstats", "helpoverlay"} {
+		sc.wr.Place(name, 0, tw)
+	}
+}
+
+// resize re-flows the screen after the terminal is resized to columns wide
+func (sc *sparkyClient) resize(columns int) {
+	sc.layout(columns)
+	if sc.tui != nil {
+		sc.tui.resize()
+	}
+	if sc.review != nil && sc.review.isShown() {
+		sc.updateReview()
+	}
+
+	// Anything drawn outside the widgets' new bounds would linger
+	sc.wr.Clear()
+	sc.wr.Render()
+}
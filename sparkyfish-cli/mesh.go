@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/freinold/sparkyfish"
+	"github.com/gizak/termui/v3"
+)
+
+// meshTest runs the test suite against several servers at once.  Each test
+// (ping, download, upload) starts against every server at the same time, so
+// that they share our link.  If they're all slow, the bottleneck is likely to
+// be our end of it.  If only some are, it's likely to be the path to them.
+type meshTest struct {
+	clients []*sparkyfish.Client
+	wr      renderer
+
+	mu      sync.Mutex
+	results []sparkyfish.Results
+	errs    []error
+	dlHist  [][]float64
+	ulHist  [][]float64
+}
+
+// runMesh runs a mesh test against clients, charting the servers together
+// unless headless is set.  The results are then added to hist and sent to
+// sinks, and printed as a comparison table if headless (or as JSON, with
+// jsonOutput).  It returns our exit status.
+func runMesh(ctx context.Context, cancel context.CancelFunc, clients []*sparkyfish.Client, hist *history, sinks sinkList, headless bool, jsonOutput bool) int {
+	mt := &meshTest{
+		clients: clients,
+		wr:      newRenderer(headless),
+		results: make([]sparkyfish.Results, len(clients)),
+		errs:    make([]error, len(clients)),
+		dlHist:  make([][]float64, len(clients)),
+		ulHist:  make([][]float64, len(clients)),
+	}
+	for i, client := range clients {
+		i := i
+		client.OnThroughput = func(s sparkyfish.Sample) {
+			mt.sample(i, s)
+		}
+		sinks.attach(client)
+	}
+	mt.buildWidgets()
+
+	var finished bool
+	if headless {
+		finished = mt.run(ctx)
+	} else {
+		// Logging redirects and retries would scribble over the screen
+		for _, client := range clients {
+			client.OnRedirect = nil
+			client.OnRetry = nil
+		}
+
+		scr, err := openScreen()
+		if err != nil {
+			panic(err)
+		}
+
+		for _, key := range []string{"q", "Q", "<C-c>"} {
+			scr.handle(key, func(termui.Event) {
+				cancel()
+				scr.stopLoop()
+			})
+		}
+
+		// The results stay on the screen until the user quits
+		mt.wr.Render()
+		done := make(chan bool, 1)
+		go func() {
+			done <- mt.run(ctx)
+		}()
+
+		scr.loop()
+		scr.close()
+		finished = <-done
+	}
+
+	if !finished {
+		fatal(exitAborted, "tests cancelled")
+	}
+
+	status := exitOK
+	var results []campaignResult
+	for i, client := range clients {
+		if mt.errs[i] != nil {
+			log.Printf("test run against %v failed: %v", client.Addr(), mt.errs[i])
+			results = append(results, campaignResult{Server: client.Addr(), Error: mt.errs[i].Error()})
+			status = exitAborted
+			continue
+		}
+
+		r := mt.results[i]
+		err := hist.add(r)
+		if err != nil {
+			log.Println("error recording results in history:", err)
+		}
+		sinks.results(r, true)
+
+		results = append(results, campaignResult{Server: r.Server, Results: &r})
+	}
+
+	switch {
+	case jsonOutput:
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(results)
+	case headless:
+		printComparison(os.Stdout, results)
+	}
+	return status
+}
+
+// run runs each test against all of our servers at once, waiting for them
+// all to finish before starting the next.  A server that fails a test drops
+// out of the rest.  It reports whether the tests ran to the end, rather than
+// being cancelled.
+func (mt *meshTest) run(ctx context.Context) bool {
+	retries := make([]int, len(mt.clients))
+	for i, client := range mt.clients {
+		mt.results[i] = sparkyfish.Results{Server: client.Addr(), StartTime: time.Now(), DSCP: client.DSCP, Compressible: client.Compressible, Tags: client.Tags, Note: client.Note}
+		retries[i] = client.RetryCount()
+	}
+
+	mt.runEach(ctx, "Testing latency...", func(client *sparkyfish.Client, r *sparkyfish.Results) error {
+		info, err := client.Hello(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to connect: %v", err)
+		}
+		r.Family = info.Family
+		r.Connect = &info.Timings
+		if client.CaptureEnvironment {
+			env := client.Environment(ctx, nil)
+			r.Environment = &env
+		}
+		r.Ping, err = client.RunPingTest(ctx)
+		return err
+	})
+
+	mt.runEach(ctx, "Testing download speed...", func(client *sparkyfish.Client, r *sparkyfish.Results) error {
+		var err error
+		switch {
+		case client.SkipDownload:
+			r.Download.Skipped = true
+		case client.UDP:
+			r.Download, err = client.RunUDPDownloadTest(ctx)
+		default:
+			r.Download, err = client.RunDownloadTest(ctx)
+		}
+		return err
+	})
+
+	mt.runEach(ctx, "Testing upload speed...", func(client *sparkyfish.Client, r *sparkyfish.Results) error {
+		var err error
+		switch {
+		case client.SkipUpload:
+			r.Upload.Skipped = true
+		case client.UDP:
+			r.Upload, err = client.RunUDPUploadTest(ctx)
+		default:
+			r.Upload, err = client.RunUploadTest(ctx)
+		}
+		r.EndTime = time.Now()
+		return err
+	})
+
+	mt.mu.Lock()
+	for i, client := range mt.clients {
+		mt.results[i].Retries = client.RetryCount() - retries[i]
+	}
+	mt.mu.Unlock()
+
+	if ctx.Err() != nil {
+		return false
+	}
+	mt.setStatus("Done")
+	return true
+}
+
+// runEach runs test against each of our servers that hasn't failed yet, all
+// at the same time, and waits for them to finish
+func (mt *meshTest) runEach(ctx context.Context, status string, test func(*sparkyfish.Client, *sparkyfish.Results) error) {
+	if ctx.Err() != nil {
+		return
+	}
+	mt.setStatus(status)
+
+	var wg sync.WaitGroup
+	for i, client := range mt.clients {
+		if mt.failed(i) {
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, client *sparkyfish.Client) {
+			defer wg.Done()
+
+			// The legend reads the results as the test goes, so the test
+			// fills in a copy of them
+			mt.mu.Lock()
+			r := mt.results[i]
+			mt.mu.Unlock()
+
+			err := test(client, &r)
+
+			mt.mu.Lock()
+			mt.results[i] = r
+			if err != nil {
+				mt.errs[i] = err
+			}
+			mt.updateLegend()
+			mt.mu.Unlock()
+			mt.wr.Render()
+		}(i, client)
+	}
+	wg.Wait()
+}
+
+func (mt *meshTest) failed(i int) bool {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	return mt.errs[i] != nil
+}
+
+// sample charts a throughput measurement from the server at index i
+func (mt *meshTest) sample(i int, s sparkyfish.Sample) {
+	mt.mu.Lock()
+	switch s.TestType {
+	case sparkyfish.Inbound, sparkyfish.UDPInbound:
+		mt.dlHist[i] = appendThroughput(mt.dlHist[i], s.Mbps)
+		mt.results[i].Download = s.Stats
+	case sparkyfish.Outbound, sparkyfish.UDPOutbound:
+		mt.ulHist[i] = appendThroughput(mt.ulHist[i], s.Mbps)
+		mt.results[i].Upload = s.Stats
+	}
+	mt.updateGraphs()
+	mt.updateLegend()
+	mt.mu.Unlock()
+
+	mt.wr.Render()
+}
+
+// updateGraphs charts every server's measurements, in the unit that suits
+// the fastest of them.  mt.mu must be held.
+func (mt *meshTest) updateGraphs() {
+	for _, g := range []struct {
+		name, label string
+		hists       [][]float64
+	}{{"dlgraph", "Download", mt.dlHist}, {"ulgraph", "Upload", mt.ulHist}} {
+		u := unitFor(maxOf(g.hists...))
+		scaled := make([][]float64, len(g.hists))
+		for i, hist := range g.hists {
+			scaled[i] = u.scale(hist)
+		}
+		mt.wr.SetData(g.name, scaled...)
+		mt.wr.SetTitle(g.name, fmt.Sprintf(" %v Speed (%v) ", g.label, u.name))
+	}
+}
+
+func (mt *meshTest) setStatus(status string) {
+	mt.wr.SetText("bannerbox", status)
+	mt.wr.Render()
+}
+
+// updateLegend shows each server's color and its latest stats.  mt.mu must
+// be held.
+func (mt *meshTest) updateLegend() {
+	var lines []string
+	for i, client := range mt.clients {
+		_, markup := seriesColor(i)
+		line := fmt.Sprintf("[■](%v) %v  ", markup, client.Addr())
+
+		r := mt.results[i]
+		switch {
+		case mt.errs[i] != nil:
+			line += "failed: " + mt.errs[i].Error()
+		case r.Ping.Probes == 0:
+			line += "--"
+		default:
+			line += fmt.Sprintf("ping %.2f ms  down %v  up %v", r.Ping.Avg, legendThroughput(r.Download), legendThroughput(r.Upload))
+		}
+		lines = append(lines, line)
+	}
+	mt.wr.SetText("legend", strings.Join(lines, "\n"))
+}
+
+// legendThroughput renders the average throughput so far for the legend
+func legendThroughput(tr sparkyfish.ThroughputResult) string {
+	switch {
+	case tr.Skipped:
+		return "skipped"
+	case tr.Avg == 0:
+		return "--"
+	}
+	return formatRate(tr.Avg)
+}
+
+// buildWidgets builds the widgets on the mesh test's screen
+func (mt *meshTest) buildWidgets() {
+	titleBox := newTextBox("──────[ sparkyfish ]────────────────────────────────────────", colors.text, 0, 0, 60, 1)
+	borderless(&titleBox.Block)
+
+	bannerBox := newTextBox("", colors.banner, 0, 1, 60, 1)
+	borderless(&bannerBox.Block)
+
+	var styles []termui.Style
+	for i := range mt.clients {
+		style, _ := seriesColor(i)
+		styles = append(styles, style)
+	}
+
+	dlGraph := newLineChart(styles...)
+	dlGraph.Title = fmt.Sprintf(" Download Speed (%v) ", unitFor(0).name)
+	dlGraph.SetRect(0, 2, 60, 12)
+
+	ulGraph := newLineChart(styles...)
+	ulGraph.Title = fmt.Sprintf(" Upload Speed (%v) ", unitFor(0).name)
+	ulGraph.SetRect(0, 12, 60, 22)
+
+	legend := newTextBox("", colors.text, 0, 22, 60, len(mt.clients)+2)
+	legend.Title = " Servers "
+
+	helpBox := newHelpBar(" COMMANDS: [q]uit", 22+len(mt.clients)+2)
+
+	mt.wr.Add("titlebox", titleBox)
+	mt.wr.Add("bannerbox", bannerBox)
+	mt.wr.Add("dlgraph", dlGraph)
+	mt.wr.Add("ulgraph", ulGraph)
+	mt.wr.Add("legend", legend)
+	mt.wr.Add("helpbox", helpBox)
+
+	mt.updateLegend()
+}
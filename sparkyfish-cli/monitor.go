@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/freinold/sparkyfish"
+	"github.com/gizak/termui/v3"
+	"github.com/gizak/termui/v3/widgets"
+)
+
+// monitorWindow is the number of recent probes charted by the latency monitor
+const monitorWindow = 58
+
+// runMonitor sends a ping to client's server every interval until ctx is
+// cancelled.  Without the terminal UI, each probe is streamed to stdout as
+// CSV (or JSON, with jsonOutput).  cancel is called if the user quits the UI.
+// Lost probes are counted rather than returned, so any error that it returns
+// is from our first connection, and a connectError.
+func runMonitor(ctx context.Context, cancel context.CancelFunc, client *sparkyfish.Client, interval time.Duration, headless bool, jsonOutput bool) error {
+	if headless {
+		return streamLatency(ctx, client, interval, os.Stdout, jsonOutput)
+	}
+
+	// Logging redirects and retries would scribble over the screen
+	client.OnRedirect = nil
+	client.OnRetry = nil
+
+	scr, err := openScreen()
+	if err != nil {
+		return err
+	}
+	defer scr.close()
+
+	for _, key := range []string{"q", "Q", "<C-c>"} {
+		scr.handle(key, func(termui.Event) {
+			cancel()
+		})
+	}
+
+	wr := newRenderer(false)
+	buildMonitorWidgets(wr, fmt.Sprintf("Pinging %v every %v", client.Addr(), interval))
+	wr.Render()
+
+	var stats latencyStats
+	go func() {
+		err = client.MonitorLatency(ctx, interval, func(lp sparkyfish.LatencyProbe) {
+			stats.add(lp)
+			wr.SetData("rttgraph", stats.recent)
+			wr.SetText("rttstats", stats.text())
+			wr.Render()
+		})
+		scr.stopLoop()
+	}()
+
+	scr.loop()
+
+	if ctx.Err() != nil || err == nil {
+		return nil
+	}
+	return connectError{fmt.Errorf("unable to connect to %v: %v", client.Addr(), err)}
+}
+
+// streamLatency writes the outcome of each probe to w as it comes in
+func streamLatency(ctx context.Context, client *sparkyfish.Client, interval time.Duration, w io.Writer, jsonOutput bool) error {
+	var onProbe func(sparkyfish.LatencyProbe)
+
+	if jsonOutput {
+		enc := json.NewEncoder(w)
+		onProbe = func(lp sparkyfish.LatencyProbe) {
+			enc.Encode(newProbeRecord(lp))
+		}
+	} else {
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"time", "seq", "rtt_ms", "lost", "losses"})
+		cw.Flush()
+		onProbe = func(lp sparkyfish.LatencyProbe) {
+			rtt := ""
+			if !lp.Lost {
+				rtt = strconv.FormatFloat(msec(lp.RTT), 'f', 3, 64)
+			}
+			cw.Write([]string{lp.Time.Format(time.RFC3339Nano), strconv.Itoa(lp.Seq), rtt,
+				strconv.FormatBool(lp.Lost), strconv.Itoa(lp.Losses)})
+			cw.Flush()
+		}
+	}
+
+	err := client.MonitorLatency(ctx, interval, onProbe)
+	if ctx.Err() != nil || err == nil {
+		return nil
+	}
+	return connectError{fmt.Errorf("unable to connect to %v: %v", client.Addr(), err)}
+}
+
+// probeRecord is the JSON form of a sparkyfish.LatencyProbe
+type probeRecord struct {
+	Time   time.Time `json:"time"`
+	Seq    int       `json:"seq"`
+	RTT    float64   `json:"rtt_ms,omitempty"`
+	Lost   bool      `json:"lost"`
+	Losses int       `json:"losses"`
+	Error  string    `json:"error,omitempty"`
+}
+
+func newProbeRecord(lp sparkyfish.LatencyProbe) probeRecord {
+	pr := probeRecord{Time: lp.Time, Seq: lp.Seq, RTT: msec(lp.RTT), Lost: lp.Lost, Losses: lp.Losses}
+	if lp.Err != nil {
+		pr.Error = lp.Err.Error()
+	}
+	return pr
+}
+
+// latencyStats keeps running stats for the latency monitor
+type latencyStats struct {
+	sent, received int
+	losses         int
+	current        time.Duration
+	min, max, sum  time.Duration
+	jitterSum      time.Duration
+	lastLoss       sparkyfish.LatencyProbe
+
+	// recent holds the round-trip times (in microseconds) of the last
+	// monitorWindow probes.  Lost probes are charted as zero.
+	recent []float64
+}
+
+// add updates our stats with the outcome of a probe
+func (ls *latencyStats) add(lp sparkyfish.LatencyProbe) {
+	ls.sent = lp.Seq
+	ls.losses = lp.Losses
+
+	if len(ls.recent) >= monitorWindow {
+		ls.recent = ls.recent[1:]
+	}
+
+	if lp.Lost {
+		ls.lastLoss = lp
+		ls.recent = append(ls.recent, 0)
+		return
+	}
+	ls.recent = append(ls.recent, float64(lp.RTT.Nanoseconds()/1000))
+
+	if ls.received > 0 {
+		diff := lp.RTT - ls.current
+		if diff < 0 {
+			diff = -diff
+		}
+		ls.jitterSum += diff
+	}
+	if ls.received == 0 || lp.RTT < ls.min {
+		ls.min = lp.RTT
+	}
+	if lp.RTT > ls.max {
+		ls.max = lp.RTT
+	}
+	ls.current = lp.RTT
+	ls.sum += lp.RTT
+	ls.received++
+}
+
+// text renders our stats for the monitor's stats widget
+func (ls *latencyStats) text() string {
+	var avg, jitter time.Duration
+	if ls.received > 0 {
+		avg = ls.sum / time.Duration(ls.received)
+	}
+	if ls.received > 1 {
+		jitter = ls.jitterSum / time.Duration(ls.received-1)
+	}
+
+	var lossPct float64
+	if ls.sent > 0 {
+		lossPct = float64(ls.losses) / float64(ls.sent) * 100
+	}
+
+	text := fmt.Sprintf("Current: %.2f ms\nMin/Avg/Max: %.2f/%.2f/%.2f ms\nJitter: %.2f ms\nSent: %v  Lost: %v (%.1f%%)",
+		msec(ls.current), msec(ls.min), msec(avg), msec(ls.max), msec(jitter), ls.sent, ls.losses, lossPct)
+	if ls.losses > 0 {
+		text += fmt.Sprintf("\nLast loss: %v (%v)", ls.lastLoss.Time.Format("15:04:05"), ls.lastLoss.Err)
+	}
+	return text
+}
+
+// msec converts d to fractional milliseconds
+func msec(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// buildMonitorWidgets builds the widgets for the latency monitor's screen
+func buildMonitorWidgets(wr renderer, banner string) {
+	titleBox := newTextBox("──────[ sparkyfish ]────────────────────────────────────────", colors.text, 0, 0, 60, 1)
+	borderless(&titleBox.Block)
+
+	bannerBox := newTextBox(banner, colors.banner, 0, 1, 60, 1)
+	borderless(&bannerBox.Block)
+
+	rttGraph := widgets.NewSparkline()
+	rttGraph.LineColor = colors.latency.Fg
+	rttGraph.Data = []float64{0}
+
+	rttGroup := widgets.NewSparklineGroup(rttGraph)
+	rttGroup.Title = " Round-Trip Time "
+	rttGroup.SetRect(0, 2, 60, 14)
+
+	rttStats := newTextBox("Waiting for the first probe...", colors.text, 0, 14, 60, 7)
+	rttStats.Title = " Latency "
+
+	helpBox := newHelpBar(" COMMANDS: [q]uit", 21)
+
+	wr.Add("titlebox", titleBox)
+	wr.Add("bannerbox", bannerBox)
+	wr.Add("rttgraph", rttGroup)
+	wr.Add("rttstats", rttStats)
+	wr.Add("helpbox", helpBox)
+}
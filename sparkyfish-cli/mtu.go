@@ -0,0 +1,12 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/freinold/sparkyfish"
+)
+
+// mtuText describes the path MTU, e.g. "1420 bytes (link: 1500)"
+func mtuText(mr sparkyfish.MTUResult) string {
+	return fmt.Sprintf("%v bytes (link: %v)", mr.MTU, mr.LinkMTU)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/freinold/sparkyfish"
+)
+
+// plainEvery is how often a plainSink reports the throughput.  Screen readers
+// read out every line, so it's kept well apart from our report interval.
+const plainEvery = 2 * time.Second
+
+// plainSink reports the progress of the tests as lines of text, e.g.
+// "DL 94.2 Mbit/s avg 89.1", for screen readers and braille displays, which
+// can't make anything of the charts
+type plainSink struct {
+	w io.Writer
+
+	mu   sync.Mutex
+	last map[string]time.Time // when we last reported each direction
+}
+
+func newPlainSink(w io.Writer) *plainSink {
+	return &plainSink{w: w, last: make(map[string]time.Time)}
+}
+
+// pinging announces the ping test
+func (ps *plainSink) pinging(server string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.last = make(map[string]time.Time)
+	fmt.Fprintf(ps.w, "Testing latency to %v\n", server)
+}
+
+// pinged reports the results of the ping test
+func (ps *plainSink) pinged(p sparkyfish.PingResult) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	fmt.Fprintf(ps.w, "Latency %.2f ms avg, min %.2f, max %.2f, jitter %.2f ms\n", p.Avg, p.Min, p.Max, p.Jitter)
+}
+
+func (ps *plainSink) sample(server string, s sparkyfish.Sample) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	// Announce each test as its first measurement comes in
+	direction := sampleDirection(s)
+	last, ok := ps.last[direction]
+	if !ok {
+		fmt.Fprintf(ps.w, "Testing %v speed\n", direction)
+	}
+	if time.Since(last) < plainEvery {
+		return
+	}
+	ps.last[direction] = time.Now()
+
+	name := "DL"
+	if direction == "upload" {
+		name = "UL"
+	}
+	// There's no average until the warm-up is over
+	u := unitFor(maxOf([]float64{s.Mbps, s.Stats.Max}))
+	if s.WarmUp {
+		fmt.Fprintf(ps.w, "%v %v (warming up)\n", name, u.format(s.Mbps))
+		return
+	}
+	fmt.Fprintf(ps.w, "%v %v avg %v\n", name, u.format(s.Mbps), u.number(s.Stats.Avg))
+}
+
+// results marks the end of the tests.  The summary that follows says how
+// they went.
+func (ps *plainSink) results(r sparkyfish.Results) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	_, err := fmt.Fprintln(ps.w, "Done")
+	return err
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/freinold/sparkyfish/internal/profiling"
+)
+
+// servePprof serves Go's profiles and runtime metrics on listenAddr, for
+// looking into how a long-running daemon performs, until ctx is done.  It
+// only returns an error if it can't listen.
+func servePprof(ctx context.Context, listenAddr string) error {
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: profiling.Handler(), ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		err := srv.Serve(listener)
+		if err != http.ErrServerClosed {
+			log.Println("error serving profiles:", err)
+		}
+	}()
+	return nil
+}
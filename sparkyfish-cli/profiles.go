@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/freinold/sparkyfish/internal/config"
+)
+
+// defaultConfigPath returns where we look for a config file when -config
+// isn't given
+func defaultConfigPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "sparkyfish", "config.yaml")
+}
+
+// profileKeys are the settings in a profile that aren't flags.  A profile
+// names its server either with server, or with host, port and tls.
+var profileKeys = []string{"server", "host", "port", "tls"}
+
+// profiles returns the names of the server profiles in cfg, in order
+func profiles(cfg *config.Config) []string {
+	var names []string
+	if sec := cfg.Sections["profiles"]; sec != nil {
+		for name := range sec.Sections {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// profile returns the server profile in cfg called name.  Profiles live in the
+// profiles section of the config file, e.g.
+//
+//	profiles:
+//	  home:
+//	    server: 192.168.1.10
+//	  work-vpn:
+//	    host: speedtest.corp.example.com
+//	    tls: true
+//	    token: s3cret
+//	    interface: tun0
+//
+// Other than the server, each key sets the flag with the same name, like
+// the top-level settings do.
+func profile(cfg *config.Config, name string) (*config.Config, error) {
+	var p *config.Config
+	if sec := cfg.Sections["profiles"]; sec != nil {
+		p = sec.Sections[name]
+	}
+	if p == nil {
+		if names := profiles(cfg); len(names) > 0 {
+			return nil, fmt.Errorf("no profile named %v (try %v)", name, strings.Join(names, ", "))
+		}
+		return nil, fmt.Errorf("no profile named %v", name)
+	}
+	return p, nil
+}
+
+// profileServer returns the address of the server that profile p tests
+// against, or "" if it doesn't name one.  With tls set, the tests run over
+// WebSocket with TLS.
+func profileServer(p *config.Config) (string, error) {
+	host, port := p.Values["host"], p.Values["port"]
+
+	useTLS := false
+	if v := p.Values["tls"]; v != "" {
+		var err error
+		useTLS, err = strconv.ParseBool(config.YAMLBool(v))
+		if err != nil {
+			return "", fmt.Errorf("invalid tls: %v", v)
+		}
+	}
+
+	if host == "" {
+		if port != "" || useTLS {
+			return "", fmt.Errorf("port and tls need a host")
+		}
+		return p.Values["server"], nil
+	}
+	if p.Values["server"] != "" {
+		return "", fmt.Errorf("set either server or host, not both")
+	}
+
+	addr := host
+	if port != "" {
+		addr = net.JoinHostPort(host, port)
+	}
+	if useTLS {
+		addr = "wss://" + addr
+	}
+	return addr, nil
+}
+
+// chooseProfile asks the user which of the profiles in cfg to use
+func chooseProfile(cfg *config.Config) (string, error) {
+	names := profiles(cfg)
+
+	var choices []string
+	for _, name := range names {
+		server, _ := profileServer(cfg.Sections["profiles"].Sections[name])
+		choices = append(choices, fmt.Sprintf("%-12v %v", name, server))
+	}
+
+	i, err := choose("Use which profile?", choices)
+	if err != nil {
+		return "", fmt.Errorf("no profile chosen")
+	}
+	return names[i], nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/freinold/sparkyfish"
+)
+
+// exporter serves the results of our most recent test run in the Prometheus
+// text exposition format
+type exporter struct {
+	mu       sync.Mutex
+	server   string
+	last     *sparkyfish.Results
+	runs     uint64
+	failures uint64
+	history  *history
+	sinks    sinkList
+}
+
+// runExporter runs the full test suite against client every interval and
+// serves the results on /metrics on listener.  Each result is also added to
+// hist and sent to sinks.  It returns when ctx is cancelled or the HTTP server
+// fails.
+func runExporter(ctx context.Context, client *sparkyfish.Client, listener net.Listener, interval time.Duration, hist *history, sinks sinkList) error {
+	e := &exporter{server: client.Addr(), history: hist, sinks: sinks}
+
+	go runEvery(ctx, interval, func() {
+		e.run(ctx, client)
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", e)
+	srv := &http.Server{Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	log.Printf("Serving metrics on %v/metrics, testing %v every %v", listener.Addr(), e.server, interval)
+
+	err := srv.Serve(listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// run performs a single test run and records the outcome
+func (e *exporter) run(ctx context.Context, client *sparkyfish.Client) {
+	r, err := client.Run(ctx)
+	if ctx.Err() != nil {
+		return
+	}
+	if err == nil {
+		e.sinks.results(r, true)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.runs++
+	if err != nil {
+		log.Println("test run failed:", err)
+		e.failures++
+		return
+	}
+
+	e.last = &r
+
+	err = e.history.add(r)
+	if err != nil {
+		log.Println("error recording results in history:", err)
+	}
+}
+
+func (e *exporter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	labels := fmt.Sprintf("{server=%q}", e.server)
+
+	metric := func(name, kind, help string, value interface{}) {
+		fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n%v%v %v\n", name, help, name, kind, name, labels, value)
+	}
+
+	metric("sparkyfish_tests_total", "counter", "Number of test runs attempted.", e.runs)
+	metric("sparkyfish_test_failures_total", "counter", "Number of test runs that failed.", e.failures)
+
+	// Until a test run succeeds, there's nothing else to report
+	if e.last == nil {
+		return
+	}
+
+	writeMetrics(w, labels, *e.last)
+}
+
+// writeMetrics writes the results of a test run to w in the Prometheus text
+// exposition format, with labels on each sample
+func writeMetrics(w io.Writer, labels string, r sparkyfish.Results) {
+	metric := func(name, kind, help string, value interface{}) {
+		fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n%v%v %v\n", name, help, name, kind, name, labels, value)
+	}
+
+	metric("sparkyfish_last_success_timestamp_seconds", "gauge", "Time that the last successful test run finished.", r.EndTime.Unix())
+	if !r.Download.Skipped {
+		metric("sparkyfish_download_mbps", "gauge", "Average download throughput in the last successful test run.", r.Download.Avg)
+		metric("sparkyfish_download_max_mbps", "gauge", "Maximum download throughput in the last successful test run.", r.Download.Max)
+	}
+	if !r.Upload.Skipped {
+		metric("sparkyfish_upload_mbps", "gauge", "Average upload throughput in the last successful test run.", r.Upload.Avg)
+		metric("sparkyfish_upload_max_mbps", "gauge", "Maximum upload throughput in the last successful test run.", r.Upload.Max)
+	}
+	metric("sparkyfish_ping_ms", "gauge", "Average latency in the last successful test run.", r.Ping.Avg)
+	metric("sparkyfish_jitter_ms", "gauge", "Latency jitter in the last successful test run.", r.Ping.Jitter)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/freinold/sparkyfish"
+)
+
+// pushgatewaySink pushes the results of each test run to a Prometheus
+// Pushgateway, grouped by job and server.  Each push replaces the metrics
+// from the server's last run.
+type pushgatewaySink struct {
+	addr   string
+	client *http.Client
+}
+
+// newPushgatewaySink creates a pushgatewaySink that pushes to the
+// Pushgateway at addr, e.g. "http://localhost:9091"
+func newPushgatewaySink(addr string) (*pushgatewaySink, error) {
+	u, err := url.Parse(addr)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid Pushgateway URL: %v", addr)
+	}
+
+	return &pushgatewaySink{
+		addr:   strings.TrimSuffix(addr, "/"),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (ps *pushgatewaySink) sample(server string, s sparkyfish.Sample) {}
+
+func (ps *pushgatewaySink) results(r sparkyfish.Results) error {
+	// The server goes in the grouping key rather than in a label.  It's
+	// base64 encoded as it may contain slashes, e.g. in WebSocket URLs.
+	pushURL := ps.addr + "/metrics/job/sparkyfish/server@base64/" + base64.RawURLEncoding.EncodeToString([]byte(r.Server))
+
+	var body bytes.Buffer
+	writeMetrics(&body, "", r)
+
+	return deliver(ps.client, "PUT", pushURL, "text/plain; version=0.0.4", body.String(), "the Pushgateway")
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/freinold/sparkyfish"
+)
+
+// rampScaling is how much faster the last step of a ramp test has to be than
+// the first for us to put it down to per-flow limiting
+const rampScaling = 1.5
+
+// runRamp runs a ramp test against client, stepping through
+// sparkyfish.DefaultRampSteps, and prints the throughput at each step, or a
+// JSON array of the steps with jsonOutput.  It returns our exit status.
+func runRamp(ctx context.Context, client *sparkyfish.Client, jsonOutput bool) int {
+	_, err := client.Hello(ctx)
+	if ctx.Err() != nil {
+		fatal(exitAborted, "tests cancelled")
+	}
+	if err != nil {
+		fatal(exitConnectFailed, "unable to connect:", err)
+	}
+
+	// Run the steps one at a time, so that we can say how far along we are
+	var steps []sparkyfish.RampStep
+	for _, n := range sparkyfish.DefaultRampSteps {
+		log.Printf("Testing %v over %v stream(s)", client.Addr(), n)
+
+		step, err := client.RunRampTest(ctx, []int{n})
+		if ctx.Err() != nil {
+			fatal(exitAborted, "tests cancelled")
+		}
+		if err != nil {
+			fatal(exitAborted, err)
+		}
+		steps = append(steps, step...)
+	}
+
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(steps)
+	} else {
+		printRamp(os.Stdout, steps)
+	}
+	return exitOK
+}
+
+// printRamp writes a table of the throughput at each step of a ramp test to
+// w, followed by what we make of it
+func printRamp(w io.Writer, steps []sparkyfish.RampStep) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STREAMS\tDOWNLOAD (Mbit/s)\tUPLOAD (Mbit/s)")
+	for _, step := range steps {
+		fmt.Fprintf(tw, "%v\t%v\t%v\n", step.Streams, comparisonThroughput(step.Download), comparisonThroughput(step.Upload))
+	}
+	tw.Flush()
+
+	if len(steps) < 2 {
+		return
+	}
+	first, last := steps[0], steps[len(steps)-1]
+	var verdicts []string
+	if v := rampVerdict("Download", first.Download, last.Download, last.Streams); v != "" {
+		verdicts = append(verdicts, v)
+	}
+	if v := rampVerdict("Upload", first.Upload, last.Upload, last.Streams); v != "" {
+		verdicts = append(verdicts, v)
+	}
+	if len(verdicts) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, strings.Join(verdicts, "\n"))
+	}
+}
+
+// rampVerdict compares the throughput of a single stream, first, with that of
+// the most streams that we tried, last
+func rampVerdict(direction string, first, last sparkyfish.ThroughputResult, streams int) string {
+	if first.Skipped || last.Skipped || first.Avg == 0 {
+		return ""
+	}
+
+	gain := last.Avg / first.Avg
+	if gain >= rampScaling {
+		return fmt.Sprintf("%v: %v streams ran %.1fx as fast as one, so something along the path is probably limiting each flow.", direction, streams, gain)
+	}
+	return fmt.Sprintf("%v: %v streams ran about as fast as one (%.1fx), so the link's total capacity is probably the limit.", direction, streams, gain)
+}
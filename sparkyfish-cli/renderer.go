@@ -0,0 +1,69 @@
+package main
+
+import (
+	"github.com/gizak/termui/v3"
+)
+
+// renderer keeps the widgets on our screens, by name, and draws them.  The
+// rest of the client updates the widgets through it, rather than reaching
+// into them, so that it doesn't have to know what draws them, and so that an
+// update never races with drawing the widget.  Setters that don't apply to a
+// widget, or that name one that we don't have, do nothing.
+type renderer interface {
+	// Add adds a widget, in place of any that was called name
+	Add(name string, w termui.Drawable)
+	Delete(name string)
+
+	// Hide stops a widget from being drawn until it's shown again
+	Hide(name string)
+	// Show draws a widget that was previously hidden
+	Show(name string)
+	// Raise draws a widget over all of the others, e.g. an overlay
+	Raise(name string)
+	// Place moves a widget to column x and makes it width columns wide
+	Place(name string, x, width int)
+
+	// Text returns the text of a box of text
+	Text(name string) string
+	SetText(name, text string)
+	// SetTitle sets the title on a widget's border
+	SetTitle(name, title string)
+
+	// SetData charts series, in order, on a chart, or on a sparkline
+	SetData(name string, series ...[]float64)
+	// SetLabels labels the points along the time axis of a chart
+	SetLabels(name string, labels []string)
+	// Mark marks the time axis of a chart with marks, in place of any that
+	// it had
+	Mark(name string, marks []chartMark)
+	// Points returns the number of points that fit across a chart
+	Points(name string) int
+
+	SetPercent(name string, percent int)
+	// SetBarStyle sets the style that a progress bar fills up in
+	SetBarStyle(name string, style termui.Style)
+
+	// Clear clears the screen, so that the next Render leaves nothing
+	// behind from widgets that have been hidden or moved
+	Clear()
+	Render()
+}
+
+// newRenderer creates a renderer.  A headless renderer keeps track of its
+// widgets but never draws them to the screen.
+func newRenderer(headless bool) renderer {
+	wr := newwidgetRenderer()
+	if headless {
+		return headlessRenderer{wr}
+	}
+	return wr
+}
+
+// headlessRenderer keeps our widgets up to date without a screen to draw
+// them on
+type headlessRenderer struct {
+	*widgetRenderer
+}
+
+func (headlessRenderer) Clear()  {}
+func (headlessRenderer) Render() {}
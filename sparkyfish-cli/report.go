@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/freinold/sparkyfish"
+)
+
+// The size of the charts in our reports, and the margins inside them that
+// hold the axes' labels
+const (
+	reportChartWidth  = 720
+	reportChartHeight = 220
+	reportMarginLeft  = 64
+	reportMarginRight = 16
+	reportMarginTop   = 16
+	reportMarginBot   = 36
+)
+
+// The colors of our charts' series
+const (
+	reportDownloadColor = "#1f77b4"
+	reportUploadColor   = "#d95f02"
+	reportLatencyColor  = "#0e7c86"
+)
+
+// reportRow is a row of one of a report's tables
+type reportRow struct {
+	Name, Value string
+}
+
+// reportSection is a table, and perhaps a chart, in a report
+type reportSection struct {
+	Title string
+	Chart template.HTML
+	Rows  []reportRow
+}
+
+// report is what reportTemplate draws
+type report struct {
+	Title     string
+	Generated string
+	Details   []reportRow
+	Sections  []reportSection
+}
+
+// writeReport writes a standalone HTML report of the test run with results
+// r to path: charts of every measurement (dl and ul, in Mbit/s, taken every
+// interval, and pings, in ms), tables of their stats, and details of the run,
+// so that it can be attached to e.g. a support ticket as it is
+func writeReport(path string, r sparkyfish.Results, dl, ul, pings []float64, interval time.Duration) error {
+	if interval == 0 {
+		interval = sparkyfish.DefaultReportInterval
+	}
+
+	rep := report{
+		Title:     fmt.Sprintf("sparkyfish results for %v", r.Server),
+		Generated: fmt.Sprintf("sparkyfish-cli %v, %v", sparkyfish.Version, time.Now().Format(time.RFC1123)),
+		Details:   reportDetails(r),
+	}
+
+	rep.Sections = append(rep.Sections, reportSection{
+		Title: "Latency",
+		Chart: svgChart(pings, 1, "ping", "ms", reportLatencyColor),
+		Rows: []reportRow{
+			{"Pings answered", fmt.Sprintf("%v", r.Ping.Probes)},
+			{"Min / Avg / Max", fmt.Sprintf("%.2f / %.2f / %.2f ms", r.Ping.Min, r.Ping.Avg, r.Ping.Max)},
+			{"Jitter", fmt.Sprintf("%.2f ms", r.Ping.Jitter)},
+			{"Standard deviation", fmt.Sprintf("%.2f ms", r.Ping.StdDev)},
+		},
+	})
+	for _, t := range []struct {
+		name, color string
+		data        []float64
+		tr          sparkyfish.ThroughputResult
+	}{{"Download", reportDownloadColor, dl, r.Download}, {"Upload", reportUploadColor, ul, r.Upload}} {
+		section := reportSection{Title: t.name, Rows: reportThroughputRows(t.tr)}
+		if !t.tr.Skipped {
+			section.Chart = svgChart(t.data, interval.Seconds(), "seconds", "Mbit/s", t.color)
+		}
+		rep.Sections = append(rep.Sections, section)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error writing the report to %v: %v", path, err)
+	}
+	defer f.Close()
+
+	err = reportTemplate.Execute(f, rep)
+	if err != nil {
+		return fmt.Errorf("error writing the report to %v: %v", path, err)
+	}
+	return f.Close()
+}
+
+// reportDetails describes how the run with results r went about its tests
+func reportDetails(r sparkyfish.Results) []reportRow {
+	rows := []reportRow{
+		{"Server", r.Server},
+		{"Address family", r.Family},
+		{"Started", r.StartTime.Format(time.RFC1123)},
+		{"Finished", r.EndTime.Format(time.RFC1123)},
+	}
+	if r.Status != nil {
+		rows = append(rows, reportRow{"Server version", fmt.Sprintf("%v (protocol %v)", r.Status.Version, r.Status.Protocol)})
+		if r.Status.ServerLocation != nil {
+			rows = append(rows, reportRow{"Server location", r.Status.ServerLocation.String()})
+		}
+		if r.Status.ClientLocation != nil {
+			rows = append(rows, reportRow{"Your location", r.Status.ClientLocation.String()})
+		}
+	}
+
+	tests := "Download, then upload"
+	if r.Bidirectional {
+		tests = "Download and upload at once"
+	}
+	if r.Download.Datagrams != nil || r.Upload.Datagrams != nil {
+		tests += ", over UDP"
+	}
+	rows = append(rows, reportRow{"Tests", tests})
+	if r.Streams > 1 {
+		rows = append(rows, reportRow{"Streams", fmt.Sprintf("%v", r.Streams)})
+	}
+	if r.DSCP != 0 {
+		rows = append(rows, reportRow{"DSCP", sparkyfish.DSCPName(r.DSCP)})
+	}
+	if r.Compressible {
+		rows = append(rows, reportRow{"Data", "Compressible"})
+	}
+	if len(r.Tags) > 0 {
+		rows = append(rows, reportRow{"Tags", strings.Join(r.Tags, ", ")})
+	}
+	if r.Note != "" {
+		rows = append(rows, reportRow{"Note", r.Note})
+	}
+	if env := r.Environment; env != nil {
+		rows = append(rows,
+			reportRow{"Host", fmt.Sprintf("%v (%v)", env.Hostname, env.OS)},
+			reportRow{"Connection", env.Connection()})
+		if env.Gateway != "" {
+			rows = append(rows, reportRow{"Gateway", env.Gateway})
+		}
+	}
+	if from := testingFromText(r.Status); from != "" {
+		rows = append(rows, reportRow{"Testing from", from})
+	}
+	if r.MTU != nil {
+		rows = append(rows, reportRow{"Path MTU", mtuText(*r.MTU)})
+		for _, warning := range r.MTU.Warnings() {
+			rows = append(rows, reportRow{"Warning", warning})
+		}
+	}
+	if r.Connect != nil {
+		rows = append(rows, reportRow{"Connected in", connectText(*r.Connect)})
+	}
+	if r.DNS != nil {
+		rows = append(rows, reportRow{"DNS lookup", dnsSettingsText(*r.DNS)})
+	}
+	if r.Retries > 0 {
+		rows = append(rows, reportRow{"Retries", strconv.Itoa(r.Retries)})
+	}
+	return rows
+}
+
+// reportThroughputRows tabulates the stats of a throughput test
+func reportThroughputRows(tr sparkyfish.ThroughputResult) []reportRow {
+	if tr.Skipped {
+		return []reportRow{{"Skipped", "This test wasn't run"}}
+	}
+
+	mbps := func(v float64) string {
+		return fmt.Sprintf("%.1f Mbit/s", v)
+	}
+	rows := []reportRow{
+		{"Average", mbps(tr.Avg)},
+		{"Maximum", mbps(tr.Max)},
+		{"Median", mbps(tr.Median)},
+		{"5th / 95th percentile", fmt.Sprintf("%.1f / %.1f Mbit/s", tr.P5, tr.P95)},
+		{"Standard deviation", mbps(tr.StdDev)},
+		{"Average, including the warm-up", mbps(tr.RawAvg)},
+		{"Data transferred", formatBytes(tr.Bytes)},
+	}
+	if d := tr.Datagrams; d != nil {
+		rows = append(rows, reportRow{"Datagrams lost", fmt.Sprintf("%.2f%% of %v", d.LossPercent, d.Sent)})
+	}
+	if ts := tr.TCP; ts != nil {
+		rows = append(rows,
+			reportRow{"TCP round-trip time", fmt.Sprintf("%.2f ms (variance %.2f)", ts.RTT, ts.RTTVar)},
+			reportRow{"TCP retransmits", fmt.Sprintf("%v", ts.Retransmits)})
+	}
+	if tr.CappedBy != nil {
+		rows = append(rows, reportRow{"Cut short", cappedText(tr.CappedBy)})
+	}
+	if tr.Stopped != "" && tr.Stopped != sparkyfish.StopServerCap {
+		rows = append(rows, reportRow{"Stopped early", tr.Stopped.String()})
+	}
+	if len(tr.Stalls) > 0 {
+		rows = append(rows, reportRow{"Stalls", stallsSummaryText(tr.Stalls)})
+	}
+	if len(tr.Events) > 0 {
+		rows = append(rows, reportRow{"Events", eventsSummaryText(tr.Events)})
+	}
+	return rows
+}
+
+// svgChart draws data as a line chart in SVG, in color.  Each point is step
+// apart on the x axis.  The axes are captioned xLabel and yLabel.
+func svgChart(data []float64, step float64, xLabel, yLabel, color string) template.HTML {
+	const (
+		plotWidth  = reportChartWidth - reportMarginLeft - reportMarginRight
+		plotHeight = reportChartHeight - reportMarginTop - reportMarginBot
+	)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%v" height="%v" viewBox="0 0 %[1]v %[2]v" role="img">`,
+		reportChartWidth, reportChartHeight)
+	if len(data) == 0 {
+		fmt.Fprintf(&b, `<text x="%v" y="%v" text-anchor="middle">No measurements</text></svg>`, reportChartWidth/2, reportChartHeight/2)
+		return template.HTML(b.String())
+	}
+
+	top := niceCeil(maxOf(data))
+	x := func(i float64) float64 {
+		if len(data) == 1 {
+			return reportMarginLeft
+		}
+		return reportMarginLeft + i/float64(len(data)-1)*plotWidth
+	}
+	y := func(v float64) float64 {
+		return reportMarginTop + plotHeight - v/top*plotHeight
+	}
+
+	// Gridlines, with the y axis's labels
+	for i := 0; i <= 4; i++ {
+		v := top * float64(i) / 4
+		fmt.Fprintf(&b, `<line x1="%v" y1="%.1f" x2="%v" y2="%.1f" stroke="#ddd"/>`, reportMarginLeft, y(v), reportMarginLeft+plotWidth, y(v))
+		fmt.Fprintf(&b, `<text x="%v" y="%.1f" text-anchor="end" font-size="11">%v</text>`, reportMarginLeft-6, y(v)+4, trimFloat(v))
+	}
+	fmt.Fprintf(&b, `<text x="12" y="%v" font-size="11" transform="rotate(-90 12 %[1]v)" text-anchor="middle">%v</text>`,
+		reportMarginTop+plotHeight/2, template.HTMLEscapeString(yLabel))
+	fmt.Fprintf(&b, `<text x="%v" y="%v" font-size="11" text-anchor="middle">%v</text>`,
+		reportMarginLeft+plotWidth/2, reportChartHeight-4, template.HTMLEscapeString(xLabel))
+
+	// The x axis's labels, at most about one every 80 pixels
+	every := int(math.Ceil(float64(len(data)) / (plotWidth / 80)))
+	for i := 0; i < len(data); i += every {
+		fmt.Fprintf(&b, `<text x="%.1f" y="%v" text-anchor="middle" font-size="11">%v</text>`,
+			x(float64(i)), reportMarginTop+plotHeight+16, trimFloat(float64(i+1)*step))
+	}
+
+	// The data itself
+	points := make([]string, len(data))
+	for i, v := range data {
+		points[i] = fmt.Sprintf("%.1f,%.1f", x(float64(i)), y(v))
+	}
+	fmt.Fprintf(&b, `<polyline fill="none" stroke="%v" stroke-width="1.5" points="%v"/>`, color, strings.Join(points, " "))
+	if len(data) == 1 {
+		fmt.Fprintf(&b, `<circle cx="%.1f" cy="%.1f" r="3" fill="%v"/>`, x(0), y(data[0]), color)
+	}
+
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+// niceCeil rounds v up to 1, 2 or 5 times a power of ten, to top a chart's
+// axis with
+func niceCeil(v float64) float64 {
+	if v <= 0 {
+		return 1
+	}
+	pow := math.Pow(10, math.Floor(math.Log10(v)))
+	for _, m := range []float64{1, 2, 5, 10} {
+		if v <= m*pow {
+			return m * pow
+		}
+	}
+	return 10 * pow
+}
+
+// trimFloat renders v to at most three decimal places, without trailing
+// zeroes, for labelling axes
+func trimFloat(v float64) string {
+	return strconv.FormatFloat(math.Round(v*1000)/1000, 'f', -1, 64)
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; max-width: 760px; margin: 2em auto; color: #222; }
+h1 { font-size: 1.4em; }
+h2 { font-size: 1.15em; margin-top: 2em; border-bottom: 1px solid #ccc; }
+table { border-collapse: collapse; margin: 1em 0; }
+th, td { text-align: left; padding: 0.2em 1.5em 0.2em 0; }
+th { font-weight: normal; color: #555; }
+footer { margin-top: 3em; font-size: 0.85em; color: #777; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<table>
+{{range .Details}}<tr><th>{{.Name}}</th><td>{{.Value}}</td></tr>
+{{end}}</table>
+{{range .Sections}}
+<h2>{{.Title}}</h2>
+{{if .Chart}}{{.Chart}}{{end}}
+<table>
+{{range .Rows}}<tr><th>{{.Name}}</th><td>{{.Value}}</td></tr>
+{{end}}</table>
+{{end}}
+<footer>Generated by {{.Generated}}</footer>
+</body>
+</html>
+`))
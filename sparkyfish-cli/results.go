@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/freinold/sparkyfish"
+)
+
+// latencyText renders our latency stats for the latency stats widget
+func latencyText(p sparkyfish.PingResult) string {
+	return fmt.Sprintf(msg("Min/Avg/Max\n%v/%v/%v ms"), formatNumber(p.Min, 2), formatNumber(p.Avg, 2), formatNumber(p.Max, 2))
+}
+
+// jitterText renders our jitter stats for the jitter stats widget
+func jitterText(p sparkyfish.PingResult) string {
+	return fmt.Sprintf(msg("Jitter/σ\n%v/%v ms"), formatNumber(p.Jitter, 2), formatNumber(p.StdDev, 2))
+}
+
+// summaryText renders our throughput stats for the stats summary widget
+func summaryText(dl, ul sparkyfish.ThroughputResult) string {
+	return liveSummaryText(dl, ul, false, false)
+}
+
+// liveSummaryText renders our throughput stats while the tests are running,
+// noting which of them are still warming up
+func liveSummaryText(dl, ul sparkyfish.ThroughputResult, dlWarmUp, ulWarmUp bool) string {
+	return msg("DOWNLOAD") + throughputText(dl, dlWarmUp) + "\n" + msg("UPLOAD") + throughputText(ul, ulWarmUp)
+}
+
+// statsFormat lays out the stats of a throughput test: the current,
+// maximum, average and median throughput, the 5th and 95th percentiles, and
+// the standard deviation
+const statsFormat = "Current: %v  Max: %v  Avg: %v\nMedian: %v  p5/p95: %v/%v  σ: %v"
+
+// throughputText renders the stats for a single throughput test
+func throughputText(tr sparkyfish.ThroughputResult, warmUp bool) string {
+	if tr.Skipped {
+		return msg(" (skipped)") + "\n\n"
+	}
+
+	var note string
+	if warmUp {
+		note = msg("(warming up)")
+	} else if tr.RawAvg > 0 {
+		note = fmt.Sprintf(msg("(raw avg: %v)"), unitFor(tr.Max).number(tr.RawAvg))
+	}
+	if tr.Bytes > 0 {
+		note = note + "  " + formatBytes(tr.Bytes)
+	}
+	if tr.CappedBy != nil {
+		note = note + "  " + cappedText(tr.CappedBy)
+	}
+	if stopped := stoppedText(tr); stopped != "" {
+		note = note + "  " + stopped
+	}
+	if note != "" && tr.Datagrams != nil {
+		note = "  " + note
+	}
+
+	// Every stat is shown in the unit that suits the fastest of them
+	u := unitFor(tr.Max)
+	return fmt.Sprintf("%v%v\n"+msg(statsFormat), lossText(tr), note,
+		u.format(tr.Current), u.number(tr.Max), u.number(tr.Avg),
+		u.number(tr.Median), u.number(tr.P5), u.number(tr.P95), u.number(tr.StdDev))
+}
+
+// cappedText renders the limit that the server cut a test short at
+func cappedText(limit *sparkyfish.ServerLimit) string {
+	if limit.Kind == sparkyfish.LimitBytes {
+		return "capped by server at " + formatBytes(limit.Value)
+	}
+	return fmt.Sprintf("capped by server at %v", limit)
+}
+
+// stoppedText says why a test was cut short, unless it was by one of the
+// server's limits, which cappedText covers, or by our own data cap
+func stoppedText(tr sparkyfish.ThroughputResult) string {
+	if tr.Stopped == "" || tr.Stopped == sparkyfish.StopServerCap || tr.Stopped == sparkyfish.StopLocalCap {
+		return ""
+	}
+	return "cut short: " + tr.Stopped.String()
+}
+
+// lossText renders the packet loss for a UDP test, if there was one
+func lossText(tr sparkyfish.ThroughputResult) string {
+	if tr.Datagrams == nil {
+		return " "
+	}
+	return fmt.Sprintf(" (UDP)  Loss: %.2f%% of %v datagrams", tr.Datagrams.LossPercent, tr.Datagrams.Sent)
+}
+
+// statusText renders the server's INFO response for the server status widget
+func statusText(st sparkyfish.ServerStatus) string {
+	features := strings.Join(st.Features, ", ")
+	if features == "" {
+		features = "none"
+	}
+
+	load := fmt.Sprintf("%v connections", st.ActiveConnections)
+	if st.MaxConnections > 0 {
+		load = fmt.Sprintf("%v of %v connections", st.ActiveConnections, st.MaxConnections)
+	}
+
+	maxLength := st.MaxDuration.String()
+	if st.MaxBytes > 0 {
+		maxLength += " or " + formatBytes(st.MaxBytes)
+	}
+
+	text := fmt.Sprintf("Version: %v (protocol %v)\nMax test length: %v\nFeatures: %v\nLoad: %v",
+		st.Version, st.Protocol, maxLength, features, load)
+	if st.ServerLocation != nil {
+		text += "\nServer location: " + st.ServerLocation.String()
+	}
+	if st.ClientLocation != nil {
+		text += "\nYour location: " + st.ClientLocation.String()
+	}
+	return text
+}
+
+// testingFromText describes the address that the server saw us test from,
+// e.g. "203.0.113.7 (AS3320 Deutsche Telekom AG)", with the autonomous system
+// that it belongs to if the server knows it.  It returns "" if the server
+// didn't tell us.
+func testingFromText(st *sparkyfish.ServerStatus) string {
+	if st == nil || st.ClientAddress == "" {
+		return ""
+	}
+	if st.ClientLocation == nil || st.ClientLocation.ASN == 0 {
+		return st.ClientAddress
+	}
+	return fmt.Sprintf("%v (%v)", st.ClientAddress, sparkyfish.GeoLocation{ASN: st.ClientLocation.ASN, ASOrg: st.ClientLocation.ASOrg})
+}
+
+// connectStep is a step of connecting to the server, as shown by
+// connectText and connectTimingsText
+type connectStep struct {
+	short, long string
+	ms          float64
+}
+
+// connectSteps lists the steps of connecting to the server that took any
+// time
+func connectSteps(t sparkyfish.ConnectTimings) []connectStep {
+	var steps []connectStep
+	for _, step := range []connectStep{
+		{"DNS", "DNS lookup", t.DNS},
+		{"TCP", "TCP connect", t.Connect},
+		{"TLS", "TLS handshake", t.TLS},
+		{"WebSocket", "WebSocket upgrade", t.WebSocket},
+		{"QUIC", "QUIC handshake", t.QUIC},
+		{"HELO", "HELO exchange", t.Hello},
+	} {
+		if step.ms > 0 {
+			steps = append(steps, step)
+		}
+	}
+	return steps
+}
+
+// connectText sums up how long it took to connect to the server in one
+// line, e.g. "45.21 ms (DNS 12.10, TCP 20.30, HELO 12.81)"
+func connectText(t sparkyfish.ConnectTimings) string {
+	var parts []string
+	for _, step := range connectSteps(t) {
+		parts = append(parts, step.short+" "+formatNumber(step.ms, 2))
+	}
+	return fmt.Sprintf("%v ms (%v)", formatNumber(t.Total, 2), strings.Join(parts, ", "))
+}
+
+// connectTimingsText breaks down how long it took to connect to the server
+// with a line per step, like curl's -w timings
+func connectTimingsText(t sparkyfish.ConnectTimings) []string {
+	var lines []string
+	for _, step := range connectSteps(t) {
+		lines = append(lines, fmt.Sprintf("%-19v %9v ms", step.long+":", formatNumber(step.ms, 2)))
+	}
+	return append(lines, fmt.Sprintf("%-19v %9v ms", "Total:", formatNumber(t.Total, 2)))
+}
+
+// printSummary writes the final latency and throughput stats to w.  It's used
+// in headless mode, where there's no screen to look at.
+func printSummary(w io.Writer, r sparkyfish.Results) {
+	fmt.Fprintln(w, "Server:", r.Server)
+	fmt.Fprintln(w, "Family:", r.Family)
+	if r.DSCP != 0 {
+		fmt.Fprintln(w, "DSCP:", sparkyfish.DSCPName(r.DSCP))
+	}
+	if len(r.Tags) > 0 {
+		fmt.Fprintln(w, "Tags:", strings.Join(r.Tags, ", "))
+	}
+	if r.Note != "" {
+		fmt.Fprintln(w, "Note:", r.Note)
+	}
+	if env := r.Environment; env != nil {
+		fmt.Fprintf(w, "Host: %v (%v)\n", env.Hostname, env.OS)
+		fmt.Fprintln(w, "Connection:", env.Connection())
+		if env.Gateway != "" {
+			fmt.Fprintln(w, "Gateway:", env.Gateway)
+		}
+	}
+	if from := testingFromText(r.Status); from != "" {
+		fmt.Fprintln(w, "Testing from:", from)
+	}
+	if r.MTU != nil {
+		fmt.Fprintln(w, "Path MTU:", mtuText(*r.MTU))
+		for _, warning := range r.MTU.Warnings() {
+			fmt.Fprintln(w, "!", warning)
+		}
+	}
+	if r.Retries > 0 {
+		fmt.Fprintln(w, "Retries:", r.Retries)
+	}
+	if r.Status != nil {
+		fmt.Fprintln(w, "Server version:", r.Status.Version)
+		if r.Status.ServerLocation != nil {
+			fmt.Fprintln(w, "Server location:", r.Status.ServerLocation)
+		}
+		if r.Status.ClientLocation != nil {
+			fmt.Fprintln(w, "Your location:", r.Status.ClientLocation)
+		}
+	}
+	if r.Connect != nil {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, msg("TIMINGS"))
+		fmt.Fprintln(w, strings.Join(connectTimingsText(*r.Connect), "\n"))
+	}
+	if r.DNS != nil {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, msg("DNS"))
+		fmt.Fprintln(w, strings.Join(dnsText(*r.DNS), "\n"))
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, msg("LATENCY"))
+	fmt.Fprintln(w, latencyText(r.Ping))
+	fmt.Fprintln(w, jitterText(r.Ping))
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, summaryText(r.Download, r.Upload))
+	fmt.Fprintln(w, dataUsageText(r))
+	if text := tcpSummaryText(r); text != "" {
+		fmt.Fprintln(w, text)
+	}
+	if stalls := stallsText(r); len(stalls) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, msg("STALLS"))
+		fmt.Fprintln(w, strings.Join(stalls, "\n"))
+	}
+	if events := eventsText(r); len(events) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, msg("EVENTS"))
+		fmt.Fprintln(w, strings.Join(events, "\n"))
+	}
+	if r.Traceroute != nil {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, msg("ROUTE"))
+		fmt.Fprintln(w, strings.Join(routeText(*r.Traceroute), "\n"))
+	}
+}
+
+// dataUsageText renders the amount of data that the throughput tests used
+func dataUsageText(r sparkyfish.Results) string {
+	return fmt.Sprintf("Data used: %v down / %v up", formatBytes(r.Download.Bytes), formatBytes(r.Upload.Bytes))
+}
+
+// oneLineSummary renders the results as a single line, for daemon mode
+func oneLineSummary(r sparkyfish.Results) string {
+	return fmt.Sprintf("%v %v  download %v  upload %v  ping %.2f ms  jitter %.2f ms",
+		r.EndTime.Format(time.RFC3339), r.Server, oneLineThroughput(r.Download), oneLineThroughput(r.Upload), r.Ping.Avg, r.Ping.Jitter)
+}
+
+// oneLineThroughput renders a throughput result for oneLineSummary
+func oneLineThroughput(tr sparkyfish.ThroughputResult) string {
+	if tr.Skipped {
+		return "skipped"
+	}
+	u := unitFor(tr.Max)
+	if tr.CappedBy != nil {
+		return fmt.Sprintf("%v (max %v, %v)", u.format(tr.Avg), u.number(tr.Max), cappedText(tr.CappedBy))
+	}
+	if stopped := stoppedText(tr); stopped != "" {
+		return fmt.Sprintf("%v (max %v, %v)", u.format(tr.Avg), u.number(tr.Max), stopped)
+	}
+	return fmt.Sprintf("%v (max %v)", u.format(tr.Avg), u.number(tr.Max))
+}
+
+// writeJSON encodes our results as a single JSON document
+func writeJSON(w io.Writer, r sparkyfish.Results) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
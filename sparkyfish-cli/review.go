@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/freinold/sparkyfish"
+	"github.com/gizak/termui/v3"
+)
+
+// The pages of the review panel, which the left and right arrow keys step
+// through
+const (
+	reviewDownload = iota
+	reviewUpload
+	reviewLatency
+	reviewPages
+)
+
+// reviewHelp lists the keys that work while the review is shown
+const reviewHelp = " [q]uit [h]istory [a]dvanced [v] graphs [←/→] page [r]erun [e]xport"
+
+// reviewPanel looks back over the whole run once the tests are done: every
+// measurement of each throughput test, every ping, their stats and anything
+// that looked amiss, a page at a time.  Like the history panel, it takes the
+// place of the throughput graphs, and the stats summary too, while it's shown.
+type reviewPanel struct {
+	mu    sync.Mutex
+	shown bool
+	page  int
+}
+
+// addReviewWidgets builds the review panel, hidden until the tests are done
+func (sc *sparkyClient) addReviewWidgets() {
+	// The chart spans both of the throughput graphs
+	var columns int
+	if !sc.headless {
+		columns, _ = termui.TerminalDimensions()
+	}
+
+	chart := newLineChart(style(colors.latency.Fg, colors.latency.Modifier|termui.ModifierBold))
+	chart.PaddingTop = 1
+	chart.SetRect(0, 6, graphWidth(columns)*2, 18)
+
+	stats := newTextBox("", colors.text, 0, 18, 60, 8)
+
+	sc.wr.Add("reviewchart", chart)
+	sc.wr.Add("reviewstats", stats)
+	sc.wr.Hide("reviewchart")
+	sc.wr.Hide("reviewstats")
+}
+
+// showReview switches to the review panel, if it isn't already shown
+func (sc *sparkyClient) showReview() {
+	if !sc.review.isShown() {
+		sc.toggleReview()
+	}
+}
+
+// hideReview switches back to the graphs, if the review panel is shown
+func (sc *sparkyClient) hideReview() {
+	if sc.review.isShown() {
+		sc.toggleReview()
+	}
+}
+
+// toggleReview swaps the throughput graphs and the stats summary for the
+// review panel and back.  It does nothing until the tests are done.  Showing
+// it hides the history, TCP stats and route panels, which live in the same
+// spot.
+func (sc *sparkyClient) toggleReview() {
+	rp := sc.review
+
+	select {
+	case <-sc.allTestsDone:
+	default:
+		if !rp.isShown() {
+			return
+		}
+	}
+
+	if !rp.isShown() {
+		if sc.historyPanel.isShown() {
+			sc.toggleHistoryPanel()
+		}
+		if sc.tcpPanel.isShown() {
+			sc.toggleTCPPanel()
+		}
+		if sc.routePanel.isShown() {
+			sc.toggleRoutePanel()
+		}
+	}
+
+	rp.mu.Lock()
+	rp.shown = !rp.shown
+	shown := rp.shown
+	rp.mu.Unlock()
+
+	if shown {
+		sc.updateReview()
+		sc.wr.Show("reviewchart")
+		sc.wr.Show("reviewstats")
+		for _, name := range []string{"dlgraph", "ulgraph", "statsSummary"} {
+			sc.wr.Hide(name)
+		}
+		sc.wr.SetText("helpbox", msg(reviewHelp))
+	} else {
+		sc.wr.Hide("reviewchart")
+		sc.wr.Hide("reviewstats")
+		for _, name := range []string{"dlgraph", "ulgraph", "statsSummary"} {
+			sc.wr.Show(name)
+		}
+		sc.wr.SetText("helpbox", msg(helpText))
+	}
+
+	sc.wr.Clear()
+	sc.wr.Render()
+}
+
+// turnReviewPage steps forward (or back) through the review panel's pages
+func (sc *sparkyClient) turnReviewPage(forward bool) {
+	rp := sc.review
+
+	rp.mu.Lock()
+	if !rp.shown {
+		rp.mu.Unlock()
+		return
+	}
+	if forward {
+		rp.page = (rp.page + 1) % reviewPages
+	} else {
+		rp.page = (rp.page + reviewPages - 1) % reviewPages
+	}
+	rp.mu.Unlock()
+
+	sc.updateReview()
+	sc.wr.Clear()
+	sc.wr.Render()
+}
+
+// updateReview draws the review panel's current page
+func (sc *sparkyClient) updateReview() {
+	rp := sc.review
+	rp.mu.Lock()
+	page := rp.page
+	rp.mu.Unlock()
+
+	r := sc.currentResults()
+
+	// Throughput measurements are labelled with the time into the test
+	// that they were taken, and pings with their number
+	var data []float64
+	var events []sparkyfish.Event
+	var what, unit, text string
+	label := func(x float64) string {
+		return fmt.Sprintf("%.1fs", (x+1)*sc.client.ReportInterval.Seconds())
+	}
+	switch page {
+	case reviewDownload:
+		data, _ = sc.tui.samples()
+		u := unitFor(maxOf(data))
+		data, what, unit = u.scale(data), msg("Download"), u.name
+		events = r.Download.Events
+		text = msg("DOWNLOAD") + throughputText(r.Download, false)
+	case reviewUpload:
+		_, data = sc.tui.samples()
+		u := unitFor(maxOf(data))
+		data, what, unit = u.scale(data), msg("Upload"), u.name
+		events = r.Upload.Events
+		text = msg("UPLOAD") + throughputText(r.Upload, false)
+	case reviewLatency:
+		data = sc.pings
+		what, unit = msg("Latency"), "ms"
+		text = msg("LATENCY") + "\n" + latencyText(r.Ping) + "\n" + jitterText(r.Ping)
+		label = func(x float64) string {
+			return fmt.Sprintf("%.1f", x+1)
+		}
+	}
+
+	points := sc.wr.Points("reviewchart")
+	values, labels := reviewView(data, points, label)
+	sc.wr.SetData("reviewchart", values)
+	sc.wr.SetLabels("reviewchart", labels)
+	sc.wr.Mark("reviewchart", reviewMarks(events, sc.client.ReportInterval, len(data), points))
+	if len(events) > 0 {
+		text += "\n" + fmt.Sprintf(msg("Events: %v"), eventLegend(events))
+	}
+	sc.wr.SetTitle("reviewchart", fmt.Sprintf(msg(" %v (%v), %v measurements  [%v/%v] "), what, unit, len(data), page+1, reviewPages))
+
+	title := msg(" Review ")
+	warnings := reviewWarnings(r, sc.client.Pings)
+	if len(warnings) > 0 {
+		title = fmt.Sprintf(msg(" Review: %v warning(s) "), len(warnings))
+		text += "\n" + strings.Join(warnings, "\n")
+	}
+	sc.wr.SetTitle("reviewstats", title)
+	sc.wr.SetText("reviewstats", text)
+}
+
+// reviewView fits the whole of data onto a chart that holds points points,
+// averaging measurements together if there are too many, or drawing straight
+// lines between them if there are too few.  It labels each point with label,
+// given the position in data that it stands for.
+func reviewView(data []float64, points int, label func(x float64) string) ([]float64, []string) {
+	n := len(data)
+	if n < 2 || points < 2 {
+		return newChartWindow(points, n).view(data), []string{label(0)}
+	}
+
+	var values []float64
+	if n >= points {
+		values = newChartWindow(points, n).view(data)
+	} else {
+		values = make([]float64, points)
+		for i := range values {
+			x := float64(i) * float64(n-1) / float64(points-1)
+			j := int(x)
+			if j >= n-1 {
+				values[i] = data[n-1]
+				continue
+			}
+			values[i] = data[j] + (data[j+1]-data[j])*(x-float64(j))
+		}
+	}
+
+	labels := make([]string, len(values))
+	for i := range labels {
+		labels[i] = label(float64(i) * float64(n-1) / float64(len(values)-1))
+	}
+	return values, labels
+}
+
+// reviewMarks marks events on a chart that reviewView laid out to hold points
+// points, from n measurements taken every interval.  Events after the last
+// measurement are marked under it.
+func reviewMarks(events []sparkyfish.Event, interval time.Duration, n, points int) []chartMark {
+	var marks []chartMark
+	for _, e := range events {
+		k := eventIndex(e.At, interval)
+		if k >= n {
+			k = n - 1
+		}
+
+		var p int
+		if n < 2 || points < 2 || n >= points {
+			p = newChartWindow(points, n).point(n, k)
+		} else {
+			p = int(float64(k)*float64(points-1)/float64(n-1) + 0.5)
+		}
+		if p >= 0 {
+			marks = append(marks, chartMark{p, e.Kind})
+		}
+	}
+	return marks
+}
+
+func (rp *reviewPanel) isShown() bool {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return rp.shown
+}
+
+// unaccountedWarning is the share of a download's data that has to go
+// missing between the server and us before we warn about it
+const unaccountedWarning = 0.05
+
+// reviewWarnings describes anything about r that looked amiss, given that we
+// sent pings pings
+func reviewWarnings(r sparkyfish.Results, pings int) []string {
+	var warnings []string
+
+	if r.Ping.Probes < pings {
+		warnings = append(warnings, fmt.Sprintf("! %v of %v pings didn't come back", pings-r.Ping.Probes, pings))
+	}
+
+	for _, t := range []struct {
+		name string
+		tr   sparkyfish.ThroughputResult
+	}{{"Download", r.Download}, {"Upload", r.Upload}} {
+		tr := t.tr
+		if tr.Skipped {
+			continue
+		}
+		if tr.CappedBy != nil {
+			warnings = append(warnings, fmt.Sprintf("! %v %v", t.name, cappedText(tr.CappedBy)))
+		}
+		if stopped := stoppedText(tr); stopped != "" {
+			warnings = append(warnings, fmt.Sprintf("! %v %v", t.name, stopped))
+		}
+		if len(tr.Stalls) > 0 {
+			warnings = append(warnings, fmt.Sprintf("! %v stalled at %v", t.name, stallsSummaryText(tr.Stalls)))
+		}
+		if tr.Datagrams != nil && tr.Datagrams.LossPercent > 1 {
+			warnings = append(warnings, fmt.Sprintf("! %v lost %.2f%% of its datagrams", t.name, tr.Datagrams.LossPercent))
+		}
+		if ba := tr.Accounting; ba != nil && !ba.InFlight && ba.Sent > 0 && float64(ba.Unaccounted())/float64(ba.Sent) > unaccountedWarning {
+			warnings = append(warnings, fmt.Sprintf("! %v of the %v went unaccounted for; something may be buffering it", formatBytes(ba.Unaccounted()), strings.ToLower(t.name)))
+		}
+	}
+
+	if r.MTU != nil {
+		for _, warning := range r.MTU.Warnings() {
+			warnings = append(warnings, "! "+warning)
+		}
+	}
+
+	return warnings
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/freinold/sparkyfish"
+)
+
+// routeLines is the number of lines of hops that fit in the route panel
+const routeLines = 9
+
+// routePanel shows the path to the server, as traced with -traceroute before
+// the tests.  Like the TCP stats panel, it takes the place of the throughput
+// graphs while it's shown.
+type routePanel struct {
+	mu    sync.Mutex
+	shown bool
+	text  string // what to show until there's a route, e.g. why there isn't one
+}
+
+// addRouteWidgets builds the route panel, hidden until the user asks for it
+func (sc *sparkyClient) addRouteWidgets() {
+	route := newTextBox("", colors.text, 0, 6, 60, 12)
+	route.Title = msg(" Route ")
+
+	sc.wr.Add("route", route)
+
+	// The panel may already have been toggled on while we were starting up
+	sc.routePanel.mu.Lock()
+	if !sc.routePanel.shown {
+		sc.wr.Hide("route")
+	}
+	sc.routePanel.mu.Unlock()
+
+	sc.updateRoutePanel()
+}
+
+// updateRoutePanel shows the route that we traced, or what's become of it
+func (sc *sparkyClient) updateRoutePanel() {
+	rp := sc.routePanel
+
+	rp.mu.Lock()
+	text := rp.text
+	rp.mu.Unlock()
+
+	tr := sc.currentResults().Traceroute
+	if tr == nil {
+		sc.wr.SetTitle("route", msg(" Route "))
+		sc.wr.SetText("route", text)
+		return
+	}
+	sc.wr.SetTitle("route", fmt.Sprintf(msg(" Route (%v) "), strings.ToUpper(tr.Method)))
+	lines := routeText(*tr)
+	if len(lines) > routeLines+1 {
+		// Keep the nearest hops and the ones closest to the server, which
+		// are the ones that tell us the most
+		keep := routeLines / 2
+		skipped := len(lines) - routeLines
+		lines = append(append(lines[:keep+1:keep+1], fmt.Sprintf(msg("    (%v more hops)"), skipped)), lines[len(lines)-(routeLines-keep-1):]...)
+	}
+	sc.wr.SetText("route", strings.Join(lines, "\n"))
+}
+
+// setRouteText shows text in the route panel in place of a route
+func (sc *sparkyClient) setRouteText(text string) {
+	sc.routePanel.mu.Lock()
+	sc.routePanel.text = text
+	sc.routePanel.mu.Unlock()
+
+	sc.updateRoutePanel()
+	sc.wr.Render()
+}
+
+// toggleRoutePanel swaps the throughput graphs for the route panel and back.
+// Showing it hides the other panels that live in the same spot.
+func (sc *sparkyClient) toggleRoutePanel() {
+	rp := sc.routePanel
+
+	if !rp.isShown() {
+		if sc.historyPanel.isShown() {
+			sc.toggleHistoryPanel()
+		}
+		if sc.tcpPanel.isShown() {
+			sc.toggleTCPPanel()
+		}
+		if sc.review.isShown() {
+			sc.toggleReview()
+		}
+	}
+
+	rp.mu.Lock()
+	rp.shown = !rp.shown
+	shown := rp.shown
+	rp.mu.Unlock()
+
+	if shown {
+		sc.wr.Show("route")
+		sc.wr.Hide("dlgraph")
+		sc.wr.Hide("ulgraph")
+	} else {
+		sc.wr.Hide("route")
+		sc.wr.Show("dlgraph")
+		sc.wr.Show("ulgraph")
+	}
+
+	sc.wr.Clear()
+	sc.wr.Render()
+}
+
+func (rp *routePanel) isShown() bool {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return rp.shown
+}
+
+// routeText renders a traced route as a header and a line per hop.  Runs of
+// hops that didn't answer are collapsed into a single line.
+func routeText(tr sparkyfish.TracerouteResult) []string {
+	lines := []string{msg("TTL  HOST                                    LOSS   AVG MS")}
+	for i := 0; i < len(tr.Hops); i++ {
+		h := tr.Hops[i]
+		if h.Received == 0 {
+			first := h.TTL
+			for i+1 < len(tr.Hops) && tr.Hops[i+1].Received == 0 {
+				i++
+			}
+			ttl := fmt.Sprint(first)
+			if last := tr.Hops[i].TTL; last != first {
+				ttl = fmt.Sprintf("%v-%v", first, last)
+			}
+			lines = append(lines, fmt.Sprintf("%-4v %v", ttl, msg("(no answer)")))
+			continue
+		}
+
+		host := h.Address
+		if h.Name != "" {
+			host = h.Name
+		}
+		if len(host) > 38 {
+			host = host[:37] + "…"
+		}
+		lines = append(lines, fmt.Sprintf("%-4v %-38v %5v%% %7v", h.TTL, host,
+			formatNumber(h.LossPercent(), 0), formatNumber(h.Avg, 2)))
+	}
+	if !tr.Reached {
+		lines = append(lines, msg("     (the server didn't answer)"))
+	}
+	return lines
+}
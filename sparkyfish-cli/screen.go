@@ -0,0 +1,63 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/gizak/termui/v3"
+)
+
+// screen is the terminal, while the terminal UI has it.  It passes the keys
+// pressed on it, and its other events, to their handlers.
+type screen struct {
+	handlers map[string]func(termui.Event)
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// openScreen takes over the terminal for the terminal UI
+func openScreen() (*screen, error) {
+	err := termui.Init()
+	if err != nil {
+		return nil, err
+	}
+	return &screen{handlers: make(map[string]func(termui.Event)), stop: make(chan struct{})}, nil
+}
+
+// handle calls f for each event with the termui ID id, e.g. "q", "<C-c>",
+// "<Left>" or "<Resize>".  Handlers must be set before loop is called.
+func (s *screen) handle(id string, f func(termui.Event)) {
+	s.handlers[id] = f
+}
+
+// loop passes events to their handlers until stopLoop is called
+func (s *screen) loop() {
+	events := termui.PollEvents()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case e := <-events:
+			if f := s.handlers[e.ID]; f != nil {
+				f(e)
+			}
+		}
+	}
+}
+
+// stopLoop makes loop return.  It may be called more than once.
+func (s *screen) stopLoop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+}
+
+// close hands the terminal back
+func (s *screen) close() {
+	termui.Close()
+}
+
+// width returns the width of the terminal, in columns
+func (s *screen) width() int {
+	width, _ := termui.TerminalDimensions()
+	return width
+}
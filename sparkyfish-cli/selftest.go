@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/freinold/sparkyfish"
+	"github.com/freinold/sparkyfish/sparkyfishd"
+)
+
+// benchBuffer is the size of the socket buffers that we ask for with -bench
+const benchBuffer = 8 << 20
+
+// selftestCommand runs the tests against a server that we start ourselves, on
+// the loopback interface.  It checks that the install works from end to end,
+// and since nothing but our own CPU stands in the way, its throughput is a
+// rough upper bound on what this machine can measure.  With -bench, we tune
+// the connections for speed, with big socket buffers and blocks, to measure
+// how fast sparkyfish itself can go.  It returns the exit status to exit with.
+func selftestCommand(args []string) int {
+	fs := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	jsonOutput := fs.Bool("json", false, "Print the results as JSON")
+	udp := fs.Bool("udp", false, "Run the download and upload tests over UDP")
+	bidirectional := fs.Bool("bidirectional", false, "Run the download and upload tests at the same time")
+	bench := fs.Bool("bench", false, "Tune the connections for speed, with big socket buffers and blocks, to measure how fast sparkyfish itself can go on this machine's CPU; if a real test is much slower, it's the network that's limiting it")
+	debug := fs.Bool("debug", false, "Log what the server does to stderr")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:", os.Args[0], "selftest [options]")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	if *udp && *bidirectional {
+		fatal(exitUsage, "-udp and -bidirectional are mutually exclusive")
+	}
+	if *udp && *bench {
+		fatal(exitUsage, "-bench only applies to TCP tests, not -udp")
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	var buffer int
+	if *bench {
+		buffer = benchBuffer
+	}
+	addr, err := startSelftestServer(ctx, *debug, buffer)
+	if err != nil {
+		fatal(exitConnectFailed, "unable to start the server:", err)
+	}
+
+	client, err := sparkyfish.NewClient(addr)
+	if err != nil {
+		fatal(exitError, err)
+	}
+	if *bench {
+		// The biggest blocks and socket buffers keep the per-copy
+		// overhead, and the waiting on the kernel, to a minimum
+		client.BlockSize = sparkyfish.MaxBlockSize
+		client.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, network, addr)
+			if err == nil {
+				setBuffers(conn, buffer)
+			}
+			return conn, err
+		}
+	}
+	client.UDP = *udp
+	client.Bidirectional = *bidirectional
+
+	results, err := client.Run(ctx)
+	if ctx.Err() != nil {
+		fatal(exitAborted, "tests cancelled")
+	}
+	if err != nil {
+		fatal(exitAborted, "self-test failed:", err)
+	}
+
+	if *jsonOutput {
+		err = writeJSON(os.Stdout, results)
+		if err != nil {
+			fatal(exitAborted, "error writing results:", err)
+		}
+	} else {
+		printSummary(os.Stdout, results)
+	}
+
+	if problem := selftestProblem(results, client.Pings); problem != "" {
+		fatal(exitAborted, "self-test failed:", problem)
+	}
+	if !*jsonOutput {
+		over := "over loopback"
+		if *bench {
+			over = "before its CPU runs out; much slower readings come from the network, not from sparkyfish"
+		}
+		fmt.Println()
+		fmt.Printf("Self-test passed.  This machine can measure up to about %.0f Mbit/s %v.\n", math.Max(results.Download.Max, results.Upload.Max), over)
+	}
+	return exitOK
+}
+
+// startSelftestServer starts a server on a free loopback port, with a UDP
+// socket alongside, that serves until ctx is cancelled, and logs what it does
+// to stderr if debug is set.  If buffer is set, the server's connections get
+// socket buffers of that size.  It returns the server's address.
+func startSelftestServer(ctx context.Context, debug bool, buffer int) (string, error) {
+	ls := &sparkyfishd.Listeners{}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	if buffer > 0 {
+		listener = bufferedListener{Listener: listener, buffer: buffer}
+	}
+	ls.Tests = append(ls.Tests, listener)
+
+	// UDP tests reach the server on the same port as TCP ones
+	addr := listener.Addr().String()
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		listener.Close()
+		return "", err
+	}
+	ls.Packets = append(ls.Packets, pc)
+
+	var w io.Writer = io.Discard
+	if debug {
+		w = os.Stderr
+	}
+	ss := &sparkyfishd.Server{
+		Addr:     addr,
+		Cname:    "localhost",
+		Location: "selftest",
+		Logger:   slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	}
+	go ss.ServeListeners(ctx, ls)
+
+	return addr, nil
+}
+
+// bufferedListener gives the connections that it accepts socket buffers of
+// buffer bytes
+type bufferedListener struct {
+	net.Listener
+	buffer int
+}
+
+func (bl bufferedListener) Accept() (net.Conn, error) {
+	conn, err := bl.Listener.Accept()
+	if err == nil {
+		setBuffers(conn, bl.buffer)
+	}
+	return conn, err
+}
+
+// setBuffers asks for socket buffers of size bytes for conn, if it's a TCP
+// connection.  The kernel may give it less.
+func setBuffers(conn net.Conn, size int) {
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetReadBuffer(size)
+		tc.SetWriteBuffer(size)
+	}
+}
+
+// selftestProblem returns what's wrong with the results of a self-test, if
+// anything is, or ""
+func selftestProblem(r sparkyfish.Results, pings int) string {
+	switch {
+	case r.Ping.Probes != pings:
+		return fmt.Sprintf("%v of %v pings came back", r.Ping.Probes, pings)
+	case r.Download.Bytes == 0 || r.Download.Avg <= 0:
+		return "the download test didn't move any data"
+	case r.Upload.Bytes == 0 || r.Upload.Avg <= 0:
+		return "the upload test didn't move any data"
+	}
+	return ""
+}
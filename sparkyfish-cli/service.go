@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// serviceName names the daemon to the system's service manager
+const serviceName = "sparkyfish"
+
+// serviceCommand implements "sparkyfish-cli service", which installs the
+// daemon that -interval runs as a Windows service or a launchd agent, so
+// that it tests in the background from boot or login on
+func serviceCommand(args []string) error {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage:", os.Args[0], "service install [-interval 15m] [-- options] [<sparkyfish server hostname/IP>[:port]]")
+		fmt.Fprintln(os.Stderr, "      ", os.Args[0], "service start")
+		fmt.Fprintln(os.Stderr, "      ", os.Args[0], "service uninstall")
+	}
+	if len(args) == 0 {
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	switch args[0] {
+	case "install":
+		fs := flag.NewFlagSet("service install", flag.ContinueOnError)
+		interval := fs.Duration("interval", 15*time.Minute, "How often the service runs the tests")
+		fs.Usage = func() {
+			usage()
+			fmt.Fprintln(os.Stderr, "\nThe options and server after the flags are passed on to the daemon, as they would be on the command line.")
+			fs.PrintDefaults()
+		}
+		parseFlags(fs, args[1:])
+		if *interval <= 0 {
+			fatal(exitUsage, "-interval must be positive")
+		}
+
+		exe, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("can't find our own executable: %w", err)
+		}
+		err = installService(exe, daemonArgs(*interval, fs.Args()))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Installed the %v service, testing every %v.  Run \"%v service start\" to start it now.\n", serviceName, *interval, filepath.Base(os.Args[0]))
+		return nil
+	case "start":
+		return startService()
+	case "uninstall":
+		return uninstallService()
+	default:
+		usage()
+		os.Exit(exitUsage)
+	}
+	return nil
+}
+
+// daemonArgs returns the command line that the service runs us with: the
+// daemon, testing every interval, with the options in args.  The service
+// may not run as the user who installs it, so we pin the history database
+// and config file to this user's.  Anything in args comes later on the
+// command line, and so wins.
+func daemonArgs(interval time.Duration, args []string) []string {
+	daemon := []string{"-interval", interval.String(), "-history", defaultHistoryPath()}
+	if path := defaultConfigPath(); path != "" {
+		if _, err := os.Stat(path); err == nil {
+			daemon = append(daemon, "-config", path)
+		}
+	}
+	return append(daemon, args...)
+}
@@ -0,0 +1,136 @@
+//go:build darwin
+// +build darwin
+
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// launchdLabel names our launchd agent
+const launchdLabel = "com.github.freinold.sparkyfish"
+
+// agentPath returns where our launchd agent's plist goes
+func agentPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, "Library", "LaunchAgents", launchdLabel+".plist"), nil
+}
+
+// logPath returns where the agent's output goes
+func logPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, "Library", "Logs", "sparkyfish.log"), nil
+}
+
+// installService writes a launchd agent that runs exe with args from login
+// on, and restarts it if it quits.  launchd loads it at the next login, or
+// when it's started.
+func installService(exe string, args []string) error {
+	path, err := agentPath()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("the %v agent is already installed at %v; uninstall it first", launchdLabel, path)
+	}
+	logs, err := logPath()
+	if err != nil {
+		return err
+	}
+
+	var plist strings.Builder
+	plist.WriteString(xml.Header)
+	plist.WriteString(`<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">` + "\n")
+	plist.WriteString("<plist version=\"1.0\">\n<dict>\n")
+	plistString(&plist, "Label", launchdLabel)
+	plist.WriteString("\t<key>ProgramArguments</key>\n\t<array>\n")
+	for _, arg := range append([]string{exe}, args...) {
+		plist.WriteString("\t\t<string>")
+		xml.EscapeText(&plist, []byte(arg))
+		plist.WriteString("</string>\n")
+	}
+	plist.WriteString("\t</array>\n")
+	plist.WriteString("\t<key>RunAtLoad</key>\n\t<true/>\n")
+	plist.WriteString("\t<key>KeepAlive</key>\n\t<true/>\n")
+	plistString(&plist, "StandardOutPath", logs)
+	plistString(&plist, "StandardErrorPath", logs)
+	plist.WriteString("</dict>\n</plist>\n")
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(plist.String()), 0644)
+}
+
+// plistString writes a key with a string value to a plist's dict
+func plistString(plist *strings.Builder, key, value string) {
+	fmt.Fprintf(plist, "\t<key>%v</key>\n\t<string>", key)
+	xml.EscapeText(plist, []byte(value))
+	plist.WriteString("</string>\n")
+}
+
+// startService loads the agent into launchd, which starts it, or restarts it
+// if it's already loaded
+func startService() error {
+	path, err := agentPath()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("the %v agent isn't installed: %w", launchdLabel, err)
+	}
+
+	domain := fmt.Sprintf("gui/%v", os.Getuid())
+	if exec.Command("launchctl", "print", domain+"/"+launchdLabel).Run() == nil {
+		return launchctl("kickstart", "-k", domain+"/"+launchdLabel)
+	}
+	return launchctl("bootstrap", domain, path)
+}
+
+// uninstallService unloads the agent, if it's loaded, and removes it
+func uninstallService() error {
+	path, err := agentPath()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("the %v agent isn't installed: %w", launchdLabel, err)
+	}
+
+	domain := fmt.Sprintf("gui/%v", os.Getuid())
+	if exec.Command("launchctl", "print", domain+"/"+launchdLabel).Run() == nil {
+		err = launchctl("bootout", domain+"/"+launchdLabel)
+		if err != nil {
+			return err
+		}
+	}
+	return os.Remove(path)
+}
+
+// launchctl runs launchctl with args
+func launchctl(args ...string) error {
+	out, err := exec.Command("launchctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("launchctl %v: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// runAsService does nothing, since launchd stops us with SIGTERM, which
+// cancels our tests anyway
+func runAsService(cancel context.CancelFunc) func(code int) {
+	return func(int) {}
+}
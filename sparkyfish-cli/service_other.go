@@ -0,0 +1,31 @@
+//go:build !windows && !darwin
+// +build !windows,!darwin
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// errNoService is returned on systems that we can't install the daemon on
+// ourselves
+var errNoService = errors.New("services can only be installed on Windows and macOS; elsewhere, run \"sparkyfish-cli -interval 15m <server>\" from your init system, e.g. with a systemd unit like the server's in dist/systemd")
+
+func installService(exe string, args []string) error {
+	return errNoService
+}
+
+func startService() error {
+	return errNoService
+}
+
+func uninstallService() error {
+	return errNoService
+}
+
+// runAsService does nothing, since service managers here stop us with
+// SIGTERM, which cancels our tests anyway
+func runAsService(cancel context.CancelFunc) func(code int) {
+	return func(int) {}
+}
@@ -0,0 +1,156 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// installService registers exe, run with args, as a service that starts
+// with Windows and is restarted if it fails
+func installService(exe string, args []string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("can't connect to the service manager (installing a service needs an Administrator prompt): %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err == nil {
+		s.Close()
+		return fmt.Errorf("the %v service is already installed; uninstall it first", serviceName)
+	}
+
+	s, err = m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "Sparkyfish",
+		Description: "Runs sparkyfish's network speed tests periodically and records the results",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return fmt.Errorf("can't create the service: %w", err)
+	}
+	defer s.Close()
+
+	err = s.SetRecoveryActions([]mgr.RecoveryAction{{Type: mgr.ServiceRestart, Delay: time.Minute}}, uint32((24 * time.Hour).Seconds()))
+	if err == nil {
+		// We report the daemon quitting by itself as a failure, not a
+		// crash
+		err = s.SetRecoveryActionsOnNonCrashFailures(true)
+	}
+	if err != nil {
+		log.Println("unable to have the service restarted if it fails:", err)
+	}
+	return nil
+}
+
+// startService starts the installed service
+func startService() error {
+	return withService(func(s *mgr.Service) error {
+		return s.Start()
+	})
+}
+
+// uninstallService stops the installed service, if it's running, and
+// removes it
+func uninstallService() error {
+	return withService(func(s *mgr.Service) error {
+		status, err := s.Query()
+		if err == nil && status.State != svc.Stopped {
+			_, err = s.Control(svc.Stop)
+			if err != nil {
+				log.Println("unable to stop the service:", err)
+			}
+		}
+		return s.Delete()
+	})
+}
+
+// withService calls fn with our service, opened on the service manager
+func withService(fn func(s *mgr.Service) error) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("can't connect to the service manager (this needs an Administrator prompt): %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("the %v service isn't installed: %w", serviceName, err)
+	}
+	defer s.Close()
+
+	return fn(s)
+}
+
+// runAsService, if we were started by the service manager, tells it that
+// we're running and cancels our tests when it asks us to stop.  The returned
+// function reports that we've stopped with exit status code, and must be
+// called once the tests have wound down, or as we give up on them.
+func runAsService(cancel context.CancelFunc) func(code int) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return func(int) {}
+	}
+
+	h := &serviceHandler{cancel: cancel, done: make(chan struct{})}
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		err := svc.Run(serviceName, h)
+		if err != nil {
+			log.Println("service:", err)
+			cancel()
+		}
+	}()
+	return func(code int) {
+		h.code = code
+		close(h.done)
+		<-exited
+	}
+}
+
+// serviceHandler answers the service manager for the daemon
+type serviceHandler struct {
+	cancel context.CancelFunc
+	done   chan struct{} // closed when the daemon has stopped
+	code   int           // the daemon's exit status, once done is closed
+}
+
+func (h *serviceHandler) Execute(args []string, r <-chan svc.ChangeRequest, s chan<- svc.Status) (bool, uint32) {
+	s <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	stopping := false
+	for {
+		select {
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				s <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				s <- svc.Status{State: svc.StopPending}
+				stopping = true
+				h.cancel()
+			}
+		case <-h.done:
+			if !stopping {
+				// The daemon quit without being asked to, so
+				// we've failed, and want restarting.  Its exit
+				// status says why, e.g. that its options are
+				// invalid.
+				code := h.code
+				if code == exitOK {
+					code = exitError
+				}
+				return true, uint32(code)
+			}
+			return false, 0
+		}
+	}
+}
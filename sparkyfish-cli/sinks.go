@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/freinold/sparkyfish"
+)
+
+// maxPendingSamples caps the number of throughput measurements that a sink
+// holds on to until the end of the run, in case runs keep failing
+const maxPendingSamples = 1000
+
+// resultSink is somewhere that we send our measurements, like the screen or
+// an InfluxDB server
+type resultSink interface {
+	// sample is called with each throughput measurement as it comes in
+	sample(server string, s sparkyfish.Sample)
+
+	// results is called with the results of each complete test run
+	results(r sparkyfish.Results) error
+}
+
+// pingSink is a resultSink that also wants each ping as it comes back
+type pingSink interface {
+	ping(server string, ps sparkyfish.PingSample)
+}
+
+// sinkList fans our measurements out to a number of sinks
+type sinkList []resultSink
+
+// attach makes client pass its throughput measurements on to our sinks, and
+// its pings to those that want them, as well as to its existing OnThroughput
+// and OnPing callbacks
+func (sl sinkList) attach(client *sparkyfish.Client) {
+	if len(sl) == 0 {
+		return
+	}
+
+	onThroughput := client.OnThroughput
+	server := client.Addr()
+	client.OnThroughput = func(s sparkyfish.Sample) {
+		if onThroughput != nil {
+			onThroughput(s)
+		}
+		for _, sink := range sl {
+			sink.sample(server, s)
+		}
+	}
+
+	onPing := client.OnPing
+	client.OnPing = func(ps sparkyfish.PingSample) {
+		if onPing != nil {
+			onPing(ps)
+		}
+		for _, sink := range sl {
+			if p, ok := sink.(pingSink); ok {
+				p.ping(server, ps)
+			}
+		}
+	}
+}
+
+// results sends r to each of our sinks.  Errors are logged if verbose is set
+// and otherwise ignored, so that one broken sink doesn't hold up the rest.
+func (sl sinkList) results(r sparkyfish.Results, verbose bool) {
+	for _, sink := range sl {
+		err := sink.results(r)
+		if err != nil && verbose {
+			log.Println(err)
+		}
+	}
+}
+
+// sampleDirection names the direction of the test that s was measured in
+func sampleDirection(s sparkyfish.Sample) string {
+	if s.TestType == sparkyfish.Outbound || s.TestType == sparkyfish.UDPOutbound {
+		return "upload"
+	}
+	return "download"
+}
+
+// deliver sends body to url with the given method, for sinks that talk HTTP.
+// Any response other than a 2xx is an error.  what names the destination in
+// error messages.
+func deliver(client *http.Client, method, url, contentType, body, what string) error {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error writing to %v: %v", what, err)
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error writing to %v: %v", what, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("error writing to %v: %v: %v", what, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
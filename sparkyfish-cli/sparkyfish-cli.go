@@ -1,253 +1,1090 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"context"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net"
 	"os"
+	"os/signal"
 	"runtime"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/dustin/randbo"
-	"gopkg.in/gizak/termui.v2"
+	"github.com/freinold/sparkyfish"
+	"github.com/freinold/sparkyfish/internal/config"
+	"github.com/gizak/termui/v3"
+	"github.com/gizak/termui/v3/widgets"
 )
 
-const (
-	protocolVersion      uint16 = 0x00 // Protocol Version
-	blockSize            int64  = 200  // size (KB) of each block of data copied to/from remote
-	reportIntervalMS     uint64 = 500  // report interval in milliseconds
-	throughputTestLength uint   = 10   // length of time to conduct each throughput test
-	maxPingTestLength    uint   = 10   // maximum time for ping test to complete
-	numPings             int    = 30   // number of pings to attempt
-)
-
-// command is used to indicate the type of test being performed
-type command int
-
-const (
-	outbound command = iota // upload test
-	inbound                 // download test
-	echo                    // echo (ping) test
-)
+// helpText lists the keys that work while the tests run
+const helpText = " [q]uit [?]help [h]istory [a]dvanced [r]erun [s]kip [p]ause [+/-] zoom [e]xport"
 
 type sparkyClient struct {
-	conn               net.Conn
-	reader             *bufio.Reader
-	randomData         []byte
-	randReader         *bytes.Reader
-	serverCname        string
-	serverLocation     string
+	client             *sparkyfish.Client
 	serverHostname     string
-	pingTime           chan time.Duration
-	blockTicker        chan bool
+	pingTime           chan sparkyfish.PingSample
 	pingProgressTicker chan bool
 	testDone           chan bool
 	allTestsDone       chan struct{}
+	testsFailed        chan struct{}
+	retry              chan struct{}
 	progressBarReset   chan bool
-	throughputReport   chan float64
-	statsGeneratorDone chan struct{}
-	changeToUpload     chan struct{}
-	pingProcessorReady chan struct{}
-	wr                 *widgetRenderer
-	rendererMu         *sync.Mutex
+	wr                 renderer
+	resultsMu          sync.Mutex         // guards results, which our keys read while the tests write them
+	results            sparkyfish.Results // the results of the run so far
+	history            *history
+	historyPanel       *historyPanel
+	tcpPanel           *tcpPanel
+	routePanel         *routePanel
+	review             *reviewPanel
+	help               *helpOverlay
+	info               sparkyfish.ServerInfo // the server's hello, once we have it
+	control            runControl
+	pings              []float64 // every ping's round trip time, in ms
+	historyRuns        int
+	sinks              sinkList
+	tui                *tuiSink
+	plain              *plainSink // reports our progress as text, with -plain
+	reportPath         string     // where to write an HTML report of each run, if anywhere
+	shareURL           string     // the share service to share each run with, if any
+	shareToken         string
+	sharePersonal      bool   // whether to share what identifies the user too
+	sharedAt           string // where the last run's results were shared, if they were
+	picker             *serverPicker
+	flash              bannerFlash // the message flashing on the banner, if any
+	headless           bool
 }
 
 func main() {
-	if len(os.Args) < 2 {
-		log.Fatal("Usage: ", os.Args[0], " <sparkyfish server hostname/IP>[:port]")
+	var headless bool
+
+	// "sparkyfish-cli history" lists past runs instead of running tests
+	if len(os.Args) > 1 && os.Args[1] == "history" {
+		err := historyCommand(os.Args[2:])
+		if err != nil {
+			fatal(exitError, err)
+		}
+		return
+	}
+
+	// "sparkyfish-cli selftest" tests against a server of our own, to check
+	// that everything works
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		os.Exit(selftestCommand(os.Args[2:]))
+	}
+
+	// "sparkyfish-cli agent" runs tests on request, over gRPC
+	if len(os.Args) > 1 && os.Args[1] == "agent" {
+		err := agentCommand(os.Args[2:])
+		if err != nil {
+			fatal(exitError, err)
+		}
+		return
+	}
+
+	// "sparkyfish-cli service" installs the daemon as a Windows service or
+	// launchd agent
+	if len(os.Args) > 1 && os.Args[1] == "service" {
+		err := serviceCommand(os.Args[2:])
+		if err != nil {
+			fatal(exitError, err)
+		}
+		return
+	}
+
+	// Ctrl-C (or SIGTERM) cancels any tests in progress
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+
+	// So does the Windows service manager, if it started us.  It expects
+	// to hear from us soon after it does, so we answer it before reading
+	// our options, and tell it when we stop however we exit, invalid
+	// options included.
+	atExit(runAsService(cancel))
+	defer runExitHooks(exitOK)
+
+	flag.BoolVar(&headless, "no-tui", false, "Run the tests without the terminal UI and print a summary to stdout")
+	flag.BoolVar(&headless, "headless", false, "Alias for -no-tui")
+	jsonOutput := flag.Bool("json", false, "Print the results to stdout as JSON (implies -no-tui)")
+	plain := flag.Bool("plain", false, "Instead of the terminal UI's charts, print the throughput as a line of text every few seconds, then a summary, for screen readers and braille displays (implies -no-tui)")
+	check := flag.Bool("check", false, "Run the tests once as a Nagios/Icinga plugin, printing a status line with perfdata and exiting with its status")
+	var warnThresholds, critThresholds thresholdFlag
+	flag.Var(&warnThresholds, "w", "With -check, the download,upload,ping thresholds for WARNING, e.g. 100mbps,10mbps,50 (ping in ms; leave any empty to skip it)")
+	flag.Var(&critThresholds, "c", "With -check, the download,upload,ping thresholds for CRITICAL")
+	ramp := flag.Bool("ramp", false, "Repeat the download and upload tests over 1, 2, 4 and 8 connections at once and print the throughput at each step, without the terminal UI")
+	pings := flag.Int("pings", sparkyfish.DefaultPings, fmt.Sprintf("Number of probes to send during the ping test (1-%v)", sparkyfish.MaxPings))
+	retries := flag.Int("retries", sparkyfish.DefaultRetries, "Number of times to retry a test if we can't connect to the server or lose the connection, waiting longer before each retry (0: don't retry)")
+	udp := flag.Bool("udp", false, "Run the download and upload tests over UDP and measure packet loss")
+	downloadOnly := flag.Bool("download-only", false, "Skip the upload test")
+	uploadOnly := flag.Bool("upload-only", false, "Skip the download test")
+	bidirectional := flag.Bool("bidirectional", false, "Run the download and upload tests at the same time")
+	var tags tagsFlag
+	flag.Var(&tags, "tag", "Tag the results with this, e.g. a location, SSID or experiment, to pick them out later, e.g. with \"history -tag\"; may be given more than once [optional]")
+	note := flag.String("note", "", "Note to keep with the results, e.g. \"after router firmware upgrade\" [optional]")
+	traceroute := flag.Bool("traceroute", false, "Trace the route to the server before testing; press [t] to see it [optional]")
+	probeMTU := flag.Bool("mtu", false, "Probe the path MTU to the server before testing, and warn about tunnels and VPNs that shrink it [optional]")
+	timeDNS := flag.Bool("dns", false, "Time how long it takes to look up the server's hostname before testing [optional]")
+	resolvers := flag.String("resolvers", "", "DNS servers to time alongside the system's resolver, e.g. 1.1.1.1,9.9.9.9; implies -dns [optional]")
+	noEnv := flag.Bool("no-env", false, "Don't record the host, interface, Wi-Fi network, gateway and public address with the results")
+	compressible := flag.Bool("compressible", false, "Send easily compressed data instead of random data, to find out whether something along the path compresses it")
+	udpRate := flag.Int("udp-rate", sparkyfish.DefaultUDPRate, "Rate (Mbit/s) at which to send datagrams during UDP tests")
+	blockSize := flag.Int("block-size", 0, fmt.Sprintf("Size (KB) of each block of data copied during TCP throughput tests (1-%v; 0: adapt to the link's speed)", sparkyfish.MaxBlockSize))
+	reportInterval := flag.Duration("report-interval", sparkyfish.DefaultReportInterval, fmt.Sprintf("How often throughput is measured (%v-%v)", sparkyfish.MinReportInterval, sparkyfish.MaxReportInterval))
+	warmUp := flag.Duration("warm-up", sparkyfish.DefaultWarmUp, "Time at the start of each throughput test to leave out of the max and avg, while TCP ramps up")
+	stallTime := flag.Duration("stall-time", sparkyfish.DefaultStallTime, "Time without any data moving during a throughput test that counts as a stall")
+	var maxBytes byteSize
+	flag.Var(&maxBytes, "max-bytes", "End each throughput test early once it has transferred this much data (e.g. 200MB) [optional]")
+	var rateLimit bitRate
+	flag.Var(&rateLimit, "limit", "Pace the TCP throughput tests to this rate in each direction (e.g. 50mbps) [optional]")
+	iface := flag.String("interface", "", "Network interface to run the tests over, e.g. eth1 (Linux only) [optional]")
+	source := flag.String("source", "", "Local address to run the tests from, for multihomed hosts [optional]")
+	dscpFlag := flag.String("dscp", "", "Mark the test traffic with this DSCP, by name (e.g. EF, AF41) or number (Linux only) [optional]")
+	congestion := flag.String("congestion", "", "TCP congestion control algorithm to test with, e.g. bbr, cubic or reno (Linux only) [optional]")
+	token := flag.String("token", "", "Token to present to private servers (default: $SPARKYFISH_TOKEN)")
+	clientCert := flag.String("client-cert", "", "Certificate (PEM) to present to private servers over wss:// or -quic, with -client-key [optional]")
+	clientKey := flag.String("client-key", "", "Private key (PEM) of -client-cert [optional]")
+	tlsCA := flag.String("tls-ca", "", "CA certificates (PEM) to verify servers over wss:// or -quic with, instead of the system's, e.g. for servers with certificates from a private CA [optional]")
+	promAddr := flag.String("prometheus", "", "Run tests every -interval (default 15m) and serve the results to Prometheus on this IP:Port (e.g. :9110)")
+	interval := flag.Duration("interval", 0, "Run the tests every interval (e.g. 15m) until killed, without the terminal UI.  With -ping-only, the time between pings (default 1s).")
+	pingOnly := flag.Bool("ping-only", false, "Monitor the latency to the server with a ping every -interval until killed")
+	historyPath := flag.String("history", defaultHistoryPath(), "Database that the results of every run are added to")
+	noHistory := flag.Bool("no-history", false, "Don't add the results to the history database")
+	influxAddr := flag.String("influx", "", "Write the results of each run to the InfluxDB server at this URL, e.g. http://localhost:8086 [optional]")
+	influxDB := flag.String("influx-db", "sparkyfish", "InfluxDB database to write the results to")
+	influxSamples := flag.Bool("influx-samples", false, "Also write each throughput measurement to InfluxDB")
+	pushgatewayAddr := flag.String("pushgateway", "", "Push the results of each run to the Prometheus Pushgateway at this URL, e.g. http://localhost:9091 [optional]")
+	webhookURL := flag.String("webhook", "", "POST the results of each run to this URL as JSON [optional]")
+	var alertDownload, alertUpload bitRate
+	flag.Var(&alertDownload, "alert-below-download", "Treat runs whose download is slower than this (e.g. 100mbps) as a breach, reported to -webhook and in the exit status [optional]")
+	flag.Var(&alertUpload, "alert-below-upload", "Treat runs whose upload is slower than this (e.g. 10mbps) as a breach [optional]")
+	alertPing := flag.Duration("alert-above-ping", 0, "Treat runs whose average ping is higher than this (e.g. 50ms) as a breach [optional]")
+	mqttAddr := flag.String("mqtt", "", "Publish the results of each run to the MQTT broker at this URL, e.g. tcp://broker:1883 [optional]")
+	mqttTopic := flag.String("mqtt-topic", "sparkyfish/results", "MQTT topic to publish the results to")
+	pprofAddr := flag.String("pprof", "", "Serve Go's profiles and runtime metrics on this IP:Port, at /debug/pprof/ and /debug/vars, without authentication, for looking into a daemon's performance, e.g. localhost:6060 [optional]")
+	jsonOut := flag.String("json-out", "", "Append the results of each run to this file, one JSON document per line [optional]")
+	csvOut := flag.String("csv", "", "Append the results of each run to this CSV file, one row per run [optional]")
+	shareURL := flag.String("share", "", "Share the results of the run with the sparkyfish share service at this URL, e.g. https://share.example.com, and show the short URL of the page that they can be seen on [optional]")
+	shareToken := flag.String("share-token", "", "Token to present to the -share service (default: $SPARKYFISH_SHARE_TOKEN)")
+	sharePersonal := flag.Bool("share-personal", false, "Include the environment, your address and city and the traceroute in the results sent to -share, which are left out otherwise, since anyone with the URL can see them")
+	reportOut := flag.String("report", "", "Write an HTML report of the run to this file, with charts of every measurement, for e.g. attaching to a support ticket [optional]")
+	debugOut := flag.String("debug", "", "Trace every protocol command, connection and measurement, with timestamps, to this file (never the screen), for attaching to bug reports [optional]")
+	chartOut := flag.String("chart", "", "Draw the download, upload and latency of each run as charts in this SVG or PNG file, replacing the last run's [optional]")
+	csvSamples := flag.Bool("csv-samples", false, "Also append each throughput measurement to a second CSV file alongside -csv, e.g. results-samples.csv")
+	historyRuns := flag.Int("history-runs", 20, "Number of past runs to chart in the history panel")
+	unitsName := flag.String("units", "mbps", "Units to show throughput in: mbps (Mbit/s), MBps (megabytes per second) or auto (Mbit/s or Gbit/s, whichever suits); results saved or sent elsewhere stay in Mbit/s")
+	langName := flag.String("lang", "", "Language to show the terminal UI in: en, de, fr or es (default: from LC_ALL, LC_MESSAGES or LANG, falling back to en); given explicitly, it also applies to the stats in -headless output")
+	themeName := flag.String("theme", "", "Colors to draw the terminal UI in: dark, light (for light terminal backgrounds), mono (no color) or colorblind (blue and yellow instead of red and green) (default: mono if NO_COLOR is set, dark otherwise)")
+	ipv4Only := flag.Bool("4", false, "Only connect to the server over IPv4")
+	ipv6Only := flag.Bool("6", false, "Only connect to the server over IPv6")
+	useQUIC := flag.Bool("quic", false, "Run the tests over QUIC instead of TCP, to compare the two, on the server's QUIC port (default "+sparkyfish.DefaultQUICPort+"), which it answers with -quic-addr")
+	auto := flag.Bool("auto", false, "Test against the server with the lowest latency instead of naming one")
+	discover := flag.Bool("discover", false, "Look for servers on the local network and choose one to test against (or the nearest, with -auto)")
+	profileName := flag.String("profile", "", "Use the settings and server of this profile from the config file (default: choose one, if there's no server to test)")
+	configPath := flag.String("config", "", "Config file to read default settings from (default: "+defaultConfigPath()+")")
+	mesh := flag.Bool("mesh", false, "With -servers, test all of the servers at the same time and chart them together")
+	registryURL := flag.String("registry", "", "Choose a server to test against (or the nearest, with -auto) from those listed by the sparkyfish registry at this URL, e.g. https://registry.example.com")
+	serverList := flag.String("servers", "", "Servers to test one after another and compare, or with -auto to choose from: host[:port],host[:port]... or a file listing one host[:port] [location] per line (default with -auto: the public servers)")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:", os.Args[0], "[options] <sparkyfish server hostname/IP>[:port]")
+		fmt.Fprintln(os.Stderr, "      ", os.Args[0], "-auto [options]")
+		fmt.Fprintln(os.Stderr, "      ", os.Args[0], "-discover [options]")
+		fmt.Fprintln(os.Stderr, "      ", os.Args[0], "-registry URL [options]")
+		fmt.Fprintln(os.Stderr, "      ", os.Args[0], "-servers host1,host2... [options]")
+		fmt.Fprintln(os.Stderr, "      ", os.Args[0], "history [options]")
+		fmt.Fprintln(os.Stderr, "      ", os.Args[0], "selftest [options]")
+		fmt.Fprintln(os.Stderr, "      ", os.Args[0], "service install|start|uninstall [options]")
+		flag.PrintDefaults()
+	}
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	err := flag.CommandLine.Parse(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		exit(exitUsage)
 	}
 
-	dest := os.Args[1]
-	i := last(dest, ':')
-	if i < 0 {
-		dest = fmt.Sprint(dest, ":7121")
+	// Fill in anything that wasn't given on the command line from our config
+	// file, and from the profile that we're using, if any
+	var cfg *config.Config
+	if *configPath != "" {
+		cfg, err = config.Load(*configPath, true)
+	} else {
+		cfg, err = config.Load(defaultConfigPath(), false)
+	}
+	if err != nil {
+		fatal(exitUsage, "config:", err)
+	}
+
+	cmdline := config.SetFlags(flag.CommandLine)
+	err = cfg.Apply(flag.CommandLine, cmdline, "server", "config", "profiles")
+	if err != nil {
+		fatal(exitUsage, "config:", err)
+	}
+
+	serverAddr := flag.Arg(0)
+	if serverAddr == "" {
+		serverAddr = cfg.Values["server"]
+	}
+
+	// Without -auto, -servers runs a campaign against each of them in turn
+	campaign := *serverList != "" && !*auto
+
+	// With nothing else to go on, we let the user pick a profile
+	if *profileName == "" && serverAddr == "" && !*auto && !*discover && *registryURL == "" && !campaign && len(profiles(cfg)) > 0 {
+		*profileName, err = chooseProfile(cfg)
+		if err != nil {
+			fatal(exitUsage, err)
+		}
+	}
+
+	if *profileName != "" {
+		var p *config.Config
+		p, err = profile(cfg, *profileName)
+		if err == nil {
+			err = p.Apply(flag.CommandLine, cmdline, append(profileKeys, "config", "profile")...)
+		}
+		var server string
+		if err == nil {
+			server, err = profileServer(p)
+		}
+		if err != nil {
+			fatal(exitUsage, fmt.Sprintf("profile %v: %v", *profileName, err))
+		}
+		if server != "" && flag.Arg(0) == "" {
+			serverAddr = server
+		}
+	}
+
+	if serverAddr == "" && !*auto && !*discover && *registryURL == "" && !campaign {
+		flag.Usage()
+		exit(exitUsage)
+	}
+
+	if *ipv4Only && *ipv6Only {
+		fatal(exitUsage, "-4 and -6 are mutually exclusive")
+	}
+
+	// Servers are only listed with their TCP port, so the server to test
+	// over QUIC has to be named
+	if *useQUIC {
+		switch {
+		case serverAddr == "" || *auto || *discover || *registryURL != "" || campaign:
+			fatal(exitUsage, "-quic needs a server named on the command line, rather than -auto, -discover, -registry or -servers")
+		case strings.Contains(serverAddr, "://"):
+			fatal(exitUsage, "-quic can't be used with a ws:// or wss:// server")
+		case *udp || *probeMTU:
+			fatal(exitUsage, "-udp and -mtu can't be run over QUIC")
+		}
+		serverAddr = "quic://" + serverAddr
+	}
+
+	if *downloadOnly && *uploadOnly {
+		fatal(exitUsage, "-download-only and -upload-only are mutually exclusive")
+	}
+
+	if *bidirectional && (*downloadOnly || *uploadOnly || *udp) {
+		fatal(exitUsage, "-bidirectional can't be combined with -download-only, -upload-only or -udp")
+	}
+
+	if *csvSamples && *csvOut == "" {
+		fatal(exitUsage, "-csv-samples needs a -csv file to go alongside")
+	}
+
+	if *traceroute && (*mesh || *pingOnly || *ramp) {
+		fatal(exitUsage, "-traceroute can't be combined with -mesh, -ping-only or -ramp")
+	}
+
+	var resolverList []string
+	if *resolvers != "" {
+		resolverList = strings.Split(*resolvers, ",")
+		err := sparkyfish.CheckResolvers(resolverList)
+		if err != nil {
+			fatal(exitUsage, "-resolvers:", err)
+		}
+		*timeDNS = true
+	}
+
+	if *probeMTU && (*mesh || *pingOnly || *ramp) {
+		fatal(exitUsage, "-mtu can't be combined with -mesh, -ping-only or -ramp")
+	}
+
+	if *timeDNS && (*mesh || *pingOnly || *ramp) {
+		fatal(exitUsage, "-dns and -resolvers can't be combined with -mesh, -ping-only or -ramp")
+	}
+
+	if *chartOut != "" && (campaign || *pingOnly || *ramp) {
+		fatal(exitUsage, "-chart draws one server's runs, so it can't be combined with -servers, -ping-only or -ramp")
+	}
+
+	if *shareURL != "" && (campaign || *interval > 0 || *pingOnly || *ramp || *check || *promAddr != "") {
+		fatal(exitUsage, "-share shares a single run, so it can't be combined with -servers, -interval, -ping-only, -ramp, -check or -prometheus")
+	}
+	if *shareToken == "" {
+		*shareToken = os.Getenv("SPARKYFISH_SHARE_TOKEN")
+	}
+
+	if *reportOut != "" && (campaign || *interval > 0 || *pingOnly || *ramp || *check || *promAddr != "") {
+		fatal(exitUsage, "-report writes up a single run, so it can't be combined with -servers, -interval, -ping-only, -ramp, -check or -prometheus")
+	}
+
+	alerts := alertThresholds{
+		minDownload: float64(alertDownload),
+		minUpload:   float64(alertUpload),
+		maxPing:     msec(*alertPing),
+	}
+	if *plain && *jsonOutput {
+		fatal(exitUsage, "-plain and -json can't be used together; both print to stdout")
+	}
+	if *plain {
+		headless = true
+	}
+
+	if *webhookURL == "" && !headless && !*jsonOutput && alerts != (alertThresholds{}) {
+		fatal(exitUsage, "the -alert thresholds need a -webhook to report to, or -no-tui to set the exit status")
+	}
+
+	if *mesh && !campaign {
+		fatal(exitUsage, "-mesh needs a list of -servers to test, without -auto")
+	}
+
+	if *mesh && *bidirectional {
+		fatal(exitUsage, "-mesh can't be combined with -bidirectional")
+	}
+
+	if campaign && (flag.Arg(0) != "" || *discover || *promAddr != "" || *interval > 0 || *pingOnly || *check) {
+		fatal(exitUsage, "-servers can't be combined with a server to test, -discover, -prometheus, -interval, -ping-only or -check, unless it's with -auto")
+	}
+
+	if *registryURL != "" && (flag.Arg(0) != "" || *discover || *serverList != "") {
+		fatal(exitUsage, "-registry can't be combined with a server to test, -discover or -servers")
+	}
+
+	if *ramp && (campaign || *promAddr != "" || *interval > 0 || *pingOnly || *check || *udp || *bidirectional) {
+		fatal(exitUsage, "-ramp can't be combined with -servers, -prometheus, -interval, -ping-only, -check, -udp or -bidirectional")
+	}
+
+	if *check && (*promAddr != "" || *interval > 0 || *pingOnly) {
+		fatal(exitUsage, "-check can't be combined with -prometheus, -interval or -ping-only")
+	}
+
+	if !*check && (warnThresholds != (thresholdFlag{}) || critThresholds != (thresholdFlag{})) {
+		fatal(exitUsage, "-w and -c only apply to -check")
+	}
+
+	if *pingOnly && *promAddr != "" {
+		fatal(exitUsage, "-ping-only and -prometheus are mutually exclusive")
+	}
+
+	if *compressible && (*udp || *bidirectional) {
+		fatal(exitUsage, "-compressible only applies to TCP download and upload tests, not -udp or -bidirectional")
+	}
+
+	if *udpRate < 1 {
+		fatal(exitUsage, "-udp-rate must be at least 1 Mbit/s")
+	}
+
+	if *blockSize < 0 || *blockSize > sparkyfish.MaxBlockSize {
+		fatal(exitUsage, "-block-size must be between 0 and", sparkyfish.MaxBlockSize)
+	}
+
+	if *reportInterval < sparkyfish.MinReportInterval || *reportInterval > sparkyfish.MaxReportInterval {
+		fatal(exitUsage, fmt.Sprintf("-report-interval must be between %v and %v", sparkyfish.MinReportInterval, sparkyfish.MaxReportInterval))
+	}
+
+	if *warmUp < 0 || *warmUp >= sparkyfish.MaxWarmUp {
+		fatal(exitUsage, "-warm-up must be shorter than", sparkyfish.MaxWarmUp)
+	}
+
+	if *stallTime <= 0 {
+		fatal(exitUsage, "-stall-time must be positive")
+	}
+
+	if *interval < 0 {
+		fatal(exitUsage, "-interval must be positive")
+	}
+
+	if *retries < 0 {
+		fatal(exitUsage, "-retries can't be negative")
+	}
+
+	if *historyRuns < 1 {
+		fatal(exitUsage, "-history-runs must be at least 1")
+	}
+
+	err = useTheme(*themeName)
+	if err != nil {
+		fatal(exitUsage, err)
+	}
+	err = useUnits(*unitsName)
+	if err != nil {
+		fatal(exitUsage, err)
+	}
+	// Scripts read headless output, so it's only translated when asked
+	if *langName != "" || !(headless || *jsonOutput) {
+		err = useLang(*langName)
+		if err != nil {
+			fatal(exitUsage, err)
+		}
+	}
+
+	if *pings < 1 || *pings > sparkyfish.MaxPings {
+		fatal(exitUsage, "-pings must be between 1 and", sparkyfish.MaxPings)
+	}
+
+	var sourceIP net.IP
+	if *source != "" {
+		sourceIP = net.ParseIP(*source)
+		if sourceIP == nil {
+			fatal(exitUsage, "-source must be an IP address")
+		}
+	}
+
+	var dscp int
+	if *dscpFlag != "" {
+		var err error
+		dscp, err = sparkyfish.ParseDSCP(*dscpFlag)
+		if err != nil {
+			fatal(exitUsage, "-dscp must be a DSCP name or a number between 0 and", sparkyfish.MaxDSCP)
+		}
+	}
+
+	tlsConfig, err := clientTLSConfig(*clientCert, *clientKey, *tlsCA)
+	if err != nil {
+		fatal(exitUsage, err)
+	}
+
+	// The trace is written as we go, so that it's there even if we crash
+	var trace *slog.Logger
+	if *debugOut != "" {
+		f, err := os.Create(*debugOut)
+		if err != nil {
+			fatal(exitError, err)
+		}
+		defer f.Close()
+		trace = slog.New(slog.NewTextHandler(f, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		trace.Debug("started", "args", os.Args[1:], "go", runtime.Version(), "os", runtime.GOOS, "arch", runtime.GOARCH)
+	}
+
+	network := "tcp"
+	if *ipv4Only {
+		network = "tcp4"
+	} else if *ipv6Only {
+		network = "tcp6"
+	}
+
+	newClient := func(addr string) (*sparkyfish.Client, error) {
+		client, err := sparkyfish.NewClient(addr)
+		if err != nil {
+			return nil, err
+		}
+		client.Network = network
+		client.Pings = *pings
+		client.Retries = *retries
+		client.UDP = *udp
+		client.SkipDownload = *uploadOnly
+		client.SkipUpload = *downloadOnly
+		client.Bidirectional = *bidirectional
+		client.Compressible = *compressible
+		client.Tags = tags
+		client.Note = *note
+		client.CaptureEnvironment = !*noEnv
+		client.TracePath = *traceroute
+		client.TimeDNS = *timeDNS
+		client.ProbeMTU = *probeMTU
+		client.Resolvers = resolverList
+		client.UDPRate = *udpRate
+		client.BlockSize = *blockSize
+		client.ReportInterval = *reportInterval
+		client.WarmUp = *warmUp
+		client.StallTime = *stallTime
+		client.MaxBytes = int64(maxBytes)
+		client.RateLimit = float64(rateLimit)
+		client.Congestion = *congestion
+		client.Interface = *iface
+		client.Source = sourceIP
+		client.DSCP = dscp
+		client.Token = *token
+		if client.Token == "" {
+			client.Token = os.Getenv("SPARKYFISH_TOKEN")
+		}
+		client.TLSConfig = tlsConfig
+		client.Logger = trace
+		client.OnRedirect = func(from, to string) {
+			log.Printf("%v is busy and sent us to %v", from, to)
+		}
+		client.OnRetry = func(r sparkyfish.Retry) {
+			log.Printf("%v; retrying in %v (%v of %v)", r.Err, r.Wait, r.Attempt, client.Retries)
+		}
+		return client, nil
+	}
+
+	if *pprofAddr != "" {
+		err = servePprof(ctx, *pprofAddr)
+		if err != nil {
+			fatal(exitUsage, err)
+		}
+	}
+
+	var client *sparkyfish.Client
+	var picker *serverPicker
+	var candidates []sparkyfish.Candidate
+
+	// Figure out which servers we're choosing from, if we weren't given one
+	switch {
+	case *discover:
+		candidates, err = discoverServers(ctx)
+		if err != nil {
+			fatal(exitConnectFailed, err)
+		}
+	case *serverList != "":
+		candidates, err = loadServers(*serverList)
+		if err != nil {
+			fatal(exitUsage, err)
+		}
+	case *registryURL != "":
+		candidates, err = loadRegistry(ctx, *registryURL)
+		if err != nil {
+			fatal(exitConnectFailed, err)
+		}
+	case *auto:
+		candidates = sparkyfish.PublicServers
+	}
+
+	var campaignClients []*sparkyfish.Client
+	switch {
+	case campaign:
+		for _, c := range candidates {
+			client, err = newClient(c.Addr)
+			if err != nil {
+				break
+			}
+			campaignClients = append(campaignClients, client)
+		}
+	case *auto:
+		picker = &serverPicker{candidates: candidates, network: network, newClient: newClient, registry: *registryURL}
+	case *discover || *registryURL != "":
+		var choice sparkyfish.Candidate
+		choice, err = chooseServer(candidates)
+		if err != nil {
+			fatal(exitAborted, err)
+		}
+		client, err = newClient(choice.Addr)
+	default:
+		client, err = newClient(serverAddr)
+	}
+	if err != nil {
+		fatal(exitUsage, err)
+	}
+
+	var hist *history
+	if !*noHistory {
+		hist = newHistory(*historyPath)
+	}
+
+	var sinks sinkList
+	if *influxAddr != "" {
+		is, err := newInfluxSink(*influxAddr, *influxDB, *influxSamples)
+		if err != nil {
+			fatal(exitUsage, err)
+		}
+		sinks = append(sinks, is)
+	}
+	if *pushgatewayAddr != "" {
+		ps, err := newPushgatewaySink(*pushgatewayAddr)
+		if err != nil {
+			fatal(exitUsage, err)
+		}
+		sinks = append(sinks, ps)
+	}
+	if *webhookURL != "" {
+		ws, err := newWebhookSink(*webhookURL, alerts)
+		if err != nil {
+			fatal(exitUsage, err)
+		}
+		sinks = append(sinks, ws)
+	}
+	if *mqttAddr != "" {
+		ms, err := newMQTTSink(*mqttAddr, *mqttTopic)
+		if err != nil {
+			fatal(exitUsage, err)
+		}
+		sinks = append(sinks, ms)
+	}
+	if *jsonOut != "" {
+		sinks = append(sinks, &jsonFileSink{path: *jsonOut})
+	}
+	if *csvOut != "" {
+		sinks = append(sinks, newCSVSink(*csvOut, *csvSamples))
+	}
+	if *chartOut != "" {
+		cs, err := newChartFileSink(*chartOut, *reportInterval)
+		if err != nil {
+			fatal(exitUsage, err)
+		}
+		sinks = append(sinks, cs)
+	}
+
+	if campaign && *mesh {
+		exit(runMesh(ctx, cancel, campaignClients, hist, sinks, headless || *jsonOutput, *jsonOutput))
+	}
+	if campaign {
+		exit(runCampaign(ctx, campaignClients, hist, sinks, *jsonOutput))
+	}
+
+	// Our daemons, checks, ramp tests and the latency monitor pick a server
+	// once, up front
+	if picker != nil && (*promAddr != "" || *interval > 0 || *pingOnly || *check || *ramp) {
+		client, err = picker.pick(ctx, nil)
+		if err != nil {
+			fatal(exitConnectFailed, "unable to pick a server:", err)
+		}
+		log.Println("Selected", client.Addr())
+	}
+
+	if *promAddr != "" {
+		if *interval == 0 {
+			*interval = 15 * time.Minute
+		}
+
+		// Run as a Prometheus exporter until we're interrupted
+		listener, err := net.Listen("tcp", *promAddr)
+		if err != nil {
+			fatal(exitUsage, err)
+		}
+		sinks.attach(client)
+		err = runExporter(ctx, client, listener, *interval, hist, sinks)
+		if err != nil {
+			fatal(exitError, err)
+		}
+		return
+	}
+
+	if *check {
+		sinks.attach(client)
+		exit(runCheck(ctx, client, alertThresholds(warnThresholds), alertThresholds(critThresholds), hist, sinks))
+	}
+
+	if *ramp {
+		exit(runRamp(ctx, client, *jsonOutput))
+	}
+
+	if *pingOnly {
+		if *interval == 0 {
+			*interval = time.Second
+		}
+
+		// Monitor the latency to the server until we're interrupted
+		err = runMonitor(ctx, cancel, client, *interval, headless || *jsonOutput, *jsonOutput)
+		if err != nil {
+			fatal(exitCode(err), err)
+		}
+		return
+	}
+
+	if *interval > 0 {
+		// Run as a daemon until we're interrupted
+		sinks.attach(client)
+		runDaemon(ctx, client, *interval, hist, sinks, *jsonOutput)
+		return
+	}
+
+	var plainOut *plainSink
+	if *plain {
+		plainOut = newPlainSink(os.Stdout)
+		sinks = append(sinks, plainOut)
+	}
+	sc := newsparkyClient(client, sinks)
+	sc.plain = plainOut
+	sc.reportPath = *reportOut
+	sc.shareURL, sc.shareToken, sc.sharePersonal = *shareURL, *shareToken, *sharePersonal
+	sc.headless = headless || *jsonOutput
+	sc.history = hist
+	sc.historyRuns = *historyRuns
+	sc.picker = picker
+
+	sc.wr = newRenderer(sc.headless)
+
+	if sc.headless {
+		// Run our tests in the foreground and print the results when they're done
+		err = sc.runTestSequence(ctx)
+		if ctx.Err() != nil {
+			fatal(exitAborted, "tests cancelled")
+		}
+		if err != nil {
+			fatal(exitCode(err), err)
+		}
+		if *jsonOutput {
+			err := writeJSON(os.Stdout, sc.results)
+			if err != nil {
+				fatal(exitAborted, "error writing results:", err)
+			}
+		} else {
+			printSummary(os.Stdout, sc.results)
+		}
+		// With -json, stdout is only for the results
+		switch {
+		case sc.sharedAt != "" && *jsonOutput:
+			log.Println("shared the results at", sc.sharedAt)
+		case sc.sharedAt != "":
+			fmt.Println("\nShared at:", sc.sharedAt)
+		}
+
+		if breaches := alerts.check(sc.results); len(breaches) > 0 {
+			fatal(exitBreach, "alert:", breachText(breaches))
+		}
+		return
 	}
 
 	// Initialize our screen
-	err := termui.Init()
+	scr, err := openScreen()
 	if err != nil {
 		panic(err)
 	}
 
-	defer termui.Close()
+	defer scr.close()
 
-	// 'q' quits the program
-	termui.Handle("/sys/kbd/q", func(termui.Event) {
-		termui.StopLoop()
+	// 'q' quits the program, cancelling any tests in progress
+	scr.handle("q", func(termui.Event) {
+		cancel()
 	})
 	// 'Q' also works
-	termui.Handle("/sys/kbd/Q", func(termui.Event) {
-		termui.StopLoop()
+	scr.handle("Q", func(termui.Event) {
+		cancel()
+	})
+	// The terminal UI swallows Ctrl-C, so we handle it ourselves
+	scr.handle("<C-c>", func(termui.Event) {
+		cancel()
 	})
 
-	sc := newsparkyClient()
-	sc.serverHostname = dest
+	// 'h' toggles the history panel
+	sc.historyPanel = &historyPanel{}
+	if client != nil {
+		sc.historyPanel.load(sc.history, sc.serverHostname, sc.historyRuns)
+	}
+	scr.handle("h", func(termui.Event) {
+		sc.toggleHistoryPanel()
+	})
+	scr.handle("H", func(termui.Event) {
+		sc.toggleHistoryPanel()
+	})
 
-	sc.prepareChannels()
+	// 'a' toggles the advanced (TCP) stats panel
+	sc.tcpPanel = &tcpPanel{}
+	scr.handle("a", func(termui.Event) {
+		sc.toggleTCPPanel()
+	})
+	scr.handle("A", func(termui.Event) {
+		sc.toggleTCPPanel()
+	})
+
+	// 't' toggles the route panel
+	sc.routePanel = &routePanel{text: msg("Run with -traceroute to trace the route to the server\nbefore the tests.")}
+	scr.handle("t", func(termui.Event) {
+		sc.toggleRoutePanel()
+	})
+	scr.handle("T", func(termui.Event) {
+		sc.toggleRoutePanel()
+	})
+
+	// 'p' pauses the throughput graphs, and '+' and '-' zoom them in and out
+	scr.handle("p", func(termui.Event) {
+		sc.tui.togglePause()
+	})
+	scr.handle("P", func(termui.Event) {
+		sc.tui.togglePause()
+	})
+	for _, key := range []string{"+", "="} {
+		scr.handle(key, func(termui.Event) {
+			sc.tui.zoom(true)
+		})
+	}
+	scr.handle("-", func(termui.Event) {
+		sc.tui.zoom(false)
+	})
+
+	// Once the tests are done, 'v' toggles the review panel, and the arrow
+	// keys turn its pages
+	sc.review = &reviewPanel{}
+	scr.handle("v", func(termui.Event) {
+		sc.toggleReview()
+	})
+	scr.handle("V", func(termui.Event) {
+		sc.toggleReview()
+	})
+	scr.handle("<Left>", func(termui.Event) {
+		sc.turnReviewPage(false)
+	})
+	scr.handle("<Right>", func(termui.Event) {
+		sc.turnReviewPage(true)
+	})
+
+	// '?' toggles the help overlay, which welcomes the user the first time
+	// that they run us
+	sc.help = &helpOverlay{}
+	if hist.isNew() {
+		sc.help.shown, sc.help.welcome = true, true
+	}
+	scr.handle("?", func(termui.Event) {
+		sc.toggleHelp()
+	})
+
+	// Our widgets re-flow to fit the terminal whenever it's resized
+	scr.handle("<Resize>", func(e termui.Event) {
+		sc.resize(e.Payload.(termui.Resize).Width)
+	})
 
-	sc.wr = newwidgetRenderer()
+	// 'r' runs the tests again, 's' skips the test that's running, and 'e'
+	// exports the results so far
+	scr.handle("r", func(termui.Event) {
+		sc.requestRetry()
+	})
+	scr.handle("R", func(termui.Event) {
+		sc.requestRetry()
+	})
+	scr.handle("s", func(termui.Event) {
+		sc.control.skip()
+	})
+	scr.handle("S", func(termui.Event) {
+		sc.control.skip()
+	})
+	scr.handle("e", func(termui.Event) {
+		sc.exportResults()
+	})
+	scr.handle("E", func(termui.Event) {
+		sc.exportResults()
+	})
 
 	// Begin our tests
-	go sc.runTestSequence()
+	sequenceDone := make(chan struct{})
+	go func() {
+		sc.supervise(ctx)
+		close(sequenceDone)
+	}()
 
-	termui.Loop()
+	// Once we've been cancelled, give the tests a moment to hang up on the
+	// server before we tear down the screen
+	go func() {
+		<-ctx.Done()
+		select {
+		case <-sequenceDone:
+		case <-time.After(5 * time.Second):
+		}
+		scr.stopLoop()
+	}()
+
+	scr.loop()
 }
 
-// NewsparkyClient creates a new sparkyClient object
-func newsparkyClient() *sparkyClient {
-	m := sparkyClient{}
+// newsparkyClient creates a new sparkyClient object that runs its tests with
+// client and sends the results to sinks.  If client is nil, a server is picked
+// when the tests begin.
+func newsparkyClient(client *sparkyfish.Client, sinks sinkList) *sparkyClient {
+	sc := &sparkyClient{retry: make(chan struct{})}
 
-	// Make a 10MB byte slice to hold our random data blob
-	m.randomData = make([]byte, 1024*1024*10)
+	// The screen comes first, so that it never waits on a slow sink
+	sc.tui = &tuiSink{sc: sc}
+	sc.sinks = append(sinkList{sc.tui}, sinks...)
 
-	// Use a randbo Reader to fill our big slice with random data
-	_, err := randbo.New().Read(m.randomData)
-	if err != nil {
-		log.Fatalln("error generating random data:", err)
+	if client != nil {
+		sc.setClient(client)
 	}
+	return sc
+}
+
+// setClient makes sc run its tests with client
+func (sc *sparkyClient) setClient(client *sparkyfish.Client) {
+	sc.client = client
+	sc.serverHostname = client.Addr()
 
-	// Create a bytes.Reader over this byte slice
-	m.randReader = bytes.NewReader(m.randomData)
+	// Relay ping times from the client to our ping processor, and
+	// throughput measurements to our sinks
+	client.OnPing = func(ps sparkyfish.PingSample) {
+		sc.pingTime <- ps
+	}
+	sc.sinks.attach(client)
 
-	return &m
+	// A busy server may send us to another one, which we then test
+	// against.  Logging it would scribble over the screen, so we show it
+	// on our banner instead, until the new server's banner replaces it.
+	client.OnRedirect = func(from, to string) {
+		sc.serverHostname = to
+		sc.resultsMu.Lock()
+		sc.results.Server = to
+		sc.resultsMu.Unlock()
+		if sc.headless {
+			log.Printf("%v is busy and sent us to %v", from, to)
+			return
+		}
+		sc.wr.SetText("bannerbox", fmt.Sprintf("%v is busy; trying %v", from, to))
+		sc.wr.Render()
+	}
+
+	// A test that's retried starts over, so what we've drawn of it so far
+	// goes, and we say why on our banner for a while
+	client.OnRetry = func(r sparkyfish.Retry) {
+		if sc.headless {
+			log.Printf("%v; retrying in %v (%v of %v)", r.Err, r.Wait, r.Attempt, client.Retries)
+			return
+		}
+		sc.progressBarReset <- true
+		sc.tui.restart()
+		sc.flashBanner(fmt.Sprintf(msg("Retrying in %v (%v of %v): %v"), r.Wait, r.Attempt, client.Retries, r.Err))
+	}
 }
 
 func (sc *sparkyClient) prepareChannels() {
 
 	// Prepare some channels that we'll use for measuring
 	// throughput and latency
-	sc.blockTicker = make(chan bool, 200)
-	sc.throughputReport = make(chan float64)
-	sc.pingTime = make(chan time.Duration, 10)
-	sc.pingProgressTicker = make(chan bool, numPings)
+	sc.pingTime = make(chan sparkyfish.PingSample, 10)
+	sc.pingProgressTicker = make(chan bool, sparkyfish.MaxPings)
 
 	// Prepare some channels that we'll use to signal
 	// various state changes in the testing process
-	sc.pingProcessorReady = make(chan struct{})
-	sc.changeToUpload = make(chan struct{})
-	sc.statsGeneratorDone = make(chan struct{})
 	sc.testDone = make(chan bool)
 	sc.progressBarReset = make(chan bool)
 	sc.allTestsDone = make(chan struct{})
+	sc.testsFailed = make(chan struct{})
+
+}
+
+// runTestSequence builds our widgets and runs the tests once
+func (sc *sparkyClient) runTestSequence(ctx context.Context) error {
+	sc.buildWidgets()
+	return sc.runTests(ctx)
+}
+
+// supervise builds our widgets and runs the tests.  If they fail, the error is
+// displayed, and if they succeed, we switch to the review panel, until the
+// user asks us to run them again.  The user may also start over while the
+// tests are running.  It returns when ctx is cancelled.
+func (sc *sparkyClient) supervise(ctx context.Context) {
+	sc.buildWidgets()
+
+	for {
+		err := sc.runTests(sc.control.startRun(ctx))
+		restarted := sc.control.endRun()
+		if ctx.Err() != nil {
+			return
+		}
+		if restarted {
+			continue
+		}
+
+		if err == nil {
+			sc.showReview()
+		} else {
+			sc.showError(err)
+		}
+		select {
+		case <-sc.retry:
+		case <-ctx.Done():
+			return
+		}
+		if err == nil {
+			sc.hideReview()
+		} else {
+			sc.hideError()
+		}
+	}
+}
 
+// requestRetry asks the supervisor to run the tests again, cancelling them
+// first if they're running
+func (sc *sparkyClient) requestRetry() {
+	if sc.control.restart() {
+		return
+	}
+	select {
+	case sc.retry <- struct{}{}:
+	default:
+	}
 }
 
-func (sc *sparkyClient) runTestSequence() {
-	// First, we need to build the widgets on our screen.
+// buildWidgets builds the widgets on our screen
+func (sc *sparkyClient) buildWidgets() {
 
 	// Build our title box
-	titleBox := termui.NewPar("──────[ sparkyfish ]────────────────────────────────────────")
-	titleBox.Height = 1
-	titleBox.Width = 60
-	titleBox.Y = 0
-	titleBox.Border = false
-	titleBox.TextFgColor = termui.ColorWhite | termui.AttrBold
+	titleBox := newTextBox("──────[ sparkyfish ]────────────────────────────────────────", colors.text, 0, 0, 60, 1)
+	borderless(&titleBox.Block)
 
 	// Build the server name/location banner line
-	bannerBox := termui.NewPar("")
-	bannerBox.Height = 1
-	bannerBox.Width = 60
-	bannerBox.Y = 1
-	bannerBox.Border = false
-	bannerBox.TextFgColor = termui.ColorRed | termui.AttrBold
+	bannerBox := newTextBox("", colors.banner, 0, 1, 60, 1)
+	borderless(&bannerBox.Block)
+
+	// The graphs share the terminal's width, so that they can show as much
+	// of each test as possible
+	var columns int
+	if !sc.headless {
+		columns, _ = termui.TerminalDimensions()
+	}
+	graphWidth := graphWidth(columns)
 
 	// Build a download graph widget
-	dlGraph := termui.NewLineChart()
-	dlGraph.BorderLabel = " Download Speed (Mbit/s)"
-	dlGraph.Data = []float64{0}
-	dlGraph.Width = 30
-	dlGraph.Height = 12
+	dlGraph := newLineChart(colors.download)
+	dlGraph.Title = fmt.Sprintf(msg(" Download Speed (%v)"), unitFor(0).name)
 	dlGraph.PaddingTop = 1
-	dlGraph.X = 0
-	dlGraph.Y = 6
-	// Windows Command Prompt doesn't support our Unicode characters with the default font
-	if runtime.GOOS == "windows" {
-		dlGraph.Mode = "dot"
-		dlGraph.DotStyle = '+'
-	}
-	dlGraph.AxesColor = termui.ColorWhite
-	dlGraph.LineColor = termui.ColorGreen | termui.AttrBold
+	dlGraph.SetRect(0, 6, graphWidth, 18)
 
 	// Build an upload graph widget
-	ulGraph := termui.NewLineChart()
-	ulGraph.BorderLabel = " Upload Speed (Mbit/s)"
-	ulGraph.Data = []float64{0}
-	ulGraph.Width = 30
-	ulGraph.Height = 12
+	ulGraph := newLineChart(colors.upload)
+	ulGraph.Title = fmt.Sprintf(msg(" Upload Speed (%v)"), unitFor(0).name)
 	ulGraph.PaddingTop = 1
-	ulGraph.X = 30
-	ulGraph.Y = 6
-	// Windows Command Prompt doesn't support our Unicode characters with the default font
-	if runtime.GOOS == "windows" {
-		ulGraph.Mode = "dot"
-		ulGraph.DotStyle = '+'
-	}
-	ulGraph.AxesColor = termui.ColorWhite
-	ulGraph.LineColor = termui.ColorGreen | termui.AttrBold
-
-	latencyGraph := termui.NewSparkline()
-	latencyGraph.LineColor = termui.ColorCyan
-	latencyGraph.Height = 3
-
-	latencyGroup := termui.NewSparklines(latencyGraph)
-	latencyGroup.Y = 3
-	latencyGroup.Height = 3
-	latencyGroup.Width = 30
-	latencyGroup.Border = false
-	latencyGroup.Lines[0].Data = []int{0}
-
-	latencyTitle := termui.NewPar("Latency")
-	latencyTitle.Height = 1
-	latencyTitle.Width = 30
-	latencyTitle.Border = false
-	latencyTitle.TextFgColor = termui.ColorGreen
-	latencyTitle.Y = 2
-
-	latencyStats := termui.NewPar("")
-	latencyStats.Height = 4
-	latencyStats.Width = 30
-	latencyStats.X = 32
-	latencyStats.Y = 2
-	latencyStats.Border = false
-	latencyStats.TextFgColor = termui.ColorWhite | termui.AttrBold
-	latencyStats.Text = "Last: 30ms\nMin: 2ms\nMax: 34ms"
+	ulGraph.SetRect(graphWidth, 6, 2*graphWidth, 18)
+
+	latencyGraph := widgets.NewSparkline()
+	latencyGraph.LineColor = colors.latency.Fg
+
+	latencyGroup := widgets.NewSparklineGroup(latencyGraph)
+	latencyGroup.SetRect(0, 3, 30, 6)
+	borderless(&latencyGroup.Block)
+
+	latencyTitle := newTextBox(msg("Latency"), colors.heading, 0, 2, 30, 1)
+	borderless(&latencyTitle.Block)
+
+	latencyStats := newTextBox("", colors.text, 32, 2, 28, 2)
+	borderless(&latencyStats.Block)
+
+	// Build a jitter stats widget
+	jitterStats := newTextBox("", colors.text, 32, 4, 28, 2)
+	borderless(&jitterStats.Block)
 
 	// Build a stats summary widget
-	statsSummary := termui.NewPar("")
-	statsSummary.Height = 7
-	statsSummary.Width = 60
-	statsSummary.Y = 18
-	statsSummary.BorderLabel = " Throughput Summary "
-	statsSummary.Text = fmt.Sprintf("DOWNLOAD \nCurrent: -- Mbit/s\tMax: --\tAvg: --\n\nUPLOAD\nCurrent: -- Mbit/s\tMax: --\tAvg: --")
-	statsSummary.TextFgColor = termui.ColorWhite | termui.AttrBold
+	statsSummary := newTextBox("", colors.text, 0, 18, 60, 8)
+	statsSummary.Title = msg(" Throughput Summary ")
 
 	// Build out progress gauge widget
-	progress := termui.NewGauge()
-	progress.Percent = 40
-	progress.Width = 60
-	progress.Height = 3
-	progress.Y = 25
-	progress.X = 0
-	progress.Border = true
-	progress.BorderLabel = " Test Progress "
-	progress.Percent = 0
-	progress.BarColor = termui.ColorRed
-	progress.BorderFg = termui.ColorWhite
-	progress.PercentColorHighlighted = termui.ColorWhite | termui.AttrBold
-	progress.PercentColor = termui.ColorWhite | termui.AttrBold
+	progress := newProgressBar()
+	progress.Title = msg(" Test Progress ")
+	progress.SetRect(0, 26, 60, 29)
+
+	// Build a server status widget, which takes the place of the stats
+	// summary widget until the throughput tests begin
+	statusBox := newTextBox("", colors.text, 0, 18, 60, 8)
+	statusBox.Title = msg(" Server Info ")
+
+	// Build an error widget, which takes the place of the stats summary
+	// widget if the tests fail
+	errorBox := newTextBox("", colors.text, 0, 18, 60, 8)
+	errorBox.Title = msg(" Error ")
+	errorBox.BorderStyle = colors.alert
+	errorBox.WrapText = true
 
 	// Build our helpbox widget
-	helpBox := termui.NewPar(" COMMANDS: [q]uit")
-	helpBox.Height = 1
-	helpBox.Width = 60
-	helpBox.Y = 28
-	helpBox.Border = false
-	helpBox.TextBgColor = termui.ColorBlue
-	helpBox.TextFgColor = termui.ColorYellow | termui.AttrBold
-	helpBox.Bg = termui.ColorBlue
+	helpBox := newHelpBar(msg(helpText), 29)
 
 	// Add the widgets to the rendering jobs and render the screen
 	sc.wr.Add("titlebox", titleBox)
@@ -257,37 +1094,220 @@ func (sc *sparkyClient) runTestSequence() {
 	sc.wr.Add("latency", latencyGroup)
 	sc.wr.Add("latencytitle", latencyTitle)
 	sc.wr.Add("latencystats", latencyStats)
+	sc.wr.Add("jitterstats", jitterStats)
 	sc.wr.Add("statsSummary", statsSummary)
+	sc.wr.Add("errorbox", errorBox)
+	sc.wr.Hide("errorbox")
+	sc.wr.Add("statusbox", statusBox)
+	sc.wr.Hide("statusbox")
 	sc.wr.Add("progress", progress)
 	sc.wr.Add("helpbox", helpBox)
+	if sc.historyPanel != nil {
+		sc.addHistoryWidgets()
+	}
+	if sc.tcpPanel != nil {
+		sc.addTCPWidgets()
+	}
+	if sc.routePanel != nil {
+		sc.addRouteWidgets()
+	}
+	if sc.review != nil {
+		sc.addReviewWidgets()
+	}
+	if sc.help != nil {
+		sc.addHelpWidgets()
+	}
+	sc.layout(columns)
+}
+
+// resetWidgets puts our widgets back the way they look before any tests run
+func (sc *sparkyClient) resetWidgets() {
+	sc.wr.SetData("dlgraph", []float64{0})
+	sc.wr.SetData("ulgraph", []float64{0})
+	sc.wr.SetData("latency", []float64{0})
+	placeholder := fmt.Sprintf(msg(statsFormat), "-- "+unitFor(0).name, "--", "--", "--", "--", "--", "--")
+	sc.wr.SetText("latencystats", fmt.Sprintf(msg("Min/Avg/Max\n%v/%v/%v ms"), "--", "--", "--"))
+	sc.wr.SetText("jitterstats", fmt.Sprintf(msg("Jitter/σ\n%v/%v ms"), "--", "--"))
+	sc.wr.SetText("statsSummary", msg("DOWNLOAD")+" \n"+placeholder+"\n"+msg("UPLOAD")+"\n"+placeholder)
+	sc.wr.SetPercent("progress", 0)
+	if sc.historyPanel != nil {
+		sc.updateHistoryPanel(sparkyfish.ThroughputResult{}, sparkyfish.ThroughputResult{})
+	}
+	if sc.tcpPanel != nil {
+		sc.updateTCPPanel()
+	}
 	sc.wr.Render()
+}
+
+// runTests runs the full test suite once, updating our widgets as it goes.
+// If any test fails, the remaining tests are skipped and the error returned.
+func (sc *sparkyClient) runTests(ctx context.Context) error {
+	sc.setResults(sparkyfish.Results{Server: sc.serverHostname, StartTime: time.Now()})
+
+	sc.prepareChannels()
+	sc.resetWidgets()
 
 	// Launch a progress bar updater
 	go sc.updateProgressBar()
 
-	// Start our ping test and block until it's complete
-	sc.pingTest()
+	// With -auto, we don't know which server to test until we've pinged them all
+	if sc.client == nil {
+		err := sc.selectServer(ctx)
+		if err != nil {
+			return sc.testFailed(connectError{err})
+		}
+		sc.resultsMu.Lock()
+		sc.results.Server = sc.serverHostname
+		sc.resultsMu.Unlock()
+	}
 
-	// Start our stats generator, which receives realtime measurements from the throughput
-	// reporter and generates metrics from them
-	go sc.generateStats()
+	// Our client runs the tests, and tells us how each stage goes
+	runError := sc.followStages(ctx)
+	r, err := sc.client.Run(ctx)
+	sc.setResults(r)
+	if err != nil {
+		return sc.testFailed(runError(err))
+	}
 
-	// Run our download tests and block until that's done
-	sc.runThroughputTest(inbound)
+	// Notify the progress bar updater to change the bar color to green
+	close(sc.allTestsDone)
 
-	// Signal to our MeasureThroughput that we're about to begin the upload test
-	close(sc.changeToUpload)
+	// Keep a record of this run.  Failing to do so isn't worth interrupting
+	// the user over, unless they're watching stderr.
+	err = sc.history.add(sc.results)
+	if err != nil && sc.headless {
+		log.Println("error recording results in history:", err)
+	}
+	sc.sinks.results(sc.results, sc.headless)
 
-	// Run an outbound (upload) throughput test and block until it's complete
-	sc.runThroughputTest(outbound)
+	if sc.reportPath != "" {
+		dl, ul := sc.tui.samples()
+		err = writeReport(sc.reportPath, sc.results, dl, ul, sc.pings, sc.client.ReportInterval)
+		switch {
+		case sc.headless && err != nil:
+			log.Println(err)
+		case err != nil:
+			sc.flashBanner(err.Error())
+		}
+	}
 
-	// Signal to our generators that the upload test is complete
-	close(sc.statsGeneratorDone)
+	if sc.shareURL != "" {
+		sc.shareResults(ctx)
+	}
 
-	// Notify the progress bar updater to change the bar color to green
-	close(sc.allTestsDone)
+	return nil
+}
+
+// setResults replaces the results of the run so far with r
+func (sc *sparkyClient) setResults(r sparkyfish.Results) {
+	sc.resultsMu.Lock()
+	defer sc.resultsMu.Unlock()
+	sc.results = r
+}
+
+// currentResults returns a copy of the results of the run so far
+func (sc *sparkyClient) currentResults() sparkyfish.Results {
+	sc.resultsMu.Lock()
+	defer sc.resultsMu.Unlock()
+	return sc.results
+}
+
+// resultsSoFar returns a copy of the results of the run so far, with the
+// stats of any throughput test that's still running in place of the results
+// that it has yet to report
+func (sc *sparkyClient) resultsSoFar() sparkyfish.Results {
+	r := sc.currentResults()
+
+	dl, ul, ok := sc.tui.live()
+	if !ok {
+		return r
+	}
+	if r.Download.Bytes == 0 && !r.Download.Skipped {
+		r.Download = dl
+	}
+	if r.Upload.Bytes == 0 && !r.Upload.Skipped {
+		r.Upload = ul
+	}
+	return r
+}
+
+// shareResults shares our results with our share service, and shows where
+// they can be seen on our banner, until the next run
+func (sc *sparkyClient) shareResults(ctx context.Context) {
+	sc.sharedAt = ""
+	shared, err := sparkyfish.ShareResults(ctx, sc.shareURL, sc.shareToken, sc.results, sc.sharePersonal)
+	switch {
+	case sc.headless && err != nil:
+		log.Println("error sharing the results:", err)
+		return
+	case err != nil:
+		sc.flashBanner(fmt.Sprintf("Unable to share the results: %v", err))
+		return
+	}
+
+	sc.sharedAt = shared.URL
+	if !sc.headless {
+		sc.wr.SetText("bannerbox", "Shared at "+shared.URL)
+		sc.wr.Render()
+	}
+}
 
-	return
+// testFailed stops the progress bar updater after a test fails and passes
+// err back to the caller
+func (sc *sparkyClient) testFailed(err error) error {
+	close(sc.testsFailed)
+	return err
+}
+
+// showServerStatus replaces the stats summary widget with the server's INFO
+// response
+func (sc *sparkyClient) showServerStatus(st sparkyfish.ServerStatus) {
+	sc.wr.SetTitle("statusbox", msg(" Server Info "))
+	sc.wr.SetText("statusbox", statusText(st))
+	sc.wr.Hide("statsSummary")
+	sc.wr.Show("statusbox")
+	sc.wr.Render()
+}
+
+// hideServerStatus puts the stats summary widget back
+func (sc *sparkyClient) hideServerStatus() {
+	sc.wr.Hide("statusbox")
+	sc.wr.Show("statsSummary")
+	sc.wr.Render()
+}
+
+// showError replaces the stats summary widget with our error widget
+func (sc *sparkyClient) showError(err error) {
+	sc.wr.SetText("errorbox", fmt.Sprintf(msg("%v\n\nPress [r] to retry or [q] to quit"), err))
+	sc.wr.Hide("statsSummary")
+	sc.wr.Show("errorbox")
+	sc.wr.Clear()
+	sc.wr.Render()
+}
+
+// hideError puts the stats summary widget back
+func (sc *sparkyClient) hideError() {
+	sc.wr.Hide("errorbox")
+	sc.wr.Show("statsSummary")
+	sc.wr.Clear()
+	sc.wr.Render()
+}
+
+// showBanner displays the server's name and location in the banner box
+func (sc *sparkyClient) showBanner(info sparkyfish.ServerInfo) {
+	banner := info.Cname
+	if info.Location != "" {
+		banner = banner + " :: " + info.Location
+	}
+
+	if len(banner) > 0 {
+		// Don't write a banner longer than 60 characters
+		if len(banner) > 60 {
+			banner = banner[:59]
+		}
+		sc.wr.SetText("bannerbox", banner)
+		sc.wr.Render()
+	}
 }
 
 // updateProgressBar updates the progress bar as tests run
@@ -295,7 +1315,11 @@ func (sc *sparkyClient) updateProgressBar() {
 	var updateIntervalMS uint = 500
 	var progress uint
 
-	sc.wr.jobs["progress"].(*termui.Gauge).BarColor = termui.ColorRed
+	// Hold on to this run's channels, since the next run replaces them
+	pingProgressTicker, testDone, progressBarReset := sc.pingProgressTicker, sc.testDone, sc.progressBarReset
+	allTestsDone, testsFailed := sc.allTestsDone, sc.testsFailed
+
+	sc.wr.SetBarStyle("progress", colors.running)
 
 	//progressPerUpdate := throughputTestLength / (updateIntervalMS / 1000)
 	var progressPerUpdate uint = 100 / 20
@@ -311,55 +1335,40 @@ func (sc *sparkyClient) updateProgressBar() {
 			if progress > 100 {
 				progress = 100
 			}
-			sc.wr.jobs["progress"].(*termui.Gauge).Percent = int(progress)
+			sc.wr.SetPercent("progress", int(progress))
 			sc.wr.Render()
 
-		case <-sc.pingProgressTicker:
+		case <-pingProgressTicker:
 			// Update as each ping comes back, but never beyond 100%
-			progress = progress + uint(100/numPings)
+			progress = progress + uint(100/sc.client.Pings)
 			if progress > 100 {
 				progress = 100
 			}
-			sc.wr.jobs["progress"].(*termui.Gauge).Percent = int(progress)
+			sc.wr.SetPercent("progress", int(progress))
 			sc.wr.Render()
 
 			// No need to render, since it's already happening with each ping
-		case <-sc.testDone:
+		case <-testDone:
 			// As each test completes, we set the progress bar to 100% completion.
 			// It will be reset to 0% at the start of the next test.
-			sc.wr.jobs["progress"].(*termui.Gauge).Percent = 100
+			sc.wr.SetPercent("progress", 100)
 			sc.wr.Render()
-		case <-sc.progressBarReset:
+		case <-progressBarReset:
 			// Reset our progress tracker
 			progress = 0
 			// Reset the progress bar
-			sc.wr.jobs["progress"].(*termui.Gauge).Percent = 0
+			sc.wr.SetPercent("progress", 0)
 			sc.wr.Render()
-		case <-sc.allTestsDone:
+		case <-allTestsDone:
 			// Make sure that our progress bar always ends at 100%.  :)
-			sc.wr.jobs["progress"].(*termui.Gauge).Percent = 100
-			sc.wr.jobs["progress"].(*termui.Gauge).BarColor = termui.ColorGreen
+			sc.wr.SetPercent("progress", 100)
+			sc.wr.SetBarStyle("progress", colors.done)
 			sc.wr.Render()
 			return
+		case <-testsFailed:
+			// Leave the progress bar where it stopped, in red
+			return
 		}
 	}
 
 }
-
-func fatalError(err error) {
-	termui.Clear()
-	termui.Close()
-	log.Fatal(err)
-}
-
-// Index of rightmost occurrence of b in s.
-// Borrowed from golang.org/pkg/net/net.go
-func last(s string, b byte) int {
-	i := len(s)
-	for i--; i >= 0; i-- {
-		if s[i] == b {
-			break
-		}
-	}
-	return i
-}
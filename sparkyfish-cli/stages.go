@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/freinold/sparkyfish"
+)
+
+// followStages has our client tell us as each stage of a run begins and
+// ends, so that we can show its progress, and lets the user skip the tests
+// as they run.  ctx is the run's context.  It returns a func that turns the
+// error that the run ended with into the one that we show.
+func (sc *sparkyClient) followStages(ctx context.Context) (runError func(error) error) {
+	var processorDone chan struct{}
+	var failed sparkyfish.Stage
+	var failure error
+
+	sc.client.OnStage = func(stageCtx context.Context, stage sparkyfish.Stage) context.Context {
+		switch stage {
+		case sparkyfish.StageTraceroute:
+			if sc.routePanel != nil {
+				sc.setRouteText(msg("Tracing the route to the server..."))
+			}
+		case sparkyfish.StagePing:
+			// Reset our progress bar to 0% if it's not there already,
+			// and start our ping processor
+			sc.progressBarReset <- true
+			processorDone = make(chan struct{})
+			go sc.pingProcessor(processorDone)
+			if sc.plain != nil {
+				sc.plain.pinging(sc.serverHostname)
+			}
+		case sparkyfish.StageDownload, sparkyfish.StageUpload, sparkyfish.StageBidirectional:
+			sc.progressBarReset <- true
+		}
+
+		if stage.Skippable() {
+			return sc.control.startPhase(stageCtx)
+		}
+		return stageCtx
+	}
+
+	sc.client.OnStageDone = func(stage sparkyfish.Stage, r sparkyfish.Results, err error) {
+		if stage.Skippable() {
+			sc.control.endPhase()
+		}
+		sc.setResults(r)
+		if err != nil {
+			failed, failure = stage, err
+		}
+
+		switch stage {
+		case sparkyfish.StageDNS, sparkyfish.StageMTU:
+			// These are for the help overlay, and the tests go ahead
+			// without them
+			if err != nil {
+				if sc.headless {
+					log.Printf("%v failed: %v", stage, err)
+				}
+				return
+			}
+			sc.refreshHelp()
+
+		case sparkyfish.StageHello:
+			// Show the server's name and location on our banner
+			if err != nil {
+				return
+			}
+			sc.info = sc.client.ServerInfo()
+			sc.showBanner(sc.info)
+			sc.refreshHelp()
+
+		case sparkyfish.StageInfo:
+			if err != nil {
+				return
+			}
+			sc.showServerStatus(*r.Status)
+			if from := testingFromText(r.Status); from != "" {
+				sc.flashBanner(fmt.Sprintf(msg("Testing from %v"), from))
+			}
+
+		case sparkyfish.StageTraceroute:
+			switch {
+			case err != nil && sc.routePanel != nil:
+				sc.setRouteText(err.Error())
+			case err != nil:
+				log.Println(err)
+			case sc.routePanel != nil:
+				sc.updateRoutePanel()
+				sc.wr.Render()
+			}
+
+		case sparkyfish.StagePing:
+			// Shut down the ping processor once it's handled every ping
+			close(sc.pingTime)
+			<-processorDone
+			if err != nil {
+				return
+			}
+			if sc.plain != nil {
+				sc.plain.pinged(r.Ping)
+			}
+			sc.testDone <- true
+
+			// Get the screen ready for the realtime measurements from the
+			// throughput tests
+			sc.tui.reset(ctx)
+			sc.hideServerStatus()
+
+		case sparkyfish.StageDownload, sparkyfish.StageUpload, sparkyfish.StageBidirectional:
+			if err != nil {
+				return
+			}
+			if sc.tcpPanel != nil {
+				sc.updateTCPPanel()
+			}
+			sc.testDone <- true
+		}
+	}
+
+	return func(err error) error {
+		if err != failure {
+			return err
+		}
+		if failed == sparkyfish.StageHello {
+			return connectError{fmt.Errorf("unable to connect to %v: %v", sc.serverHostname, err)}
+		}
+		return fmt.Errorf("%v failed: %v", failed, err)
+	}
+}
+
+// refreshHelp brings the help overlay up to date with what we've learnt
+// about this run, if it's showing
+func (sc *sparkyClient) refreshHelp() {
+	if sc.help != nil && sc.help.isShown() {
+		sc.updateHelp()
+		sc.wr.Render()
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/freinold/sparkyfish"
+)
+
+// stallOffset renders how far into a test a stall began as minutes and
+// seconds, e.g. "00:07"
+func stallOffset(at float64) string {
+	secs := int(at)
+	return fmt.Sprintf("%02d:%02d", secs/60, secs%60)
+}
+
+// stallsText lists the stalls in the download and upload tests, a line each,
+// e.g. "Download stalled at 00:07 for 3.0 s"
+func stallsText(r sparkyfish.Results) []string {
+	var lines []string
+	for _, st := range r.Download.Stalls {
+		lines = append(lines, fmt.Sprintf(msg("Download stalled at %v for %v s"), stallOffset(st.At), formatNumber(st.Duration, 1)))
+	}
+	for _, st := range r.Upload.Stalls {
+		lines = append(lines, fmt.Sprintf(msg("Upload stalled at %v for %v s"), stallOffset(st.At), formatNumber(st.Duration, 1)))
+	}
+	return lines
+}
+
+// stallsSummaryText sums up a test's stalls in one line, e.g.
+// "00:07 (3.0 s), 00:12 (2.5 s)"
+func stallsSummaryText(stalls []sparkyfish.Stall) string {
+	var parts []string
+	for _, st := range stalls {
+		parts = append(parts, fmt.Sprintf("%v (%v s)", stallOffset(st.At), formatNumber(st.Duration, 1)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// flashStall says on our banner that the test that s is from has stalled,
+// if it's a stall that we haven't already flashed.  flashed is the number of
+// the test's stalls that we have.
+func (sc *sparkyClient) flashStall(s sparkyfish.Sample, flashed *int) {
+	if !s.Stalled || len(s.Stats.Stalls) <= *flashed {
+		return
+	}
+	*flashed = len(s.Stats.Stalls)
+
+	at := stallOffset(s.Stats.Stalls[len(s.Stats.Stalls)-1].At)
+	switch s.TestType {
+	case sparkyfish.Inbound, sparkyfish.UDPInbound:
+		sc.flashBanner(fmt.Sprintf(msg("Download stalled at %v"), at))
+	default:
+		sc.flashBanner(fmt.Sprintf(msg("Upload stalled at %v"), at))
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/freinold/sparkyfish"
+)
+
+// tagsFlag collects the tags given with -tag, which may be given any number
+// of times
+type tagsFlag []string
+
+func (tf *tagsFlag) String() string {
+	return strings.Join(*tf, ",")
+}
+
+func (tf *tagsFlag) Set(s string) error {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "":
+		return fmt.Errorf("tags can't be empty")
+	case strings.Contains(s, ","):
+		// Tags are listed with commas between them, e.g. in CSV files
+		return fmt.Errorf("tags can't contain commas; give -tag once for each tag")
+	}
+	*tf = append(*tf, s)
+	return nil
+}
+
+// hasTag reports whether r was tagged with tag
+func hasTag(r sparkyfish.Results, tag string) bool {
+	for _, t := range r.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
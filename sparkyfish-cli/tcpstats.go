@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/freinold/sparkyfish"
+)
+
+// tcpPanel shows the kernel's TCP stats for each throughput test once it's
+// done, along with what each end counted of the test's data.  Like the history panel, it takes the place of the throughput graphs
+// while it's shown.
+type tcpPanel struct {
+	mu    sync.Mutex
+	shown bool
+}
+
+// addTCPWidgets builds the TCP stats panel, hidden until the user asks for it
+func (sc *sparkyClient) addTCPWidgets() {
+	tcpStats := newTextBox("", colors.text, 0, 6, 60, 12)
+	tcpStats.Title = msg(" Advanced Stats ")
+
+	sc.wr.Add("tcpstats", tcpStats)
+
+	// The panel may already have been toggled on while we were starting up
+	sc.tcpPanel.mu.Lock()
+	if !sc.tcpPanel.shown {
+		sc.wr.Hide("tcpstats")
+	}
+	sc.tcpPanel.mu.Unlock()
+
+	sc.updateTCPPanel()
+}
+
+// updateTCPPanel shows the TCP stats and byte accounting from the tests that
+// have finished
+func (sc *sparkyClient) updateTCPPanel() {
+	r := sc.currentResults()
+	sc.wr.SetText("tcpstats", "DOWNLOAD"+tcpText(r.Download)+accountingText(r.Download)+
+		"\nUPLOAD"+tcpText(r.Upload)+accountingText(r.Upload))
+}
+
+// toggleTCPPanel swaps the throughput graphs for the TCP stats panel and back.
+// Showing it hides the history, review and route panels, which live in the
+// same spot.
+func (sc *sparkyClient) toggleTCPPanel() {
+	tp := sc.tcpPanel
+
+	if !tp.isShown() && sc.historyPanel.isShown() {
+		sc.toggleHistoryPanel()
+	}
+	if !tp.isShown() && sc.review.isShown() {
+		sc.toggleReview()
+	}
+	if !tp.isShown() && sc.routePanel.isShown() {
+		sc.toggleRoutePanel()
+	}
+
+	tp.mu.Lock()
+	tp.shown = !tp.shown
+	shown := tp.shown
+	tp.mu.Unlock()
+
+	if shown {
+		sc.wr.Show("tcpstats")
+		sc.wr.Hide("dlgraph")
+		sc.wr.Hide("ulgraph")
+	} else {
+		sc.wr.Hide("tcpstats")
+		sc.wr.Show("dlgraph")
+		sc.wr.Show("ulgraph")
+	}
+
+	sc.wr.Clear()
+	sc.wr.Render()
+}
+
+func (tp *tcpPanel) isShown() bool {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	return tp.shown
+}
+
+// tcpText renders the TCP stats for a single throughput test
+func tcpText(tr sparkyfish.ThroughputResult) string {
+	switch {
+	case tr.Skipped:
+		return " (skipped)"
+	case tr.TCP != nil:
+		ts := tr.TCP
+		text := fmt.Sprintf("\nRTT: %v ms (var %v)  Retransmits: %v\nCwnd: %v segments  Delivery rate: %v",
+			strconv.FormatFloat(ts.RTT, 'f', 2, 64), strconv.FormatFloat(ts.RTTVar, 'f', 2, 64), ts.Retransmits,
+			ts.Cwnd, formatRate(ts.DeliveryRate))
+		if ts.Congestion != "" {
+			text += "\nCongestion control: " + ts.Congestion
+		}
+		return text
+	case tr.Bytes > 0:
+		// The test ran, but there was no TCP connection or we couldn't read
+		// its stats on this platform
+		return "\nNot available"
+	default:
+		return "\nWaiting for the test to finish..."
+	}
+}
+
+// accountingText compares what the server and we counted of a throughput
+// test's data, or renders nothing if the server didn't keep count
+func accountingText(tr sparkyfish.ThroughputResult) string {
+	ba := tr.Accounting
+	if tr.Skipped || ba == nil {
+		return ""
+	}
+
+	// When we stopped the test, the rest was just still on its way
+	if ba.InFlight {
+		return fmt.Sprintf("\nSent: %v  Received: %v  In flight at the end: %v", formatBytes(ba.Sent), formatBytes(ba.Received), formatBytes(ba.Unaccounted()))
+	}
+
+	text := fmt.Sprintf("\nSent: %v  Received: %v  Gap: %v", formatBytes(ba.Sent), formatBytes(ba.Received), formatBytes(ba.Unaccounted()))
+	if ba.Sent > 0 {
+		text += fmt.Sprintf(" (%.1f%%)", float64(ba.Unaccounted())/float64(ba.Sent)*100)
+	}
+	return text
+}
+
+// tcpSummaryText renders the TCP stats and byte accounting for printSummary,
+// or nothing if we don't have any
+func tcpSummaryText(r sparkyfish.Results) string {
+	if r.Download.TCP == nil && r.Upload.TCP == nil && r.Download.Accounting == nil && r.Upload.Accounting == nil {
+		return ""
+	}
+	return "\nTCP (DOWNLOAD)" + tcpText(r.Download) + accountingText(r.Download) +
+		"\nTCP (UPLOAD)" + tcpText(r.Upload) + accountingText(r.Upload)
+}
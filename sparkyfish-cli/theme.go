@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/gizak/termui/v3"
+)
+
+// theme is the set of colors that our screens are drawn in
+type theme struct {
+	text     termui.Style // text in our boxes
+	banner   termui.Style // the server's name under the title
+	border   termui.Style
+	label    termui.Style // the labels on borders
+	axes     termui.Style
+	download termui.Style
+	upload   termui.Style
+	latency  termui.Style
+	history  termui.Style // past runs in the history panel
+	heading  termui.Style // e.g. the latency title
+	running  termui.Style // the progress bar while the tests run
+	done     termui.Style // the progress bar once they're done
+	alert    termui.Style // the border around errors
+	helpFg   termui.Style // the help bar along the bottom, and the help overlay
+	helpBg   termui.Style
+
+	// series are the styles that we draw the series of a lineChart in, in
+	// order
+	series []termui.Style
+}
+
+// themes are the themes that may be picked with -theme
+var themes = map[string]theme{
+	// dark suits the light-on-dark terminals that we started out with
+	"dark": {
+		text:     style(termui.ColorWhite, termui.ModifierBold),
+		banner:   style(termui.ColorRed, termui.ModifierBold),
+		border:   style(termui.ColorWhite),
+		label:    style(termui.ColorGreen),
+		axes:     style(termui.ColorWhite),
+		download: style(termui.ColorGreen, termui.ModifierBold),
+		upload:   style(termui.ColorGreen, termui.ModifierBold),
+		latency:  style(termui.ColorCyan),
+		history:  style(termui.ColorYellow, termui.ModifierBold),
+		heading:  style(termui.ColorGreen),
+		running:  style(termui.ColorRed),
+		done:     style(termui.ColorGreen),
+		alert:    style(termui.ColorRed, termui.ModifierBold),
+		helpFg:   style(termui.ColorYellow, termui.ModifierBold),
+		helpBg:   style(termui.ColorBlue),
+		series:   []termui.Style{style(termui.ColorGreen), style(termui.ColorYellow), style(termui.ColorCyan), style(termui.ColorMagenta), style(termui.ColorRed), style(termui.ColorBlue), style(termui.ColorWhite)},
+	},
+
+	// light keeps to the terminal's own foreground for text, and to colors
+	// that stand out against white
+	"light": {
+		text:     style(termui.ColorClear, termui.ModifierBold),
+		banner:   style(termui.ColorRed, termui.ModifierBold),
+		border:   style(termui.ColorClear),
+		label:    style(termui.ColorBlue),
+		axes:     style(termui.ColorClear),
+		download: style(termui.ColorBlue, termui.ModifierBold),
+		upload:   style(termui.ColorBlue, termui.ModifierBold),
+		latency:  style(termui.ColorMagenta),
+		history:  style(termui.ColorMagenta, termui.ModifierBold),
+		heading:  style(termui.ColorBlue),
+		running:  style(termui.ColorRed),
+		done:     style(termui.ColorBlue),
+		alert:    style(termui.ColorRed, termui.ModifierBold),
+		helpFg:   style(termui.ColorWhite, termui.ModifierBold),
+		helpBg:   style(termui.ColorBlue),
+		series:   []termui.Style{style(termui.ColorBlue), style(termui.ColorMagenta), style(termui.ColorRed), style(termui.ColorGreen), style(termui.ColorBlack), style(termui.ColorCyan)},
+	},
+
+	// mono doesn't use color at all, for NO_COLOR and terminals without it.
+	// Bold, underlining and reverse video set things apart instead.
+	"mono": {
+		text:     style(termui.ColorClear, termui.ModifierBold),
+		banner:   style(termui.ColorClear, termui.ModifierBold),
+		border:   style(termui.ColorClear),
+		label:    style(termui.ColorClear, termui.ModifierBold),
+		axes:     style(termui.ColorClear),
+		download: style(termui.ColorClear, termui.ModifierBold),
+		upload:   style(termui.ColorClear, termui.ModifierBold),
+		latency:  style(termui.ColorClear),
+		history:  style(termui.ColorClear),
+		heading:  style(termui.ColorClear, termui.ModifierUnderline),
+		running:  style(termui.ColorClear, termui.ModifierReverse),
+		done:     style(termui.ColorClear, termui.ModifierReverse),
+		alert:    style(termui.ColorClear, termui.ModifierBold),
+		helpFg:   style(termui.ColorClear, termui.ModifierReverse),
+		helpBg:   style(termui.ColorClear, termui.ModifierReverse),
+		series:   []termui.Style{style(termui.ColorClear, termui.ModifierBold), style(termui.ColorClear), style(termui.ColorClear, termui.ModifierUnderline), style(termui.ColorClear, termui.ModifierReverse)},
+	},
+
+	// colorblind avoids telling things apart by red and green, which are
+	// hard to tell apart with the commonest color blindness, and leans on
+	// blue and yellow instead
+	"colorblind": {
+		text:     style(termui.ColorWhite, termui.ModifierBold),
+		banner:   style(termui.ColorYellow, termui.ModifierBold),
+		border:   style(termui.ColorWhite),
+		label:    style(termui.ColorCyan),
+		axes:     style(termui.ColorWhite),
+		download: style(termui.ColorBlue, termui.ModifierBold),
+		upload:   style(termui.ColorYellow, termui.ModifierBold),
+		latency:  style(termui.ColorCyan),
+		history:  style(termui.ColorMagenta, termui.ModifierBold),
+		heading:  style(termui.ColorCyan),
+		running:  style(termui.ColorYellow),
+		done:     style(termui.ColorBlue),
+		alert:    style(termui.ColorMagenta, termui.ModifierBold),
+		helpFg:   style(termui.ColorYellow, termui.ModifierBold),
+		helpBg:   style(termui.ColorBlue),
+		series:   []termui.Style{style(termui.ColorBlue), style(termui.ColorYellow), style(termui.ColorCyan), style(termui.ColorMagenta), style(termui.ColorWhite)},
+	},
+}
+
+// colors is the theme that we draw our screens in
+var colors = themes["dark"]
+
+// useTheme makes us draw our screens in the theme called name.  If name is
+// empty, we pick mono if the user has set NO_COLOR (see https://no-color.org),
+// or dark otherwise.
+func useTheme(name string) error {
+	if name == "" {
+		name = "dark"
+		if os.Getenv("NO_COLOR") != "" {
+			name = "mono"
+		}
+	}
+
+	t, ok := themes[name]
+	if !ok {
+		return fmt.Errorf("unknown theme %q; -theme must be dark, light, mono or colorblind", name)
+	}
+	colors = t
+
+	// Borders, and their titles, get their styles from termui's own theme
+	termui.Theme.Block.Border = t.border
+	termui.Theme.Block.Title = t.label
+	return nil
+}
+
+// style returns the style of text in fg, with mods
+func style(fg termui.Color, mods ...termui.Modifier) termui.Style {
+	s := termui.NewStyle(fg)
+	for _, mod := range mods {
+		s.Modifier |= mod
+	}
+	return s
+}
+
+// colorNames are the names of colors in termui's text markup
+var colorNames = map[termui.Color]string{
+	termui.ColorClear:   "clear",
+	termui.ColorBlack:   "black",
+	termui.ColorRed:     "red",
+	termui.ColorGreen:   "green",
+	termui.ColorYellow:  "yellow",
+	termui.ColorBlue:    "blue",
+	termui.ColorMagenta: "magenta",
+	termui.ColorCyan:    "cyan",
+	termui.ColorWhite:   "white",
+}
+
+// modifierNames are the names of modifiers in termui's text markup
+var modifierNames = []struct {
+	mod  termui.Modifier
+	name string
+}{{termui.ModifierBold, "bold"}, {termui.ModifierUnderline, "underline"}, {termui.ModifierReverse, "reverse"}}
+
+// seriesColor returns the style of a lineChart's ith series, and the same
+// style in termui's text markup, e.g. "fg:green"
+func seriesColor(i int) (termui.Style, string) {
+	s := colors.series[i%len(colors.series)]
+	markup := "fg:" + colorNames[s.Fg]
+	for _, m := range modifierNames {
+		if s.Modifier&m.mod != 0 {
+			markup += ",mod:" + m.name
+		}
+	}
+	return s, markup
+}
@@ -1,231 +1,253 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"log"
-	"strconv"
-	"syscall"
+	"sync"
 	"time"
 
-	"gopkg.in/gizak/termui.v2"
+	"github.com/freinold/sparkyfish"
 )
 
-// Kick off a throughput measurement test
-func (sc *sparkyClient) runThroughputTest(testType command) {
-	// Notify the progress bar updater to reset the bar
-	sc.progressBarReset <- true
+// tuiSink updates the throughput graphs and the stats widget as measurements
+// come in.  In a bidirectional test, measurements for both tests come in at
+// once.  Every measurement is kept, and the graphs show a window onto them.
+type tuiSink struct {
+	sc *sparkyClient
+
+	mu       sync.Mutex
+	ctx      context.Context
+	dl, ul   sparkyfish.ThroughputResult
+	dlWarmUp bool
+	ulWarmUp bool
+
+	// dlSamples and ulSamples are every measurement, in Mbit/s.  While
+	// the graphs are paused, they only show the first dlShown and ulShown
+	// of them.
+	dlSamples, ulSamples []float64
+	dlShown, ulShown     int
+	window               *chartWindow
+	interval             time.Duration // how often measurements come in
+	dlUnit, ulUnit       rateUnit      // the units that the graphs are in
+
+	// dlStale and ulStale are set when a test is retried.  The
+	// measurements that we have of it go once the retry's come in.
+	dlStale, ulStale bool
+
+	// dlStalls and ulStalls are the number of each test's stalls that
+	// we've flashed on the banner
+	dlStalls, ulStalls int
+}
 
-	// Used to signal test completion to the throughput measurer
-	measurerDone := make(chan struct{})
+// reset clears the stats before the throughput tests begin.  Once ctx is
+// cancelled, measurements are ignored rather than drawn.
+func (ts *tuiSink) reset(ctx context.Context) {
+	sc := ts.sc
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.ctx = ctx
+	ts.dl, ts.ul = sparkyfish.ThroughputResult{}, sparkyfish.ThroughputResult{}
+	ts.dlWarmUp, ts.ulWarmUp = false, false
+	ts.dlSamples, ts.ulSamples = nil, nil
+	ts.dlShown, ts.ulShown = 0, 0
+	ts.dlStale, ts.ulStale = false, false
+	ts.dlStalls, ts.ulStalls = 0, 0
+	interval := sc.client.ReportInterval
+	if interval == 0 {
+		interval = sparkyfish.DefaultReportInterval
+	}
+	ts.window = newChartWindow(sc.wr.Points("dlgraph"), int(sparkyfish.TestLength/interval))
+	ts.interval = interval
+	sc.wr.Mark("dlgraph", nil)
+	sc.wr.Mark("ulgraph", nil)
+	ts.dlUnit, ts.ulUnit = unitFor(0), unitFor(0)
+	ts.showWindow()
+
+	// Show which tests won't be run from the start
+	ts.dl.Skipped, ts.ul.Skipped = sc.client.SkipDownload, sc.client.SkipUpload
+	if ts.dl.Skipped || ts.ul.Skipped {
+		sc.wr.SetText("statsSummary", summaryText(ts.dl, ts.ul))
+		sc.wr.Render()
+	}
+}
 
-	// Launch a throughput measurer and then kick off the metered copy,
-	// blocking until it completes.
-	go sc.MeasureThroughput(measurerDone)
-	sc.MeteredCopy(testType, measurerDone)
+func (ts *tuiSink) sample(server string, s sparkyfish.Sample) {
+	sc := ts.sc
 
-	// Notify the progress bar updater that the test is done
-	sc.testDone <- true
-}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
 
-// Kicks off a metered copy (throughput test) by sending a command to the server
-// and then performing the appropriate I/O copy, sending "ticks" by channel as
-// each block of data passes through.
-func (sc *sparkyClient) MeteredCopy(testType command, measurerDone chan<- struct{}) {
-	var tl time.Duration
-
-	// Connect to the remote sparkyfish server
-	sc.beginSession()
-
-	defer sc.conn.Close()
-
-	// Send the appropriate command to the sparkyfish server to initiate our
-	// throughput test
-	switch testType {
-	case inbound:
-		// For inbound tests, we bump our timer by 2 seconds to account for
-		// the remote server's test startup time
-		tl = time.Second * time.Duration(throughputTestLength+2)
-
-		// Send the SND command to the remote server, requesting a download test
-		// (remote sends).
-		err := sc.writeCommand("SND")
-		if err != nil {
-			termui.Close()
-			log.Fatalln(err)
-		}
-	case outbound:
-		tl = time.Second * time.Duration(throughputTestLength)
-
-		// Send the RCV command to the remote server, requesting an upload test
-		// (remote receives).
-		err := sc.writeCommand("RCV")
-		if err != nil {
-			termui.Close()
-			log.Fatalln(err)
-		}
+	if ts.ctx == nil || ts.ctx.Err() != nil {
+		return
 	}
 
-	// Set a timer for running the tests
-	timer := time.NewTimer(tl)
-
-	switch testType {
-	case inbound:
-		// Receive, tally, and discard incoming data as fast as we can until the sender stops sending or the timer expires
-		for {
-			select {
-			case <-timer.C:
-				// Timer has elapsed and test is finished
-				close(measurerDone)
-				return
-			default:
-				// Copy data from our net.Conn to the rubbish bin in (blockSize) KB chunks
-				_, err := io.CopyN(ioutil.Discard, sc.conn, 1024*blockSize)
-				if err != nil {
-					// Handle the EOF when the test timer has expired at the remote end.
-					if err == io.EOF || err == io.ErrClosedPipe || err == syscall.EPIPE {
-						close(measurerDone)
-						return
-					}
-					log.Println("Error copying:", err)
-					return
-				}
-				// With each chunk copied, we send a message on our blockTicker channel
-				sc.blockTicker <- true
-
-			}
+	// Update the appropriate graph with the latest measurements, unless
+	// it's paused
+	switch s.TestType {
+	case sparkyfish.Inbound, sparkyfish.UDPInbound:
+		if ts.dlStale {
+			ts.dlSamples, ts.dlShown, ts.dlStale, ts.dlStalls = nil, 0, false, 0
 		}
-	case outbound:
-		// Send and tally outgoing data as fast as we can until the receiver stops receiving or the timer expires
-		for {
-			select {
-			case <-timer.C:
-				// Timer has elapsed and test is finished
-				close(measurerDone)
-				return
-			default:
-				// Copy data from our pre-filled bytes.Reader to the net.Conn in (blockSize) KB chunks
-				_, err := io.CopyN(sc.conn, sc.randReader, 1024*blockSize)
-				if err != nil {
-					// If we get any of these errors, it probably just means that the server closed the connection
-					if err == io.EOF || err == io.ErrClosedPipe || err == syscall.EPIPE {
-						close(measurerDone)
-						return
-					}
-					log.Println("Error copying:", err)
-					return
-				}
-
-				// Make sure that we have enough runway in our bytes.Reader to handle the next read
-				if sc.randReader.Len() <= int(1024*blockSize) {
-					// We're nearing the end of the Reader, so seek back to the beginning and start again
-					sc.randReader.Seek(0, 0)
-				}
-
-				// With each chunk copied, we send a message on our blockTicker channel
-				sc.blockTicker <- true
-			}
+		ts.dl, ts.dlWarmUp = s.Stats, s.WarmUp
+		ts.dlSamples = append(ts.dlSamples, s.Mbps)
+		sc.flashStall(s, &ts.dlStalls)
+	case sparkyfish.Outbound, sparkyfish.UDPOutbound:
+		if ts.ulStale {
+			ts.ulSamples, ts.ulShown, ts.ulStale, ts.ulStalls = nil, 0, false, 0
 		}
+		ts.ul, ts.ulWarmUp = s.Stats, s.WarmUp
+		ts.ulSamples = append(ts.ulSamples, s.Mbps)
+		sc.flashStall(s, &ts.ulStalls)
+	}
+	if !ts.window.paused {
+		ts.updateGraphs()
+	}
+
+	// Update our stats widget with the latest readings
+	sc.wr.SetText("statsSummary", liveSummaryText(ts.dl, ts.ul, ts.dlWarmUp, ts.ulWarmUp))
+	if sc.historyPanel != nil {
+		sc.updateHistoryPanel(ts.dl, ts.ul)
 	}
+	sc.wr.Render()
 }
 
-// MeasureThroughput receives ticks sent by MeteredCopy() and derives a throughput rate, which is then sent
-// to the throughput reporter.
-func (sc *sparkyClient) MeasureThroughput(measurerDone <-chan struct{}) {
-	var testType = inbound
-	var blockCount, prevBlockCount uint64
-	var throughput float64
-	var throughputHist []float64
-
-	tick := time.NewTicker(time.Duration(reportIntervalMS) * time.Millisecond)
-	for {
-		select {
-		case <-sc.blockTicker:
-			// Increment our block counter when we get a ticker
-			blockCount++
-		case <-measurerDone:
-			tick.Stop()
-			return
-		case <-sc.changeToUpload:
-			// The download test has completed, so we switch to tallying upload chunks
-			testType = outbound
-		case <-tick.C:
-			throughput = (float64(blockCount - prevBlockCount)) * float64(blockSize*8) / float64(reportIntervalMS)
-
-			// We discard the first element of the throughputHist slice once we have 70
-			// elements stored.  This gives the user a chart that appears to scroll to
-			// the left as new measurements come in and old ones are discarded.
-			if len(throughputHist) >= 70 {
-				throughputHist = throughputHist[1:]
-			}
-
-			// Add our latest measurement to the slice of historical measurements
-			throughputHist = append(throughputHist, throughput)
-
-			// Update the appropriate graph with the latest measurements
-			switch testType {
-			case inbound:
-				sc.wr.jobs["dlgraph"].(*termui.LineChart).Data = throughputHist
-			case outbound:
-				sc.wr.jobs["ulgraph"].(*termui.LineChart).Data = throughputHist
-			}
-
-			// Send the latest measurement on to the stats generator
-			sc.throughputReport <- throughput
-
-			// Update the current block counter
-			prevBlockCount = blockCount
-		}
+// restart is called when a test is retried.  Only the test that's retried
+// has more measurements to come, so whichever test they're for, we start
+// its graph over when they do.
+func (ts *tuiSink) restart() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.dlStale, ts.ulStale = true, true
+}
+
+// results shows the final stats once the tests are done
+func (ts *tuiSink) results(r sparkyfish.Results) error {
+	sc := ts.sc
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	sc.wr.SetText("statsSummary", summaryText(r.Download, r.Upload))
+	if sc.historyPanel != nil {
+		sc.updateHistoryPanel(r.Download, r.Upload)
 	}
+	sc.wr.Render()
+
+	return nil
+}
+
+// live returns the stats so far of the throughput tests in the run that's in
+// progress.  ok is false once the run is over, or before its throughput tests
+// have begun.
+func (ts *tuiSink) live() (dl, ul sparkyfish.ThroughputResult, ok bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.ctx == nil || ts.ctx.Err() != nil {
+		return dl, ul, false
+	}
+	return ts.dl, ts.ul, true
+}
+
+// samples returns copies of every download and upload measurement so far
+func (ts *tuiSink) samples() (dl, ul []float64) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return append([]float64{}, ts.dlSamples...), append([]float64{}, ts.ulSamples...)
 }
 
-// generateStats receives download and upload speed reports and computes metrics
-// which are displayed in the stats widget.
-func (sc *sparkyClient) generateStats() {
-	var measurement float64
-	var currentDL, maxDL, avgDL float64
-	var currentUL, maxUL, avgUL float64
-	var dlReadingCount, dlReadingSum float64
-	var ulReadingCount, ulReadingSum float64
-	var testType = inbound
-
-	for {
-		select {
-		case measurement = <-sc.throughputReport:
-			switch testType {
-			case inbound:
-				currentDL = measurement
-				dlReadingCount++
-				dlReadingSum = dlReadingSum + currentDL
-				avgDL = dlReadingSum / dlReadingCount
-				if currentDL > maxDL {
-					maxDL = currentDL
-				}
-				// Update our stats widget with the latest readings
-				sc.wr.jobs["statsSummary"].(*termui.Par).Text = fmt.Sprintf("DOWNLOAD \nCurrent: %v Mbit/s\tMax: %v\tAvg: %v\n\nUPLOAD\nCurrent: %v Mbit/s\tMax: %v\tAvg: %v",
-					strconv.FormatFloat(currentDL, 'f', 1, 64), strconv.FormatFloat(maxDL, 'f', 1, 64), strconv.FormatFloat(avgDL, 'f', 1, 64),
-					strconv.FormatFloat(currentUL, 'f', 1, 64), strconv.FormatFloat(maxUL, 'f', 1, 64), strconv.FormatFloat(avgUL, 'f', 1, 64))
-				sc.wr.Render()
-			case outbound:
-				currentUL = measurement
-				ulReadingCount++
-				ulReadingSum = ulReadingSum + currentUL
-				avgUL = ulReadingSum / ulReadingCount
-				if currentUL > maxUL {
-					maxUL = currentUL
-				}
-				// Update our stats widget with the latest readings
-				sc.wr.jobs["statsSummary"].(*termui.Par).Text = fmt.Sprintf("DOWNLOAD \nCurrent: %v Mbit/s\tMax: %v\tAvg: %v\n\nUPLOAD\nCurrent: %v Mbit/s\tMax: %v\tAvg: %v",
-					strconv.FormatFloat(currentDL, 'f', 1, 64), strconv.FormatFloat(maxDL, 'f', 1, 64), strconv.FormatFloat(avgDL, 'f', 1, 64),
-					strconv.FormatFloat(currentUL, 'f', 1, 64), strconv.FormatFloat(maxUL, 'f', 1, 64), strconv.FormatFloat(avgUL, 'f', 1, 64))
-				sc.wr.Render()
-
-			}
-		case <-sc.changeToUpload:
-			testType = outbound
-		case <-sc.statsGeneratorDone:
-			return
+// updateGraphs shows the measurements in our window on the graphs, in the
+// units that suit them.  Unless we're paused, that includes the latest ones.
+// ts.mu must be held.
+func (ts *tuiSink) updateGraphs() {
+	sc := ts.sc
+
+	if !ts.window.paused {
+		ts.dlShown, ts.ulShown = len(ts.dlSamples), len(ts.ulSamples)
+	}
+	dl, ul := ts.window.view(ts.dlSamples[:ts.dlShown]), ts.window.view(ts.ulSamples[:ts.ulShown])
+	ts.dlUnit, ts.ulUnit = unitFor(maxOf(dl)), unitFor(maxOf(ul))
+	sc.wr.SetData("dlgraph", ts.dlUnit.scale(dl))
+	sc.wr.SetData("ulgraph", ts.ulUnit.scale(ul))
+	sc.wr.Mark("dlgraph", windowMarks(ts.window, ts.dl.Events, ts.interval, ts.dlShown))
+	sc.wr.Mark("ulgraph", windowMarks(ts.window, ts.ul.Events, ts.interval, ts.ulShown))
+	ts.showWindow()
+}
+
+// togglePause freezes the graphs where they are, or catches them up with the
+// measurements that came in while they were frozen.  Measurements are kept
+// either way.
+func (ts *tuiSink) togglePause() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.window == nil {
+		return
+	}
+	ts.window.paused = !ts.window.paused
+	ts.updateGraphs()
+}
+
+// zoom zooms the graphs in, showing fewer measurements in more detail, or
+// out
+func (ts *tuiSink) zoom(in bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.window == nil {
+		return
+	}
+	if in {
+		ts.window.zoomIn()
+	} else {
+		n := ts.dlShown
+		if ts.ulShown > n {
+			n = ts.ulShown
 		}
+		ts.window.zoomOut(n)
+	}
+	ts.updateGraphs()
+}
+
+// resize fits our window to the graphs after they've changed size
+func (ts *tuiSink) resize() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.window == nil {
+		return
+	}
+	ts.window.resize(ts.sc.wr.Points("dlgraph"))
+	ts.updateGraphs()
+}
+
+// showWindow labels the graphs with their units and the state of our window:
+// whether it's paused, and how far it's zoomed out.  ts.mu must be held.
+func (ts *tuiSink) showWindow() {
+	sc := ts.sc
+
+	var state string
+	if ts.window.zoom > 1 {
+		state += fmt.Sprintf(" [%vx]", ts.window.zoom)
+	}
+	if ts.window.paused {
+		state += msg(" [paused]")
+	}
+	sc.wr.SetTitle("dlgraph", fmt.Sprintf(msg(" Download Speed (%v)"), ts.dlUnit.name)+state)
+	sc.wr.SetTitle("ulgraph", fmt.Sprintf(msg(" Upload Speed (%v)"), ts.ulUnit.name)+state)
+	sc.wr.Render()
+}
+
+// appendThroughput adds a measurement to a graph's history.  We discard the
+// first element of the history once we have 70 elements stored.  This gives
+// the user a chart that appears to scroll to the left as new measurements
+// come in and old ones are discarded.
+func appendThroughput(hist []float64, mbps float64) []float64 {
+	if len(hist) >= 70 {
+		hist = hist[1:]
 	}
+	return append(hist, mbps)
 }
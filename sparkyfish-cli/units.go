@@ -0,0 +1,84 @@
+package main
+
+import "fmt"
+
+// rateUnit is a unit that we show throughput in.  Throughput is measured in
+// Mbit/s, and converted for display.
+type rateUnit struct {
+	name   string
+	mbps   float64 // Mbit/s in one of these
+	digits int     // decimal places to show
+}
+
+var (
+	mbitUnit  = rateUnit{name: "Mbit/s", mbps: 1, digits: 1}
+	gbitUnit  = rateUnit{name: "Gbit/s", mbps: 1000, digits: 2}
+	mbyteUnit = rateUnit{name: "MB/s", mbps: 8, digits: 1}
+)
+
+// units is how we show throughput, as given to -units: "mbps" for Mbit/s,
+// "MBps" for megabytes per second, or "auto" for Mbit/s or Gbit/s, whichever
+// suits the throughput
+var units = "mbps"
+
+// useUnits makes us show throughput in the units called name
+func useUnits(name string) error {
+	switch name {
+	case "mbps", "MBps", "auto":
+		units = name
+		return nil
+	}
+	return fmt.Errorf("unknown units %q; -units must be mbps, MBps or auto", name)
+}
+
+// unitFor returns the unit to show throughput of up to max Mbit/s in, so that
+// related numbers, e.g. the stats of one test, share a unit
+func unitFor(max float64) rateUnit {
+	switch {
+	case units == "MBps":
+		return mbyteUnit
+	case units == "auto" && max >= gbitUnit.mbps:
+		return gbitUnit
+	}
+	return mbitUnit
+}
+
+// number renders mbps in u, without the unit's name
+func (u rateUnit) number(mbps float64) string {
+	return formatNumber(mbps/u.mbps, u.digits)
+}
+
+// format renders mbps in u, with the unit's name
+func (u rateUnit) format(mbps float64) string {
+	return u.number(mbps) + " " + u.name
+}
+
+// scale converts data, in Mbit/s, to u for charting
+func (u rateUnit) scale(data []float64) []float64 {
+	if u.mbps == 1 {
+		return data
+	}
+	scaled := make([]float64, len(data))
+	for i, v := range data {
+		scaled[i] = v / u.mbps
+	}
+	return scaled
+}
+
+// formatRate renders mbps in the unit that suits it
+func formatRate(mbps float64) string {
+	return unitFor(mbps).format(mbps)
+}
+
+// maxOf returns the largest of data, or 0 if it's empty
+func maxOf(data ...[]float64) float64 {
+	var max float64
+	for _, d := range data {
+		for _, v := range d {
+			if v > max {
+				max = v
+			}
+		}
+	}
+	return max
+}
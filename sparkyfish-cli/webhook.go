@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/freinold/sparkyfish"
+)
+
+// webhookEvent is the JSON payload that webhookSink posts.  Text summarizes
+// the event for chat services like Slack, which display it as the message.
+type webhookEvent struct {
+	Event    string             `json:"event"`
+	Text     string             `json:"text"`
+	Breaches []breach           `json:"breaches,omitempty"`
+	Results  sparkyfish.Results `json:"results"`
+}
+
+// breach is a measurement that fell on the wrong side of its alert threshold
+type breach struct {
+	Metric    string  `json:"metric"`
+	Value     float64 `json:"value"`
+	Threshold float64 `json:"threshold"`
+}
+
+// alertThresholds are the limits beyond which a test run is reported as a
+// breach rather than as a plain completion.  Zero disables a threshold.
+type alertThresholds struct {
+	minDownload float64 // Mbit/s
+	minUpload   float64 // Mbit/s
+	maxPing     float64 // ms
+}
+
+// check returns the measurements in r that breach our thresholds
+func (at alertThresholds) check(r sparkyfish.Results) []breach {
+	var breaches []breach
+	if at.minDownload > 0 && !r.Download.Skipped && r.Download.Avg < at.minDownload {
+		breaches = append(breaches, breach{"download_mbps", r.Download.Avg, at.minDownload})
+	}
+	if at.minUpload > 0 && !r.Upload.Skipped && r.Upload.Avg < at.minUpload {
+		breaches = append(breaches, breach{"upload_mbps", r.Upload.Avg, at.minUpload})
+	}
+	if at.maxPing > 0 && r.Ping.Avg > at.maxPing {
+		breaches = append(breaches, breach{"ping_ms", r.Ping.Avg, at.maxPing})
+	}
+	return breaches
+}
+
+// webhookSink posts the results of each test run to a URL as JSON.  Runs
+// that breach the alert thresholds are posted as a "threshold_breached" event
+// instead of a "completed" one.
+type webhookSink struct {
+	url        string
+	thresholds alertThresholds
+	client     *http.Client
+}
+
+func newWebhookSink(addr string, thresholds alertThresholds) (*webhookSink, error) {
+	u, err := url.Parse(addr)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook URL: %v", addr)
+	}
+
+	return &webhookSink{
+		url:        addr,
+		thresholds: thresholds,
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (ws *webhookSink) sample(server string, s sparkyfish.Sample) {}
+
+func (ws *webhookSink) results(r sparkyfish.Results) error {
+	ev := webhookEvent{Event: "completed", Results: r}
+	ev.Breaches = ws.thresholds.check(r)
+	if len(ev.Breaches) > 0 {
+		ev.Event = "threshold_breached"
+		ev.Text = fmt.Sprintf("sparkyfish alert for %v: %v", r.Server, breachText(ev.Breaches))
+	} else {
+		ev.Text = "sparkyfish " + oneLineSummary(r)
+	}
+
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	return deliver(ws.client, "POST", ws.url, "application/json", string(body), "the webhook")
+}
+
+// breachText describes the breaches in a test run
+func breachText(breaches []breach) string {
+	var parts []string
+	for _, b := range breaches {
+		switch b.Metric {
+		case "download_mbps":
+			parts = append(parts, fmt.Sprintf("download %.1f Mbit/s is below %v Mbit/s", b.Value, b.Threshold))
+		case "upload_mbps":
+			parts = append(parts, fmt.Sprintf("upload %.1f Mbit/s is below %v Mbit/s", b.Value, b.Threshold))
+		case "ping_ms":
+			parts = append(parts, fmt.Sprintf("ping %.2f ms is above %v ms", b.Value, b.Threshold))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
@@ -2,31 +2,208 @@
 package main
 
 import (
-	"gopkg.in/gizak/termui.v2"
+	"sync"
+
+	"github.com/gizak/termui/v3"
+	"github.com/gizak/termui/v3/widgets"
 )
 
+// widgetRenderer is the renderer that draws our widgets to the terminal with
+// termui.  Each widget is locked while it's updated, as termui locks it while
+// it's drawn.
 type widgetRenderer struct {
-	jobs map[string]termui.Bufferer
+	mu     sync.Mutex
+	jobs   map[string]termui.Drawable
+	hidden map[string]bool
+	top    string // drawn over the other widgets, if set
 }
 
 func newwidgetRenderer() *widgetRenderer {
 	wr := widgetRenderer{}
-	wr.jobs = make(map[string]termui.Bufferer)
+	wr.jobs = make(map[string]termui.Drawable)
+	wr.hidden = make(map[string]bool)
 	return &wr
 }
 
-func (wr *widgetRenderer) Add(name string, job termui.Bufferer) {
+func (wr *widgetRenderer) Add(name string, job termui.Drawable) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
 	wr.jobs[name] = job
 }
 
 func (wr *widgetRenderer) Delete(name string) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
 	delete(wr.jobs, name)
 }
 
+func (wr *widgetRenderer) Hide(name string) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	wr.hidden[name] = true
+}
+
+func (wr *widgetRenderer) Show(name string) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	delete(wr.hidden, name)
+}
+
+func (wr *widgetRenderer) Raise(name string) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	wr.top = name
+}
+
+// update calls f with the widget called name, locked, if we have it
+func (wr *widgetRenderer) update(name string, f func(w termui.Drawable)) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+
+	w, ok := wr.jobs[name]
+	if !ok {
+		return
+	}
+	w.Lock()
+	defer w.Unlock()
+	f(w)
+}
+
+func (wr *widgetRenderer) Place(name string, x, width int) {
+	wr.update(name, func(w termui.Drawable) {
+		r := w.GetRect()
+		w.SetRect(x, r.Min.Y, x+width, r.Max.Y)
+	})
+}
+
+func (wr *widgetRenderer) Text(name string) string {
+	var text string
+	wr.update(name, func(w termui.Drawable) {
+		switch w := w.(type) {
+		case *widgets.Paragraph:
+			text = w.Text
+		case *helpBar:
+			text = w.Text
+		}
+	})
+	return text
+}
+
+func (wr *widgetRenderer) SetText(name, text string) {
+	wr.update(name, func(w termui.Drawable) {
+		switch w := w.(type) {
+		case *widgets.Paragraph:
+			w.Text = text
+		case *helpBar:
+			w.Text = text
+		}
+	})
+}
+
+func (wr *widgetRenderer) SetTitle(name, title string) {
+	wr.update(name, func(w termui.Drawable) {
+		if b := block(w); b != nil {
+			b.Title = title
+		}
+	})
+}
+
+func (wr *widgetRenderer) SetData(name string, series ...[]float64) {
+	wr.update(name, func(w termui.Drawable) {
+		switch w := w.(type) {
+		case *lineChart:
+			for i := range w.Series {
+				w.Series[i].Data = nil
+				if i < len(series) {
+					w.Series[i].Data = series[i]
+				}
+			}
+		case *widgets.SparklineGroup:
+			for i, sl := range w.Sparklines {
+				sl.Data = nil
+				if i < len(series) {
+					sl.Data = series[i]
+				}
+			}
+		}
+	})
+}
+
+func (wr *widgetRenderer) SetLabels(name string, labels []string) {
+	wr.update(name, func(w termui.Drawable) {
+		if lc, ok := w.(*lineChart); ok {
+			lc.DataLabels = labels
+		}
+	})
+}
+
+func (wr *widgetRenderer) Mark(name string, marks []chartMark) {
+	wr.update(name, func(w termui.Drawable) {
+		if lc, ok := w.(*lineChart); ok {
+			lc.Marks = marks
+		}
+	})
+}
+
+func (wr *widgetRenderer) Points(name string) int {
+	var points int
+	wr.update(name, func(w termui.Drawable) {
+		if lc, ok := w.(*lineChart); ok {
+			points = lc.points()
+		}
+	})
+	return points
+}
+
+func (wr *widgetRenderer) SetPercent(name string, percent int) {
+	wr.update(name, func(w termui.Drawable) {
+		if pb, ok := w.(*progressBar); ok {
+			pb.Percent = percent
+		}
+	})
+}
+
+func (wr *widgetRenderer) SetBarStyle(name string, style termui.Style) {
+	wr.update(name, func(w termui.Drawable) {
+		if pb, ok := w.(*progressBar); ok {
+			pb.Bar = style
+		}
+	})
+}
+
+func (wr *widgetRenderer) Clear() {
+	termui.Clear()
+}
+
 func (wr *widgetRenderer) Render() {
-	var jobs []termui.Bufferer
-	for _, j := range wr.jobs {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+
+	var jobs []termui.Drawable
+	for name, j := range wr.jobs {
+		if !wr.hidden[name] && name != wr.top {
+			jobs = append(jobs, j)
+		}
+	}
+	if j, ok := wr.jobs[wr.top]; ok && !wr.hidden[wr.top] {
 		jobs = append(jobs, j)
 	}
 	termui.Render(jobs...)
 }
+
+// block returns the block that w is drawn in, with its border and title
+func block(w termui.Drawable) *termui.Block {
+	switch w := w.(type) {
+	case *widgets.Paragraph:
+		return &w.Block
+	case *widgets.SparklineGroup:
+		return &w.Block
+	case *helpBar:
+		return &w.Block
+	case *lineChart:
+		return &w.Block
+	case *progressBar:
+		return &w.Block
+	}
+	return nil
+}
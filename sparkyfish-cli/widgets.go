@@ -0,0 +1,85 @@
+package main
+
+import (
+	"image"
+	"strconv"
+
+	"github.com/gizak/termui/v3"
+	"github.com/gizak/termui/v3/widgets"
+)
+
+// newTextBox returns a box of text in style, at column x and row y, width
+// columns wide and height rows high, borders included.  Lines too long for
+// the box are cut off at its edge, unless WrapText is set.
+func newTextBox(text string, style termui.Style, x, y, width, height int) *widgets.Paragraph {
+	p := widgets.NewParagraph()
+	p.Text = text
+	p.TextStyle = style
+	p.WrapText = false
+	p.SetRect(x, y, x+width, y+height)
+	return p
+}
+
+// borderless takes the border off b, and gives its room to what's inside it
+func borderless(b *termui.Block) {
+	b.Border = false
+	b.PaddingLeft, b.PaddingTop, b.PaddingRight, b.PaddingBottom = -1, -1, -1, -1
+	b.SetRect(b.Min.X, b.Min.Y, b.Max.X, b.Max.Y)
+}
+
+// helpBar is a line of text on a background of its own, e.g. the list of
+// keys along the bottom of the screen
+type helpBar struct {
+	widgets.Paragraph
+}
+
+// newHelpBar returns a help bar in our theme's colors, at row y and 60
+// columns wide
+func newHelpBar(text string, y int) *helpBar {
+	hb := &helpBar{Paragraph: *widgets.NewParagraph()}
+	hb.Text = text
+	hb.TextStyle = termui.NewStyle(colors.helpFg.Fg, colors.helpBg.Fg, colors.helpFg.Modifier|colors.helpBg.Modifier)
+	hb.WrapText = false
+	hb.SetRect(0, y, 60, y+1)
+	borderless(&hb.Block)
+	return hb
+}
+
+func (hb *helpBar) Draw(buf *termui.Buffer) {
+	buf.Fill(termui.NewCell(' ', hb.TextStyle), hb.Inner)
+	hb.Paragraph.Draw(buf)
+}
+
+// progressBar fills up from the left as Percent goes from 0 to 100, in
+// reverse video of Bar, so that it shows in themes without colors too.  The
+// percentage is shown in the middle.
+type progressBar struct {
+	termui.Block
+	Percent    int
+	Bar        termui.Style
+	LabelStyle termui.Style
+}
+
+func newProgressBar() *progressBar {
+	return &progressBar{Block: *termui.NewBlock(), Bar: colors.running, LabelStyle: colors.text}
+}
+
+func (pb *progressBar) Draw(buf *termui.Buffer) {
+	pb.Block.Draw(buf)
+
+	bar := pb.Bar
+	bar.Modifier |= termui.ModifierReverse
+	filled := pb.Inner.Min.X + pb.Percent*pb.Inner.Dx()/100
+	buf.Fill(termui.NewCell(' ', bar), image.Rect(pb.Inner.Min.X, pb.Inner.Min.Y, filled, pb.Inner.Max.Y))
+
+	label := strconv.Itoa(pb.Percent) + "%"
+	x := pb.Inner.Min.X + (pb.Inner.Dx()-len(label))/2
+	y := pb.Inner.Min.Y + (pb.Inner.Dy()-1)/2
+	for i, r := range label {
+		style := pb.LabelStyle
+		if x+i < filled {
+			style = bar
+		}
+		buf.SetCell(termui.NewCell(r, style), image.Pt(x+i, y))
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// defaultACMECache returns where we keep our ACME account key and
+// certificates when -acme-cache isn't given: in the state directory that
+// systemd gives us with StateDirectory=, or else in our user's cache
+// directory
+func defaultACMECache() string {
+	if dir := os.Getenv("STATE_DIRECTORY"); dir != "" {
+		return filepath.Join(dir, "acme")
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "sparkyfish-server", "acme")
+}
+
+// acmeTLSConfig returns a TLS config whose certificate for hostname is got
+// from, and renewed with, the ACME CA at directoryURL (Let's Encrypt, if
+// it's empty).  Certificates are kept in cacheDir, so that a restart doesn't
+// ask for a new one.  email, if set, is where the CA may write to us about
+// them.  It also returns the manager, which answers HTTP-01 challenges.
+func acmeTLSConfig(hostname, cacheDir, email, directoryURL string) (*tls.Config, *autocert.Manager) {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(hostname),
+		Email:      email,
+	}
+	if cacheDir != "" {
+		m.Cache = autocert.DirCache(cacheDir)
+	}
+	if directoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: directoryURL}
+	}
+	return m.TLSConfig(), m
+}
+
+// serveACMEChallenges answers the CA's HTTP-01 challenges for m on addr until
+// ctx is cancelled.  Anything else is redirected to HTTPS.  CAs only send
+// HTTP-01 challenges to port 80; without it, m has to rely on TLS-ALPN-01
+// challenges on port 443.
+func serveACMEChallenges(ctx context.Context, addr string, m *autocert.Manager) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		slog.Error("error listening for ACME challenges", "addr", addr, "err", err)
+		return
+	}
+
+	hs := &http.Server{Handler: m.HTTPHandler(nil), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		hs.Close()
+	}()
+
+	err = hs.Serve(listener)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("error serving ACME challenges", "addr", addr, "err", err)
+	}
+}
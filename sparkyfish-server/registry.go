@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/freinold/sparkyfish/sparkyfishd"
+)
+
+// registryCommand runs a registry that sparkyfish servers register with, for
+// clients to choose from with sparkyfish-cli -registry, until we're told to
+// stop
+func registryCommand(args []string) error {
+	fs := flag.NewFlagSet("registry", flag.ExitOnError)
+	listenAddr := fs.String("listen-addr", ":7180", "IP:Port to serve the registry on")
+	token := fs.String("token", "", "Only list servers that present this token (default: $SPARKYFISH_REGISTRY_TOKEN)")
+	ttl := fs.Duration("ttl", sparkyfishd.DefaultRegistryTTL, "How long to list a server that hasn't renewed its registration; servers renew theirs every minute")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:", os.Args[0], "registry [options]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *token == "" {
+		*token = os.Getenv("SPARKYFISH_REGISTRY_TOKEN")
+	}
+
+	reg := &sparkyfishd.Registry{Token: *token, TTL: *ttl}
+	hs := &http.Server{Addr: *listenAddr, Handler: reg, ReadHeaderTimeout: 10 * time.Second}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		hs.Close()
+	}()
+
+	slog.Info("serving the registry", "addr", *listenAddr)
+	err := hs.ListenAndServe()
+	if err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/freinold/sparkyfish/internal/config"
+	"github.com/freinold/sparkyfish/sparkyfishd"
+)
+
+// reloadableFlags are the flags that SIGHUP can change, which set the
+// server's sparkyfishd.Settings.  Changing any other flag takes a restart.
+var reloadableFlags = map[string]bool{
+	"max-concurrent":   true,
+	"per-ip-limit":     true,
+	"auth-token":       true,
+	"geoip":            true,
+	"allow-cc":         true,
+	"allow-asn":        true,
+	"max-test-seconds": true,
+	"max-test-bytes":   true,
+}
+
+// loadConfig fills in the flags in fs that weren't given on the command line,
+// cmdline, from the config file at path, if there is one
+func loadConfig(fs *flag.FlagSet, path string, cmdline map[string]bool) error {
+	if path == "" {
+		return nil
+	}
+	cfg, err := config.Load(path, true)
+	if err != nil {
+		return err
+	}
+	return cfg.Apply(fs, cmdline, "config")
+}
+
+// reloadOnHUP reloads ss's settings on each SIGHUP until ctx is cancelled.
+// The flags in fs that weren't given on the command line are set again from
+// their defaults and our config file at path, and settings works out the
+// server's new Settings from them, opening its GeoIP databases afresh, so
+// that they can be updated too.  If anything's wrong with them, we keep to
+// the old ones.  Flags that can't be changed without a restart keep their
+// old values, with a warning.
+func reloadOnHUP(ctx context.Context, ss *sparkyfishd.Server, fs *flag.FlagSet, path string, cmdline map[string]bool, settings func() (sparkyfishd.Settings, error)) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigs:
+		}
+
+		sdNotify("RELOADING=1")
+		err := reload(ss, fs, path, cmdline, settings)
+		if err != nil {
+			slog.Error("error reloading; keeping the old settings", "config", path, "err", err)
+		} else {
+			slog.Info("reloaded settings", "config", path)
+		}
+		sdNotify("READY=1")
+	}
+}
+
+// reload does reloadOnHUP's work for one SIGHUP
+func reload(ss *sparkyfishd.Server, fs *flag.FlagSet, path string, cmdline map[string]bool, settings func() (sparkyfishd.Settings, error)) error {
+	old := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		old[f.Name] = f.Value.String()
+	})
+	restore := func(name string) {
+		fs.Set(name, old[name])
+	}
+
+	// Start from scratch, so that settings taken out of the config file go
+	// back to their defaults
+	fs.VisitAll(func(f *flag.Flag) {
+		if !cmdline[f.Name] {
+			f.Value.Set(f.DefValue)
+		}
+	})
+	err := loadConfig(fs, path, cmdline)
+	if err == nil {
+		var st sparkyfishd.Settings
+		st, err = settings()
+		if err == nil {
+			ss.Reload(st)
+		}
+	}
+
+	fs.VisitAll(func(f *flag.Flag) {
+		switch {
+		case err != nil:
+			restore(f.Name)
+		case !reloadableFlags[f.Name] && f.Value.String() != old[f.Name]:
+			slog.Warn("changing this flag takes a restart; keeping its old value", "flag", f.Name)
+			restore(f.Name)
+		}
+	})
+	return err
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/freinold/sparkyfish/sparkyfishd"
+)
+
+// usageReport sums up the tests in a test log
+type usageReport struct {
+	First      *time.Time     `json:"first,omitempty"`
+	Last       *time.Time     `json:"last,omitempty"`
+	Tests      int            `json:"tests"`
+	Clients    int            `json:"clients"`
+	Bytes      int64          `json:"bytes"`
+	MedianDown float64        `json:"median_download_mbps,omitempty"`
+	MedianUp   float64        `json:"median_upload_mbps,omitempty"`
+	Days       []*reportDay   `json:"days"`
+	TopClients []*reportUsage `json:"top_clients"`
+
+	clients map[string]*reportUsage
+	rates   reportRates
+}
+
+// reportDay sums up a day's tests
+type reportDay struct {
+	Day        string  `json:"day"`
+	Tests      int     `json:"tests"`
+	Clients    int     `json:"clients"`
+	Bytes      int64   `json:"bytes"`
+	MedianDown float64 `json:"median_download_mbps,omitempty"`
+	MedianUp   float64 `json:"median_upload_mbps,omitempty"`
+
+	clients map[string]bool
+	rates   reportRates
+}
+
+// reportUsage sums up a client's tests
+type reportUsage struct {
+	Client   string    `json:"client"`
+	Tests    int       `json:"tests"`
+	Bytes    int64     `json:"bytes"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// reportRates collects the rates of TCP throughput tests, for their medians.
+// UDP tests run at whatever rate the client asks for, so they'd only muddy
+// them.
+type reportRates struct {
+	down, up []float64
+}
+
+func (rr *reportRates) add(r sparkyfishd.TestRecord) {
+	switch r.Test {
+	case "download":
+		rr.down = append(rr.down, r.Mbps)
+	case "upload":
+		rr.up = append(rr.up, r.Mbps)
+	}
+}
+
+// add counts r in the report
+func (ur *usageReport) add(r sparkyfishd.TestRecord) {
+	t := r.Time
+	if ur.First == nil {
+		ur.First = &t
+	}
+	ur.Last = &t
+	ur.Tests++
+	ur.Bytes += r.Bytes
+	ur.rates.add(r)
+
+	cu := ur.clients[r.Client]
+	if cu == nil {
+		cu = &reportUsage{Client: r.Client}
+		ur.clients[r.Client] = cu
+	}
+	cu.Tests++
+	cu.Bytes += r.Bytes
+	cu.LastSeen = r.Time
+
+	// Records come oldest first, so a new day is always the last one
+	day := r.Time.Local().Format("2006-01-02")
+	if len(ur.Days) == 0 || ur.Days[len(ur.Days)-1].Day != day {
+		ur.Days = append(ur.Days, &reportDay{Day: day, clients: make(map[string]bool)})
+	}
+	rd := ur.Days[len(ur.Days)-1]
+	rd.Tests++
+	rd.Bytes += r.Bytes
+	rd.clients[r.Client] = true
+	rd.rates.add(r)
+}
+
+// finish works out the report's medians and its top clients, the top by
+// data moved
+func (ur *usageReport) finish(top int) {
+	ur.Clients = len(ur.clients)
+	ur.MedianDown, ur.MedianUp = median(ur.rates.down), median(ur.rates.up)
+	for _, rd := range ur.Days {
+		rd.Clients = len(rd.clients)
+		rd.MedianDown, rd.MedianUp = median(rd.rates.down), median(rd.rates.up)
+	}
+
+	ur.TopClients = []*reportUsage{}
+	for _, cu := range ur.clients {
+		ur.TopClients = append(ur.TopClients, cu)
+	}
+	sort.Slice(ur.TopClients, func(i, j int) bool {
+		a, b := ur.TopClients[i], ur.TopClients[j]
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		return a.Tests > b.Tests
+	})
+	if len(ur.TopClients) > top {
+		ur.TopClients = ur.TopClients[:top]
+	}
+}
+
+// median returns the median of rates, or 0 if there aren't any
+func median(rates []float64) float64 {
+	if len(rates) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), rates...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+// reportCommand implements "sparkyfish-server report", which sums up the
+// tests recorded with -test-log
+func reportCommand(args []string) error {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	path := fs.String("test-log", "", "Path of the test log that the server records tests in")
+	since := fs.Duration("since", 0, "Only count tests from the last duration (e.g. 720h)")
+	top := fs.Int("top", 10, "Number of top clients to list")
+	jsonOutput := fs.Bool("json", false, "Print the report as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:", os.Args[0], "report -test-log <path> [options]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *path == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var from time.Time
+	if *since > 0 {
+		from = time.Now().Add(-*since)
+	}
+
+	ur := &usageReport{Days: []*reportDay{}, clients: make(map[string]*reportUsage)}
+	err := sparkyfishd.NewTestLog(*path).Records(from, ur.add)
+	if err != nil {
+		return fmt.Errorf("error reading %v: %v", *path, err)
+	}
+	ur.finish(*top)
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(ur)
+	}
+
+	return printReport(os.Stdout, ur)
+}
+
+// printReport writes ur to w as text, with a table of days and one of the
+// top clients
+func printReport(w io.Writer, ur *usageReport) error {
+	if ur.Tests == 0 {
+		_, err := fmt.Fprintln(w, "No tests recorded")
+		return err
+	}
+
+	fmt.Fprintf(w, "%v tests from %v clients between %v and %v, moving %v\n", ur.Tests, ur.Clients,
+		ur.First.Local().Format("2006-01-02 15:04"), ur.Last.Local().Format("2006-01-02 15:04"), formatBytes(ur.Bytes))
+	fmt.Fprintf(w, "Median rates: download %v, upload %v\n\n", formatRate(ur.MedianDown), formatRate(ur.MedianUp))
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DAY\tTESTS\tCLIENTS\tDATA\tMEDIAN DOWN\tMEDIAN UP")
+	for _, rd := range ur.Days {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\n", rd.Day, rd.Tests, rd.Clients, formatBytes(rd.Bytes),
+			formatRate(rd.MedianDown), formatRate(rd.MedianUp))
+	}
+	tw.Flush()
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(tw, "TOP CLIENTS\tTESTS\tDATA\tLAST SEEN")
+	for _, cu := range ur.TopClients {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", cu.Client, cu.Tests, formatBytes(cu.Bytes), cu.LastSeen.Local().Format("2006-01-02 15:04"))
+	}
+	return tw.Flush()
+}
+
+// formatRate renders a median rate for printReport
+func formatRate(mbps float64) string {
+	if mbps == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f Mbit/s", mbps)
+}
+
+// formatBytes renders n as a human-readable amount of data, e.g. "1.4 GB"
+func formatBytes(n int64) string {
+	units := []string{"KB", "MB", "GB", "TB", "PB"}
+	if n < 1024 {
+		return fmt.Sprintf("%v B", n)
+	}
+	f := float64(n) / 1024
+	i := 0
+	for ; f >= 1024 && i < len(units)-1; i++ {
+		f /= 1024
+	}
+	return fmt.Sprintf("%.1f %v", f, units[i])
+}
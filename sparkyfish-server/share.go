@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/freinold/sparkyfish/sparkyfishd"
+)
+
+// shareCommand runs a share service that keeps the results that clients
+// share with it, with sparkyfish-cli -share, and shows them on pages of their
+// own, until we're told to stop
+func shareCommand(args []string) error {
+	fs := flag.NewFlagSet("share", flag.ExitOnError)
+	listenAddr := fs.String("listen-addr", ":7181", "IP:Port to serve the share service on")
+	dir := fs.String("dir", "", "Directory to keep the shared results in, so that they outlive the service (default: keep them in memory)")
+	baseURL := fs.String("base-url", "", "URL that the results' pages are at, e.g. https://share.example.com, for when we're behind a proxy (default: the host that the results were sent to)")
+	token := fs.String("token", "", "Only take results from clients that present this token; anyone may view them (default: $SPARKYFISH_SHARE_TOKEN)")
+	keepPersonal := fs.Bool("keep-personal", false, "Keep the environment, client address, city and traceroute of the results that clients send with -share-personal, rather than dropping them; anyone with a page's URL can see them")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:", os.Args[0], "share [options]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *token == "" {
+		*token = os.Getenv("SPARKYFISH_SHARE_TOKEN")
+	}
+	if *dir != "" {
+		err := os.MkdirAll(*dir, 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	ss := &sparkyfishd.ShareService{Dir: *dir, BaseURL: *baseURL, Token: *token, KeepPersonalData: *keepPersonal}
+	hs := &http.Server{Addr: *listenAddr, Handler: ss, ReadHeaderTimeout: 10 * time.Second}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		hs.Close()
+	}()
+
+	slog.Info("serving the share service", "addr", *listenAddr)
+	err := hs.ListenAndServe()
+	if err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
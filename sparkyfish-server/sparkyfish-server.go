@@ -1,335 +1,395 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"log"
+	"log/slog"
 	"net"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/dustin/randbo"
+	"github.com/freinold/sparkyfish"
+	"github.com/freinold/sparkyfish/internal/config"
+	"github.com/freinold/sparkyfish/sparkyfishd"
+	"golang.org/x/crypto/acme/autocert"
 )
 
-var (
-	cname    *string
-	location *string
-	debug    *bool
-)
-
-const (
-	protocolVersion  uint16 = 0x00 // The latest version of the sparkyfish protocol supported
-	blockSize        int64  = 1024 // size of each block copied to/from remote
-	reportIntervalMS uint64 = 1000 // report interval in milliseconds
-	testLength       uint   = 10   // length of throughput tests (sec)
-	pingTestLength   int    = 30   // number of pings allowed in a ping test
-
-)
-
-// TestType is used to indicate the type of test being performed
-type TestType int
-
-const (
-	outbound TestType = iota
-	inbound
-	echo
-)
-
-type sparkyServer struct {
-	randomData []byte
-}
-
-// newsparkyServer creates a sparkyServer object and pre-fills some random data
-func newsparkyServer() sparkyServer {
-	ss := sparkyServer{}
-
-	// Make a 10MB byte slice
-	ss.randomData = make([]byte, 1024*1024*10)
-
-	// Fill our 10MB byte slice with random data
-	_, err := randbo.New().Read(ss.randomData)
-	if err != nil {
-		log.Fatalln("error generating random data:", err)
+func main() {
+	// "sparkyfish-server report" sums up the tests in a test log instead of
+	// serving them
+	if len(os.Args) > 1 && os.Args[1] == "report" {
+		err := reportCommand(os.Args[2:])
+		if err != nil {
+			fatal(err.Error())
+		}
+		return
 	}
 
-	return ss
-}
-
-// sparkyClient handles requests for throughput and latency tests
-type sparkyClient struct {
-	client      net.Conn
-	testType    TestType
-	reader      *bufio.Reader
-	randReader  *bytes.Reader
-	blockTicker chan bool
-	done        chan bool
-}
-
-func newsparkyClient(client net.Conn) sparkyClient {
-	sc := sparkyClient{client: client}
-	return sc
-}
-
-func startListener(listenAddr string, ss *sparkyServer) {
-	listener, err := net.Listen("tcp", listenAddr)
-	if err != nil {
-		panic(err)
+	// "sparkyfish-server registry" keeps a list of servers for clients to
+	// choose from, instead of serving tests itself
+	if len(os.Args) > 1 && os.Args[1] == "registry" {
+		err := registryCommand(os.Args[2:])
+		if err != nil {
+			fatal(err.Error())
+		}
+		return
 	}
 
-	for {
-		conn, err := listener.Accept()
+	// "sparkyfish-server share" keeps the results that clients share with
+	// it, instead of serving tests itself
+	if len(os.Args) > 1 && os.Args[1] == "share" {
+		err := shareCommand(os.Args[2:])
 		if err != nil {
-			log.Println("error accepting connection:", err)
-			continue
+			fatal(err.Error())
 		}
-		go handler(conn, ss)
+		return
 	}
 
-}
-
-func handler(conn net.Conn, ss *sparkyServer) {
-	var version uint64
-
-	sc := newsparkyClient(conn)
-
-	sc.done = make(chan bool)
-	sc.blockTicker = make(chan bool, 200)
-
-	// Create a bytes.Reader over our pre-filled 10MB byte slice
-	sc.randReader = bytes.NewReader(ss.randomData)
-
-	defer sc.client.Close()
+	listenAddr := flag.String("listen-addr", ":7121", "IP:Port to listen on for speed tests (default: all IPs, port 7121)")
+	wsListenAddr := flag.String("ws-listen-addr", "", "IP:Port to also listen on for speed tests over WebSocket, at "+sparkyfish.WebSocketPath+" [optional]")
+	quicAddr := flag.String("quic-addr", "", "IP:Port (UDP) to also listen on for speed tests over QUIC, e.g. :"+sparkyfish.DefaultQUICPort+", with the certificate from -acme or -tls-cert, or a self-signed one [optional]")
+	webAddr := flag.String("web", "", "IP:Port to serve the web UI on, e.g. :8080 [optional]")
+	apiAddr := flag.String("api-addr", "", "IP:Port to serve the REST API on, for running tests against other servers on request [optional]")
+	healthAddr := flag.String("health-addr", "", "IP:Port to answer health and readiness probes on, at /healthz and /readyz, over plain HTTP [optional]")
+	pprofAddr := flag.String("pprof", "", "IP:Port to serve Go's profiles and runtime metrics on, at /debug/pprof/ and /debug/vars, over plain HTTP and without authentication, e.g. localhost:6060 [optional]")
+	debug := flag.Bool("debug", false, "Log debugging information")
+	logFormat := flag.String("log-format", "text", "Format to log in: text (logfmt-style key=value pairs) or json, one object per line")
 
-	sc.reader = bufio.NewReader(sc.client)
+	// Fetch our hostname.  Reported to the client after a successful HELO
+	cname := flag.String("cname", "", "Canonical hostname or IP address to optionally report to client. If you specify one, it must be DNS-resolvable.")
+	location := flag.String("location", "", "Location of server (e.g. \"Dallas, TX\") [optional]")
+	maxConcurrent := flag.Int("max-concurrent", 0, "Maximum number of connections to handle at once (0: no limit)")
+	perIPLimit := flag.Int("per-ip-limit", 0, "Maximum number of connections to handle at once from a single client IP (0: no limit)")
+	advertise := flag.Bool("mdns", false, "Advertise the server on the local network over mDNS, for sparkyfish-cli -discover")
+	authToken := flag.String("auth-token", "", "Only run tests for clients that present this token [optional]")
+	maxTestSeconds := flag.Int("max-test-seconds", 0, "Cut TCP throughput tests short after this many seconds (0: no limit; tests run for 10 seconds at most anyway)")
+	maxTestBytes := flag.Int64("max-test-bytes", 0, "Cut TCP throughput tests short once they've sent or received this many bytes over a connection (0: no limit)")
+	workers := flag.Int("workers", sparkyfishd.DefaultWorkers, "Maximum number of connections to serve at once, counting ones that have yet to start a test; beyond it, we stop accepting connections until one finishes")
+	idleTimeout := flag.Duration("idle-timeout", sparkyfishd.DefaultIdleTimeout, "How long to wait for a client to send its next command or its next megabyte of upload before dropping it")
+	writeTimeout := flag.Duration("write-timeout", sparkyfishd.DefaultWriteTimeout, "How long to wait for a client to take its next megabyte of download, or any other reply, before dropping it as too slow")
+	sendfile := flag.Bool("sendfile", false, "On Linux, send downloads with sendfile(2) from a 32 MB block of test data that every download repeats, which takes far less CPU than generating fresh data for each one, but which a deduplicating WAN optimizer along the path can recognize")
+	geoIP := flag.String("geoip", "", "Comma-separated MaxMind databases (e.g. GeoLite2-City.mmdb,GeoLite2-ASN.mmdb) to look up where clients are in, for -allow-cc, -allow-asn and INFO [optional]")
+	allowCC := flag.String("allow-cc", "", "Only run tests for clients in these comma-separated countries, e.g. DE,AT (needs -geoip) [optional]")
+	allowASN := flag.String("allow-asn", "", "Only run tests for clients in these comma-separated autonomous systems, e.g. 3320,AS8881 (needs -geoip) [optional]")
+	proxyProtocol := flag.Bool("proxy-protocol", false, "Expect a PROXY protocol (v1 or v2) header from a load balancer at the start of each TCP connection, naming the real client; connections without one are dropped")
+	proxyFrom := flag.String("proxy-from", "", "With -proxy-protocol, only expect PROXY headers from these comma-separated load balancer IPs or networks, e.g. 10.0.0.0/8, and serve anybody else directly [optional]")
+	drainTimeout := flag.Duration("drain-timeout", 30*time.Second, "On SIGTERM or SIGINT, how long to wait for running tests to finish before closing their connections and exiting")
+	testLog := flag.String("test-log", "", "Record each test in this database, for \"sparkyfish-server report\" [optional]")
+	useACME := flag.Bool("acme", false, "Get a certificate for -hostname from Let's Encrypt, renew it as needed, and serve WebSocket tests, the web UI and the API over HTTPS with it; WebSocket tests are served on :443 unless -ws-listen-addr says otherwise")
+	hostname := flag.String("hostname", "", "With -acme, the hostname to get a certificate for (default: -cname)")
+	acmeCache := flag.String("acme-cache", defaultACMECache(), "With -acme, the directory to keep our certificates in")
+	acmeEmail := flag.String("acme-email", "", "With -acme, an email address for Let's Encrypt to write to about our certificates [optional]")
+	acmeHTTPAddr := flag.String("acme-http-addr", ":80", "With -acme, IP:Port to answer HTTP-01 challenges on, which Let's Encrypt sends to port 80; empty to rely on TLS-ALPN-01 challenges on port 443 alone")
+	acmeDirectory := flag.String("acme-directory", "", "With -acme, the directory URL of another ACME CA to use, e.g. Let's Encrypt's staging one while trying things out [optional]")
+	tlsCert := flag.String("tls-cert", "", "Certificate (PEM) to serve WebSocket tests, the web UI and the API over HTTPS with, instead of one from -acme; read again on SIGHUP [optional]")
+	tlsKey := flag.String("tls-key", "", "Private key (PEM) of -tls-cert [optional]")
+	clientCA := flag.String("client-ca", "", "Only run tests for clients that present a certificate from one of these CAs (PEM), or else the -auth-token; needs -acme or -tls-cert [optional]")
+	registryURL := flag.String("registry", "", "Register with the sparkyfish registry at this URL (e.g. https://registry.example.com), keeping our location and load up to date, so that clients can find us through it [optional]")
+	registryAddr := flag.String("registry-addr", "", "With -registry, the host:port to register as (default: -cname and our port, or else the address that we register from)")
+	registryToken := flag.String("registry-token", "", "With -registry, a token to present to the registry (default: $SPARKYFISH_REGISTRY_TOKEN)")
+	siblings := flag.String("siblings", "", "When we're already at -max-concurrent, send clients to these comma-separated host:port servers instead of turning them away; with -registry, the other servers that it lists are added to them [optional]")
+	configPath := flag.String("config", "", "Read the defaults of these flags from this config file, which is read again on SIGHUP [optional]")
+	flag.Parse()
 
-	// Every connection begins with a HELO<version> command,
-	// where <version> is one byte that will be converted to a uint16
-	helo, err := sc.reader.ReadString('\n')
+	// Anything that wasn't given on the command line may come from our
+	// config file
+	cmdline := config.SetFlags(flag.CommandLine)
+	err := loadConfig(flag.CommandLine, *configPath, cmdline)
 	if err != nil {
-		// If a client hangs up, just hang up silently
-		return
+		fatal("error reading config file", "err", err)
 	}
-	helo = strings.TrimSpace(helo)
 
+	// Everything is logged to stderr, including what other packages log
+	// with the standard log package
+	level := slog.LevelInfo
 	if *debug {
-		log.Println("COMMAND RECEIVED:", helo)
+		level = slog.LevelDebug
 	}
-
-	// The HELO command must be exactly 7 bytes long, including version and CRLF
-	if len(helo) != 5 {
-		sc.client.Write([]byte("ERR:Invalid HELO received\n"))
-		return
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch *logFormat {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -log-format %q: must be text or json\n", *logFormat)
+		os.Exit(2)
 	}
+	logger := slog.New(handler)
+	slog.SetDefault(logger)
+
+	// settings works out the settings that SIGHUP can change from our flags.
+	// Once we're serving, it also reloads our certificate, if we have one.
+	var certs *certFiles
+	settings := func() (sparkyfishd.Settings, error) {
+		st := sparkyfishd.Settings{
+			MaxConcurrent:  *maxConcurrent,
+			PerIPLimit:     *perIPLimit,
+			AuthToken:      *authToken,
+			AllowCountries: splitList(*allowCC),
+			MaxTestSeconds: *maxTestSeconds,
+			MaxTestBytes:   *maxTestBytes,
+		}
 
-	if helo[:4] != "HELO" {
-		sc.client.Write([]byte("ERR:Invalid HELO received\n"))
-		return
-	}
+		// Let the token be kept off the command line, where other
+		// users can see it
+		if st.AuthToken == "" {
+			st.AuthToken = os.Getenv("SPARKYFISH_AUTH_TOKEN")
+		}
 
-	// Parse the version number
-	version, err = strconv.ParseUint(helo[4:], 10, 16)
+		var err error
+		if *geoIP != "" {
+			st.GeoIP, err = sparkyfishd.OpenGeoIP(strings.Split(*geoIP, ",")...)
+			if err != nil {
+				return st, fmt.Errorf("error opening GeoIP database: %v", err)
+			}
+		}
+		st.AllowASNs, err = parseASNs(*allowASN)
+		if err != nil {
+			return st, fmt.Errorf("invalid -allow-asn: %v", err)
+		}
+		if (len(st.AllowCountries) > 0 || len(st.AllowASNs) > 0) && st.GeoIP == nil {
+			return st, fmt.Errorf("-allow-cc and -allow-asn need a -geoip database")
+		}
+		if certs != nil {
+			err = certs.load()
+		}
+		return st, err
+	}
+	st, err := settings()
 	if err != nil {
-		sc.client.Write([]byte("ERR:Invalid HELO received\n"))
-		log.Println("error parsing version", err)
-		return
+		fatal(err.Error())
+	}
+	proxies, err := parseNetworks(*proxyFrom)
+	if err != nil {
+		fatal("invalid -proxy-from", "err", err)
+	}
+	if len(proxies) > 0 && !*proxyProtocol {
+		fatal("-proxy-from needs -proxy-protocol")
 	}
 
-	if *debug {
-		log.Printf("HELO received.  Version: %#x", version)
+	// With -acme or -tls-cert, we serve over HTTPS, with a certificate from
+	// Let's Encrypt or our own, and WebSocket tests default to its port
+	var tlsConfig *tls.Config
+	var acmeManager *autocert.Manager
+	switch {
+	case *useACME && (*tlsCert != "" || *tlsKey != ""):
+		fatal("-acme and -tls-cert are mutually exclusive")
+	case *useACME:
+		host := *hostname
+		if host == "" {
+			host = *cname
+		}
+		if host == "" {
+			fatal("-acme needs a -hostname")
+		}
+		tlsConfig, acmeManager = acmeTLSConfig(host, *acmeCache, *acmeEmail, *acmeDirectory)
+	case *tlsCert != "" || *tlsKey != "":
+		if *tlsCert == "" || *tlsKey == "" {
+			fatal("-tls-cert and -tls-key go together")
+		}
+		certs = &certFiles{certFile: *tlsCert, keyFile: *tlsKey}
+		err = certs.load()
+		if err != nil {
+			fatal(err.Error())
+		}
+		tlsConfig = &tls.Config{GetCertificate: certs.getCertificate}
+	}
+	wsAddr := *wsListenAddr
+	if tlsConfig != nil && wsAddr == "" {
+		wsAddr = ":443"
 	}
 
-	// Close the connection if the client requests a protocol version
-	// greater than what we support
-	if uint16(version) > protocolVersion {
-		sc.client.Write([]byte("ERR:Protocol version not supported\n"))
-		log.Println("Invalid protocol version requested", version)
-		return
+	// With -client-ca, clients have to present a certificate from our PKI
+	if *clientCA != "" {
+		if tlsConfig == nil {
+			fatal("-client-ca needs -acme or -tls-cert")
+		}
+		tlsConfig.ClientCAs, err = loadCAs(*clientCA)
+		if err != nil {
+			fatal("error loading -client-ca", "err", err)
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
 	}
 
-	banner := bytes.NewBufferString("HELO\n")
-	if *cname != "" {
-		banner.WriteString(fmt.Sprintln(*cname))
-	} else {
-		banner.WriteString("none\n")
+	ss := &sparkyfishd.Server{
+		Addr:     *listenAddr,
+		Cname:    *cname,
+		Location: *location,
+		Logger:   logger,
+
+		MaxConcurrent:  st.MaxConcurrent,
+		PerIPLimit:     st.PerIPLimit,
+		AuthToken:      st.AuthToken,
+		Advertise:      *advertise,
+		WebSocketAddr:  wsAddr,
+		QUICAddr:       *quicAddr,
+		WebAddr:        *webAddr,
+		APIAddr:        *apiAddr,
+		HealthAddr:     *healthAddr,
+		PprofAddr:      *pprofAddr,
+		Sendfile:       *sendfile,
+		MaxTestSeconds: st.MaxTestSeconds,
+		MaxTestBytes:   st.MaxTestBytes,
+		Workers:        *workers,
+		IdleTimeout:    *idleTimeout,
+		WriteTimeout:   *writeTimeout,
+		GeoIP:          st.GeoIP,
+		AllowCountries: st.AllowCountries,
+		AllowASNs:      st.AllowASNs,
+		ProxyProtocol:  *proxyProtocol,
+		ProxyFrom:      proxies,
+		TLSConfig:      tlsConfig,
+
+		RequireClientCert: *clientCA != "",
+		RegistryURL:       *registryURL,
+		RegistryAddr:      *registryAddr,
+		RegistryToken:     *registryToken,
+		Siblings:          splitList(*siblings),
+	}
+	if ss.RegistryToken == "" {
+		ss.RegistryToken = os.Getenv("SPARKYFISH_REGISTRY_TOKEN")
 	}
-	if *location != "" {
-		banner.WriteString(fmt.Sprintln(*location))
-	} else {
-		banner.WriteString("none\n")
+	if *testLog != "" {
+		ss.TestLog = sparkyfishd.NewTestLog(*testLog)
 	}
 
-	_, err = banner.WriteTo(sc.client)
+	// Under systemd, we may be handed our sockets rather than opening them
+	// ourselves.  We open any others that we've been asked for.
+	ls := &sparkyfishd.Listeners{}
+	activated, err := systemdListeners(ls)
 	if err != nil {
-		log.Println("error writing HELO response to client:", err)
-		return
+		fatal("error using sockets from systemd", "err", err)
+	}
+	if activated {
+		slog.Info("serving on sockets from systemd", "tcp", len(ls.Tests), "udp", len(ls.Packets))
 	}
 
-	cmd, err := sc.reader.ReadString('\n')
+	// The API makes us connect to whatever servers we're asked to, so it
+	// mustn't be open to all
+	if *apiAddr != "" || ls.API != nil {
+		err = ss.CheckAPIAccess()
+		if err != nil {
+			fatal("the API (-api-addr) needs -auth-token, or -client-ca over HTTPS", "err", err)
+		}
+	}
+	err = ss.Listen(ls)
 	if err != nil {
-		return
+		fatal("error listening", "err", err)
 	}
-	cmd = strings.TrimSpace(cmd)
 
-	if *debug {
-		log.Println("COMMAND RECEIVED:", string(cmd))
+	ctx, cancel := context.WithCancel(context.Background())
+	err = sdNotify("READY=1")
+	if err != nil {
+		slog.Warn("error notifying systemd", "err", err)
 	}
-
-	if len(cmd) != 3 {
-		sc.client.Write([]byte("ERR:Invalid command received\n"))
-		return
+	go sdWatchdog(ctx)
+	if acmeManager != nil && *acmeHTTPAddr != "" {
+		go serveACMEChallenges(ctx, *acmeHTTPAddr, acmeManager)
 	}
-
-	switch cmd {
-	case "SND":
-		sc.testType = outbound
-		log.Printf("[%v] initiated download test", sc.client.RemoteAddr())
-	case "RCV":
-		sc.testType = inbound
-		log.Printf("[%v] initiated upload test", sc.client.RemoteAddr())
-	case "ECO":
-		sc.testType = echo
-		log.Printf("[%v] initiated echo test", sc.client.RemoteAddr())
-	default:
-		sc.client.Write([]byte("ERR:Invalid command received"))
-		return
+	go reloadOnHUP(ctx, ss, flag.CommandLine, *configPath, cmdline, settings)
+
+	stopped := make(chan struct{})
+	go func() {
+		shutDown(ss, *drainTimeout)
+		cancel()
+		close(stopped)
+	}()
+
+	err = ss.ServeListeners(ctx, ls)
+	if err != sparkyfishd.ErrServerClosed {
+		fatal("error serving speed tests", "err", err)
 	}
+	<-stopped
+}
 
-	if sc.testType == echo {
-		// Start an echo/ping test and block until it finishes
-		sc.echoTest()
-	} else {
-		// Start an upload/download test
+// shutDown waits for SIGTERM or SIGINT, then shuts ss down, giving the tests
+// that are running up to timeout to finish.  A second signal stops the wait.
+func shutDown(ss *sparkyfishd.Server, timeout time.Duration) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	sig := <-sigs
 
-		// Launch our throughput reporter in a goroutine
-		go sc.ReportThroughput()
+	sdNotify("STOPPING=1")
+	slog.Info("shutting down; waiting for running tests to finish", "signal", sig.String(), "timeout", timeout)
 
-		// Start our metered copier and block until it finishes
-		sc.MeteredCopy()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 
-		// When our metered copy unblocks, the speed test is done, so we close
-		// this channel to signal the throughput reporter to halt
-		sc.done <- true
+	err := ss.Shutdown(ctx)
+	if err != nil {
+		slog.Warn("stopped waiting for running tests to finish", "err", err)
 	}
 }
 
-func (sc *sparkyClient) echoTest() {
-	for c := 0; c <= pingTestLength-1; c++ {
-		chr, err := sc.reader.ReadByte()
-		if err != nil {
-			log.Println("Error reading byte:", err)
-			break
-		}
-		if *debug {
-			log.Println("Copying byte:", chr)
-		}
-		_, err = sc.client.Write([]byte{chr})
-		if err != nil {
-			log.Println("Error writing byte:", err)
-			break
-		}
-	}
-	return
+// fatal logs msg as an error and exits
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
 
-// MeteredCopy copies to or from a net.Conn, keeping count of the data it passes
-func (sc *sparkyClient) MeteredCopy() {
-	var err error
-	var timer *time.Timer
-
-	// Set a timer that we'll use to stop the test.  If we're running an inbound test,
-	// we extend the timer by two seconds to allow the client to finish its sending.
-	if sc.testType == inbound {
-		timer = time.NewTimer(time.Second * time.Duration(testLength+2))
-	} else if sc.testType == outbound {
-		timer = time.NewTimer(time.Second * time.Duration(testLength))
+// splitList splits a comma-separated list, dropping any empty items
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
+	return items
+}
 
-	for {
-		select {
-		case <-timer.C:
-			if *debug {
-				log.Println(testLength, "seconds have elapsed.")
-			}
-			return
-		default:
-			// Copy our random data from randbo to our ResponseWriter, 100KB at a time
-			switch sc.testType {
-			case outbound:
-				// Try to copy the entire 10MB bytes.Reader to the client.
-				_, err = io.CopyN(sc.client, sc.randReader, 1024*1024*10)
-			case inbound:
-				_, err = io.CopyN(ioutil.Discard, sc.client, 1024*blockSize)
-			}
-
-			// io.EOF is normal when a client drops off after the test
-			if err != nil {
-				if err != io.EOF {
-					log.Println("Error copying:", err)
-				}
-				return
-			}
-
-			// Seek back to the beginning of the bytes.Reader
-			sc.randReader.Seek(0, 0)
-
-			// // With each 100K copied, we send a message on our blockTicker channel
-			sc.blockTicker <- true
+// parseASNs parses a comma-separated list of autonomous system numbers, which
+// may be written with or without an "AS" in front
+func parseASNs(list string) ([]uint32, error) {
+	var asns []uint32
+	for _, item := range splitList(list) {
+		n, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(item), "AS"), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ASN %v", item)
 		}
+		asns = append(asns, uint32(n))
 	}
+	return asns, nil
 }
 
-// ReportThroughput reports on throughput of data passed by MeterWrite
-func (sc *sparkyClient) ReportThroughput() {
-	var blockCount, prevBlockCount uint64
-
-	tick := time.NewTicker(time.Duration(reportIntervalMS) * time.Millisecond)
-
-	start := time.Now()
-
-blockcounter:
-	for {
-		select {
-		case <-sc.blockTicker:
-			// Increment our block counter when we get a ticker
-			blockCount++
-		case <-sc.done:
-			tick.Stop()
-			break blockcounter
-		case <-tick.C:
-			// Every second, we calculate how many blocks were received
-			// and derive an average throughput rate.
-			if *debug {
-				log.Printf("[%v] %v Kbit/sec", sc.client.RemoteAddr(), (blockCount-prevBlockCount)*uint64(blockSize*8)*(1000/reportIntervalMS))
+// parseNetworks parses a comma-separated list of networks in CIDR notation.
+// Plain IP addresses are networks of just themselves.
+func parseNetworks(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, item := range splitList(list) {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %v", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
 			}
-			prevBlockCount = blockCount
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
 		}
-	}
 
-	duration := time.Now().Sub(start).Seconds()
-	if sc.testType == outbound {
-		mbCopied := float64(blockCount * 10)
-		log.Printf("[%v] Sent %v MB in %.2f seconds (%.2f Mbit/s)", sc.client.RemoteAddr(), mbCopied, duration, (mbCopied/duration)*8)
-	} else if sc.testType == inbound {
-		mbCopied := float64(blockCount * uint64(blockSize) / 1024)
-		log.Printf("[%v] Recd %v MB in %.2f seconds (%.2f) Mbit/s", sc.client.RemoteAddr(), mbCopied, duration, (mbCopied/duration)*8)
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %v", item)
+		}
+		networks = append(networks, n)
 	}
-}
-
-func main() {
-	listenAddr := flag.String("listen-addr", ":7121", "IP:Port to listen on for speed tests (default: all IPs, port 7121)")
-	debug = flag.Bool("debug", false, "Print debugging information to stdout")
-
-	// Fetch our hostname.  Reported to the client after a successful HELO
-	cname = flag.String("cname", "", "Canonical hostname or IP address to optionally report to client. If you specify one, it must be DNS-resolvable.")
-	location = flag.String("location", "", "Location of server (e.g. \"Dallas, TX\") [optional]")
-	flag.Parse()
-
-	ss := newsparkyServer()
-
-	startListener(*listenAddr, &ss)
+	return networks, nil
 }
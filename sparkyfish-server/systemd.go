@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/freinold/sparkyfish/sparkyfishd"
+)
+
+// listenFDsStart is the first of the file descriptors that systemd passes us
+// with socket activation
+const listenFDsStart = 3
+
+// systemdListeners adds the sockets that systemd passed us with socket
+// activation, if it did, to ls.  They're sorted by the names that the socket
+// units give them with FileDescriptorName=: "websocket", "web", "api",
+// "health" and "pprof" sockets are for those, a "quic" one is for speed tests
+// over QUIC, and any others are for speed tests, over TCP or UDP.  It reports
+// whether there were any.
+func systemdListeners(ls *sparkyfishd.Listeners) (bool, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return false, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return false, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// The sockets are meant for us, not for anything that we might start
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	for i := 0; i < n; i++ {
+		var name string
+		if i < len(names) {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		listener, err := net.FileListener(f)
+		if err != nil {
+			pc, perr := net.FilePacketConn(f)
+			f.Close()
+			if perr != nil {
+				return false, fmt.Errorf("socket %v from systemd isn't one that we can use: %v", i+listenFDsStart, err)
+			}
+			if name == "quic" {
+				ls.QUIC = pc
+			} else {
+				ls.Packets = append(ls.Packets, pc)
+			}
+			continue
+		}
+		f.Close()
+
+		switch name {
+		case "websocket":
+			ls.WebSocket = listener
+		case "web":
+			ls.Web = listener
+		case "api":
+			ls.API = listener
+		case "health":
+			ls.Health = listener
+		case "pprof":
+			ls.Pprof = listener
+		default:
+			ls.Tests = append(ls.Tests, listener)
+		}
+	}
+
+	if len(ls.Packets) > 0 && len(ls.Tests) == 0 {
+		return false, fmt.Errorf("systemd passed us UDP sockets without any TCP ones to go with them")
+	}
+	return true, nil
+}
+
+// sdNotify tells systemd about our state, e.g. "READY=1", if it started us
+// as a Type=notify service
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+
+	// Addresses that start with @ are in the abstract namespace, which
+	// the net package understands
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdog keeps systemd's watchdog from restarting us, if it's watching
+// us, until ctx is cancelled.  We ping it at half of its timeout, as systemd
+// recommends.
+func sdWatchdog(ctx context.Context) {
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	tick := time.NewTicker(time.Duration(usec) * time.Microsecond / 2)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			err := sdNotify("WATCHDOG=1")
+			if err != nil {
+				slog.Warn("error pinging systemd's watchdog", "err", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// certFiles serves our certificate from -tls-cert and -tls-key.  SIGHUP has
+// us load them again, so that a renewed certificate is picked up without a
+// restart.
+type certFiles struct {
+	certFile, keyFile string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// load reads our certificate from its files.  If they're no good, we keep the
+// one that we had.
+func (cf *certFiles) load() error {
+	cert, err := tls.LoadX509KeyPair(cf.certFile, cf.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading TLS certificate: %v", err)
+	}
+
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	cf.cert = &cert
+	return nil
+}
+
+// getCertificate is our tls.Config's GetCertificate
+func (cf *certFiles) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cf.mu.RLock()
+	defer cf.mu.RUnlock()
+	return cf.cert, nil
+}
+
+// loadCAs reads the CA certificates in the PEM file at path
+func loadCAs(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %v", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,129 @@
+package sparkyfishd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/freinold/sparkyfish"
+)
+
+// testRequest is the body of a POST to /api/v1/test
+type testRequest struct {
+	// Server is the sparkyfish server to test against, as host[:port]
+	Server string `json:"server"`
+
+	// Token is presented to the other server, if it needs one
+	Token string `json:"token,omitempty"`
+
+	UDP           bool `json:"udp,omitempty"`
+	DownloadOnly  bool `json:"download_only,omitempty"`
+	UploadOnly    bool `json:"upload_only,omitempty"`
+	Bidirectional bool `json:"bidirectional,omitempty"`
+}
+
+// apiError is the body of an API response that reports an error
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// APIHandler returns an http.Handler for our REST API.  POST /api/v1/test
+// makes us run a speed test, as a client, against another sparkyfish server
+// and respond with the results.  Since that has us connect wherever we're
+// told, callers must present our AuthToken as a bearer token, or a client
+// certificate from one of our CAs, and without either to check, we turn every
+// request away.  We only run one test at a time.
+func (s *Server) APIHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/test", s.apiTest)
+	return mux
+}
+
+// CheckAPIAccess returns an error if nobody could use our API, because we
+// have neither an AuthToken nor client certificates to check callers with.
+// Client certificates are only checked over TLS, so RequireClientCert needs
+// a TLSConfig with ClientCAs to count.
+func (s *Server) CheckAPIAccess() error {
+	switch {
+	case s.settings().AuthToken != "":
+		return nil
+	case s.RequireClientCert && (s.TLSConfig == nil || s.TLSConfig.ClientCAs == nil):
+		return fmt.Errorf("client certificates can only be checked over TLS, with ClientCAs")
+	case s.RequireClientCert:
+		return nil
+	}
+	return fmt.Errorf("the API needs an auth token or client certificates")
+}
+
+func (s *Server) apiTest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeAPIError(w, http.StatusMethodNotAllowed, "only POST is allowed")
+		return
+	}
+
+	if !verifiedCert(r.TLS) {
+		st := s.settings()
+		if st.AuthToken == "" {
+			writeAPIError(w, http.StatusForbidden, "the API needs an auth token or client certificates to be set up")
+			return
+		}
+		if !st.validToken(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")) {
+			writeAPIError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+	}
+
+	var req testRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid request: %v", err))
+		return
+	}
+	if req.Server == "" {
+		writeAPIError(w, http.StatusBadRequest, "no server given")
+		return
+	}
+	if req.DownloadOnly && req.UploadOnly {
+		writeAPIError(w, http.StatusBadRequest, "download_only and upload_only can't both be set")
+		return
+	}
+
+	// Tests running side by side would skew each other's results
+	if !atomic.CompareAndSwapInt32(&s.apiBusy, 0, 1) {
+		writeAPIError(w, http.StatusConflict, "a test is already running")
+		return
+	}
+	defer atomic.StoreInt32(&s.apiBusy, 0)
+
+	client, err := sparkyfish.NewClient(req.Server)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	client.Token = req.Token
+	client.UDP = req.UDP
+	client.SkipUpload = req.DownloadOnly
+	client.SkipDownload = req.UploadOnly
+	client.Bidirectional = req.Bidirectional
+
+	s.logger().Info("API requested a test", "caller", r.RemoteAddr, "server", client.Addr())
+
+	// The test is abandoned if the caller hangs up
+	results, err := client.Run(r.Context())
+	if err != nil {
+		writeAPIError(w, http.StatusBadGateway, fmt.Sprintf("test against %v failed: %v", client.Addr(), err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiError{Error: msg})
+}
@@ -0,0 +1,30 @@
+package sparkyfishd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+)
+
+func TestCheckAPIAccess(t *testing.T) {
+	withCAs := &tls.Config{ClientCAs: x509.NewCertPool()}
+	tests := []struct {
+		name string
+		s    *Server
+		ok   bool
+	}{
+		{"nothing", &Server{}, false},
+		{"token", &Server{AuthToken: "secret"}, true},
+		{"client certificates over TLS", &Server{RequireClientCert: true, TLSConfig: withCAs}, true},
+		{"client certificates without TLS", &Server{RequireClientCert: true}, false},
+		{"client certificates without CAs", &Server{RequireClientCert: true, TLSConfig: &tls.Config{}}, false},
+		{"token and client certificates without TLS", &Server{AuthToken: "secret", RequireClientCert: true}, true},
+		{"TLS alone", &Server{TLSConfig: withCAs}, false},
+	}
+	for _, tt := range tests {
+		err := tt.s.CheckAPIAccess()
+		if (err == nil) != tt.ok {
+			t.Errorf("%v: CheckAPIAccess returned %v", tt.name, err)
+		}
+	}
+}
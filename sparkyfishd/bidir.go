@@ -0,0 +1,119 @@
+package sparkyfishd
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// bidPairTimeout is how long the download half of a bidirectional test waits
+// for the client to connect its upload half
+const bidPairTimeout = 5 * time.Second
+
+// bidPair is a bidirectional test that's waiting for its upload half
+type bidPair struct {
+	id     uint64
+	joined chan struct{}
+}
+
+// bidPairs maps pairing IDs to bidirectional tests that are waiting for
+// their upload half
+type bidPairs struct {
+	mu sync.Mutex
+	m  map[uint64]*bidPair
+}
+
+func (bp *bidPairs) add() *bidPair {
+	var b [8]byte
+
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	if bp.m == nil {
+		bp.m = make(map[uint64]*bidPair)
+	}
+
+	for {
+		rand.Read(b[:])
+		id := binary.BigEndian.Uint64(b[:])
+		if _, ok := bp.m[id]; !ok {
+			pair := &bidPair{id: id, joined: make(chan struct{})}
+			bp.m[id] = pair
+			return pair
+		}
+	}
+}
+
+// take removes the pair with id, returning nil if there isn't one.  Each pair
+// can only be taken once.
+func (bp *bidPairs) take(id uint64) *bidPair {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	pair := bp.m[id]
+	delete(bp.m, id)
+	return pair
+}
+
+// beginBidirectional handles a BID command.  A bare BID opens the download
+// half of a bidirectional test: we reply with a pairing ID and wait for the
+// client to present it with BID <id> on a second connection, which becomes
+// the upload half.  Both halves start as soon as they're paired.  It reports
+// whether the test should go ahead.
+func (sc *sparkyClient) beginBidirectional(args []string) bool {
+	s := sc.server
+
+	switch len(args) {
+	case 1:
+		pair := s.bids.add()
+
+		_, err := fmt.Fprintf(sc.client, "%016x\n", pair.id)
+		if err != nil {
+			s.bids.take(pair.id)
+			return false
+		}
+
+		select {
+		case <-pair.joined:
+		case <-time.After(bidPairTimeout):
+			if s.bids.take(pair.id) != nil {
+				sc.client.Write([]byte("ERR:Upload connection never arrived\n"))
+				return false
+			}
+			// We lost a race with the upload half, which has just joined
+		}
+
+		sc.testType = outbound
+		sc.log = sc.log.With("pair", fmt.Sprintf("%016x", pair.id))
+		sc.log.Info("initiated bidirectional test (download)")
+	case 2:
+		id, err := strconv.ParseUint(args[1], 16, 64)
+		var pair *bidPair
+		if err == nil {
+			pair = s.bids.take(id)
+		}
+		if pair == nil {
+			sc.client.Write([]byte("ERR:Unknown BID session\n"))
+			return false
+		}
+
+		// Start the download half and tell the client to start uploading
+		close(pair.joined)
+		_, err = sc.client.Write([]byte("OK\n"))
+		if err != nil {
+			return false
+		}
+
+		sc.testType = inbound
+		sc.log = sc.log.With("pair", fmt.Sprintf("%016x", pair.id))
+		sc.log.Info("initiated bidirectional test (upload)")
+	default:
+		sc.client.Write([]byte("ERR:Invalid command received\n"))
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,184 @@
+package sparkyfishd
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+
+	"github.com/freinold/sparkyfish"
+)
+
+// GeoIP looks up where IP addresses are in MaxMind databases, such as the
+// free GeoLite2 ones.  A Country or City database gives the country and city,
+// and an ASN database the autonomous system.  Lookups merge what each of the
+// databases knows.
+type GeoIP struct {
+	dbs []*mmdb
+}
+
+// OpenGeoIP opens the MaxMind databases at paths
+func OpenGeoIP(paths ...string) (*GeoIP, error) {
+	g := &GeoIP{}
+	for _, path := range paths {
+		db, err := openMMDB(path)
+		if err != nil {
+			return nil, err
+		}
+		g.dbs = append(g.dbs, db)
+	}
+	return g, nil
+}
+
+// Lookup returns what our databases know about where ip is.  Private and
+// loopback addresses, which they never cover, come back empty.
+func (g *GeoIP) Lookup(ip net.IP) sparkyfish.GeoLocation {
+	var gl sparkyfish.GeoLocation
+	if ip == nil || isLocalIP(ip) {
+		return gl
+	}
+
+	for _, db := range g.dbs {
+		rec, err := db.lookup(ip)
+		if err != nil {
+			slog.Warn("error looking up an address", "ip", ip.String(), "database", db.dbType, "err", err)
+			continue
+		}
+		if rec == nil {
+			continue
+		}
+
+		if gl.Country == "" {
+			gl.Country, _ = mmdbPath(rec, "country", "iso_code").(string)
+		}
+		if gl.Country == "" {
+			gl.Country, _ = mmdbPath(rec, "registered_country", "iso_code").(string)
+		}
+		if gl.City == "" {
+			gl.City, _ = mmdbPath(rec, "city", "names", "en").(string)
+		}
+		if gl.ASN == 0 {
+			gl.ASN = uint32(mmdbUint(rec["autonomous_system_number"]))
+			gl.ASOrg, _ = rec["autonomous_system_organization"].(string)
+		}
+	}
+
+	return gl
+}
+
+// mmdbPath returns the value at path in a record of nested maps, or nil if
+// it isn't there
+func mmdbPath(rec map[string]interface{}, path ...string) interface{} {
+	var v interface{} = rec
+	for _, key := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+	return v
+}
+
+// isLocalIP reports whether ip is a loopback, link-local or private address
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, block := range privateBlocks {
+		if block.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// privateBlocks are the private address ranges of RFC 1918, RFC 6598 (carrier
+// grade NAT) and RFC 4193
+var privateBlocks = func() []*net.IPNet {
+	var blocks []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"} {
+		_, block, _ := net.ParseCIDR(cidr)
+		blocks = append(blocks, block)
+	}
+	return blocks
+}()
+
+// geoAllowed reports whether a client at ip may run tests, given our
+// AllowCountries and AllowASNs.  Clients on private and loopback addresses
+// always may, since GeoIP databases don't cover them, but clients that we
+// can't place otherwise may not.  It returns the reason if the client may
+// not.
+func (st *Settings) geoAllowed(ip net.IP) string {
+	if len(st.AllowCountries) == 0 && len(st.AllowASNs) == 0 {
+		return ""
+	}
+	if ip == nil || isLocalIP(ip) {
+		return ""
+	}
+
+	var gl sparkyfish.GeoLocation
+	if st.GeoIP != nil {
+		gl = st.GeoIP.Lookup(ip)
+	}
+
+	if len(st.AllowCountries) > 0 {
+		allowed := false
+		for _, cc := range st.AllowCountries {
+			if strings.EqualFold(cc, gl.Country) {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return "Tests aren't available from your country"
+		}
+	}
+
+	if len(st.AllowASNs) > 0 {
+		allowed := false
+		for _, asn := range st.AllowASNs {
+			if asn == gl.ASN {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return "Tests aren't available from your network"
+		}
+	}
+
+	return ""
+}
+
+// writeGeoInfo writes what we know about where the server and the client of
+// sc are to an INFO response, with their keys prefixed by "server-" and
+// "client-"
+func (sc *sparkyClient) writeGeoInfo(info io.Writer) {
+	if sc.settings.GeoIP == nil {
+		return
+	}
+
+	write := func(prefix string, gl sparkyfish.GeoLocation) {
+		if gl.Country != "" {
+			fmt.Fprintln(info, prefix+"country", gl.Country)
+		}
+		if gl.City != "" {
+			fmt.Fprintln(info, prefix+"city", gl.City)
+		}
+		if gl.ASN != 0 {
+			fmt.Fprintln(info, prefix+"asn", strings.TrimSpace(fmt.Sprintf("%v %v", gl.ASN, gl.ASOrg)))
+		}
+	}
+
+	write("server-", sc.settings.GeoIP.Lookup(addrIP(sc.client.LocalAddr())))
+	write("client-", sc.settings.GeoIP.Lookup(addrIP(sc.client.RemoteAddr())))
+}
+
+// addrIP returns the IP address of addr, or nil if there isn't one
+func addrIP(addr net.Addr) net.IP {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,636 @@
+package sparkyfishd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/freinold/sparkyfish"
+	"github.com/freinold/sparkyfish/internal/neterr"
+	"github.com/freinold/sparkyfish/internal/quicnet"
+)
+
+// TestType is used to indicate the type of test being performed
+type TestType int
+
+const (
+	outbound TestType = iota
+	inbound
+	echo
+	udpOutbound
+	udpInbound
+	mtuProbe
+)
+
+// String names the test from the client's point of view, for our TestLog
+func (t TestType) String() string {
+	switch t {
+	case outbound:
+		return "download"
+	case inbound:
+		return "upload"
+	case echo:
+		return "ping"
+	case udpOutbound:
+		return "udp-download"
+	case udpInbound:
+		return "udp-upload"
+	case mtuProbe:
+		return "mtu"
+	}
+	return "unknown"
+}
+
+// sparkyClient handles requests for throughput and latency tests
+type sparkyClient struct {
+	client   net.Conn
+	testType TestType
+	reader   *bufio.Reader
+	payload  *sparkyfish.Payload
+	sender   *segmentSender
+	done     chan bool
+	server   *Server
+	log      *slog.Logger
+
+	// settings are the server's Settings as they were when we connected,
+	// which we keep to even if they're reloaded in the meantime
+	settings *Settings
+
+	// progress, if set, is how often we report the bytes that we've
+	// received during an upload test, which are counted in received
+	progress time.Duration
+	received int64
+
+	// sent counts the bytes that we've sent during a download test.  If
+	// the client asked for a tally, it's recorded there when we're done.
+	sent  int64
+	tally *tally
+}
+
+func newsparkyClient(client net.Conn, server *Server) sparkyClient {
+	sc := sparkyClient{client: client, server: server, log: server.sessionLogger(remoteIP(client)), settings: server.settings()}
+	return sc
+}
+
+// readCommand reads a command from the client and splits it into its
+// arguments.  Commands may be followed by arguments, e.g. "USND 100".
+func (sc *sparkyClient) readCommand() ([]string, error) {
+	sc.refreshDeadlines()
+	cmd, err := sc.reader.ReadString('\n')
+	if err != nil {
+		if isTimeout(err) {
+			sc.log.Debug("timed out waiting for a command")
+		}
+		return nil, err
+	}
+	cmd = strings.TrimSpace(cmd)
+
+	// Keep tokens out of our logs
+	if strings.HasPrefix(cmd, "AUTH ") {
+		sc.log.Debug("command received", "command", "AUTH")
+	} else {
+		sc.log.Debug("command received", "command", cmd)
+	}
+
+	args := strings.Fields(cmd)
+	if len(args) == 0 {
+		sc.client.Write([]byte("ERR:Invalid command received\n"))
+		return nil, fmt.Errorf("empty command")
+	}
+
+	return args, nil
+}
+
+// info answers the INFO command with one "key value" line per field,
+// followed by END
+func (sc *sparkyClient) info() {
+	s := sc.server
+	st := sc.settings
+
+	info := bytes.NewBufferString("")
+	fmt.Fprintln(info, "version", sparkyfish.Version)
+	fmt.Fprintln(info, "protocol", sparkyfish.ProtocolVersion)
+	if s.Location != "" {
+		fmt.Fprintln(info, "location", s.Location)
+	}
+	fmt.Fprintln(info, "max-duration", st.testSeconds())
+	if st.MaxTestBytes > 0 {
+		fmt.Fprintln(info, "max-bytes", st.MaxTestBytes)
+	}
+	fmt.Fprintln(info, "features", strings.Join(s.capabilities(st), " "))
+	if ip := addrIP(sc.client.RemoteAddr()); ip != nil {
+		fmt.Fprintln(info, "client-address", ip)
+	}
+	sc.writeGeoInfo(info)
+	fmt.Fprintf(info, "load %v/%v\n", s.limits.active(), st.MaxConcurrent)
+	fmt.Fprintln(info, "END")
+
+	_, err := info.WriteTo(sc.client)
+	if err != nil {
+		sc.log.Warn("error writing INFO response to client", "err", err)
+	}
+}
+
+// capabilities returns the optional features that we advertise to clients
+// under st
+func (s *Server) capabilities(st *Settings) []string {
+	var caps []string
+
+	if s.udpEnabled() {
+		caps = append(caps, sparkyfish.CapUDP, sparkyfish.CapMTU)
+	}
+	if st.AuthToken != "" {
+		caps = append(caps, sparkyfish.CapAuth)
+	}
+	caps = append(caps, sparkyfish.CapMultiStream, sparkyfish.CapInfo, sparkyfish.CapBidirectional, sparkyfish.CapProgress, sparkyfish.CapTally, sparkyfish.CapCompressible, sparkyfish.CapLimits, sparkyfish.CapNoop)
+
+	return caps
+}
+
+// verifiedCert reports whether our client presented a certificate that we
+// verified, which only clients over WebSocket with TLS or over QUIC can
+func (sc *sparkyClient) verifiedCert() bool {
+	switch c := sc.client.(type) {
+	case wsConn:
+		return verifiedCert(c.Request().TLS)
+	case *quicnet.Conn:
+		return verifiedCert(c.TLS())
+	}
+	return false
+}
+
+// overTCP reports whether our client reached us over plain TCP, rather than
+// over WebSocket or QUIC
+func (sc *sparkyClient) overTCP() bool {
+	switch sc.client.(type) {
+	case wsConn, *quicnet.Conn:
+		return false
+	}
+	return true
+}
+
+// validToken reports whether token matches our AuthToken.  Any token is
+// valid if we don't have one.
+func (st *Settings) validToken(token string) bool {
+	if st.AuthToken == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(st.AuthToken)) == 1
+}
+
+func (s *Server) handler(conn net.Conn) {
+	var version uint64
+
+	sc := newsparkyClient(conn, s)
+
+	sc.done = make(chan bool)
+
+	defer sc.client.Close()
+
+	s.tracker.add(conn)
+	defer s.tracker.remove(conn)
+
+	sc.reader = bufio.NewReader(sc.client)
+	sc.refreshDeadlines()
+
+	// Every connection begins with a HELO<version> command,
+	// where <version> is one byte that will be converted to a uint16
+	helo, err := sc.reader.ReadString('\n')
+	if err != nil {
+		// If a client hangs up, just hang up silently
+		return
+	}
+	helo = strings.TrimSpace(helo)
+
+	sc.log.Debug("command received", "command", helo)
+
+	// The HELO command must be exactly 7 bytes long, including version and CRLF
+	if len(helo) != 5 {
+		sc.client.Write([]byte("ERR:Invalid HELO received\n"))
+		return
+	}
+
+	if helo[:4] != "HELO" {
+		sc.client.Write([]byte("ERR:Invalid HELO received\n"))
+		return
+	}
+
+	// Parse the version number
+	version, err = strconv.ParseUint(helo[4:], 10, 16)
+	if err != nil {
+		sc.client.Write([]byte("ERR:Invalid HELO received\n"))
+		sc.log.Warn("error parsing version", "err", err)
+		return
+	}
+
+	sc.log.Debug("HELO received", "version", version)
+
+	// Clients that reach us as we're shutting down are sent on their way
+	if s.tracker.isDraining() {
+		sc.client.Write([]byte(errShuttingDown))
+		return
+	}
+
+	// Turn the client away if we're already handling as many connections
+	// as we're allowed to.  Clients treat this like any other ERR response.
+	ip := remoteIP(sc.client)
+	reason := s.limits.acquire(ip, sc.settings.MaxConcurrent, sc.settings.PerIPLimit)
+	if reason == errBusy && version >= 2 && sc.overTCP() {
+		if to := s.sibling(); to != "" {
+			sc.client.Write([]byte("REDIRECT " + to + "\n"))
+			sc.log.Info("redirected a client while busy", "to", to)
+			return
+		}
+	}
+	if reason != "" {
+		sc.client.Write([]byte("ERR:" + reason + "\n"))
+		sc.log.Debug("rejected connection", "reason", reason)
+		return
+	}
+	defer s.limits.release(ip)
+
+	// Close the connection if the client requests a protocol version
+	// greater than what we support
+	if uint16(version) > sparkyfish.ProtocolVersion {
+		sc.client.Write([]byte("ERR:Protocol version not supported\n"))
+		sc.log.Info("invalid protocol version requested", "version", version)
+		return
+	}
+
+	banner := bytes.NewBufferString("HELO\n")
+	if s.Cname != "" {
+		banner.WriteString(fmt.Sprintln(s.Cname))
+	} else {
+		banner.WriteString("none\n")
+	}
+	if s.Location != "" {
+		banner.WriteString(fmt.Sprintln(s.Location))
+	} else {
+		banner.WriteString("none\n")
+	}
+
+	// Version 1 clients also want to know what we're capable of
+	if version >= 1 {
+		banner.WriteString(fmt.Sprintln(strings.Join(append([]string{"CAPS"}, s.capabilities(sc.settings)...), " ")))
+	}
+
+	_, err = banner.WriteTo(sc.client)
+	if err != nil {
+		sc.log.Warn("error writing HELO response to client", "err", err)
+		return
+	}
+
+	args, err := sc.readCommand()
+	if err != nil {
+		return
+	}
+	if s.tracker.isDraining() {
+		sc.client.Write([]byte(errShuttingDown))
+		return
+	}
+
+	// NOOP lets load balancers check that we're answering tests, as
+	// cheaply as they can
+	if args[0] == "NOOP" {
+		sc.client.Write([]byte("OK\n"))
+		return
+	}
+
+	// INFO is answered even for clients that haven't authenticated, since it
+	// doesn't cost us any bandwidth
+	if args[0] == "INFO" {
+		sc.log.Debug("answering INFO")
+		sc.info()
+		return
+	}
+
+	// Our operator may only want to test clients from certain places
+	if reason := sc.settings.geoAllowed(net.ParseIP(ip)); reason != "" {
+		sc.client.Write([]byte("ERR:" + reason + "\n"))
+		sc.log.Info("turned away", "reason", reason)
+		return
+	}
+
+	// The test command may be preceded by AUTH <token>.  Servers without a
+	// token accept any AUTH, so clients can always send one.  A client
+	// certificate that we've verified does as well as a token.
+	authed := sc.verifiedCert()
+	if args[0] == "AUTH" {
+		if len(args) != 2 || !sc.settings.validToken(args[1]) {
+			sc.client.Write([]byte("ERR:Invalid token\n"))
+			sc.log.Info("failed authentication")
+			return
+		}
+		authed = authed || sc.settings.AuthToken != ""
+
+		_, err = sc.client.Write([]byte("OK\n"))
+		if err != nil {
+			return
+		}
+
+		args, err = sc.readCommand()
+		if err != nil {
+			return
+		}
+	}
+
+	switch {
+	case authed:
+	case sc.settings.AuthToken != "":
+		sc.client.Write([]byte("ERR:Authentication required\n"))
+		return
+	case s.RequireClientCert:
+		sc.client.Write([]byte("ERR:Client certificate required\n"))
+		sc.log.Info("turned away without a client certificate")
+		return
+	}
+
+	var udpRate uint64
+
+	sc.log = sc.log.With("command", args[0])
+	switch args[0] {
+	case "SND":
+		// SND may be followed by options: TALLY asks us to count what we
+		// send, for a later TALLY command, and COMPRESSIBLE asks for data
+		// that's easily compressed
+		var compressible bool
+		for _, opt := range args[1:] {
+			switch {
+			case opt == "TALLY" && sc.tally == nil:
+				sc.tally = s.tallies.add()
+			case opt == "COMPRESSIBLE" && !compressible:
+				compressible = true
+			default:
+				sc.client.Write([]byte("ERR:Invalid command received\n"))
+				return
+			}
+		}
+		if sc.tally != nil {
+			_, err = fmt.Fprintf(sc.client, "%016x\n", sc.tally.id)
+			if err != nil {
+				s.tallies.finish(sc.tally, 0, nil)
+				return
+			}
+		}
+		if compressible {
+			sc.payload = sparkyfish.NewPayload(true)
+		}
+		sc.testType = outbound
+		sc.log.Info("initiated download test")
+	case "RCV":
+		// RCV PROGRESS <ms> asks us to report what we've received as we go
+		if len(args) > 1 {
+			if len(args) != 3 || args[1] != "PROGRESS" {
+				sc.client.Write([]byte("ERR:Invalid command received\n"))
+				return
+			}
+			sc.progress, err = parseProgressInterval(args[2])
+			if err != nil {
+				sc.client.Write([]byte(fmt.Sprintf("ERR:%v\n", err)))
+				return
+			}
+		}
+		sc.testType = inbound
+		sc.log.Info("initiated upload test")
+	case "TALLY":
+		sc.answerTally(args[1:])
+		return
+	case "ECO":
+		sc.testType = echo
+		sc.log.Info("initiated echo test")
+	case "BID":
+		if !sc.beginBidirectional(args) {
+			return
+		}
+	case "USND", "URCV":
+		if !s.udpEnabled() {
+			sc.client.Write([]byte("ERR:UDP tests not supported\n"))
+			return
+		}
+		if args[0] == "USND" {
+			if len(args) != 2 {
+				sc.client.Write([]byte("ERR:USND requires a rate\n"))
+				return
+			}
+			udpRate, err = parseUDPRate(args[1])
+			if err != nil {
+				sc.client.Write([]byte(fmt.Sprintf("ERR:%v\n", err)))
+				return
+			}
+			sc.testType = udpOutbound
+			sc.log.Info("initiated UDP download test", "rate_mbps", udpRate)
+		} else {
+			sc.testType = udpInbound
+			sc.log.Info("initiated UDP upload test")
+		}
+	case "MTU":
+		if !s.udpEnabled() {
+			sc.client.Write([]byte("ERR:MTU probes not supported\n"))
+			return
+		}
+		sc.testType = mtuProbe
+		sc.log.Info("initiated MTU test")
+	default:
+		sc.client.Write([]byte("ERR:Invalid command received\n"))
+		return
+	}
+
+	switch sc.testType {
+	case echo:
+		// Start an echo/ping test and block until it finishes
+		sc.echoTest()
+	case udpOutbound:
+		sc.udpSendTest(udpRate)
+	case udpInbound:
+		sc.udpReceiveTest()
+	case mtuProbe:
+		sc.mtuTest()
+	default:
+		// Start an upload/download test
+
+		// Launch our throughput reporter in a goroutine
+		go sc.ReportThroughput()
+
+		// Keep the client up to date on what it's uploaded, if it asked
+		stopProgress := make(chan struct{})
+		progressDone := make(chan struct{})
+		if sc.progress > 0 {
+			go func() {
+				sc.reportProgress(sc.progress, stopProgress)
+				close(progressDone)
+			}()
+		} else {
+			close(progressDone)
+		}
+
+		// Start our metered copier and block until it finishes
+		capped := sc.MeteredCopy()
+		close(stopProgress)
+		<-progressDone
+		if sc.tally != nil {
+			s.tallies.finish(sc.tally, atomic.LoadInt64(&sc.sent), capped)
+		}
+		if capped != nil && sc.testType == inbound {
+			sc.reportCapped(capped)
+		}
+
+		// When our metered copy unblocks, the speed test is done, so we close
+		// this channel to signal the throughput reporter to halt
+		sc.done <- true
+	}
+}
+
+func (sc *sparkyClient) echoTest() {
+	start := time.Now()
+	c := 0
+	for ; c <= pingTestLength-1; c++ {
+		sc.refreshDeadlines()
+		chr, err := sc.reader.ReadByte()
+		if err != nil {
+			// Clients hang up once they've sent all of the pings they want
+			if err != io.EOF {
+				sc.log.Warn("error reading byte", "err", err)
+			}
+			break
+		}
+		sc.log.Debug("copying byte", "byte", chr)
+		_, err = sc.client.Write([]byte{chr})
+		if err != nil {
+			sc.log.Warn("error writing byte", "err", err)
+			break
+		}
+	}
+	sc.log.Info("test finished", "pings", c, "seconds", round2(time.Since(start).Seconds()))
+	sc.recordTest(0, start)
+	return
+}
+
+// MeteredCopy copies to or from a net.Conn, keeping count of the data it
+// passes.  It returns the limit that it cut the test short at, if it did.
+func (sc *sparkyClient) MeteredCopy() *sparkyfish.ServerLimit {
+	var err error
+	var timer *time.Timer
+	var timeLimit *sparkyfish.ServerLimit
+
+	// Downloads send incompressible data unless the client asked otherwise,
+	// straight from our send segment if we can
+	if sc.testType == outbound && sc.payload == nil {
+		if seg := sc.server.sendSegment(); seg != nil {
+			sc.sender = seg.sender(sc.client)
+		}
+		if sc.sender == nil {
+			sc.payload = sparkyfish.NewPayload(false)
+		}
+	}
+
+	// Set a timer that we'll use to stop the test.  If we're running an inbound test,
+	// we extend the timer by two seconds to allow the client to finish its sending.
+	// If our operator wants shorter tests than that, we cut them short.
+	if sc.testType == inbound {
+		timer = time.NewTimer(time.Second * time.Duration(testLength+2))
+	} else if sc.testType == outbound {
+		timer = time.NewTimer(time.Second * time.Duration(testLength))
+	}
+	if max := sc.settings.MaxTestSeconds; max > 0 && max < int(testLength) {
+		timer.Stop()
+		timer = time.NewTimer(time.Second * time.Duration(max))
+		timeLimit = &sparkyfish.ServerLimit{Kind: sparkyfish.LimitSeconds, Value: int64(max)}
+	}
+
+	for {
+		select {
+		case <-timer.C:
+			if timeLimit != nil {
+				sc.logCapped(timeLimit)
+			} else {
+				sc.log.Debug("test length elapsed", "seconds", testLength)
+			}
+			return timeLimit
+		default:
+			// Copy our test data to or from the client, 1MB at a time, or
+			// whatever's left of our data limit.  Each megabyte has to get
+			// through within our timeouts.
+			block := 1024 * blockSize
+			if max := sc.settings.MaxTestBytes; max > 0 {
+				left := max - sc.copied()
+				if left <= 0 {
+					limit := &sparkyfish.ServerLimit{Kind: sparkyfish.LimitBytes, Value: max}
+					sc.logCapped(limit)
+					return limit
+				}
+				if block > left {
+					block = left
+				}
+			}
+
+			sc.refreshDeadlines()
+			switch sc.testType {
+			case outbound:
+				if sc.sender != nil {
+					var n int64
+					n, err = sc.sender.CopyN(block)
+					atomic.AddInt64(&sc.sent, n)
+				} else {
+					_, err = sc.payload.CopyN(sentCounter{sc.client, &sc.sent}, block)
+				}
+			case inbound:
+				_, err = io.CopyN(receivedCounter{&sc.received}, sc.client, block)
+			}
+
+			// io.EOF is normal when a client drops off after the test.  A
+			// client that hangs up with our progress reports unread resets
+			// the connection instead.
+			if err != nil {
+				switch {
+				case isTimeout(err):
+					sc.logEviction(err)
+				case err != io.EOF && !(sc.progress > 0 && neterr.IsConnReset(err)):
+					sc.log.Warn("error copying", "err", err)
+				}
+				return nil
+			}
+		}
+	}
+}
+
+// ReportThroughput logs the throughput of the data that MeteredCopy passes
+// at each report interval, from the exact counts of the bytes that it has
+// sent or received, and then the test's totals once it's done
+func (sc *sparkyClient) ReportThroughput() {
+	var prev int64
+
+	tick := time.NewTicker(time.Duration(reportIntervalMS) * time.Millisecond)
+	defer tick.Stop()
+
+	start := time.Now()
+	last := start
+
+	for running := true; running; {
+		select {
+		case <-sc.done:
+			running = false
+		case <-tick.C:
+			// The ticker drifts and drops ticks under load, so we go by
+			// the time that actually went by
+			n := sc.copied()
+			elapsed := time.Since(last)
+			last = last.Add(elapsed)
+			sc.log.Debug("throughput", "bytes", n-prev, "seconds", round2(elapsed.Seconds()), "mbps", round2(float64(n-prev)/1024/1024*8/elapsed.Seconds()))
+			prev = n
+		}
+	}
+
+	// The totals are exact, so that they can be compared with what the
+	// client counted at its end
+	n := sc.copied()
+	sc.logFinished(n, start)
+	sc.recordTest(n, start)
+}
@@ -0,0 +1,95 @@
+package sparkyfishd
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// healthStatus is the body of our /healthz and /readyz responses
+type healthStatus struct {
+	// Status is "ok", or "unavailable" if we aren't ready for tests
+	Status string `json:"status"`
+
+	// Problems says why we aren't ready, if we aren't
+	Problems []string `json:"problems,omitempty"`
+
+	// Listeners is the number of TCP listeners that we're accepting speed
+	// tests on, and UDP is whether we're able to run UDP tests
+	Listeners int  `json:"listeners"`
+	UDP       bool `json:"udp"`
+
+	// Draining is whether we're shutting down
+	Draining bool `json:"draining"`
+
+	// Sessions is the number of connections that we're serving, and
+	// ActiveConnections the number of those that count towards
+	// MaxConnections, which is zero if there's no limit
+	Sessions          int `json:"sessions"`
+	ActiveConnections int `json:"active_connections"`
+	MaxConnections    int `json:"max_connections"`
+
+	// Workers is how many connections we serve at once, and WorkersFull
+	// whether we're serving that many, so that we aren't accepting more
+	Workers     int  `json:"workers"`
+	WorkersFull bool `json:"workers_full"`
+}
+
+// HealthHandler returns an http.Handler for probes from Kubernetes and load
+// balancers.  /healthz answers 200 for as long as we're running, and /readyz
+// answers 200 only while we're ready for more tests, and 503 while we're
+// shutting down, aren't listening, or are already handling as many
+// connections as we're allowed to.  Both respond with our status as JSON.
+func (s *Server) HealthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, http.StatusOK, s.health())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		hs := s.health()
+		status := http.StatusOK
+		if len(hs.Problems) > 0 {
+			status = http.StatusServiceUnavailable
+		}
+		writeHealth(w, status, hs)
+	})
+	return mux
+}
+
+// health sums up how we're doing
+func (s *Server) health() healthStatus {
+	st := s.settings()
+	hs := healthStatus{
+		UDP:               s.udpEnabled(),
+		ActiveConnections: s.limits.active(),
+		MaxConnections:    st.MaxConcurrent,
+		Workers:           s.workerCount(),
+		WorkersFull:       s.workers.full(s.workerCount()),
+	}
+	hs.Listeners, hs.Sessions, hs.Draining = s.tracker.counts()
+
+	switch {
+	case hs.Draining:
+		hs.Problems = append(hs.Problems, "shutting down")
+	case hs.Listeners == 0:
+		hs.Problems = append(hs.Problems, "not listening for speed tests")
+	}
+	if hs.MaxConnections > 0 && hs.ActiveConnections >= hs.MaxConnections {
+		hs.Problems = append(hs.Problems, "handling as many connections as we're allowed to")
+	}
+	if hs.WorkersFull {
+		hs.Problems = append(hs.Problems, "all workers are busy")
+	}
+
+	hs.Status = "ok"
+	if len(hs.Problems) > 0 {
+		hs.Status = "unavailable"
+	}
+	return hs
+}
+
+func writeHealth(w http.ResponseWriter, status int, hs healthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(hs)
+}
@@ -0,0 +1,68 @@
+package sparkyfishd
+
+import (
+	"net"
+	"sync"
+)
+
+// errBusy is why we turn clients away when we're handling MaxConcurrent
+// connections
+const errBusy = "Server busy, try again later"
+
+// connLimiter keeps track of how many connections are open, in total and per
+// client IP, so that one client can't tie up the whole server
+type connLimiter struct {
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+// acquire reserves a connection slot for ip.  It returns the reason for the
+// rejection if ip has to wait, or "" if the slot is reserved.
+func (cl *connLimiter) acquire(ip string, maxConcurrent, perIPLimit int) string {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if maxConcurrent > 0 && cl.total >= maxConcurrent {
+		return errBusy
+	}
+	if perIPLimit > 0 && cl.perIP[ip] >= perIPLimit {
+		return "Too many connections from your address, try again later"
+	}
+
+	if cl.perIP == nil {
+		cl.perIP = make(map[string]int)
+	}
+	cl.total++
+	cl.perIP[ip]++
+
+	return ""
+}
+
+// active returns the number of connections that are holding a slot
+func (cl *connLimiter) active() int {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.total
+}
+
+// release gives up a connection slot reserved by acquire
+func (cl *connLimiter) release(ip string) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	cl.total--
+	cl.perIP[ip]--
+	if cl.perIP[ip] <= 0 {
+		delete(cl.perIP, ip)
+	}
+}
+
+// remoteIP returns the IP address that conn is connected to
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
@@ -0,0 +1,62 @@
+package sparkyfishd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+
+	"github.com/freinold/sparkyfish"
+)
+
+// cappedDrainTime is how long we keep reading an upload that we've cut short,
+// so that the client gets our CAPPED notice before we hang up on it
+const cappedDrainTime = 2 * time.Second
+
+// testSeconds returns how long our throughput tests run for, at most
+func (st *Settings) testSeconds() int {
+	if st.MaxTestSeconds > 0 && st.MaxTestSeconds < int(testLength) {
+		return st.MaxTestSeconds
+	}
+	return int(testLength)
+}
+
+// copied returns the bytes that we've sent or received so far in the test
+func (sc *sparkyClient) copied() int64 {
+	if sc.testType == outbound {
+		return atomic.LoadInt64(&sc.sent)
+	}
+	return atomic.LoadInt64(&sc.received)
+}
+
+func (sc *sparkyClient) logCapped(limit *sparkyfish.ServerLimit) {
+	sc.log.Info("cut the test short at our limit", "limit", limit.String())
+}
+
+// reportCapped tells the client that we've cut its upload short at limit.
+// If it asked for progress reports, we send it our final count first.  A
+// client that reads our reports stops sending when it reads the notice, so we
+// stop sending and wait a little for it to hang up first; if we hung up
+// straight away, with its data still arriving, the reset could well wipe out
+// the notice before the client read it.  A client that doesn't read them
+// would only go on sending, and inflating its result, so we hang up on it
+// at once and hope for the best.
+func (sc *sparkyClient) reportCapped(limit *sparkyfish.ServerLimit) {
+	if sc.progress > 0 {
+		fmt.Fprintf(sc.client, "RCVD %v\n", atomic.LoadInt64(&sc.received))
+	}
+	_, err := fmt.Fprintf(sc.client, "CAPPED %v %v\n", limit.Kind, limit.Value)
+	if err != nil {
+		return
+	}
+
+	if sc.progress == 0 {
+		return
+	}
+	if cw, ok := sc.client.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	sc.client.SetReadDeadline(time.Now().Add(cappedDrainTime))
+	io.Copy(ioutil.Discard, sc.reader)
+}
@@ -0,0 +1,47 @@
+package sparkyfishd
+
+import (
+	"log/slog"
+	"math"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// logger returns where we log to: our Logger, or a text logger on stderr
+// that includes debug messages if we're set to Debug, or else slog's default
+func (s *Server) logger() *slog.Logger {
+	s.loggerOnce.Do(func() {
+		switch {
+		case s.Logger != nil:
+			s.log = s.Logger
+		case s.Debug:
+			s.log = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		default:
+			s.log = slog.Default()
+		}
+	})
+	return s.log
+}
+
+// sessionLogger returns a logger for a new session with the client at ip.
+// Everything that it logs carries the session's ID, so that the lines about
+// one client can be picked out from the rest.
+func (s *Server) sessionLogger(ip string) *slog.Logger {
+	id := atomic.AddUint64(&s.sessions, 1)
+	return s.logger().With("session", id, "client", ip)
+}
+
+// logFinished logs the outcome of a throughput test that moved n bytes since
+// start
+func (sc *sparkyClient) logFinished(n int64, start time.Time) {
+	seconds := time.Since(start).Seconds()
+	mbps := float64(n) / 1024 / 1024 * 8 / seconds
+	sc.log.Info("test finished", "bytes", n, "seconds", round2(seconds), "mbps", round2(mbps))
+}
+
+// round2 rounds f to two decimal places, which is as precise as our logs
+// need to be
+func round2(f float64) float64 {
+	return math.Round(f*100) / 100
+}
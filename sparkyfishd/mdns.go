@@ -0,0 +1,65 @@
+package sparkyfishd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/freinold/sparkyfish"
+	"github.com/hashicorp/mdns"
+)
+
+// advertise announces us over mDNS/DNS-SD as a sparkyfish server listening on
+// listener's port, so that clients on the local network can find us.  The
+// returned function withdraws the announcement.
+func (s *Server) advertise(listener net.Listener) (func(), error) {
+	tcpAddr, ok := listener.Addr().(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("can't advertise a non-TCP listener")
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	instance := s.Cname
+	if instance == "" {
+		instance = hostname
+	}
+
+	// Announce the address we're listening on, or every address that this
+	// host has if we're listening on all of them
+	var ips []net.IP
+	if !tcpAddr.IP.IsUnspecified() {
+		ips = []net.IP{tcpAddr.IP}
+	} else {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+				ips = append(ips, ipNet.IP)
+			}
+		}
+	}
+
+	txt := []string{"version=" + sparkyfish.Version}
+	if s.Location != "" {
+		txt = append(txt, "location="+s.Location)
+	}
+
+	service, err := mdns.NewMDNSService(instance, sparkyfish.MDNSService, "", strings.TrimSuffix(hostname, ".")+".", tcpAddr.Port, ips, txt)
+	if err != nil {
+		return nil, err
+	}
+
+	server, err := mdns.NewServer(&mdns.Config{Zone: service})
+	if err != nil {
+		return nil, err
+	}
+
+	return func() { server.Shutdown() }, nil
+}
@@ -0,0 +1,365 @@
+package sparkyfishd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+// mmdbMetadataMarker precedes the metadata at the end of a MaxMind database
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdbMaxDepth bounds how deeply maps and arrays may nest, so that a corrupt
+// database can't send us around in circles
+const mmdbMaxDepth = 32
+
+// mmdb is a MaxMind DB file, as described at
+// https://maxmind.github.io/MaxMind-DB/.  It's read into memory in full.  We
+// only need to look up the odd address, so it decodes records into plain
+// maps, slices and values rather than into structs.
+type mmdb struct {
+	buf        []byte
+	dbType     string
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	dataStart  uint
+	ipv4Start  uint // the node for ::/96, where IPv4 addresses start
+}
+
+func openMMDB(path string) (*mmdb, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := parseMMDB(buf)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %v: %v", path, err)
+	}
+	return db, nil
+}
+
+// parseMMDB reads a MaxMind database from buf, which it keeps
+func parseMMDB(buf []byte) (*mmdb, error) {
+	// The metadata is a map that follows the last marker in the file
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("not a MaxMind database")
+	}
+	md := &mmdbDecoder{buf: buf[i+len(mmdbMetadataMarker):]}
+	v, _, err := md.decode(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	meta, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid metadata")
+	}
+
+	db := &mmdb{buf: buf}
+	db.dbType, _ = meta["database_type"].(string)
+	nodeCount := mmdbUint(meta["node_count"])
+	db.recordSize = uint(mmdbUint(meta["record_size"]))
+	db.ipVersion = uint(mmdbUint(meta["ip_version"]))
+
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %v", db.recordSize)
+	}
+	if db.ipVersion != 4 && db.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported IP version %v", db.ipVersion)
+	}
+
+	// Each node takes at least 6 bytes, so a node count that the file
+	// can't hold is corrupt, and checking it first keeps the size of the
+	// tree from overflowing
+	if nodeCount == 0 || nodeCount > uint64(i)/6 {
+		return nil, fmt.Errorf("invalid search tree")
+	}
+	db.nodeCount = uint(nodeCount)
+	treeSize := db.nodeCount * db.recordSize / 4
+	db.dataStart = treeSize + 16
+	if db.dataStart > uint(i) {
+		return nil, fmt.Errorf("invalid search tree")
+	}
+
+	// IPv4 addresses live under ::/96 in IPv6 databases
+	if db.ipVersion == 6 {
+		for i := 0; i < 96 && db.ipv4Start < db.nodeCount; i++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node
+func (db *mmdb) record(node uint, bit uint) uint {
+	b := db.buf[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// lookup returns the record for ip, or nil if the database doesn't have one
+func (db *mmdb) lookup(ip net.IP) (map[string]interface{}, error) {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		node = db.ipv4Start
+	} else if db.ipVersion == 4 {
+		return nil, nil
+	}
+
+	for i := 0; i < len(ip)*8 && node < db.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node = db.record(node, bit)
+	}
+
+	switch {
+	case node == db.nodeCount:
+		return nil, nil
+	case node < db.nodeCount+16:
+		// The tree ran out before the address did, or pointed into the
+		// 16 bytes that separate it from the data section
+		return nil, fmt.Errorf("invalid search tree")
+	}
+
+	// Records past the end of the tree point into the data section
+	offset := node - db.nodeCount - 16
+	if db.dataStart+offset >= uint(len(db.buf)) {
+		return nil, fmt.Errorf("invalid search tree")
+	}
+	dd := &mmdbDecoder{buf: db.buf[db.dataStart:]}
+	v, _, err := dd.decode(offset, 0)
+	if err != nil {
+		return nil, err
+	}
+	rec, _ := v.(map[string]interface{})
+	return rec, nil
+}
+
+// mmdbDecoder decodes values from a data section, or from the metadata
+type mmdbDecoder struct {
+	buf []byte
+}
+
+// The types of value in a data section
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+var errMMDBCorrupt = fmt.Errorf("corrupt database")
+
+// mmdbIntSizes are the most bytes that each type of integer may take
+var mmdbIntSizes = map[uint]uint{
+	mmdbUint16:  2,
+	mmdbUint32:  4,
+	mmdbInt32:   4,
+	mmdbUint64:  8,
+	mmdbUint128: 16,
+}
+
+// decode decodes the value at offset, returning it and the offset of
+// whatever follows it
+func (d *mmdbDecoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, errMMDBCorrupt
+	}
+
+	typ, size, offset, err := d.control(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if typ == mmdbPointer {
+		// Pointers point at a value elsewhere, but are followed by the
+		// next value here
+		target, next, err := d.pointer(size, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(target, depth+1)
+		return v, next, err
+	}
+
+	// Every entry takes at least a byte, so a corrupt size can't make us
+	// allocate much more than the database itself
+	if (typ == mmdbMap || typ == mmdbArray) && size > uint(len(d.buf)) {
+		return nil, 0, errMMDBCorrupt
+	}
+
+	switch typ {
+	case mmdbMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errMMDBCorrupt
+			}
+			m[key], offset, err = d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, offset, nil
+	case mmdbArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			var v interface{}
+			v, offset, err = d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+		}
+		return a, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	}
+
+	// Everything else is size bytes long
+	end := offset + size
+	if end > uint(len(d.buf)) {
+		return nil, 0, errMMDBCorrupt
+	}
+	b := d.buf[offset:end]
+
+	switch typ {
+	case mmdbString:
+		return string(b), end, nil
+	case mmdbBytes:
+		return append([]byte(nil), b...), end, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), end, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), end, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64, mmdbUint128, mmdbInt32:
+		// Integers drop their leading zero bytes.  128-bit ones are kept
+		// to their low 64 bits, which is all that we'd ever need of them.
+		if size > mmdbIntSizes[typ] {
+			return nil, 0, errMMDBCorrupt
+		}
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		if typ == mmdbInt32 {
+			return int64(int32(n)), end, nil
+		}
+		return n, end, nil
+	}
+
+	return nil, 0, errMMDBCorrupt
+}
+
+// control decodes the control byte (or bytes) at offset, returning the type
+// and size of the value that follows, and the offset of the value itself
+func (d *mmdbDecoder) control(offset uint) (typ uint, size uint, next uint, err error) {
+	if offset >= uint(len(d.buf)) {
+		return 0, 0, 0, errMMDBCorrupt
+	}
+	c := d.buf[offset]
+	offset++
+
+	typ = uint(c >> 5)
+	if typ == mmdbExtended {
+		if offset >= uint(len(d.buf)) {
+			return 0, 0, 0, errMMDBCorrupt
+		}
+		typ = 7 + uint(d.buf[offset])
+		offset++
+	}
+
+	size = uint(c & 0x1f)
+	if typ == mmdbPointer || size < 29 {
+		return typ, size, offset, nil
+	}
+
+	// Sizes of 29 or more spill into the bytes that follow
+	extra := size - 28
+	if offset+extra > uint(len(d.buf)) {
+		return 0, 0, 0, errMMDBCorrupt
+	}
+	var n uint
+	for _, b := range d.buf[offset : offset+extra] {
+		n = n<<8 | uint(b)
+	}
+	switch size {
+	case 29:
+		size = 29 + n
+	case 30:
+		size = 285 + n
+	default:
+		size = 65821 + n
+	}
+	return typ, size, offset + extra, nil
+}
+
+// pointer decodes a pointer, whose control byte gave size, returning the
+// offset that it points at and the offset that follows it
+func (d *mmdbDecoder) pointer(size uint, offset uint) (uint, uint, error) {
+	n := (size >> 3) + 1
+	if offset+n > uint(len(d.buf)) {
+		return 0, 0, errMMDBCorrupt
+	}
+	b := d.buf[offset : offset+n]
+
+	var p uint
+	if n < 4 {
+		p = size & 0x7
+	}
+	for _, c := range b {
+		p = p<<8 | uint(c)
+	}
+	switch n {
+	case 2:
+		p += 2048
+	case 3:
+		p += 526336
+	}
+	return p, offset + n, nil
+}
+
+// mmdbUint returns v as a uint64, if it's an unsigned integer
+func mmdbUint(v interface{}) uint64 {
+	n, _ := v.(uint64)
+	return n
+}
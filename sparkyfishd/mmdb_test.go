@@ -0,0 +1,475 @@
+package sparkyfishd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// The tests build their databases with a small MaxMind DB writer of their
+// own, following https://maxmind.github.io/MaxMind-DB/
+
+// mmdbUint128 is a 128-bit unsigned integer for the writer, given by its
+// big-endian bytes
+type mmdbUint128Value []byte
+
+// mmdbPointerTo makes the writer point at a value that it wrote earlier
+type mmdbPointerTo uint
+
+// mmdbControl encodes a control byte, and any bytes that follow it, for a
+// value of type typ and size
+func mmdbControl(typ, size uint) []byte {
+	var sizeField byte
+	var extra []byte
+	switch {
+	case size < 29:
+		sizeField = byte(size)
+	case size < 285:
+		sizeField, extra = 29, []byte{byte(size - 29)}
+	case size < 65821:
+		n := size - 285
+		sizeField, extra = 30, []byte{byte(n >> 8), byte(n)}
+	default:
+		n := size - 65821
+		sizeField, extra = 31, []byte{byte(n >> 16), byte(n >> 8), byte(n)}
+	}
+
+	if typ <= 7 {
+		return append([]byte{byte(typ<<5) | sizeField}, extra...)
+	}
+	return append([]byte{sizeField, byte(typ - 7)}, extra...)
+}
+
+// mmdbEncode encodes v as a data section value
+func mmdbEncode(v interface{}) []byte {
+	// Integers drop their leading zero bytes
+	trim := func(b []byte) []byte {
+		for len(b) > 0 && b[0] == 0 {
+			b = b[1:]
+		}
+		return b
+	}
+
+	switch v := v.(type) {
+	case string:
+		return append(mmdbControl(mmdbString, uint(len(v))), v...)
+	case []byte:
+		return append(mmdbControl(mmdbBytes, uint(len(v))), v...)
+	case float64:
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, math.Float64bits(v))
+		return append(mmdbControl(mmdbDouble, 8), b...)
+	case float32:
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, math.Float32bits(v))
+		return append(mmdbControl(mmdbFloat, 4), b...)
+	case bool:
+		size := uint(0)
+		if v {
+			size = 1
+		}
+		return mmdbControl(mmdbBool, size)
+	case uint16:
+		b := trim([]byte{byte(v >> 8), byte(v)})
+		return append(mmdbControl(mmdbUint16, uint(len(b))), b...)
+	case uint32:
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, v)
+		b = trim(b)
+		return append(mmdbControl(mmdbUint32, uint(len(b))), b...)
+	case int32:
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(v))
+		b = trim(b)
+		return append(mmdbControl(mmdbInt32, uint(len(b))), b...)
+	case uint64:
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, v)
+		b = trim(b)
+		return append(mmdbControl(mmdbUint64, uint(len(b))), b...)
+	case mmdbUint128Value:
+		b := trim(v)
+		return append(mmdbControl(mmdbUint128, uint(len(b))), b...)
+	case mmdbPointerTo:
+		// Only the smallest form, for offsets below 2048
+		return []byte{byte(mmdbPointer<<5) | byte(v>>8), byte(v)}
+	case []interface{}:
+		b := mmdbControl(mmdbArray, uint(len(v)))
+		for _, item := range v {
+			b = append(b, mmdbEncode(item)...)
+		}
+		return b
+	case map[string]interface{}:
+		// In order, so that the output is the same every time
+		var keys []string
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		b := mmdbControl(mmdbMap, uint(len(v)))
+		for _, k := range keys {
+			b = append(b, mmdbEncode(k)...)
+			b = append(b, mmdbEncode(v[k])...)
+		}
+		return b
+	}
+	panic("can't encode a " + reflect.TypeOf(v).String())
+}
+
+// mmdbWriter builds a database in memory
+type mmdbWriter struct {
+	recordSize uint
+	ipVersion  uint
+	nodes      [][2]int // records: a node, or a data offset as -1-offset, or 0 for empty
+	data       []byte
+}
+
+func newMMDBWriter(recordSize, ipVersion uint) *mmdbWriter {
+	return &mmdbWriter{recordSize: recordSize, ipVersion: ipVersion, nodes: [][2]int{{0, 0}}}
+}
+
+// addData writes v to the data section, returning its offset
+func (w *mmdbWriter) addData(v interface{}) uint {
+	offset := uint(len(w.data))
+	w.data = append(w.data, mmdbEncode(v)...)
+	return offset
+}
+
+// insert points the network cidr at the value at offset in the data section.
+// IPv4 networks go under ::/96 in IPv6 databases.
+func (w *mmdbWriter) insert(t *testing.T, cidr string, offset uint) {
+	t.Helper()
+
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := ipnet.IP
+	ones, _ := ipnet.Mask.Size()
+	if ip4 := ip.To4(); ip4 != nil && w.ipVersion == 6 {
+		ip = append(make(net.IP, 12), ip4...)
+		ones += 96
+	}
+
+	node := 0
+	for i := 0; i < ones; i++ {
+		bit := int(ip[i/8]>>(7-uint(i%8))) & 1
+		if i == ones-1 {
+			w.nodes[node][bit] = -1 - int(offset)
+			return
+		}
+		next := w.nodes[node][bit]
+		if next <= 0 {
+			w.nodes = append(w.nodes, [2]int{0, 0})
+			next = len(w.nodes) - 1
+			w.nodes[node][bit] = next
+		}
+		node = next
+	}
+}
+
+// bytes lays the database out: the search tree, 16 bytes of zeroes, the data
+// section, and then the metadata
+func (w *mmdbWriter) bytes(meta map[string]interface{}) []byte {
+	nodeCount := uint(len(w.nodes))
+	var buf []byte
+	for _, n := range w.nodes {
+		var rec [2]uint
+		for bit, r := range n {
+			switch {
+			case r < 0:
+				rec[bit] = nodeCount + 16 + uint(-1-r)
+			case r == 0:
+				rec[bit] = nodeCount
+			default:
+				rec[bit] = uint(r)
+			}
+		}
+
+		l, r := rec[0], rec[1]
+		switch w.recordSize {
+		case 24:
+			buf = append(buf, byte(l>>16), byte(l>>8), byte(l), byte(r>>16), byte(r>>8), byte(r))
+		case 28:
+			buf = append(buf, byte(l>>16), byte(l>>8), byte(l), byte(l>>24)<<4|byte(r>>24)&0x0f, byte(r>>16), byte(r>>8), byte(r))
+		case 32:
+			buf = append(buf, byte(l>>24), byte(l>>16), byte(l>>8), byte(l), byte(r>>24), byte(r>>16), byte(r>>8), byte(r))
+		}
+	}
+	buf = append(buf, make([]byte, 16)...)
+	buf = append(buf, w.data...)
+	buf = append(buf, mmdbMetadataMarker...)
+
+	m := map[string]interface{}{
+		"database_type":               "Test-ASN",
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(w.recordSize),
+		"ip_version":                  uint16(w.ipVersion),
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+	}
+	for k, v := range meta {
+		m[k] = v
+	}
+	return append(buf, mmdbEncode(m)...)
+}
+
+// testMMDB builds a database with a record for 192.0.2.0/24 and one for
+// 2001:db8::/32, whose organization is shared through a pointer
+func testMMDB(t *testing.T, recordSize, ipVersion uint) []byte {
+	w := newMMDBWriter(recordSize, ipVersion)
+	org := w.addData("Example Networks")
+
+	v4 := w.addData(map[string]interface{}{
+		"autonomous_system_number":       uint32(64496),
+		"autonomous_system_organization": mmdbPointerTo(org),
+		"country": map[string]interface{}{
+			"iso_code":   "GB",
+			"names":      map[string]interface{}{"en": "United Kingdom", "de": "Vereinigtes Königreich"},
+			"geoname_id": uint32(2635167),
+		},
+		"location":    map[string]interface{}{"latitude": 51.5, "longitude": -0.125, "accuracy_radius": uint16(50)},
+		"subdivision": []interface{}{"England", "London"},
+		"anycast":     false,
+		"mobile":      true,
+		"offset":      int32(-3600),
+		"big":         uint64(1) << 40,
+		"huge":        mmdbUint128Value{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 42},
+		"ratio":       float32(0.5),
+		"raw":         []byte{0xde, 0xad},
+		"medium":      strings.Repeat("m", 100),
+		"long":        strings.Repeat("l", 300),
+		"longest":     strings.Repeat("x", 70000),
+	})
+	w.insert(t, "192.0.2.0/24", v4)
+
+	if ipVersion == 6 {
+		v6 := w.addData(map[string]interface{}{
+			"autonomous_system_number":       uint32(64497),
+			"autonomous_system_organization": mmdbPointerTo(org),
+		})
+		w.insert(t, "2001:db8::/32", v6)
+	}
+	return w.bytes(nil)
+}
+
+func TestMMDBLookup(t *testing.T) {
+	for _, recordSize := range []uint{24, 28, 32} {
+		db, err := parseMMDB(testMMDB(t, recordSize, 6))
+		if err != nil {
+			t.Fatalf("%v-bit records: %v", recordSize, err)
+		}
+		if db.dbType != "Test-ASN" {
+			t.Errorf("%v-bit records: database type is %q", recordSize, db.dbType)
+		}
+
+		rec, err := db.lookup(net.ParseIP("192.0.2.77"))
+		if err != nil {
+			t.Fatalf("%v-bit records: %v", recordSize, err)
+		}
+		want := map[string]interface{}{
+			"autonomous_system_number":       uint64(64496),
+			"autonomous_system_organization": "Example Networks",
+			"country": map[string]interface{}{
+				"iso_code":   "GB",
+				"names":      map[string]interface{}{"en": "United Kingdom", "de": "Vereinigtes Königreich"},
+				"geoname_id": uint64(2635167),
+			},
+			"location":    map[string]interface{}{"latitude": 51.5, "longitude": -0.125, "accuracy_radius": uint64(50)},
+			"subdivision": []interface{}{"England", "London"},
+			"anycast":     false,
+			"mobile":      true,
+			"offset":      int64(-3600),
+			"big":         uint64(1) << 40,
+			"huge":        uint64(42),
+			"ratio":       float32(0.5),
+			"raw":         []byte{0xde, 0xad},
+			"medium":      strings.Repeat("m", 100),
+			"long":        strings.Repeat("l", 300),
+			"longest":     strings.Repeat("x", 70000),
+		}
+		if !reflect.DeepEqual(rec, want) {
+			for k, v := range want {
+				if !reflect.DeepEqual(rec[k], v) {
+					t.Errorf("%v-bit records: %v is %#v, want %#v", recordSize, k, rec[k], v)
+				}
+			}
+			if len(rec) != len(want) {
+				t.Errorf("%v-bit records: record has %v keys, want %v", recordSize, len(rec), len(want))
+			}
+		}
+
+		// IPv4-mapped IPv6 addresses are IPv4 addresses
+		rec, err = db.lookup(net.ParseIP("::ffff:192.0.2.1"))
+		if err != nil || rec["autonomous_system_number"] != uint64(64496) {
+			t.Errorf("%v-bit records: IPv4-mapped lookup returned %v, %v", recordSize, rec, err)
+		}
+
+		rec, err = db.lookup(net.ParseIP("2001:db8:1::1"))
+		if err != nil || rec["autonomous_system_number"] != uint64(64497) || rec["autonomous_system_organization"] != "Example Networks" {
+			t.Errorf("%v-bit records: IPv6 lookup returned %v, %v", recordSize, rec, err)
+		}
+
+		for _, ip := range []string{"192.0.3.1", "10.0.0.1", "2001:db9::1", "::1"} {
+			rec, err := db.lookup(net.ParseIP(ip))
+			if rec != nil || err != nil {
+				t.Errorf("%v-bit records: lookup of %v returned %v, %v, want nothing", recordSize, ip, rec, err)
+			}
+		}
+	}
+}
+
+func TestMMDBLookupIPv4Database(t *testing.T) {
+	db, err := parseMMDB(testMMDB(t, 24, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec, err := db.lookup(net.ParseIP("192.0.2.1"))
+	if err != nil || rec["autonomous_system_number"] != uint64(64496) {
+		t.Errorf("lookup returned %v, %v", rec, err)
+	}
+
+	// IPv6 addresses aren't in IPv4 databases
+	rec, err = db.lookup(net.ParseIP("2001:db8::1"))
+	if rec != nil || err != nil {
+		t.Errorf("IPv6 lookup returned %v, %v, want nothing", rec, err)
+	}
+}
+
+func TestOpenMMDB(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.mmdb")
+	if err := os.WriteFile(path, testMMDB(t, 28, 6), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openMMDB(path); err != nil {
+		t.Errorf("openMMDB: %v", err)
+	}
+
+	if _, err := openMMDB(filepath.Join(dir, "missing.mmdb")); err == nil {
+		t.Error("opening a missing database succeeded")
+	}
+
+	junk := filepath.Join(dir, "junk.mmdb")
+	os.WriteFile(junk, []byte("not a database"), 0o600)
+	if _, err := openMMDB(junk); err == nil || !strings.Contains(err.Error(), junk) {
+		t.Errorf("opening a junk file returned %v, want an error naming it", err)
+	}
+}
+
+func TestParseMMDBRejects(t *testing.T) {
+	meta := func(m map[string]interface{}) []byte {
+		w := newMMDBWriter(24, 6)
+		w.insert(t, "192.0.2.0/24", w.addData("x"))
+		return w.bytes(m)
+	}
+
+	tests := []struct {
+		name string
+		buf  []byte
+		err  string
+	}{
+		{"empty", nil, "not a MaxMind database"},
+		{"no marker", []byte("hello, world"), "not a MaxMind database"},
+		{"nothing after the marker", append([]byte("xxxx"), mmdbMetadataMarker...), "corrupt"},
+		{"metadata isn't a map", append(append([]byte("xxxx"), mmdbMetadataMarker...), mmdbEncode("x")...), "invalid metadata"},
+		{"metadata is cut short", meta(nil)[:len(meta(nil))-10], "corrupt"},
+		{"record size", meta(map[string]interface{}{"record_size": uint16(20)}), "unsupported record size 20"},
+		{"no record size", meta(map[string]interface{}{"record_size": "24"}), "unsupported record size 0"},
+		{"IP version", meta(map[string]interface{}{"ip_version": uint16(5)}), "unsupported IP version 5"},
+		{"no nodes", meta(map[string]interface{}{"node_count": uint32(0)}), "invalid search tree"},
+		{"more nodes than the file holds", meta(map[string]interface{}{"node_count": uint32(1000)}), "invalid search tree"},
+		{"node count overflows", meta(map[string]interface{}{"node_count": uint64(1) << 62}), "invalid search tree"},
+		{"deeply nested metadata", append(append([]byte("xxxx"), mmdbMetadataMarker...), bytes.Repeat([]byte{0xe1, 0x41, 'k'}, 40)...), "corrupt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseMMDB(tt.buf)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseMMDB returned %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestMMDBDecodeCorrupt(t *testing.T) {
+	tests := []struct {
+		name string
+		buf  []byte
+	}{
+		{"empty", nil},
+		{"extended type cut short", []byte{0x00}},
+		{"string cut short", []byte{0x45, 'a', 'b'}},
+		{"size cut short", []byte{0x5d}},
+		{"long size cut short", []byte{0x5f, 0x01}},
+		{"pointer cut short", []byte{0x28}},
+		{"pointer past the end", []byte{0x27, 0xff}},
+		{"pointer to itself", []byte{0x20, 0x00}},
+		{"map with a non-string key", []byte{0xe1, 0xa1, 0x01, 0x41, 'x'}},
+		{"map bigger than the data", []byte{0xfd, 0xff}},
+		{"array bigger than the data", []byte{0x1f, 0x04, 0xff, 0xff, 0xff}},
+		{"double of the wrong size", []byte{0x64, 0, 0, 0, 0}},
+		{"float of the wrong size", []byte{0x02, 0x08, 0, 0}},
+		{"uint16 too long", []byte{0xa3, 1, 2, 3}},
+		{"int32 too long", []byte{0x05, 0x01, 1, 2, 3, 4, 5}},
+		{"unknown type", []byte{0x01, 0x10}},
+		{"end marker", []byte{0x00, 0x06}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &mmdbDecoder{buf: tt.buf}
+			v, _, err := d.decode(0, 0)
+			if err == nil {
+				t.Errorf("decoding % x returned %#v, want an error", tt.buf, v)
+			}
+		})
+	}
+}
+
+// TestMMDBTruncated makes sure that a database cut short at any point is
+// either rejected or looked up without panicking
+func TestMMDBTruncated(t *testing.T) {
+	full := testMMDB(t, 28, 6)
+	for n := 0; n < len(full); n += 1 + n/64 {
+		buf := append([]byte(nil), full[:n]...)
+		db, err := parseMMDB(buf)
+		if err != nil {
+			continue
+		}
+		for _, ip := range []string{"192.0.2.1", "2001:db8::1", "10.0.0.1"} {
+			db.lookup(net.ParseIP(ip))
+		}
+	}
+}
+
+// TestMMDBCorrupt makes sure that random damage to a database never makes a
+// lookup panic
+func TestMMDBCorrupt(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	full := testMMDB(t, 24, 6)
+
+	for i := 0; i < 2000; i++ {
+		buf := append([]byte(nil), full...)
+		for j := 0; j < 1+rng.Intn(8); j++ {
+			buf[rng.Intn(len(buf))] = byte(rng.Intn(256))
+		}
+
+		db, err := parseMMDB(buf)
+		if err != nil {
+			continue
+		}
+		for _, ip := range []string{"192.0.2.1", "2001:db8::1", "10.0.0.1"} {
+			db.lookup(net.ParseIP(ip))
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package sparkyfishd
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Limits on how often a client may ask for progress reports during an
+// upload test
+const (
+	minProgressInterval = 10 * time.Millisecond
+	maxProgressInterval = time.Second
+)
+
+// parseProgressInterval parses the interval, in ms, that a client asked for
+// progress reports at with RCV PROGRESS <ms>
+func parseProgressInterval(arg string) (time.Duration, error) {
+	ms, err := strconv.ParseUint(arg, 10, 32)
+	interval := time.Duration(ms) * time.Millisecond
+	if err != nil || interval < minProgressInterval || interval > maxProgressInterval {
+		return 0, fmt.Errorf("Progress interval must be between %v and %v ms", minProgressInterval/time.Millisecond, maxProgressInterval/time.Millisecond)
+	}
+	return interval, nil
+}
+
+// reportProgress tells the client how many bytes of its upload we've
+// received so far, every interval, until stop is closed.  The reports go back
+// over the test's own connection, which is otherwise idle in that direction.
+func (sc *sparkyClient) reportProgress(interval time.Duration, stop <-chan struct{}) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	var reported int64 = -1
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick.C:
+			received := atomic.LoadInt64(&sc.received)
+			if received == reported {
+				continue
+			}
+			_, err := fmt.Fprintf(sc.client, "RCVD %v\n", received)
+			if err != nil {
+				return
+			}
+			reported = received
+		}
+	}
+}
+
+// receivedCounter discards the data written to it, adding up its size as it
+// goes, so that our progress reports keep up with uploads
+type receivedCounter struct {
+	n *int64
+}
+
+func (rc receivedCounter) Write(p []byte) (int, error) {
+	atomic.AddInt64(rc.n, int64(len(p)))
+	return len(p), nil
+}
+
+// sentCounter writes to w, adding up what it has written as it goes, so that
+// our count of a download keeps up with it while a block is being sent
+type sentCounter struct {
+	w io.Writer
+	n *int64
+}
+
+func (sc sentCounter) Write(p []byte) (int, error) {
+	n, err := sc.w.Write(p)
+	atomic.AddInt64(sc.n, int64(n))
+	return n, err
+}
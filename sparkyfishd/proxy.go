@@ -0,0 +1,203 @@
+package sparkyfishd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/freinold/sparkyfish/internal/quicnet"
+)
+
+const (
+	// proxyV1MaxLen is the longest that a v1 PROXY header can be, with its
+	// CRLF
+	proxyV1MaxLen = 107
+
+	// proxyV2HeaderLen is the length of the fixed part of a v2 header,
+	// which is followed by the addresses and any TLVs
+	proxyV2HeaderLen = 16
+)
+
+// proxyV2Signature starts every v2 PROXY header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyConn is a connection that came to us through a load balancer, with
+// the addresses from its PROXY header
+type proxyConn struct {
+	net.Conn
+	remote, local net.Addr
+}
+
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	return pc.remote
+}
+
+func (pc *proxyConn) LocalAddr() net.Addr {
+	return pc.local
+}
+
+// expectsProxy reports whether conn should start with a PROXY header: it
+// should if we speak the PROXY protocol, and if it's from one of the load
+// balancers in ProxyFrom, if we've been given any.  Load balancers only send
+// them over TCP, so connections over QUIC never start with one.
+func (s *Server) expectsProxy(conn net.Conn) bool {
+	if _, ok := conn.(*quicnet.Conn); ok || !s.ProxyProtocol {
+		return false
+	}
+	if len(s.ProxyFrom) == 0 {
+		return true
+	}
+
+	ip := addrIP(conn.RemoteAddr())
+	for _, n := range s.ProxyFrom {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader reads the PROXY header, in either version of the protocol,
+// that a load balancer sends before anything from the client, and returns
+// conn with the client's address as its RemoteAddr.  Health checks, which
+// the load balancer makes itself, keep their own addresses.  We read exactly
+// as much as the header takes, so the client's data is left for the handler
+// to read, and conn's underlying TCP connection can still be used for
+// sendfile(2).
+func (s *Server) readProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(s.idleTimeout()))
+
+	var start [proxyV2HeaderLen]byte
+	_, err := io.ReadFull(conn, start[:6])
+	if err != nil {
+		return nil, err
+	}
+
+	var remote, local net.Addr
+	switch {
+	case string(start[:6]) == "PROXY ":
+		remote, local, err = readProxyV1(conn)
+	case bytes.Equal(start[:6], proxyV2Signature[:6]):
+		_, err = io.ReadFull(conn, start[6:])
+		if err != nil {
+			return nil, err
+		}
+		remote, local, err = readProxyV2(conn, start[:])
+	default:
+		err = fmt.Errorf("no PROXY header")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if remote == nil {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, remote: remote, local: local}, nil
+}
+
+// readProxyV1 reads the rest of the human-readable header from version 1 of
+// the protocol, e.g. "PROXY TCP4 192.0.2.1 198.51.100.2 56324 7121\r\n",
+// after its "PROXY ".  It returns nil addresses for UNKNOWN connections.
+func readProxyV1(conn net.Conn) (net.Addr, net.Addr, error) {
+	// We read a byte at a time so as not to read past the header
+	line := make([]byte, 0, proxyV1MaxLen)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLen-len("PROXY ") {
+			return nil, nil, fmt.Errorf("PROXY header is too long")
+		}
+		_, err := io.ReadFull(conn, b)
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if fields[0] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return nil, nil, fmt.Errorf("invalid PROXY header")
+	}
+
+	remote, err := proxyV1Addr(fields[1], fields[3], fields[0] == "TCP4")
+	if err != nil {
+		return nil, nil, err
+	}
+	local, err := proxyV1Addr(fields[2], fields[4], fields[0] == "TCP4")
+	if err != nil {
+		return nil, nil, err
+	}
+	return remote, local, nil
+}
+
+// proxyV1Addr parses an address from a v1 header.  TCP4 ones are in dotted
+// decimal and TCP6 ones in IPv6 notation, which includes IPv4-mapped
+// addresses such as ::ffff:192.0.2.1, from load balancers that listen on
+// dual-stack sockets.
+func proxyV1Addr(host, port string, v4 bool) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || strings.Contains(host, ":") == v4 {
+		return nil, fmt.Errorf("invalid address %q in PROXY header", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q in PROXY header", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readProxyV2 reads the rest of a binary header from version 2 of the
+// protocol, whose fixed part is in header.  It returns nil addresses for
+// LOCAL connections, and for ones that aren't over TCP.
+func readProxyV2(conn net.Conn, header []byte) (net.Addr, net.Addr, error) {
+	if !bytes.Equal(header[:12], proxyV2Signature) || header[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("invalid PROXY header")
+	}
+	command, family := header[12]&0xf, header[13]
+
+	// The addresses are followed by TLVs, which we have no use for, but
+	// have to read past
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	_, err := io.ReadFull(conn, body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch {
+	case command == 0:
+		return nil, nil, nil
+	case command != 1:
+		return nil, nil, fmt.Errorf("unknown PROXY command %v", command)
+	}
+
+	var size int
+	switch family {
+	case 0x11: // TCP over IPv4
+		size = net.IPv4len
+	case 0x21: // TCP over IPv6
+		size = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if len(body) < size*2+4 {
+		return nil, nil, fmt.Errorf("PROXY header is too short")
+	}
+
+	remote := &net.TCPAddr{
+		IP:   net.IP(body[:size]),
+		Port: int(binary.BigEndian.Uint16(body[size*2:])),
+	}
+	local := &net.TCPAddr{
+		IP:   net.IP(body[size : size*2]),
+		Port: int(binary.BigEndian.Uint16(body[size*2+2:])),
+	}
+	return remote, local, nil
+}
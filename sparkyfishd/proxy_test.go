@@ -0,0 +1,201 @@
+package sparkyfishd
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2 builds a v2 header with the given version and command byte,
+// family, and addresses and TLVs
+func proxyV2(verCmd, family byte, body []byte) []byte {
+	h := append([]byte(nil), proxyV2Signature...)
+	h = append(h, verCmd, family, 0, 0)
+	binary.BigEndian.PutUint16(h[14:], uint16(len(body)))
+	return append(h, body...)
+}
+
+// proxyV2Body encodes the addresses of a v2 header, followed by extra
+func proxyV2Body(remote, local string, remotePort, localPort uint16, extra ...byte) []byte {
+	ip := func(s string) []byte {
+		ip := net.ParseIP(s)
+		if ip4 := ip.To4(); ip4 != nil && !strings.Contains(s, ":") {
+			return ip4
+		}
+		return ip.To16()
+	}
+	b := append(ip(remote), ip(local)...)
+	b = binary.BigEndian.AppendUint16(b, remotePort)
+	b = binary.BigEndian.AppendUint16(b, localPort)
+	return append(b, extra...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := []struct {
+		name          string
+		in            []byte
+		remote, local string // empty for the connection's own addresses
+		err           string
+	}{
+		// Version 1
+		{
+			name:   "v1 TCP4",
+			in:     []byte("PROXY TCP4 192.0.2.1 198.51.100.2 56324 7121\r\n"),
+			remote: "192.0.2.1:56324", local: "198.51.100.2:7121",
+		},
+		{
+			name:   "v1 TCP6",
+			in:     []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 7121\r\n"),
+			remote: "[2001:db8::1]:56324", local: "[2001:db8::2]:7121",
+		},
+		{
+			name:   "v1 TCP6 with IPv4-mapped addresses",
+			in:     []byte("PROXY TCP6 ::ffff:192.0.2.1 ::ffff:198.51.100.2 56324 7121\r\n"),
+			remote: "192.0.2.1:56324", local: "198.51.100.2:7121",
+		},
+		{
+			name: "v1 UNKNOWN",
+			in:   []byte("PROXY UNKNOWN\r\n"),
+		},
+		{
+			name: "v1 UNKNOWN with addresses",
+			in:   []byte("PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n"),
+		},
+		{
+			name:   "v1 longest header",
+			in:     []byte("PROXY TCP6 ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff 65535 65535\r\n"),
+			remote: "[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535", local: "[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535",
+		},
+		{name: "v1 too long", in: []byte("PROXY UNKNOWN " + strings.Repeat("x", 100) + "\r\n"), err: "too long"},
+		{name: "v1 no CRLF", in: []byte("PROXY TCP4 192.0.2.1 198.51.100.2 56324 7121\n"), err: "EOF"},
+		{name: "v1 truncated", in: []byte("PROXY TCP4 192.0.2.1 198.51"), err: "EOF"},
+		{name: "v1 truncated in the signature", in: []byte("PROX"), err: "EOF"},
+		{name: "v1 unknown protocol", in: []byte("PROXY UDP4 192.0.2.1 198.51.100.2 56324 7121\r\n"), err: "invalid PROXY header"},
+		{name: "v1 missing port", in: []byte("PROXY TCP4 192.0.2.1 198.51.100.2 56324\r\n"), err: "invalid PROXY header"},
+		{name: "v1 double space", in: []byte("PROXY TCP4  192.0.2.1 198.51.100.2 56324 7121\r\n"), err: "invalid PROXY header"},
+		{name: "v1 empty", in: []byte("PROXY \r\n"), err: "invalid PROXY header"},
+		{name: "v1 TCP4 with IPv6 address", in: []byte("PROXY TCP4 2001:db8::1 198.51.100.2 56324 7121\r\n"), err: "invalid address"},
+		{name: "v1 TCP4 with IPv4-mapped address", in: []byte("PROXY TCP4 ::ffff:192.0.2.1 198.51.100.2 56324 7121\r\n"), err: "invalid address"},
+		{name: "v1 TCP6 with IPv4 address", in: []byte("PROXY TCP6 192.0.2.1 2001:db8::2 56324 7121\r\n"), err: "invalid address"},
+		{name: "v1 bad address", in: []byte("PROXY TCP4 192.0.2.256 198.51.100.2 56324 7121\r\n"), err: "invalid address"},
+		{name: "v1 hostname", in: []byte("PROXY TCP4 example.com 198.51.100.2 56324 7121\r\n"), err: "invalid address"},
+		{name: "v1 port out of range", in: []byte("PROXY TCP4 192.0.2.1 198.51.100.2 65536 7121\r\n"), err: "invalid port"},
+		{name: "v1 negative port", in: []byte("PROXY TCP4 192.0.2.1 198.51.100.2 56324 -1\r\n"), err: "invalid port"},
+
+		// Version 2
+		{
+			name:   "v2 TCP over IPv4",
+			in:     proxyV2(0x21, 0x11, proxyV2Body("192.0.2.1", "198.51.100.2", 56324, 7121)),
+			remote: "192.0.2.1:56324", local: "198.51.100.2:7121",
+		},
+		{
+			name:   "v2 TCP over IPv6",
+			in:     proxyV2(0x21, 0x21, proxyV2Body("2001:db8::1", "2001:db8::2", 56324, 7121)),
+			remote: "[2001:db8::1]:56324", local: "[2001:db8::2]:7121",
+		},
+		{
+			name:   "v2 TCP over IPv6 with IPv4-mapped addresses",
+			in:     proxyV2(0x21, 0x21, proxyV2Body("::ffff:192.0.2.1", "::ffff:198.51.100.2", 56324, 7121)),
+			remote: "192.0.2.1:56324", local: "198.51.100.2:7121",
+		},
+		{
+			name:   "v2 with TLVs",
+			in:     proxyV2(0x21, 0x11, proxyV2Body("192.0.2.1", "198.51.100.2", 56324, 7121, 0x04, 0x00, 0x02, 'h', 'i')),
+			remote: "192.0.2.1:56324", local: "198.51.100.2:7121",
+		},
+		{name: "v2 LOCAL", in: proxyV2(0x20, 0x00, nil)},
+		{name: "v2 LOCAL with addresses", in: proxyV2(0x20, 0x11, proxyV2Body("192.0.2.1", "198.51.100.2", 56324, 7121))},
+		{name: "v2 UDP", in: proxyV2(0x21, 0x12, proxyV2Body("192.0.2.1", "198.51.100.2", 56324, 7121))},
+		{name: "v2 unix socket", in: proxyV2(0x21, 0x31, make([]byte, 216))},
+		{name: "v2 unspecified family", in: proxyV2(0x21, 0x00, nil)},
+		{name: "v2 truncated in the signature", in: proxyV2Signature[:8], err: "EOF"},
+		{name: "v2 truncated in the header", in: proxyV2(0x21, 0x11, nil)[:14], err: "EOF"},
+		{name: "v2 truncated in the addresses", in: proxyV2(0x21, 0x11, proxyV2Body("192.0.2.1", "198.51.100.2", 56324, 7121))[:20], err: "EOF"},
+		{name: "v2 addresses too short for IPv4", in: proxyV2(0x21, 0x11, make([]byte, 11)), err: "too short"},
+		{name: "v2 addresses too short for IPv6", in: proxyV2(0x21, 0x21, proxyV2Body("192.0.2.1", "198.51.100.2", 56324, 7121)), err: "too short"},
+		{name: "v2 bad signature", in: append([]byte("\r\n\r\n\x00\r\nQUIX\n"), 0x21, 0x11, 0, 0), err: "invalid PROXY header"},
+		{name: "v2 version 1", in: proxyV2(0x11, 0x11, proxyV2Body("192.0.2.1", "198.51.100.2", 56324, 7121)), err: "invalid PROXY header"},
+		{name: "v2 version 3", in: proxyV2(0x31, 0x11, proxyV2Body("192.0.2.1", "198.51.100.2", 56324, 7121)), err: "invalid PROXY header"},
+		{name: "v2 unknown command", in: proxyV2(0x22, 0x11, proxyV2Body("192.0.2.1", "198.51.100.2", 56324, 7121)), err: "unknown PROXY command 2"},
+
+		// Neither
+		{name: "no header", in: []byte("HELLO\r\n"), err: "no PROXY header"},
+		{name: "lower case", in: []byte("proxy TCP4 192.0.2.1 198.51.100.2 56324 7121\r\n"), err: "no PROXY header"},
+		{name: "nothing", in: nil, err: "EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{IdleTimeout: 5 * time.Second}
+			conn, lb := net.Pipe()
+			defer conn.Close()
+
+			// The client's data follows the header, and mustn't be read
+			// with it
+			in, ok := tt.in, tt.err == ""
+			go func() {
+				lb.Write(in)
+				if ok {
+					lb.Write([]byte("HELLO\r\n"))
+				}
+				lb.Close()
+			}()
+
+			pc, err := s.readProxyHeader(conn)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("readProxyHeader returned %v, want an error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readProxyHeader: %v", err)
+			}
+
+			if tt.remote == "" {
+				if pc != conn {
+					t.Errorf("connection has addresses %v and %v, want its own", pc.RemoteAddr(), pc.LocalAddr())
+				}
+			} else {
+				if got := pc.RemoteAddr().String(); got != tt.remote {
+					t.Errorf("remote address is %v, want %v", got, tt.remote)
+				}
+				if got := pc.LocalAddr().String(); got != tt.local {
+					t.Errorf("local address is %v, want %v", got, tt.local)
+				}
+				if ip := addrIP(pc.RemoteAddr()); ip == nil {
+					t.Errorf("no IP in remote address %v", pc.RemoteAddr())
+				}
+			}
+
+			rest, _ := io.ReadAll(pc)
+			if string(rest) != "HELLO\r\n" {
+				t.Errorf("after the header, read %q, want HELLO", rest)
+			}
+		})
+	}
+}
+
+func TestExpectsProxy(t *testing.T) {
+	_, lbs, _ := net.ParseCIDR("10.0.0.0/8")
+	tests := []struct {
+		name  string
+		s     *Server
+		from  string
+		wants bool
+	}{
+		{"off", &Server{}, "10.0.0.1", false},
+		{"from anywhere", &Server{ProxyProtocol: true}, "192.0.2.1", true},
+		{"from a load balancer", &Server{ProxyProtocol: true, ProxyFrom: []*net.IPNet{lbs}}, "10.0.0.1", true},
+		{"from an IPv4-mapped load balancer", &Server{ProxyProtocol: true, ProxyFrom: []*net.IPNet{lbs}}, "::ffff:10.0.0.1", true},
+		{"from a client", &Server{ProxyProtocol: true, ProxyFrom: []*net.IPNet{lbs}}, "192.0.2.1", false},
+	}
+	for _, tt := range tests {
+		conn := &proxyConn{remote: &net.TCPAddr{IP: net.ParseIP(tt.from), Port: 1234}}
+		if got := tt.s.expectsProxy(conn); got != tt.wants {
+			t.Errorf("%v: expectsProxy = %v, want %v", tt.name, got, tt.wants)
+		}
+	}
+}
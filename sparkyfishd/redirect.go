@@ -0,0 +1,50 @@
+package sparkyfishd
+
+import (
+	"sync"
+
+	"github.com/freinold/sparkyfish"
+)
+
+// siblings keeps track of the servers that our Registry lists besides us,
+// for sending clients to when we're busy
+type siblings struct {
+	mu      sync.Mutex
+	learned []string
+	next    int
+}
+
+// learn replaces the siblings that we know about from our Registry with those
+// of servers that have room for a test, other than us at self
+func (sb *siblings) learn(servers []sparkyfish.RegisteredServer, self string) {
+	var learned []string
+	for _, rs := range servers {
+		if rs.Addr != self && !rs.Full() {
+			learned = append(learned, rs.Addr)
+		}
+	}
+
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	sb.learned = learned
+}
+
+// sibling returns the next of our Siblings, and of the servers that we've
+// learned about from our Registry, to send a client to, taking turns so that
+// we don't swamp any one of them, or "" if we don't know of any
+func (s *Server) sibling() string {
+	sb := &s.siblings
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	n := len(sb.learned) + len(s.Siblings)
+	if n == 0 {
+		return ""
+	}
+	i := sb.next % n
+	sb.next++
+	if i < len(sb.learned) {
+		return sb.learned[i]
+	}
+	return s.Siblings[i-len(sb.learned)]
+}
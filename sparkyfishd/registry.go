@@ -0,0 +1,290 @@
+package sparkyfishd
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/freinold/sparkyfish"
+)
+
+const (
+	// DefaultRegistryTTL is how long a Registry lists a server that hasn't
+	// renewed its registration, by default
+	DefaultRegistryTTL = 3 * time.Minute
+
+	// registerInterval is how often servers renew their registrations
+	registerInterval = time.Minute
+
+	// registryCheckTimeout is how long a Registry gives a new server to
+	// answer it
+	registryCheckTimeout = 5 * time.Second
+
+	// maxRegistrationBody is the largest registration that a Registry
+	// takes
+	maxRegistrationBody = 64 << 10
+
+	// registryRequestTimeout is how long servers give their registry to
+	// answer each registration
+	registryRequestTimeout = 10 * time.Second
+)
+
+// registryClient is what servers register with
+var registryClient = &http.Client{Timeout: registryRequestTimeout}
+
+// Registry keeps a list of the sparkyfish servers that register with it, with
+// their location and load, for clients to choose from, e.g. with
+// sparkyfish-cli -registry.  It's an http.Handler that answers at
+// sparkyfish.RegistryPath: servers POST a sparkyfish.RegisteredServer to
+// register (see Server.RegistryURL), and get it back as we list it, and
+// clients GET the list.  Servers that leave the host out of their address are
+// listed at the address that they registered from.  Before listing a new
+// server, we check that it answers speed tests, so that the list can't be
+// filled with junk.  Only the host that registered a server may renew its
+// registration until it runs out, so that nobody else can change its
+// listing.
+type Registry struct {
+	// Token, if set, is a pre-shared token that servers must present as a
+	// bearer token to register
+	Token string
+
+	// TTL is how long we list a server that hasn't renewed its
+	// registration.  Defaults to DefaultRegistryTTL.
+	TTL time.Duration
+
+	// Logger is where we log to.  Defaults to slog.Default().
+	Logger *slog.Logger
+
+	mu      sync.Mutex
+	servers map[string]*registration
+}
+
+// registration is a server that a Registry lists, and the host that
+// registered it
+type registration struct {
+	sparkyfish.RegisteredServer
+	from string
+}
+
+func (reg *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != sparkyfish.RegistryPath {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reg.list())
+	case http.MethodPost:
+		reg.register(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeAPIError(w, http.StatusMethodNotAllowed, "only GET and POST are allowed")
+	}
+}
+
+// register handles a server's registration
+func (reg *Registry) register(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if reg.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(reg.Token)) != 1 {
+		writeAPIError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+
+	var rs sparkyfish.RegisteredServer
+	err := json.NewDecoder(io.LimitReader(r.Body, maxRegistrationBody)).Decode(&rs)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid registration: %v", err))
+		return
+	}
+
+	host, port, err := net.SplitHostPort(rs.Addr)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid address %v: %v", rs.Addr, err))
+		return
+	}
+	from, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if host == "" {
+		rs.Addr = net.JoinHostPort(from, port)
+	}
+
+	listed, ok := reg.listed(rs.Addr)
+	if ok && listed.from != from {
+		writeAPIError(w, http.StatusConflict, fmt.Sprintf("%v was registered from another address", rs.Addr))
+		return
+	}
+	if !ok {
+		ctx, cancel := context.WithTimeout(r.Context(), registryCheckTimeout)
+		defer cancel()
+		err = checkServer(ctx, rs.Addr)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("%v doesn't answer speed tests: %v", rs.Addr, err))
+			return
+		}
+		reg.logger().Info("server registered", "addr", rs.Addr, "location", rs.Location, "from", r.RemoteAddr)
+	}
+
+	rs.LastSeen = time.Now()
+	reg.mu.Lock()
+	if reg.servers == nil {
+		reg.servers = make(map[string]*registration)
+	}
+	reg.servers[rs.Addr] = &registration{RegisteredServer: rs, from: from}
+	reg.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rs)
+}
+
+// listed returns the registration of the server at addr, if we're listing
+// it
+func (reg *Registry) listed(addr string) (registration, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	rs := reg.servers[addr]
+	if rs == nil || time.Since(rs.LastSeen) > reg.ttl() {
+		return registration{}, false
+	}
+	return *rs, true
+}
+
+// list returns the servers that we're listing, by address, and forgets
+// the ones whose registrations have run out
+func (reg *Registry) list() []sparkyfish.RegisteredServer {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	servers := []sparkyfish.RegisteredServer{}
+	for addr, rs := range reg.servers {
+		if time.Since(rs.LastSeen) > reg.ttl() {
+			reg.logger().Info("server's registration ran out", "addr", addr)
+			delete(reg.servers, addr)
+			continue
+		}
+		servers = append(servers, rs.RegisteredServer)
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].Addr < servers[j].Addr
+	})
+	return servers
+}
+
+func (reg *Registry) ttl() time.Duration {
+	if reg.TTL > 0 {
+		return reg.TTL
+	}
+	return DefaultRegistryTTL
+}
+
+func (reg *Registry) logger() *slog.Logger {
+	if reg.Logger != nil {
+		return reg.Logger
+	}
+	return slog.Default()
+}
+
+// checkServer checks that the server at addr answers speed tests
+func checkServer(ctx context.Context, addr string) error {
+	client, err := sparkyfish.NewClient(addr)
+	if err != nil {
+		return err
+	}
+	_, err = client.Hello(ctx)
+	return err
+}
+
+// registerWith keeps us registered with our RegistryURL, as serving speed
+// tests on listener, until ctx is cancelled or we start shutting down.  If
+// we have a MaxConcurrent, we also keep track of the other servers that it
+// lists, to send clients to when we're busy.
+func (s *Server) registerWith(ctx context.Context, listener net.Listener) {
+	addr := s.RegistryAddr
+	if addr == "" {
+		_, port, _ := net.SplitHostPort(listener.Addr().String())
+		addr = net.JoinHostPort(s.Cname, port)
+	}
+
+	tick := time.NewTicker(registerInterval)
+	defer tick.Stop()
+	for {
+		if s.tracker.isDraining() {
+			return
+		}
+
+		self, err := s.register(ctx, addr)
+		if err != nil && ctx.Err() == nil {
+			s.logger().Warn("error registering with registry", "registry", s.RegistryURL, "err", err)
+		}
+		if err == nil && s.settings().MaxConcurrent > 0 {
+			servers, err := sparkyfish.FetchRegistry(ctx, s.RegistryURL)
+			if err != nil && ctx.Err() == nil {
+				s.logger().Warn("error fetching servers from registry", "registry", s.RegistryURL, "err", err)
+			}
+			if err == nil {
+				s.siblings.learn(servers, self)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// register registers us with our RegistryURL as serving speed tests at addr,
+// and returns the address that it lists us at
+func (s *Server) register(ctx context.Context, addr string) (string, error) {
+	rs := sparkyfish.RegisteredServer{
+		Candidate:         sparkyfish.Candidate{Addr: addr, Location: s.Location},
+		Version:           sparkyfish.Version,
+		ActiveConnections: s.limits.active(),
+		MaxConnections:    s.settings().MaxConcurrent,
+	}
+	body, err := json.Marshal(rs)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(s.RegistryURL, "/")+sparkyfish.RegistryPath, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.RegistryToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.RegistryToken)
+	}
+
+	resp, err := registryClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		var ae apiError
+		json.NewDecoder(resp.Body).Decode(&ae)
+		if ae.Error != "" {
+			return "", fmt.Errorf("registry responded with %v: %v", resp.Status, ae.Error)
+		}
+		return "", fmt.Errorf("registry responded with %v", resp.Status)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&rs)
+	if err != nil {
+		return "", fmt.Errorf("invalid response from registry: %v", err)
+	}
+	return rs.Addr, nil
+}
@@ -0,0 +1,58 @@
+package sparkyfishd
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/freinold/sparkyfish"
+)
+
+func TestRegistryRenewal(t *testing.T) {
+	reg := &Registry{servers: map[string]*registration{
+		"192.0.2.1:7121": {
+			RegisteredServer: sparkyfish.RegisteredServer{Candidate: sparkyfish.Candidate{Addr: "192.0.2.1:7121", Location: "Berlin"}, LastSeen: time.Now()},
+			from:             "192.0.2.1",
+		},
+	}}
+
+	for _, tt := range []struct {
+		name     string
+		from     string
+		addr     string
+		want     int
+		location string
+	}{
+		{"another host", "198.51.100.1:40000", "192.0.2.1:7121", http.StatusConflict, "Berlin"},
+		{"the registrant", "192.0.2.1:40000", ":7121", http.StatusOK, "Paris"},
+	} {
+		body, err := json.Marshal(sparkyfish.RegisteredServer{Candidate: sparkyfish.Candidate{Addr: tt.addr, Location: "Paris"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodPost, sparkyfish.RegistryPath, bytes.NewReader(body))
+		req.RemoteAddr = tt.from
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%v: renewing responded with %v, want %v: %v", tt.name, w.Code, tt.want, w.Body)
+		}
+		if servers := reg.list(); len(servers) != 1 || servers[0].Location != tt.location {
+			t.Errorf("%v: registry lists %+v, want one server in %v", tt.name, servers, tt.location)
+		}
+	}
+}
+
+func TestRegistryBodyLimit(t *testing.T) {
+	reg := &Registry{}
+	body := `{"addr":"192.0.2.1:7121","location":"` + strings.Repeat("x", maxRegistrationBody) + `"}`
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest(http.MethodPost, sparkyfish.RegistryPath, strings.NewReader(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("registering %v bytes responded with %v, want %v", len(body), w.Code, http.StatusBadRequest)
+	}
+}
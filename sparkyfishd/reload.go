@@ -0,0 +1,62 @@
+package sparkyfishd
+
+import "sync"
+
+// Settings are the parts of a Server's configuration that Reload can change
+// while it's serving.  They have the same meaning as the Server's fields of
+// the same names.
+type Settings struct {
+	MaxConcurrent  int
+	PerIPLimit     int
+	AuthToken      string
+	GeoIP          *GeoIP
+	AllowCountries []string
+	AllowASNs      []uint32
+	MaxTestSeconds int
+	MaxTestBytes   int64
+}
+
+// reloadable holds the Settings that Reload last gave us, if it's been called
+type reloadable struct {
+	mu       sync.RWMutex
+	settings *Settings
+}
+
+// Reload replaces our Settings, e.g. after our config file has changed, and
+// returns the ones that it replaced.  Connections that are already being
+// served carry on under the settings that they started with, so that no
+// running test is dropped or cut short; the new settings apply to the
+// connections that come after.
+func (s *Server) Reload(st Settings) Settings {
+	s.reloaded.mu.Lock()
+	defer s.reloaded.mu.Unlock()
+
+	old := s.currentSettings()
+	s.reloaded.settings = &st
+	return *old
+}
+
+// settings returns the Settings that we're serving new connections under
+func (s *Server) settings() *Settings {
+	s.reloaded.mu.RLock()
+	defer s.reloaded.mu.RUnlock()
+	return s.currentSettings()
+}
+
+// currentSettings returns our Settings: the ones that Reload last gave us, or
+// else the ones in our fields.  s.reloaded.mu must be held.
+func (s *Server) currentSettings() *Settings {
+	if s.reloaded.settings != nil {
+		return s.reloaded.settings
+	}
+	return &Settings{
+		MaxConcurrent:  s.MaxConcurrent,
+		PerIPLimit:     s.PerIPLimit,
+		AuthToken:      s.AuthToken,
+		GeoIP:          s.GeoIP,
+		AllowCountries: s.AllowCountries,
+		AllowASNs:      s.AllowASNs,
+		MaxTestSeconds: s.MaxTestSeconds,
+		MaxTestBytes:   s.MaxTestBytes,
+	}
+}
@@ -0,0 +1,93 @@
+package sparkyfishd
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/freinold/sparkyfish"
+)
+
+// sendSegmentSize is the size of the block of test data that downloads are
+// sent from with sendfile(2)
+const sendSegmentSize = 32 * 1024 * 1024
+
+// sendSegment is a block of incompressible test data in an unlinked file,
+// which downloads are sent from with sendfile(2) on Linux.  The kernel sends
+// it straight from the page cache, so a download costs us next to no CPU,
+// where generating the data as we go can run out of CPU before a 10 Gbit/s
+// link runs out of bandwidth.  The data repeats every sendSegmentSize bytes,
+// and every download sends the same data.  That's beyond the window of a
+// streaming compressor, but not of a deduplicating WAN optimizer, which keeps
+// a store of the chunks that it has seen, across connections, and can send
+// a reference instead of a chunk that it has seen before.  So downloads are
+// only sent from it if the server's Sendfile is set.
+type sendSegment struct {
+	file *os.File
+	fd   int
+}
+
+func newSendSegment() (*sendSegment, error) {
+	f, err := ioutil.TempFile("", "sparkyfish-")
+	if err != nil {
+		return nil, err
+	}
+
+	// We only need the open file
+	os.Remove(f.Name())
+
+	_, err = sparkyfish.NewPayload(false).CopyN(f, sendSegmentSize)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &sendSegment{file: f, fd: int(f.Fd())}, nil
+}
+
+// sendSegment returns the segment that we send downloads from, creating it
+// the first time that it's needed.  It returns nil if we can't use
+// sendfile(2), in which case downloads generate their data as they go.
+func (s *Server) sendSegment() *sendSegment {
+	if !s.Sendfile || !sendfileSupported {
+		return nil
+	}
+
+	s.segmentOnce.Do(func() {
+		seg, err := newSendSegment()
+		if err != nil {
+			s.logger().Error("error creating the data to send downloads from; generating it as we go instead", "err", err)
+			return
+		}
+		s.segment = seg
+	})
+	return s.segment
+}
+
+// segmentSender sends a download from a sendSegment, starting at a random
+// offset and wrapping around at its end
+type segmentSender struct {
+	seg  *sendSegment
+	conn *net.TCPConn
+	off  int64
+}
+
+// sender returns a segmentSender for a download to conn, or nil if conn
+// isn't a TCP connection, which sendfile(2) can't send to
+func (seg *sendSegment) sender(conn net.Conn) *segmentSender {
+	if pc, ok := conn.(*proxyConn); ok {
+		conn = pc.Conn
+	}
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	var b [8]byte
+	rand.Read(b[:])
+	off := int64(binary.LittleEndian.Uint64(b[:]) % sendSegmentSize)
+
+	return &segmentSender{seg: seg, conn: tc, off: off}
+}
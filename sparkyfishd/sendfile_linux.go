@@ -0,0 +1,60 @@
+//go:build linux
+// +build linux
+
+package sparkyfishd
+
+import (
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+// sendfileSupported reports whether we can send downloads with sendfile(2)
+const sendfileSupported = true
+
+// CopyN sends the next n bytes of the segment to the client.  It returns the
+// number of bytes sent and the error that stopped it, if any.
+func (ss *segmentSender) CopyN(n int64) (int64, error) {
+	rc, err := ss.conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var written int64
+	var serr error
+	err = rc.Write(func(fd uintptr) bool {
+		for written < n {
+			count := n - written
+			if rest := sendSegmentSize - ss.off; count > rest {
+				count = rest
+			}
+
+			off := ss.off
+			m, e := syscall.Sendfile(int(fd), ss.seg.fd, &off, int(count))
+			if m > 0 {
+				written += int64(m)
+				ss.off = (ss.off + int64(m)) % sendSegmentSize
+			}
+
+			switch {
+			case e == syscall.EAGAIN:
+				// Wait for the socket to drain
+				return false
+			case e == syscall.EINTR:
+			case e != nil:
+				serr = os.NewSyscallError("sendfile", e)
+				return true
+			case m == 0:
+				serr = io.ErrUnexpectedEOF
+				return true
+			}
+		}
+		return true
+	})
+
+	if serr != nil {
+		err = &net.OpError{Op: "write", Net: "tcp", Source: ss.conn.LocalAddr(), Addr: ss.conn.RemoteAddr(), Err: serr}
+	}
+	return written, err
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package sparkyfishd
+
+import "fmt"
+
+// sendfileSupported reports whether we can send downloads with sendfile(2).
+// We only know how to on Linux.
+const sendfileSupported = false
+
+// CopyN would send the next n bytes of the segment to the client
+func (ss *segmentSender) CopyN(n int64) (int64, error) {
+	return 0, fmt.Errorf("sendfile isn't supported on this platform")
+}
@@ -0,0 +1,499 @@
+// Package sparkyfishd implements the server side of the sparkyfish speed test
+// protocol.  It's used by sparkyfish-server, but it can also be embedded in
+// other Go programs that want to answer speed tests without running a
+// separate binary.
+package sparkyfishd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/freinold/sparkyfish"
+	"github.com/freinold/sparkyfish/internal/profiling"
+	"github.com/freinold/sparkyfish/internal/quicnet"
+)
+
+const (
+	blockSize        int64  = 1024 // size of each block copied to/from remote
+	reportIntervalMS uint64 = 1000 // report interval in milliseconds
+	testLength       uint   = 10   // length of throughput tests (sec)
+	pingTestLength   int    = 30   // number of pings allowed in a ping test
+)
+
+// Server answers sparkyfish speed tests.  Its fields mustn't be changed once
+// it's serving, but Reload can change the ones in Settings.
+type Server struct {
+	// Addr is the IP:Port to listen on.  If the IP is omitted, the server
+	// listens on all IPv4 and IPv6 addresses.  Defaults to ":7121".
+	Addr string
+
+	// Cname is the canonical hostname or IP address reported to clients
+	// after a successful HELO [optional]
+	Cname string
+
+	// Location is the physical location of the server (e.g. "Dallas, TX")
+	// reported to clients after a successful HELO [optional]
+	Location string
+
+	// Debug enables logging of debugging information.  It's ignored if
+	// we have a Logger, whose level decides that instead.
+	Debug bool
+
+	// Logger is where we log to.  Each session's lines carry its ID and the
+	// client's IP, and a finished test's carry what it moved and how fast.
+	// Defaults to slog.Default().
+	Logger *slog.Logger
+
+	// MaxConcurrent caps the number of connections that we handle at once.
+	// Zero means no limit.
+	MaxConcurrent int
+
+	// Advertise announces the server over mDNS/DNS-SD so that clients on
+	// the local network can discover it
+	Advertise bool
+
+	// AuthToken, if set, is a pre-shared token that clients must present
+	// with AUTH before they're allowed to run any tests.
+	AuthToken string
+
+	// PerIPLimit caps the number of connections that we handle at once from
+	// any single client IP.  Zero means no limit.
+	PerIPLimit int
+
+	// WebSocketAddr, if set, is the IP:Port on which ListenAndServe also
+	// answers speed tests over WebSocket, at sparkyfish.WebSocketPath.
+	// This lets browsers run tests, and gets through middleboxes that only
+	// let HTTP through.
+	WebSocketAddr string
+
+	// QUICAddr, if set, is the IP:Port on which ListenAndServe also answers
+	// speed tests over QUIC, each over a QUIC connection with a single
+	// stream.  It needs a UDP port of its own, apart from Addr's, whose
+	// datagrams are for UDP tests.  We present TLSConfig's certificates,
+	// or a self-signed one without it.
+	QUICAddr string
+
+	// WebAddr, if set, is the IP:Port on which ListenAndServe serves a web
+	// UI that runs tests from the browser, over WebSocket
+	WebAddr string
+
+	// APIAddr, if set, is the IP:Port on which ListenAndServe serves our
+	// REST API (see APIHandler), which runs tests against other servers on
+	// request.  Set an AuthToken to keep strangers from using it.
+	APIAddr string
+
+	// HealthAddr, if set, is the IP:Port on which ListenAndServe answers
+	// health and readiness probes (see HealthHandler).  They're always
+	// served over plain HTTP, so that probes needn't present a certificate.
+	HealthAddr string
+
+	// PprofAddr, if set, is the IP:Port on which ListenAndServe serves Go's
+	// profiles and runtime metrics, at /debug/pprof/ and /debug/vars, over
+	// plain HTTP.  They aren't authenticated, so it's best kept to
+	// localhost.
+	PprofAddr string
+
+	// TLSConfig, if set, has us serve WebSocket connections, the web UI and
+	// the API over HTTPS, with its certificates, e.g. ones that
+	// golang.org/x/crypto/acme/autocert gets from Let's Encrypt, and
+	// present them over QUIC.  Speed tests over plain TCP and UDP are
+	// unaffected.
+	TLSConfig *tls.Config
+
+	// RequireClientCert turns away clients that haven't presented a
+	// certificate that our TLSConfig verified, with its ClientCAs and
+	// ClientAuth, unless they present our AuthToken instead.  Only clients
+	// over WebSocket with TLS or over QUIC can present one, so plain TCP
+	// tests need an AuthToken, without which nobody gets in over plain TCP.
+	RequireClientCert bool
+
+	// RegistryURL, if set, is the base URL of a Registry that we register
+	// with, and keep our registration and load up to date with, while
+	// we're serving, so that clients can find us through it
+	RegistryURL string
+
+	// RegistryAddr is the host:port that we register as, for clients to
+	// reach us at.  Defaults to our Cname and the port that we're
+	// listening on; without a Cname, the registry lists us at the address
+	// that we register from.
+	RegistryAddr string
+
+	// RegistryToken is presented to our Registry, if it needs one
+	RegistryToken string
+
+	// Siblings are the host:port of other servers that we send clients to,
+	// taking turns, when we're already handling MaxConcurrent connections,
+	// rather than turning them away.  With a RegistryURL, we also send them
+	// to the other servers that it lists with room for a test.  Only
+	// clients that speak protocol version 2 over TCP can be sent elsewhere.
+	Siblings []string
+
+	// Sendfile sends downloads with sendfile(2) on Linux, from one block of
+	// random data that every download repeats, instead of freshly generated
+	// data, at a fraction of the CPU.  Deduplicating WAN optimizers can
+	// recognize the repeats, so it's off by default.  See sendSegment.
+	Sendfile bool
+
+	// GeoIP, if set, looks up where clients are, for AllowCountries and
+	// AllowASNs, and where we and the client are for INFO responses
+	GeoIP *GeoIP
+
+	// AllowCountries, if set, only lets clients in these countries run
+	// tests.  They're ISO 3166-1 codes, e.g. "DE".  Clients on private
+	// and loopback addresses are always let in.  It needs a GeoIP with a
+	// Country or City database, without which nobody else is let in.
+	AllowCountries []string
+
+	// AllowASNs, if set, only lets clients in these autonomous systems run
+	// tests.  Like AllowCountries, but it needs an ASN database.
+	AllowASNs []uint32
+
+	// ProxyProtocol has us expect a PROXY protocol header, in version 1 or
+	// 2, at the start of each TCP connection, as sent by HAProxy and most
+	// other TCP load balancers.  We then treat the client that it names as
+	// the one we're talking to, for our limits, logs and GeoIP lookups.
+	// Connections without one are dropped, so unless every connection comes
+	// through a load balancer, set ProxyFrom too.
+	ProxyProtocol bool
+
+	// ProxyFrom, if set, only expects PROXY headers on connections from
+	// these networks, where our load balancers are.  Anybody else is served
+	// as they are.
+	ProxyFrom []*net.IPNet
+
+	// TestLog, if set, records each test that we run, for working out how
+	// we're being used.  Multi-stream tests are recorded stream by stream.
+	TestLog *TestLog
+
+	// MaxTestSeconds, if set, cuts throughput tests short after that many
+	// seconds.  Tests run for 10 seconds at most anyway.
+	MaxTestSeconds int
+
+	// MaxTestBytes, if set, cuts throughput tests short once they've sent or
+	// received that many bytes over a connection.  Clients that run a test
+	// over several connections get this much on each.
+	MaxTestBytes int64
+
+	// Workers caps the number of connections that we serve at once, counting
+	// ones that haven't asked for a test yet, and ones over MaxConcurrent
+	// that we're about to turn away.  While they're all busy, we stop
+	// accepting connections, leaving new ones in the kernel's backlog, so a
+	// flood of them can't run us out of goroutines or file descriptors.
+	// Defaults to DefaultWorkers.
+	Workers int
+
+	// IdleTimeout is how long we wait for a client to send its next command,
+	// echo its next ping or send the next megabyte of an upload before we
+	// drop it.  Defaults to DefaultIdleTimeout.
+	IdleTimeout time.Duration
+
+	// WriteTimeout is how long we wait for a client to take the next
+	// megabyte of a download, or any other reply, before we drop it as too
+	// slow.  Defaults to DefaultWriteTimeout.
+	WriteTimeout time.Duration
+
+	workers  workerPool
+	tracker  connTracker
+	limits   connLimiter
+	bids     bidPairs
+	tallies  tallies
+	udp      udpSessions
+	udpConns int32
+	apiBusy  int32
+	reloaded reloadable
+	siblings siblings
+
+	segmentOnce sync.Once
+	segment     *sendSegment
+
+	loggerOnce sync.Once
+	log        *slog.Logger
+	sessions   uint64
+}
+
+// Listeners are the sockets that we serve on.  Listen opens them from our
+// addresses, but they can also come from elsewhere, e.g. from systemd's socket
+// activation.
+type Listeners struct {
+	// Tests are the TCP listeners for speed tests
+	Tests []net.Listener
+
+	// Packets are where we receive and send the datagrams of UDP tests.
+	// Clients send to the same port that they reached us on over TCP.
+	Packets []net.PacketConn
+
+	// QUIC, if set, is where we answer speed tests over QUIC.  It can't be
+	// one of Packets, as QUIC's datagrams can't be told apart from a UDP
+	// test's.
+	QUIC net.PacketConn
+
+	// WebSocket, Web, API, Health and Pprof, if set, are where we serve
+	// speed tests over WebSocket, our web UI, our REST API, our health
+	// probes and our profiles
+	WebSocket net.Listener
+	Web       net.Listener
+	API       net.Listener
+	Health    net.Listener
+	Pprof     net.Listener
+}
+
+// ListenAndServe listens on s.Addr, and on any other addresses that we have,
+// and handles speed tests until ctx is cancelled
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	ls := &Listeners{}
+	err := s.Listen(ls)
+	if err != nil {
+		return err
+	}
+	return s.ServeListeners(ctx, ls)
+}
+
+// Listen opens whichever of our sockets ls doesn't already have.  If s.Addr
+// doesn't name a host, we open separate IPv4 and IPv6 listeners so that we're
+// reachable over both address families, even on systems where IPv6 sockets
+// don't accept IPv4 connections.  Our UDP sockets are only opened alongside
+// our TCP listeners.  If we can't open them, we carry on without UDP support.
+func (s *Server) Listen(ls *Listeners) error {
+	if len(ls.Tests) == 0 {
+		addr := s.Addr
+		if addr == "" {
+			addr = ":" + sparkyfish.DefaultPort
+		}
+
+		networks := []string{"tcp"}
+
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("invalid listen address: %v", err)
+		}
+		if host == "" {
+			networks = []string{"tcp4", "tcp6"}
+		}
+
+		for _, network := range networks {
+			listener, err := net.Listen(network, addr)
+			if err != nil {
+				s.logger().Error("error listening", "addr", addr, "network", network, "err", err)
+				continue
+			}
+			ls.Tests = append(ls.Tests, listener)
+		}
+
+		if len(ls.Tests) == 0 {
+			return fmt.Errorf("unable to listen on %v", addr)
+		}
+
+		for _, network := range networks {
+			network = strings.Replace(network, "tcp", "udp", 1)
+			pc, err := net.ListenPacket(network, addr)
+			if err != nil {
+				s.logger().Warn("error listening for UDP", "addr", addr, "network", network, "err", err)
+				continue
+			}
+			ls.Packets = append(ls.Packets, pc)
+		}
+	}
+
+	if ls.QUIC == nil && s.QUICAddr != "" {
+		pc, err := net.ListenPacket("udp", s.QUICAddr)
+		if err != nil {
+			s.logger().Error("error listening for QUIC", "addr", s.QUICAddr, "err", err)
+		} else {
+			ls.QUIC = pc
+		}
+	}
+
+	for _, hl := range []struct {
+		listener *net.Listener
+		what     string
+		addr     string
+	}{
+		{&ls.WebSocket, "WebSocket connections", s.WebSocketAddr},
+		{&ls.Web, "the web UI", s.WebAddr},
+		{&ls.API, "the API", s.APIAddr},
+		{&ls.Health, "health probes", s.HealthAddr},
+		{&ls.Pprof, "profiles", s.PprofAddr},
+	} {
+		if *hl.listener != nil || hl.addr == "" {
+			continue
+		}
+		listener, err := net.Listen("tcp", hl.addr)
+		if err != nil {
+			s.logger().Error("error listening for "+hl.what, "addr", hl.addr, "err", err)
+			continue
+		}
+		*hl.listener = listener
+	}
+
+	return nil
+}
+
+// ServeListeners handles speed tests on ls until ctx is cancelled, at which
+// point they're closed, or until Shutdown is called.  See Serve.
+func (s *Server) ServeListeners(ctx context.Context, ls *Listeners) error {
+	if len(ls.Tests) == 0 {
+		return fmt.Errorf("no listeners to serve speed tests on")
+	}
+	if ls.API != nil {
+		err := s.CheckAPIAccess()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, pc := range ls.Packets {
+		go s.ServePacket(ctx, pc)
+	}
+
+	if ls.WebSocket != nil {
+		mux := http.NewServeMux()
+		mux.Handle(sparkyfish.WebSocketPath, s.WebSocketHandler())
+		go s.serveHTTP(ctx, "WebSocket connections", ls.WebSocket, mux, s.TLSConfig)
+	}
+	if ls.Web != nil {
+		go s.serveHTTP(ctx, "the web UI", ls.Web, s.WebHandler(), s.TLSConfig)
+	}
+	if ls.API != nil {
+		go s.serveHTTP(ctx, "the API", ls.API, s.APIHandler(), s.TLSConfig)
+	}
+	if ls.Health != nil {
+		go s.serveHTTP(ctx, "health probes", ls.Health, s.HealthHandler(), nil)
+	}
+	if ls.Pprof != nil {
+		go s.serveHTTP(ctx, "profiles", ls.Pprof, profiling.Handler(), nil)
+	}
+
+	if s.Advertise {
+		stop, err := s.advertise(ls.Tests[0])
+		if err != nil {
+			s.logger().Error("error advertising over mDNS", "err", err)
+		} else {
+			defer stop()
+		}
+	}
+
+	if s.RegistryURL != "" {
+		go s.registerWith(ctx, ls.Tests[0])
+	}
+
+	// Tests over QUIC are served like any others, once each client has
+	// opened its stream
+	listeners := ls.Tests
+	if ls.QUIC != nil {
+		ql, err := quicnet.Listen(ls.QUIC, s.TLSConfig)
+		if err != nil {
+			s.logger().Error("error listening for QUIC", "addr", ls.QUIC.LocalAddr().String(), "err", err)
+			ls.QUIC.Close()
+		} else {
+			listeners = append(listeners[:len(listeners):len(listeners)], ql)
+		}
+	}
+
+	return s.Serve(ctx, listeners...)
+}
+
+// ServePacket handles the datagrams for UDP tests on pc until ctx is cancelled,
+// at which point pc is closed.  Clients send their datagrams to the same port
+// that they reached us on over TCP.
+func (s *Server) ServePacket(ctx context.Context, pc net.PacketConn) {
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+	}()
+
+	atomic.AddInt32(&s.udpConns, 1)
+	defer atomic.AddInt32(&s.udpConns, -1)
+
+	s.servePacket(ctx, pc)
+}
+
+// udpEnabled reports whether we're able to run UDP tests
+func (s *Server) udpEnabled() bool {
+	return atomic.LoadInt32(&s.udpConns) > 0
+}
+
+// Serve handles speed tests on each of listeners until ctx is cancelled, at
+// which point the listeners are closed, or until Shutdown is called.  Tests
+// that are already running are left to finish on their own, unless Shutdown
+// is told to stop waiting for them.
+func (s *Server) Serve(ctx context.Context, listeners ...net.Listener) error {
+	var wg sync.WaitGroup
+	for _, listener := range listeners {
+		if !s.tracker.addListener(listener) {
+			continue
+		}
+
+		wg.Add(1)
+		go func(listener net.Listener) {
+			defer wg.Done()
+			defer s.tracker.removeListener(listener)
+			s.acceptConnections(ctx, listener)
+		}(listener)
+	}
+
+	// Close the listeners when we're cancelled.  This unblocks Accept().
+	go func() {
+		<-ctx.Done()
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}()
+
+	wg.Wait()
+
+	if s.tracker.isDraining() {
+		return ErrServerClosed
+	}
+	return ctx.Err()
+}
+
+// acceptConnections accepts connections on listener until ctx is cancelled.
+// Each is served in a worker slot, and we only accept one when there's a
+// slot free for it.
+func (s *Server) acceptConnections(ctx context.Context, listener net.Listener) {
+	for {
+		if s.workers.full(s.workerCount()) {
+			s.logger().Debug("all workers are busy; waiting for one before accepting more connections", "workers", s.workerCount())
+		}
+		if !s.workers.acquire(ctx, s.workerCount()) {
+			return
+		}
+
+		conn, err := listener.Accept()
+		if err != nil {
+			s.workers.release()
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.logger().Error("error accepting connection", "err", err)
+			continue
+		}
+
+		go func() {
+			defer s.workers.release()
+
+			// Connections through a load balancer start with the
+			// client's address
+			if s.expectsProxy(conn) {
+				pc, err := s.readProxyHeader(conn)
+				if err != nil {
+					s.logger().Info("dropping a connection without a valid PROXY header", "peer", conn.RemoteAddr().String(), "err", err)
+					conn.Close()
+					return
+				}
+				conn = pc
+			}
+
+			s.handler(conn)
+		}()
+	}
+}
@@ -0,0 +1,292 @@
+package sparkyfishd
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/freinold/sparkyfish"
+)
+
+const (
+	// maxSharedBody is the largest set of results that a ShareService takes
+	maxSharedBody = 1 << 20
+
+	// sharePagePath is where a ShareService shows each set of results, by ID
+	sharePagePath = "/r/"
+
+	// shareIDLength is the length of the IDs that a ShareService makes up
+	shareIDLength = 8
+)
+
+// shareIDChars are the characters that a ShareService's IDs are made of,
+// leaving out those that are easily mistaken for one another when read out
+const shareIDChars = "23456789abcdefghjkmnpqrstuvwxyz"
+
+// ShareService keeps the results that clients share with it, e.g. with
+// sparkyfish-cli -share, and shows each set on a small page of its own, with
+// a short URL to pass on.  It's an http.Handler: clients POST
+// sparkyfish.Results to sparkyfish.SharePath, and get back a
+// sparkyfish.SharedResults with the page's URL.  The results are shown at
+// /r/<id>, and can be fetched as JSON from sparkyfish.SharePath + "/<id>".
+type ShareService struct {
+	// Dir, if set, is where the results are kept, one JSON file each, so
+	// that they outlive us.  Otherwise they're kept in memory.
+	Dir string
+
+	// BaseURL is the URL that the pages' URLs start with, e.g.
+	// "https://share.example.com".  Defaults to the host that each set of
+	// results was sent to.
+	BaseURL string
+
+	// Token, if set, is a pre-shared token that clients must present as a
+	// bearer token to share results.  Anyone may view them.
+	Token string
+
+	// KeepPersonalData keeps the parts of the results that identify whoever
+	// ran the tests, which are otherwise dropped even if a client sends
+	// them (see sparkyfish.Results.WithoutPersonalData), since anyone with
+	// a page's URL can see it
+	KeepPersonalData bool
+
+	// Logger is where we log to.  Defaults to slog.Default().
+	Logger *slog.Logger
+
+	mu      sync.Mutex
+	results map[string][]byte // by ID, without a Dir
+}
+
+func (ss *ShareService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == sparkyfish.SharePath && r.Method == http.MethodPost:
+		ss.share(w, r)
+	case r.URL.Path == sparkyfish.SharePath:
+		w.Header().Set("Allow", "POST")
+		writeAPIError(w, http.StatusMethodNotAllowed, "only POST is allowed")
+	case strings.HasPrefix(r.URL.Path, sparkyfish.SharePath+"/") && r.Method == http.MethodGet:
+		body, err := ss.load(strings.TrimPrefix(r.URL.Path, sparkyfish.SharePath+"/"))
+		if err != nil {
+			writeAPIError(w, http.StatusNotFound, "no such results")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	case strings.HasPrefix(r.URL.Path, sharePagePath) && r.Method == http.MethodGet:
+		ss.page(w, r, strings.TrimPrefix(r.URL.Path, sharePagePath))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// share takes a client's results and answers with where they can be seen
+func (ss *ShareService) share(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if ss.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(ss.Token)) != 1 {
+		writeAPIError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+
+	var results sparkyfish.Results
+	err := json.NewDecoder(io.LimitReader(r.Body, maxSharedBody)).Decode(&results)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid results: %v", err))
+		return
+	}
+
+	// Keep the results as we understood them, rather than whatever else the
+	// client sent along with them
+	if !ss.KeepPersonalData {
+		results = results.WithoutPersonalData()
+	}
+	body, err := json.Marshal(results)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	id, err := ss.store(body)
+	if err != nil {
+		ss.logger().Error("error storing shared results", "err", err)
+		writeAPIError(w, http.StatusInternalServerError, "unable to store the results")
+		return
+	}
+	ss.logger().Info("results shared", "id", id, "server", results.Server, "from", r.RemoteAddr)
+
+	base := ss.BaseURL
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sparkyfish.SharedResults{ID: id, URL: strings.TrimSuffix(base, "/") + sharePagePath + id})
+}
+
+// store keeps body under a new ID, and returns the ID
+func (ss *ShareService) store(body []byte) (string, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	for {
+		id, err := newShareID()
+		if err != nil {
+			return "", err
+		}
+
+		if ss.Dir == "" {
+			if ss.results == nil {
+				ss.results = make(map[string][]byte)
+			}
+			if _, ok := ss.results[id]; ok {
+				continue
+			}
+			ss.results[id] = body
+			return id, nil
+		}
+
+		// O_EXCL makes sure that we never overwrite a set of results whose
+		// ID we happen to make up again
+		f, err := os.OpenFile(filepath.Join(ss.Dir, id+".json"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		_, err = f.Write(body)
+		if err != nil {
+			f.Close()
+			return "", err
+		}
+		return id, f.Close()
+	}
+}
+
+// load returns the results kept under id
+func (ss *ShareService) load(id string) ([]byte, error) {
+	if !validShareID(id) {
+		return nil, os.ErrNotExist
+	}
+
+	if ss.Dir != "" {
+		return os.ReadFile(filepath.Join(ss.Dir, id+".json"))
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	body, ok := ss.results[id]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return body, nil
+}
+
+// page shows the results kept under id
+func (ss *ShareService) page(w http.ResponseWriter, r *http.Request, id string) {
+	body, err := ss.load(id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var results sparkyfish.Results
+	err = json.Unmarshal(body, &results)
+	if err != nil {
+		http.Error(w, "unable to read the results", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	sharePage.Execute(w, struct {
+		ID      string
+		JSONURL string
+		sparkyfish.Results
+	}{id, sparkyfish.SharePath + "/" + id, results})
+}
+
+func (ss *ShareService) logger() *slog.Logger {
+	if ss.Logger != nil {
+		return ss.Logger
+	}
+	return slog.Default()
+}
+
+// newShareID makes up a random ID for a set of results
+func newShareID() (string, error) {
+	b := make([]byte, shareIDLength)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = shareIDChars[int(b[i])%len(shareIDChars)]
+	}
+	return string(b), nil
+}
+
+// validShareID reports whether id could be one of ours, so that it's safe to
+// use in a file name
+func validShareID(id string) bool {
+	if len(id) != shareIDLength {
+		return false
+	}
+	for _, c := range id {
+		if !strings.ContainsRune(shareIDChars, c) {
+			return false
+		}
+	}
+	return true
+}
+
+var sharePage = template.Must(template.New("share").Funcs(template.FuncMap{
+	"time": func(t time.Time) string { return t.UTC().Format("2 Jan 2006 15:04 MST") },
+	"join": strings.Join,
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>sparkyfish results for {{.Server}}</title>
+<style>
+body { font-family: sans-serif; max-width: 640px; margin: 2em auto; padding: 0 1em; color: #222; }
+h1 { font-size: 1.3em; }
+table { border-collapse: collapse; margin: 1em 0; }
+th, td { text-align: left; padding: 0.3em 1.5em 0.3em 0; }
+th { font-weight: normal; color: #555; }
+.big { font-size: 1.6em; font-weight: bold; }
+footer { margin-top: 2em; font-size: 0.85em; color: #777; }
+</style>
+</head>
+<body>
+<h1>sparkyfish results for {{.Server}}</h1>
+<table>
+<tr><th>Download</th><td>{{if .Download.Skipped}}skipped{{else}}<span class="big">{{printf "%.1f" .Download.Avg}}</span> Mbit/s (max {{printf "%.1f" .Download.Max}}){{end}}</td></tr>
+<tr><th>Upload</th><td>{{if .Upload.Skipped}}skipped{{else}}<span class="big">{{printf "%.1f" .Upload.Avg}}</span> Mbit/s (max {{printf "%.1f" .Upload.Max}}){{end}}</td></tr>
+<tr><th>Latency</th><td><span class="big">{{printf "%.2f" .Ping.Avg}}</span> ms (min {{printf "%.2f" .Ping.Min}}, max {{printf "%.2f" .Ping.Max}})</td></tr>
+<tr><th>Jitter</th><td>{{printf "%.2f" .Ping.Jitter}} ms</td></tr>
+</table>
+<table>
+<tr><th>Server</th><td>{{.Server}}</td></tr>
+{{with .Status}}{{with .ServerLocation}}<tr><th>Server location</th><td>{{.}}</td></tr>
+{{end}}{{end}}<tr><th>Address family</th><td>{{.Family}}</td></tr>
+<tr><th>Tested</th><td>{{time .EndTime}}</td></tr>
+{{with .Tags}}<tr><th>Tags</th><td>{{join . ", "}}</td></tr>
+{{end}}{{with .Note}}<tr><th>Note</th><td>{{.}}</td></tr>
+{{end}}</table>
+<footer>Shared from sparkyfish.  <a href="{{.JSONURL}}">The full results</a> are also available as JSON.</footer>
+</body>
+</html>
+`))
@@ -0,0 +1,60 @@
+package sparkyfishd
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/freinold/sparkyfish"
+)
+
+func TestShareServiceDropsPersonalData(t *testing.T) {
+	results := sparkyfish.Results{
+		Server: "speedtest.example.com:7121",
+		Status: &sparkyfish.ServerStatus{
+			Version:        "1.0",
+			ClientAddress:  "203.0.113.7",
+			ClientLocation: &sparkyfish.GeoLocation{Country: "DE", City: "Berlin", ASN: 3320},
+		},
+		Environment: &sparkyfish.Environment{Hostname: "alices-laptop"},
+		Traceroute:  &sparkyfish.TracerouteResult{Method: "udp"},
+	}
+	body, err := json.Marshal(results)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, keep := range []bool{false, true} {
+		ss := &ShareService{KeepPersonalData: keep}
+		w := httptest.NewRecorder()
+		ss.ServeHTTP(w, httptest.NewRequest(http.MethodPost, sparkyfish.SharePath, bytes.NewReader(body)))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("sharing responded with %v: %v", w.Code, w.Body)
+		}
+		var shared sparkyfish.SharedResults
+		json.NewDecoder(w.Body).Decode(&shared)
+
+		stored, err := ss.load(shared.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got sparkyfish.Results
+		json.Unmarshal(stored, &got)
+
+		personal := got.Environment != nil || got.Traceroute != nil || got.Status.ClientAddress != "" || got.Status.ClientLocation.City != ""
+		if personal != keep {
+			t.Errorf("with KeepPersonalData %v, kept %+v, %+v, %+v", keep, got.Environment, got.Traceroute, *got.Status)
+		}
+		if got.Status.ClientLocation.Country != "DE" || got.Status.ClientLocation.ASN != 3320 || got.Status.Version != "1.0" {
+			t.Errorf("with KeepPersonalData %v, dropped too much: %+v", keep, *got.Status.ClientLocation)
+		}
+	}
+
+	// The results that it's given are left alone
+	results.WithoutPersonalData()
+	if results.Environment == nil || results.Status.ClientAddress == "" || results.Status.ClientLocation.City == "" {
+		t.Error("WithoutPersonalData changed the results that it was given")
+	}
+}
@@ -0,0 +1,137 @@
+package sparkyfishd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+// ErrServerClosed is returned by Serve and ServeListeners once Shutdown has
+// been called
+var ErrServerClosed = errors.New("sparkyfishd: server closed")
+
+// errShuttingDown is what we tell clients that try to start a test while
+// we're shutting down
+const errShuttingDown = "ERR:Server is shutting down, try again later\n"
+
+// connTracker keeps track of the listeners that we're accepting connections
+// on and the connections that we're serving, so that we can stop the one and
+// wait for the other when we shut down
+type connTracker struct {
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	draining  bool
+	idle      chan struct{} // closed once we're draining and conns is empty
+}
+
+// addListener starts tracking listener.  If we're already draining, it's
+// closed instead, and addListener returns false.
+func (ct *connTracker) addListener(listener net.Listener) bool {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	if ct.draining {
+		listener.Close()
+		return false
+	}
+	if ct.listeners == nil {
+		ct.listeners = make(map[net.Listener]struct{})
+	}
+	ct.listeners[listener] = struct{}{}
+	return true
+}
+
+func (ct *connTracker) removeListener(listener net.Listener) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	delete(ct.listeners, listener)
+}
+
+func (ct *connTracker) add(conn net.Conn) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	if ct.conns == nil {
+		ct.conns = make(map[net.Conn]struct{})
+	}
+	ct.conns[conn] = struct{}{}
+}
+
+func (ct *connTracker) remove(conn net.Conn) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	delete(ct.conns, conn)
+	if ct.draining && len(ct.conns) == 0 {
+		ct.closeIdle()
+	}
+}
+
+// isDraining reports whether we're shutting down
+func (ct *connTracker) isDraining() bool {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return ct.draining
+}
+
+// counts returns the number of listeners and connections that we're
+// tracking, and whether we're draining
+func (ct *connTracker) counts() (listeners, conns int, draining bool) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return len(ct.listeners), len(ct.conns), ct.draining
+}
+
+// drain closes our listeners and waits for our connections to finish, or
+// for ctx to be done, at which point it closes the ones that are left and
+// returns ctx's error
+func (ct *connTracker) drain(ctx context.Context) error {
+	ct.mu.Lock()
+	if !ct.draining {
+		ct.draining = true
+		ct.idle = make(chan struct{})
+		for listener := range ct.listeners {
+			listener.Close()
+		}
+		if len(ct.conns) == 0 {
+			ct.closeIdle()
+		}
+	}
+	idle := ct.idle
+	ct.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+	}
+
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	for conn := range ct.conns {
+		conn.Close()
+	}
+	return ctx.Err()
+}
+
+// closeIdle closes idle, if it isn't already.  ct.mu must be held.
+func (ct *connTracker) closeIdle() {
+	select {
+	case <-ct.idle:
+	default:
+		close(ct.idle)
+	}
+}
+
+// Shutdown stops us accepting connections, and waits for the tests that are
+// running to finish.  Clients that try to start a test in the meantime are
+// told that we're shutting down.  If ctx is done first, the connections that
+// are left are closed, and Shutdown returns ctx's error.  Serve returns
+// ErrServerClosed straight away; UDP, WebSocket, web UI and API serving
+// carry on until the context that they were given is cancelled, so that the
+// tests that are running can finish.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.tracker.drain(ctx)
+}
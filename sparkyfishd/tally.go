@@ -0,0 +1,124 @@
+package sparkyfishd
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/freinold/sparkyfish"
+)
+
+const (
+	// tallyExpiry is how long we keep the tally of a finished download test
+	// for the client to collect
+	tallyExpiry = time.Minute
+
+	// tallyWait is how long a TALLY waits for a download test that's still
+	// winding down
+	tallyWait = 5 * time.Second
+)
+
+// tally counts the bytes that we sent during a download test, for the client
+// to compare with what it received
+type tally struct {
+	id     uint64
+	sent   int64
+	capped *sparkyfish.ServerLimit // the limit that we cut the test short at
+	done   chan struct{}           // closed once sent and capped are final
+}
+
+// tallies maps tally IDs to the download tests that they count
+type tallies struct {
+	mu sync.Mutex
+	m  map[uint64]*tally
+}
+
+func (ts *tallies) add() *tally {
+	var b [8]byte
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.m == nil {
+		ts.m = make(map[uint64]*tally)
+	}
+
+	for {
+		rand.Read(b[:])
+		id := binary.BigEndian.Uint64(b[:])
+		if _, ok := ts.m[id]; !ok {
+			t := &tally{id: id, done: make(chan struct{})}
+			ts.m[id] = t
+			return t
+		}
+	}
+}
+
+// finish records the final count of t, and the limit that the test was cut
+// short at, if it was.  They're kept until tallyExpiry.
+func (ts *tallies) finish(t *tally, sent int64, capped *sparkyfish.ServerLimit) {
+	t.sent = sent
+	t.capped = capped
+	close(t.done)
+
+	time.AfterFunc(tallyExpiry, func() {
+		ts.mu.Lock()
+		defer ts.mu.Unlock()
+		delete(ts.m, t.id)
+	})
+}
+
+func (ts *tallies) get(id uint64) *tally {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.m[id]
+}
+
+// answerTally handles a TALLY command, which asks for the total number of
+// bytes that we sent during the download tests with the given IDs.  Clients
+// that run a test over several connections ask for all of them at once.  If
+// we cut any of the tests short, we say so.
+func (sc *sparkyClient) answerTally(ids []string) {
+	if len(ids) == 0 {
+		sc.client.Write([]byte("ERR:TALLY requires an ID\n"))
+		return
+	}
+
+	var total int64
+	var capped *sparkyfish.ServerLimit
+	deadline := time.After(tallyWait)
+	for _, arg := range ids {
+		id, err := strconv.ParseUint(arg, 16, 64)
+		var t *tally
+		if err == nil {
+			t = sc.server.tallies.get(id)
+		}
+		if t == nil {
+			sc.client.Write([]byte("ERR:Unknown tally ID\n"))
+			return
+		}
+
+		select {
+		case <-t.done:
+		case <-deadline:
+			sc.client.Write([]byte("ERR:Download test still running\n"))
+			return
+		}
+		total += t.sent
+		if t.capped != nil {
+			capped = t.capped
+		}
+	}
+
+	reply := fmt.Sprintf("SENT %v", total)
+	if capped != nil {
+		reply += fmt.Sprintf(" CAPPED %v %v", capped.Kind, capped.Value)
+	}
+	_, err := fmt.Fprintln(sc.client, reply)
+	if err != nil {
+		sc.log.Warn("error writing TALLY response to client", "err", err)
+	}
+}
@@ -0,0 +1,145 @@
+package sparkyfishd
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// testsBucket holds one TestRecord per test, keyed by the time the test
+// started and then by a sequence number, so that they sort chronologically
+var testsBucket = []byte("tests")
+
+// TestRecord describes a test that we ran for a client
+type TestRecord struct {
+	Time    time.Time `json:"time"`
+	Client  string    `json:"client"`
+	Test    string    `json:"test"` // ping, download, upload, udp-download or udp-upload
+	Bytes   int64     `json:"bytes,omitempty"`
+	Seconds float64   `json:"seconds"`
+	Mbps    float64   `json:"mbps,omitempty"`
+}
+
+// TestLog is a database of the tests that we've run, for working out how our
+// server's being used.  Like sparkyfish-cli's history, it's a bbolt database
+// that's only held open while it's being used, so a running server and a
+// report can share it.  It isn't SQLite because that would take cgo, or a
+// very large pure Go port, for a log that's only ever appended to and read
+// in order.
+type TestLog struct {
+	path string
+	mu   sync.Mutex // keeps our own tests from queueing on the file lock
+}
+
+// NewTestLog returns a TestLog that keeps its database at path.  The
+// database is created when the first test is recorded.
+func NewTestLog(path string) *TestLog {
+	return &TestLog{path: path}
+}
+
+func (tl *TestLog) open(readOnly bool) (*bolt.DB, error) {
+	return bolt.Open(tl.path, 0644, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: readOnly})
+}
+
+// Record adds r to the log
+func (tl *TestLog) Record(r TestRecord) error {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	db, err := tl.open(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	value, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(testsBucket)
+		if err != nil {
+			return err
+		}
+
+		// Tests can start at the same moment, so the sequence number keeps
+		// their keys apart
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 16)
+		binary.BigEndian.PutUint64(key, uint64(r.Time.UnixNano()))
+		binary.BigEndian.PutUint64(key[8:], seq)
+
+		return b.Put(key, value)
+	})
+}
+
+// Records calls fn with each of the tests that started at or after since,
+// oldest first.  There are none if nothing's been recorded yet.
+func (tl *TestLog) Records(since time.Time, fn func(TestRecord)) error {
+	if _, err := os.Stat(tl.path); os.IsNotExist(err) {
+		return nil
+	}
+
+	db, err := tl.open(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(testsBucket)
+		if b == nil {
+			return nil
+		}
+
+		start := make([]byte, 8)
+		if !since.IsZero() {
+			binary.BigEndian.PutUint64(start, uint64(since.UnixNano()))
+		}
+
+		c := b.Cursor()
+		for k, v := c.Seek(start); k != nil; k, v = c.Next() {
+			var r TestRecord
+			err := json.Unmarshal(v, &r)
+			if err != nil {
+				return err
+			}
+			fn(r)
+		}
+		return nil
+	})
+}
+
+// recordTest adds the test that the client just finished, having moved n
+// bytes since start, to our TestLog, if we have one
+func (sc *sparkyClient) recordTest(n int64, start time.Time) {
+	tl := sc.server.TestLog
+	if tl == nil {
+		return
+	}
+
+	seconds := time.Since(start).Seconds()
+	r := TestRecord{
+		Time:    start,
+		Client:  remoteIP(sc.client),
+		Test:    sc.testType.String(),
+		Bytes:   n,
+		Seconds: round2(seconds),
+	}
+	if n > 0 {
+		r.Mbps = round2(float64(n) / 1024 / 1024 * 8 / seconds)
+	}
+
+	err := tl.Record(r)
+	if err != nil {
+		sc.log.Error("error recording test", "err", err)
+	}
+}
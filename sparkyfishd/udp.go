@@ -0,0 +1,259 @@
+package sparkyfishd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/freinold/sparkyfish"
+)
+
+const (
+	maxUDPRate     uint64 = 10000 // highest rate (Mbit/s) that a client may request in a USND test
+	udpPeerTimeout        = 5 * time.Second
+	udpGracePeriod        = 500 * time.Millisecond // time allowed for stragglers to arrive after a URCV test
+	mtuTestTimeout        = 60 * time.Second       // time that a client may spend probing its path MTU
+)
+
+// udpPeer is the address (and the socket it arrived on) that a client sends
+// its hello datagram from
+type udpPeer struct {
+	conn net.PacketConn
+	addr net.Addr
+}
+
+// udpSession tracks the datagrams received for a single USND, URCV or MTU
+// test
+type udpSession struct {
+	id       uint64
+	received uint64
+	bytes    uint64
+	peer     chan udpPeer
+	probes   bool // we answer MTU probes for this session
+}
+
+// udpSessions maps session IDs to in-progress UDP tests
+type udpSessions struct {
+	mu sync.Mutex
+	m  map[uint64]*udpSession
+}
+
+// add starts a session, which answers MTU probes if probes is set
+func (us *udpSessions) add(probes bool) *udpSession {
+	var b [8]byte
+
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	if us.m == nil {
+		us.m = make(map[uint64]*udpSession)
+	}
+
+	for {
+		rand.Read(b[:])
+		id := binary.BigEndian.Uint64(b[:])
+		if _, ok := us.m[id]; !ok {
+			sess := &udpSession{id: id, peer: make(chan udpPeer, 1), probes: probes}
+			us.m[id] = sess
+			return sess
+		}
+	}
+}
+
+func (us *udpSessions) get(id uint64) *udpSession {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	return us.m[id]
+}
+
+func (us *udpSessions) remove(id uint64) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	delete(us.m, id)
+}
+
+// servePacket reads datagrams from pc until ctx is cancelled, crediting each
+// one to its UDP session
+func (s *Server) servePacket(ctx context.Context, pc net.PacketConn) {
+	buf := make([]byte, 65536)
+
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			s.logger().Warn("error reading datagram", "err", err)
+			continue
+		}
+
+		if n < sparkyfish.DatagramHeaderLen {
+			continue
+		}
+
+		sess := s.udp.get(binary.BigEndian.Uint64(buf[1:9]))
+		if sess == nil {
+			continue
+		}
+
+		switch buf[0] {
+		case sparkyfish.DatagramHello:
+			// Remember where the client is so that we can send to it.  Only
+			// the first hello counts.
+			select {
+			case sess.peer <- udpPeer{conn: pc, addr: addr}:
+			default:
+			}
+		case sparkyfish.DatagramData:
+			atomic.AddUint64(&sess.received, 1)
+			atomic.AddUint64(&sess.bytes, uint64(n))
+		case sparkyfish.DatagramProbe:
+			if !sess.probes {
+				continue
+			}
+			atomic.AddUint64(&sess.received, 1)
+
+			// Answer with the probe's header and size, which is all
+			// that the client needs to know that it got here
+			ack := make([]byte, sparkyfish.MTUProbeAckLen)
+			copy(ack, buf[:sparkyfish.DatagramHeaderLen])
+			ack[0] = sparkyfish.DatagramProbeAck
+			binary.BigEndian.PutUint32(ack[sparkyfish.DatagramHeaderLen:], uint32(n))
+			_, err = pc.WriteTo(ack, addr)
+			if err != nil {
+				s.logger().Warn("error answering MTU probe", "err", err)
+			}
+		}
+	}
+}
+
+// udpSendTest streams sequence-numbered datagrams to the client at the rate it
+// asked for, then reports how many we sent over the control connection
+func (sc *sparkyClient) udpSendTest(rate uint64) {
+	var sent, sentBytes uint64
+	var peer udpPeer
+
+	sess := sc.server.udp.add(false)
+	defer sc.server.udp.remove(sess.id)
+
+	_, err := fmt.Fprintf(sc.client, "%016x\n", sess.id)
+	if err != nil {
+		return
+	}
+
+	// Wait for the client's hello datagram so we know where to send
+	select {
+	case peer = <-sess.peer:
+	case <-time.After(udpPeerTimeout):
+		sc.client.Write([]byte("ERR:No UDP hello received\n"))
+		return
+	}
+
+	datagram := make([]byte, sparkyfish.DatagramSize)
+	datagram[0] = sparkyfish.DatagramData
+	binary.BigEndian.PutUint64(datagram[1:9], sess.id)
+
+	// Each datagram carries fresh data, so that none of them can be
+	// compressed
+	payload := sparkyfish.NewPayload(false)
+
+	// Datagrams per second needed to hit the requested rate
+	perSecond := float64(rate) * 1000 * 1000 / 8 / float64(sparkyfish.DatagramSize)
+
+	start := time.Now()
+	length := time.Second * time.Duration(testLength)
+
+	for {
+		elapsed := time.Since(start)
+		if elapsed >= length {
+			break
+		}
+
+		// Send as many datagrams as we need to catch up with our rate, then
+		// take a short nap
+		for due := uint64(elapsed.Seconds() * perSecond); sent < due; sent++ {
+			binary.BigEndian.PutUint64(datagram[9:17], sent)
+			payload.Read(datagram[sparkyfish.DatagramHeaderLen:])
+			_, err = peer.conn.WriteTo(datagram, peer.addr)
+			if err != nil {
+				sc.log.Warn("error sending datagram", "err", err)
+				return
+			}
+			sentBytes = sentBytes + uint64(len(datagram))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	sc.log.Info("test finished", "datagrams", sent, "bytes", sentBytes, "seconds", testLength)
+	sc.recordTest(int64(sentBytes), start)
+
+	sc.refreshDeadlines()
+	fmt.Fprintf(sc.client, "%v %v\n", sent, sentBytes)
+}
+
+// udpReceiveTest counts the datagrams that the client sends us until it says
+// it's finished, then reports how many we received over the control connection
+func (sc *sparkyClient) udpReceiveTest() {
+	start := time.Now()
+	sess := sc.server.udp.add(false)
+	defer sc.server.udp.remove(sess.id)
+
+	_, err := fmt.Fprintf(sc.client, "%016x\n", sess.id)
+	if err != nil {
+		return
+	}
+
+	// The client tells us that it's done sending with a FIN.  If it never
+	// does, we give up a little after the test should have ended.
+	sc.client.SetReadDeadline(time.Now().Add(time.Second * time.Duration(testLength+2)))
+	cmd, err := sc.reader.ReadString('\n')
+	if err != nil || strings.TrimSpace(cmd) != "FIN" {
+		return
+	}
+
+	// Give any datagrams that are still in flight a chance to arrive
+	time.Sleep(udpGracePeriod)
+
+	received := atomic.LoadUint64(&sess.received)
+	receivedBytes := atomic.LoadUint64(&sess.bytes)
+
+	sc.log.Info("test finished", "datagrams", received, "bytes", receivedBytes)
+	sc.recordTest(int64(receivedBytes), start)
+
+	fmt.Fprintf(sc.client, "%v %v\n", received, receivedBytes)
+}
+
+// mtuTest answers the client's MTU probes until it says that it's finished
+func (sc *sparkyClient) mtuTest() {
+	start := time.Now()
+	sess := sc.server.udp.add(true)
+	defer sc.server.udp.remove(sess.id)
+
+	_, err := fmt.Fprintf(sc.client, "%016x\n", sess.id)
+	if err != nil {
+		return
+	}
+
+	// The client tells us that it's done probing with a FIN, or hangs up
+	sc.client.SetReadDeadline(time.Now().Add(mtuTestTimeout))
+	sc.reader.ReadString('\n')
+
+	sc.log.Info("test finished", "probes", atomic.LoadUint64(&sess.received))
+	sc.recordTest(0, start)
+}
+
+// parseUDPRate parses the rate argument to USND
+func parseUDPRate(arg string) (uint64, error) {
+	rate, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil || rate == 0 || rate > maxUDPRate {
+		return 0, fmt.Errorf("rate must be between 1 and %v Mbit/s", maxUDPRate)
+	}
+	return rate, nil
+}
@@ -0,0 +1,70 @@
+package sparkyfishd
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"golang.org/x/net/websocket"
+)
+
+// wsConn is a test connection that came in over WebSocket.  The websocket
+// package reports the client's Origin as the remote address, so we keep track
+// of the client's real address ourselves.
+type wsConn struct {
+	*websocket.Conn
+	remoteAddr net.Addr
+}
+
+func (c wsConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// verifiedCert reports whether the client of a connection with TLS state
+// presented a certificate that we verified
+func verifiedCert(state *tls.ConnectionState) bool {
+	return state != nil && len(state.VerifiedChains) > 0
+}
+
+// WebSocketHandler returns an http.Handler that answers speed tests over
+// WebSocket, with the test protocol carried in binary frames.  It can be
+// mounted on an existing HTTP server; ListenAndServe mounts it at
+// sparkyfish.WebSocketPath on WebSocketAddr.
+func (s *Server) WebSocketHandler() http.Handler {
+	return websocket.Server{
+		// Browser front ends may well be served from another origin, and
+		// we're happy to test anyone that we'd answer over plain TCP
+		Handshake: func(*websocket.Config, *http.Request) error {
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			ws.PayloadType = websocket.BinaryFrame
+			addr, _ := net.ResolveTCPAddr("tcp", ws.Request().RemoteAddr)
+			s.serveConn(ws.Request().Context(), wsConn{Conn: ws, remoteAddr: addr})
+		},
+	}
+}
+
+// serveHTTP serves handler on listener until ctx is cancelled, over HTTPS if
+// tlsConfig is set.  what describes what we're serving, for our logs.
+func (s *Server) serveHTTP(ctx context.Context, what string, listener net.Listener, handler http.Handler, tlsConfig *tls.Config) {
+	// Clients that never finish their request are dropped like any other
+	// quiet client
+	hs := &http.Server{Handler: handler, ReadHeaderTimeout: s.idleTimeout(), TLSConfig: tlsConfig}
+
+	go func() {
+		<-ctx.Done()
+		hs.Close()
+	}()
+
+	var err error
+	if tlsConfig != nil {
+		err = hs.ServeTLS(listener, "", "")
+	} else {
+		err = hs.Serve(listener)
+	}
+	if err != nil && ctx.Err() == nil {
+		s.logger().Error("error serving "+what, "addr", listener.Addr().String(), "err", err)
+	}
+}
@@ -0,0 +1,311 @@
+package sparkyfishd
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/freinold/sparkyfish"
+)
+
+// WebHandler returns an http.Handler that serves the web UI at / along with
+// the WebSocket endpoint that it runs its tests over, at
+// sparkyfish.WebSocketPath
+func (s *Server) WebHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(sparkyfish.WebSocketPath, s.WebSocketHandler())
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, webUI)
+	})
+	return mux
+}
+
+// webUI is the web UI's page.  It speaks the same protocol as sparkyfish-cli,
+// over WebSocket, and charts the throughput tests as they run.
+const webUI = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>sparkyfish</title>
+<style>
+body { font-family: sans-serif; background: #111; color: #eee; max-width: 44em; margin: 2em auto; padding: 0 1em; }
+h1 { font-size: 1.4em; }
+#banner { color: #e55; font-weight: bold; min-height: 1.2em; }
+button { font-size: 1.2em; padding: 0.4em 1.6em; }
+input { font-size: 1em; }
+.box { border: 1px solid #555; padding: 0.6em; margin: 0.8em 0; }
+.box h2 { font-size: 1em; margin: 0 0 0.4em; color: #5c5; }
+canvas { width: 100%; height: 8em; background: #000; }
+#status { min-height: 1.2em; }
+.error { color: #e55; }
+</style>
+</head>
+<body>
+<h1>sparkyfish</h1>
+<div id="banner"></div>
+<p>
+<button id="start">Start test</button>
+<span id="tokenbox" hidden>Token: <input id="token" type="password"></span>
+</p>
+<div id="status"></div>
+<div class="box"><h2>Latency</h2><div id="ping">--</div></div>
+<div class="box"><h2>Download (Mbit/s)</h2><canvas id="dlgraph"></canvas><div id="dl">--</div></div>
+<div class="box"><h2>Upload (Mbit/s)</h2><canvas id="ulgraph"></canvas><div id="ul">--</div></div>
+<script>
+"use strict";
+
+var pings = 20;
+var testSeconds = 10;
+var reportInterval = 500;
+var encoder = new TextEncoder();
+var decoder = new TextDecoder();
+
+function $(id) { return document.getElementById(id); }
+
+// connect opens a session with the server and signs on with HELO, resolving to
+// the session once it's ready for a test command
+function connect() {
+	return new Promise(function(resolve, reject) {
+		var scheme = location.protocol === "https:" ? "wss://" : "ws://";
+		var s = { ws: new WebSocket(scheme + location.host + "/ws"), buf: "", waiter: null, onData: null, closed: false };
+		s.ws.binaryType = "arraybuffer";
+		s.ws.onopen = function() { resolve(s); };
+		s.ws.onerror = function() { reject(new Error("unable to connect to the server")); };
+		s.ws.onclose = function() {
+			s.closed = true;
+			if (s.waiter) { s.waiter.reject(new Error("the server hung up")); s.waiter = null; }
+			if (s.onClose) { s.onClose(); }
+		};
+		s.ws.onmessage = function(e) {
+			if (s.onData) { s.onData(e.data); return; }
+			s.buf += decoder.decode(new Uint8Array(e.data));
+			deliverLine(s);
+		};
+	}).then(function(s) {
+		send(s, "HELO1\n");
+		return readLine(s).then(function(line) {
+			if (line !== "HELO") { throw new Error("invalid HELO response from server"); }
+			return readLine(s);
+		}).then(function() {
+			return readLine(s);
+		}).then(function(loc) {
+			s.location = loc;
+			return readLine(s);
+		}).then(function(caps) {
+			var token = $("token").value;
+			if (caps.split(" ").indexOf("auth") >= 0) {
+				$("tokenbox").hidden = false;
+				if (token === "") { throw new Error("this server needs a token"); }
+			}
+			if (token === "") { return s; }
+			send(s, "AUTH " + token + "\n");
+			return readLine(s).then(function(ok) {
+				if (ok !== "OK") { throw new Error("invalid AUTH response from server"); }
+				return s;
+			});
+		});
+	});
+}
+
+function send(s, text) {
+	s.ws.send(encoder.encode(text));
+}
+
+// readLine resolves to the next line from the server.  ERR responses are
+// rejected with the server's message.
+function readLine(s) {
+	return new Promise(function(resolve, reject) {
+		if (s.closed) { reject(new Error("the server hung up")); return; }
+		s.waiter = { resolve: resolve, reject: reject };
+		deliverLine(s);
+	});
+}
+
+function deliverLine(s) {
+	var i = s.buf.indexOf("\n");
+	if (i < 0 || !s.waiter) { return; }
+	var line = s.buf.slice(0, i);
+	var w = s.waiter;
+	s.buf = s.buf.slice(i + 1);
+	s.waiter = null;
+	if (line.indexOf("ERR:") === 0) {
+		w.reject(new Error(line.slice(4)));
+	} else {
+		w.resolve(line);
+	}
+}
+
+// isError reports whether data, the first thing that the server sent us in a
+// download test, is an ERR response rather than test data
+function isError(s, data) {
+	if (data.byteLength > 256) { return false; }
+	var text = decoder.decode(new Uint8Array(data));
+	if (text.indexOf("ERR:") !== 0) { return false; }
+	s.err = new Error(text.slice(4).trim());
+	return true;
+}
+
+function pingTest() {
+	return connect().then(function(s) {
+		if (s.location !== "none") { $("banner").textContent = s.location; }
+		send(s, "ECO\n");
+		var rtts = [];
+		var probe = function(i) {
+			return new Promise(function(resolve, reject) {
+				var start = performance.now();
+				s.onData = function() { rtts.push(performance.now() - start); resolve(); };
+				s.onClose = function() { reject(new Error("the server hung up")); };
+				send(s, String.fromCharCode(33 + i));
+			}).then(function() {
+				showPing(rtts);
+				if (i + 1 < pings) { return probe(i + 1); }
+			});
+		};
+		return probe(0).then(function() {
+			s.onClose = null;
+			s.ws.close();
+		});
+	});
+}
+
+function showPing(rtts) {
+	var min = Math.min.apply(null, rtts), max = Math.max.apply(null, rtts);
+	var sum = 0, jitter = 0;
+	rtts.forEach(function(rtt, i) {
+		sum += rtt;
+		if (i > 0) { jitter += Math.abs(rtt - rtts[i - 1]); }
+	});
+	var text = "Min/Avg/Max: " + min.toFixed(2) + "/" + (sum / rtts.length).toFixed(2) + "/" + max.toFixed(2) + " ms";
+	if (rtts.length > 1) { text += "  Jitter: " + (jitter / (rtts.length - 1)).toFixed(2) + " ms"; }
+	$("ping").textContent = text;
+}
+
+// throughputTest runs a download or upload test, calling onSample with the
+// throughput at every report interval.  count reports how many bytes have
+// gone through so far.
+function throughputTest(command, start, count, onSample) {
+	return connect().then(function(s) {
+		return new Promise(function(resolve, reject) {
+			// Timers run late in busy or background tabs, so we divide by
+			// the time that actually went by
+			var prev = 0, last = performance.now();
+			var tick = setInterval(function() {
+				var n = count(s), now = performance.now();
+				onSample((n - prev) * 8 / 1024 / (now - last));
+				prev = n;
+				last = now;
+			}, reportInterval);
+			var finish = function() {
+				clearInterval(tick);
+				clearTimeout(timer);
+				if (s.err) { reject(s.err); } else { resolve(); }
+			};
+			// The server ends the test, but we give up if it doesn't
+			var timer = setTimeout(function() { s.ws.close(); }, (testSeconds + 3) * 1000);
+			s.onClose = finish;
+			send(s, command + "\n");
+			start(s);
+		});
+	});
+}
+
+function downloadTest(onSample) {
+	return throughputTest("SND", function(s) {
+		s.received = 0;
+		s.onData = function(data) {
+			if (s.received === 0 && isError(s, data)) { return; }
+			s.received += data.byteLength;
+		};
+	}, function(s) {
+		return s.received;
+	}, onSample);
+}
+
+function uploadTest(onSample) {
+	var block = new Uint8Array(1024 * 1024);
+	for (var i = 0; i < block.length; i += 65536) {
+		crypto.getRandomValues(block.subarray(i, i + 65536));
+	}
+
+	return throughputTest("RCV", function(s) {
+		var ends = performance.now() + testSeconds * 1000;
+		s.queued = 0;
+		// Keep a few blocks buffered so that the connection never goes idle
+		var pump = function() {
+			if (s.closed) { return; }
+			if (performance.now() >= ends) { s.ws.close(); return; }
+			while (s.ws.bufferedAmount < 4 * block.length) {
+				s.ws.send(block);
+				s.queued += block.length;
+			}
+			setTimeout(pump, 5);
+		};
+		pump();
+	}, function(s) {
+		return s.queued - s.ws.bufferedAmount;
+	}, onSample);
+}
+
+// chart keeps the stats for a throughput test and draws its graph
+function chart(canvasID, statsID) {
+	var c = { samples: [], max: 0, sum: 0 };
+	c.add = function(mbps) {
+		c.samples.push(mbps);
+		c.sum += mbps;
+		c.max = Math.max(c.max, mbps);
+		$(statsID).textContent = "Current: " + mbps.toFixed(1) + "  Max: " + c.max.toFixed(1) + "  Avg: " + (c.sum / c.samples.length).toFixed(1);
+		draw(c, $(canvasID));
+	};
+	return c;
+}
+
+function draw(c, canvas) {
+	canvas.width = canvas.clientWidth;
+	canvas.height = canvas.clientHeight;
+	var g = canvas.getContext("2d");
+	var points = testSeconds * 1000 / reportInterval;
+	var scale = c.max > 0 ? (canvas.height - 4) / c.max : 0;
+	g.strokeStyle = "#5c5";
+	g.lineWidth = 2;
+	g.beginPath();
+	c.samples.forEach(function(mbps, i) {
+		var x = i * canvas.width / points;
+		var y = canvas.height - 2 - mbps * scale;
+		if (i === 0) { g.moveTo(x, y); } else { g.lineTo(x, y); }
+	});
+	g.stroke();
+}
+
+$("start").onclick = function() {
+	var dl = chart("dlgraph", "dl");
+	var ul = chart("ulgraph", "ul");
+	$("start").disabled = true;
+	$("status").className = "";
+	["ping", "dl", "ul"].forEach(function(id) { $(id).textContent = "--"; });
+	["dlgraph", "ulgraph"].forEach(function(id) { draw({ samples: [], max: 0 }, $(id)); });
+
+	$("status").textContent = "Testing latency...";
+	pingTest().then(function() {
+		$("status").textContent = "Testing download speed...";
+		return downloadTest(dl.add);
+	}).then(function() {
+		$("status").textContent = "Testing upload speed...";
+		return uploadTest(ul.add);
+	}).then(function() {
+		$("status").textContent = "Done";
+	}, function(err) {
+		$("status").className = "error";
+		$("status").textContent = "Test failed: " + err.message;
+	}).then(function() {
+		$("start").disabled = false;
+	});
+};
+</script>
+</body>
+</html>
+`
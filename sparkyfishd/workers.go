@@ -0,0 +1,120 @@
+package sparkyfishd
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultWorkers is the number of connections that we serve at once if
+	// Server.Workers isn't set
+	DefaultWorkers = 512
+
+	// DefaultIdleTimeout is how long we wait on a quiet client if
+	// Server.IdleTimeout isn't set
+	DefaultIdleTimeout = 30 * time.Second
+
+	// DefaultWriteTimeout is how long we wait on a slow client if
+	// Server.WriteTimeout isn't set
+	DefaultWriteTimeout = 30 * time.Second
+)
+
+// workerPool hands out the slots that connections are served in, so that
+// there are never more than a fixed number of them at once
+type workerPool struct {
+	once  sync.Once
+	slots chan struct{}
+}
+
+// pool returns the pool's slots, making room for size of them the first
+// time that it's called
+func (wp *workerPool) pool(size int) chan struct{} {
+	wp.once.Do(func() {
+		wp.slots = make(chan struct{}, size)
+	})
+	return wp.slots
+}
+
+// acquire waits for a free slot in a pool of size, returning false if ctx
+// is cancelled first
+func (wp *workerPool) acquire(ctx context.Context, size int) bool {
+	select {
+	case wp.pool(size) <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// full reports whether every slot in a pool of size is taken
+func (wp *workerPool) full(size int) bool {
+	slots := wp.pool(size)
+	return len(slots) == cap(slots)
+}
+
+func (wp *workerPool) release() {
+	<-wp.slots
+}
+
+func (s *Server) workerCount() int {
+	if s.Workers > 0 {
+		return s.Workers
+	}
+	return DefaultWorkers
+}
+
+func (s *Server) idleTimeout() time.Duration {
+	if s.IdleTimeout > 0 {
+		return s.IdleTimeout
+	}
+	return DefaultIdleTimeout
+}
+
+func (s *Server) writeTimeout() time.Duration {
+	if s.WriteTimeout > 0 {
+		return s.WriteTimeout
+	}
+	return DefaultWriteTimeout
+}
+
+// serveConn serves conn in a worker slot, waiting for one to come free if
+// they're all busy.  It returns once conn is done with, or straight away if
+// ctx is cancelled while it waits, in which case conn is closed unserved.
+func (s *Server) serveConn(ctx context.Context, conn net.Conn) {
+	if !s.workers.acquire(ctx, s.workerCount()) {
+		conn.Close()
+		return
+	}
+	defer s.workers.release()
+
+	s.handler(conn)
+}
+
+// refreshDeadlines gives the client another IdleTimeout to send us whatever
+// we're waiting for, and another WriteTimeout to take whatever we're sending
+// it.  We call it whenever the client makes progress, so that a client that
+// stops, or that can't keep up, is dropped rather than holding its worker
+// forever.
+func (sc *sparkyClient) refreshDeadlines() {
+	now := time.Now()
+	sc.client.SetReadDeadline(now.Add(sc.server.idleTimeout()))
+	sc.client.SetWriteDeadline(now.Add(sc.server.writeTimeout()))
+}
+
+// isTimeout reports whether err is a deadline passing
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// logEviction logs that we've dropped the client because it stopped sending
+// or stopped keeping up with what we send
+func (sc *sparkyClient) logEviction(err error) {
+	if sc.testType == outbound {
+		sc.log.Info("dropping a client that can't keep up", "err", err)
+	} else {
+		sc.log.Info("dropping a client that's gone quiet", "err", err)
+	}
+}
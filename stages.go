@@ -0,0 +1,82 @@
+package sparkyfish
+
+import (
+	"context"
+	"fmt"
+)
+
+// Stage is one of the steps of a Run, in the order that they happen.  Only
+// the ones that the Client's settings ask for are run.
+type Stage int
+
+const (
+	StageDNS           Stage = iota // timing lookups of the server's hostname (TimeDNS)
+	StageHello                      // connecting and signing on to the server
+	StageInfo                       // asking the server about itself
+	StageEnvironment                // recording our environment (CaptureEnvironment)
+	StageTraceroute                 // tracing the route to the server (TracePath)
+	StageMTU                        // finding the path MTU (ProbeMTU)
+	StagePing                       // the ping test
+	StageDownload                   // the download test
+	StageUpload                     // the upload test
+	StageBidirectional              // the download and upload tests at once
+)
+
+func (s Stage) String() string {
+	switch s {
+	case StageDNS:
+		return "DNS lookup"
+	case StageHello:
+		return "hello"
+	case StageInfo:
+		return "server info"
+	case StageEnvironment:
+		return "environment"
+	case StageTraceroute:
+		return "traceroute"
+	case StageMTU:
+		return "MTU probe"
+	case StagePing:
+		return "ping test"
+	case StageDownload:
+		return "download test"
+	case StageUpload:
+		return "upload test"
+	case StageBidirectional:
+		return "bidirectional test"
+	}
+	return fmt.Sprintf("Stage(%d)", int(s))
+}
+
+// Skippable reports whether a stage is one of the tests, which the caller of
+// Run may skip by cancelling the context that OnStage returns
+func (s Stage) Skippable() bool {
+	return s >= StagePing
+}
+
+// stage runs one stage of a Run, passing it the context that OnStage returns
+// for it, and then tells OnStageDone how it went.  A test whose context was
+// cancelled while ctx wasn't has been skipped, which isn't an error, and a
+// throughput test that was skipped is marked as such in r.
+func (c *Client) stage(ctx context.Context, stage Stage, r *Results, run func(context.Context) error) error {
+	sctx := ctx
+	if c.OnStage != nil {
+		sctx = c.OnStage(ctx, stage)
+	}
+
+	err := run(sctx)
+	if err != nil && stage.Skippable() && sctx.Err() != nil && ctx.Err() == nil {
+		err = nil
+		if stage == StageDownload || stage == StageBidirectional {
+			r.Download.Skipped = true
+		}
+		if stage == StageUpload || stage == StageBidirectional {
+			r.Upload.Skipped = true
+		}
+	}
+
+	if c.OnStageDone != nil {
+		c.OnStageDone(stage, *r, err)
+	}
+	return err
+}
@@ -0,0 +1,90 @@
+package sparkyfish
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/freinold/sparkyfish/internal/neterr"
+)
+
+// StopReason says why a throughput test stopped copying data before its time
+// was up
+type StopReason string
+
+const (
+	StopServerClosed StopReason = "server_closed" // the server hung up early
+	StopServerCap    StopReason = "server_cap"    // the server cut the test short at one of its limits, given by CappedBy
+	StopLocalCap     StopReason = "local_cap"     // we'd copied the client's MaxBytes
+	StopTimeout      StopReason = "timeout"       // the connection stalled
+	StopReset        StopReason = "reset"         // the connection was reset
+	StopError        StopReason = "error"         // the connection failed some other way
+)
+
+var stopDescriptions = map[StopReason]string{
+	StopServerClosed: "the server hung up",
+	StopServerCap:    "the server cut the test short",
+	StopLocalCap:     "the data cap was reached",
+	StopTimeout:      "the connection stalled",
+	StopReset:        "the connection was reset",
+	StopError:        "the connection failed",
+}
+
+func (r StopReason) String() string {
+	if d, ok := stopDescriptions[r]; ok {
+		return d
+	}
+	return string(r)
+}
+
+const (
+	// copyStallTimeout is how long past its end we let a throughput test's
+	// copy run before we give up on a connection that has stalled
+	copyStallTimeout = 10 * time.Second
+
+	// serverCloseSlack is how long before the end of a throughput test the
+	// server may hang up without it counting as early, since its clock
+	// starts before ours
+	serverCloseSlack = time.Second
+)
+
+// CopyError is returned by a throughput test whose connection failed
+// partway through, saying how
+type CopyError struct {
+	Reason StopReason // StopServerClosed, StopTimeout, StopReset or StopError
+	Err    error
+}
+
+func (e *CopyError) Error() string {
+	return e.Reason.String() + ": " + e.Err.Error()
+}
+
+func (e *CopyError) Unwrap() error {
+	return e.Err
+}
+
+// newCopyError sorts err, which broke off a throughput test's copy, by its
+// cause
+func newCopyError(err error) *CopyError {
+	reason := StopError
+	var ne net.Error
+	switch {
+	case errors.As(err, &ne) && ne.Timeout():
+		reason = StopTimeout
+	case neterr.IsConnReset(err):
+		reason = StopReset
+	case neterr.IsBrokenPipe(err):
+		reason = StopServerClosed
+	}
+	return &CopyError{Reason: reason, Err: err}
+}
+
+// stopReason returns the reason that a throughput test's copy stopped, from
+// err, the error that it ended with
+func stopReason(err error) StopReason {
+	var ce *CopyError
+	if errors.As(err, &ce) {
+		return ce.Reason
+	}
+	return ""
+}
@@ -0,0 +1,142 @@
+package sparkyfish
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ByteAccounting compares the data that the sending and receiving ends of a
+// throughput test each counted.  Data that was sent but not received was
+// still in flight when the test ended, or was held up or dropped along the
+// way, e.g. by a proxy or some other middlebox that buffers.
+type ByteAccounting struct {
+	Sent     int64 `json:"sent_bytes"`
+	Received int64 `json:"received_bytes"`
+
+	// InFlight is set if we ended the test ourselves, at the client's
+	// MaxBytes, while the data was still flowing.  The data that went
+	// unaccounted for was then still on its way: in socket buffers that we
+	// stopped reading, or past the server's last progress report.  It says
+	// nothing about the path.  Tests that run their course end with the
+	// server, which counts all that it sent or received, so what goes
+	// unaccounted for in them was held up along the way.
+	InFlight bool `json:"in_flight,omitempty"`
+}
+
+// Unaccounted returns the data that was sent but wasn't received
+func (ba ByteAccounting) Unaccounted() int64 {
+	return ba.Sent - ba.Received
+}
+
+// beginDownload starts a download test on s.  Servers that support it are
+// asked to keep a tally of what they send, whose ID they give us before the
+// data starts, and which is kept in s.tally.  If c.Compressible is set, the
+// server is asked for compressible data.
+func (c *Client) beginDownload(s *session) error {
+	cmd := "SND"
+	if c.Compressible {
+		if s.info.Version == 0 || !s.info.Supports(CapCompressible) {
+			return fmt.Errorf("server can't send compressible data")
+		}
+		cmd += " COMPRESSIBLE"
+	}
+
+	if s.info.Version == 0 || !s.info.Supports(CapTally) {
+		return s.writeCommand(cmd)
+	}
+
+	err := s.writeCommand(cmd + " TALLY")
+	if err != nil {
+		return err
+	}
+
+	id, err := s.readLine()
+	if err != nil {
+		return err
+	}
+	if _, err := strconv.ParseUint(id, 16, 64); err != nil {
+		return fmt.Errorf("invalid tally ID from server: %v", id)
+	}
+	s.tally = id
+
+	return nil
+}
+
+// accounting compares what we and the server counted of a finished test over
+// sessions.  For downloads, we ask the server for its tally; for uploads, we
+// have its progress reports.  It returns nil if the server didn't keep count
+// on every session, or we couldn't get its tally.  The tally also tells us if
+// the server cut any of the downloads short at one of its limits, which is
+// returned as well.
+func (c *Client) accounting(ctx context.Context, sessions []*session) (*ByteAccounting, *ServerLimit) {
+	var ba ByteAccounting
+	var ids []string
+	for _, s := range sessions {
+		if s.endedCopy {
+			ba.InFlight = true
+		}
+		switch {
+		case s.tally != "":
+			ids = append(ids, s.tally)
+			ba.Received += s.copied
+		case s.progress:
+			ba.Sent += s.copied
+			ba.Received += s.received
+		default:
+			return nil, nil
+		}
+	}
+
+	var capped *ServerLimit
+	if len(ids) > 0 {
+		var err error
+		ba.Sent, capped, err = c.fetchTally(ctx, ids)
+		if err != nil {
+			return nil, nil
+		}
+	}
+
+	return &ba, capped
+}
+
+// fetchTally asks the server for the total that it sent during the download
+// tests with the given tally IDs, and the limit that it cut them short at, if
+// it did
+func (c *Client) fetchTally(ctx context.Context, ids []string) (int64, *ServerLimit, error) {
+	s, err := c.beginSession(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer s.close()
+
+	err = s.writeCommand("TALLY " + strings.Join(ids, " "))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	line, err := s.readLine()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// SENT <bytes>, followed by a CAPPED notice if the server cut any of
+	// the tests short
+	fields := strings.Fields(line)
+	if len(fields) >= 2 && fields[0] == "SENT" {
+		sent, err := strconv.ParseInt(fields[1], 10, 64)
+		if err == nil && sent >= 0 {
+			if len(fields) == 2 {
+				return sent, nil, nil
+			}
+			if fields[2] == "CAPPED" {
+				capped, err := parseCapped(fields[3:])
+				if err == nil {
+					return sent, capped, nil
+				}
+			}
+		}
+	}
+	return 0, nil, fmt.Errorf("invalid TALLY response from server")
+}
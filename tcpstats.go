@@ -0,0 +1,56 @@
+package sparkyfish
+
+// TCPStats holds the kernel's statistics for a throughput test's connection,
+// read just before it's closed.  They describe our end of the connection, so
+// the congestion figures are most telling for uploads, where we're the
+// sender.  For tests that run over several streams, Retransmits, Cwnd and
+// DeliveryRate are totals across the connections, and RTT and RTTVar are
+// averages.
+type TCPStats struct {
+	// Retransmits is the number of segments retransmitted over the test
+	Retransmits uint32 `json:"retransmits"`
+
+	// RTT and RTTVar are the kernel's smoothed round-trip time and its
+	// variance
+	RTT    float64 `json:"rtt_ms"`
+	RTTVar float64 `json:"rtt_var_ms"`
+
+	// Cwnd is the congestion window, in segments
+	Cwnd uint32 `json:"cwnd"`
+
+	// DeliveryRate is the kernel's most recent estimate of the rate at which
+	// data was delivered to the peer, in Mbit/s.  It's zero on kernels that
+	// are too old to measure it.
+	DeliveryRate float64 `json:"delivery_rate_mbps"`
+
+	// Congestion is the congestion control algorithm that the connection
+	// used
+	Congestion string `json:"congestion,omitempty"`
+}
+
+// combineTCPStats adds up the stats of a test's streams.  Streams whose
+// stats couldn't be read are left out.  It returns nil if there are none.
+func combineTCPStats(stats []*TCPStats) *TCPStats {
+	var total *TCPStats
+	var n float64
+	for _, ts := range stats {
+		if ts == nil {
+			continue
+		}
+		if total == nil {
+			total = &TCPStats{Congestion: ts.Congestion}
+		}
+		total.Retransmits += ts.Retransmits
+		total.Cwnd += ts.Cwnd
+		total.DeliveryRate += ts.DeliveryRate
+		total.RTT += ts.RTT
+		total.RTTVar += ts.RTTVar
+		n++
+	}
+
+	if total != nil {
+		total.RTT /= n
+		total.RTTVar /= n
+	}
+	return total
+}
@@ -0,0 +1,81 @@
+//go:build linux && !386
+// +build linux,!386
+
+package sparkyfish
+
+import (
+	"net"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// tcpCANameMax is the longest name that a congestion control algorithm can have
+const tcpCANameMax = 16
+
+// tcpInfo mirrors the start of the kernel's struct tcp_info, up to
+// tcpi_delivery_rate.  The syscall package's version stops well short of it.
+type tcpInfo struct {
+	state, caState, retransmits, probes, backoff, options, wscale, flags uint8
+
+	rto, ato, sndMSS, rcvMSS                             uint32
+	unacked, sacked, lost, retrans, fackets              uint32
+	lastDataSent, lastAckSent, lastDataRecv, lastAckRecv uint32
+	pmtu, rcvSsthresh, rtt, rttvar                       uint32
+	sndSsthresh, sndCwnd, advMSS, reordering             uint32
+	rcvRTT, rcvSpace, totalRetrans                       uint32
+
+	pacingRate, maxPacingRate, bytesAcked, bytesReceived uint64
+	segsOut, segsIn, notsentBytes, minRTT                uint32
+	dataSegsIn, dataSegsOut                              uint32
+	deliveryRate                                         uint64
+}
+
+// readTCPStats reads TCP_INFO from conn.  It returns nil if conn isn't a TCP
+// connection or the kernel won't tell us.
+func readTCPStats(conn net.Conn) *TCPStats {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+
+	var info tcpInfo
+	size := uint32(unsafe.Sizeof(info))
+	var congestion [tcpCANameMax]byte
+	congestionSize := uint32(len(congestion))
+	var errno syscall.Errno
+	err = rc.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			return
+		}
+		_, _, cerrno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_CONGESTION,
+			uintptr(unsafe.Pointer(&congestion[0])), uintptr(unsafe.Pointer(&congestionSize)), 0)
+		if cerrno != 0 {
+			congestionSize = 0
+		}
+	})
+	if err != nil || errno != 0 {
+		return nil
+	}
+
+	ts := &TCPStats{
+		Retransmits: info.totalRetrans,
+		RTT:         float64(info.rtt) / 1000,
+		RTTVar:      float64(info.rttvar) / 1000,
+		Cwnd:        info.sndCwnd,
+		Congestion:  strings.TrimRight(string(congestion[:congestionSize]), "\x00"),
+	}
+
+	// Older kernels hand back a shorter struct without the delivery rate
+	if uintptr(size) >= unsafe.Offsetof(info.deliveryRate)+unsafe.Sizeof(info.deliveryRate) {
+		ts.DeliveryRate = float64(info.deliveryRate*8) / 1024 / 1000
+	}
+
+	return ts
+}
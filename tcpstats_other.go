@@ -0,0 +1,12 @@
+//go:build !linux || (linux && 386)
+// +build !linux linux,386
+
+package sparkyfish
+
+import "net"
+
+// readTCPStats always returns nil, as we only know how to read TCP_INFO on
+// Linux
+func readTCPStats(conn net.Conn) *TCPStats {
+	return nil
+}
@@ -0,0 +1,697 @@
+package sparkyfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/freinold/sparkyfish/internal/neterr"
+)
+
+// ThroughputResult holds throughput measurements, in Mbit/s.  Everything
+// but Current and RawAvg leaves out the measurements taken during the warm-up
+// period at the start of the test, while TCP is still ramping up.
+type ThroughputResult struct {
+	Current float64 `json:"current_mbps"`
+	Min     float64 `json:"min_mbps"`
+	Max     float64 `json:"max_mbps"`
+	Avg     float64 `json:"avg_mbps"`
+	Median  float64 `json:"median_mbps"`
+	P5      float64 `json:"p5_mbps"`  // 5th percentile
+	P95     float64 `json:"p95_mbps"` // 95th percentile
+	StdDev  float64 `json:"stddev_mbps"`
+
+	// RawAvg is the average of every measurement, including the warm-up
+	RawAvg float64 `json:"raw_avg_mbps"`
+
+	// Bytes is the amount of data transferred during the test
+	Bytes int64 `json:"bytes"`
+
+	// Datagrams holds the datagram accounting for UDP tests
+	Datagrams *DatagramStats `json:"datagrams,omitempty"`
+
+	// TCP holds the kernel's statistics for the test's connection, where we
+	// can read them
+	TCP *TCPStats `json:"tcp,omitempty"`
+
+	// Accounting compares what the server and we counted of the test's
+	// data, if the server keeps count
+	Accounting *ByteAccounting `json:"accounting,omitempty"`
+
+	// ReceiverMeasured is set for uploads that were measured by what the
+	// server reported receiving, rather than by what we sent
+	ReceiverMeasured bool `json:"receiver_measured,omitempty"`
+
+	// CappedBy is the limit that the server cut the test short at, if it
+	// did
+	CappedBy *ServerLimit `json:"capped_by,omitempty"`
+
+	// Stalls are the stretches of the test in which no data moved for the
+	// client's StallTime or longer
+	Stalls []Stall `json:"stalls,omitempty"`
+
+	// Events is the timeline of the test, such as its stalls and bursts of
+	// retransmits, in order
+	Events []Event `json:"events,omitempty"`
+
+	// Stopped is why the test stopped before its time was up, if it did.
+	// Tests that fail partway through say how.
+	Stopped StopReason `json:"stopped,omitempty"`
+
+	// Skipped is set if the test wasn't run
+	Skipped bool `json:"skipped,omitempty"`
+
+	readings    float64
+	sum         float64
+	rawReadings float64
+	rawSum      float64
+	samples     []float64 // measurements since the warm-up, in order
+}
+
+// Sample is passed to Client.OnThroughput at every report interval
+type Sample struct {
+	TestType TestType
+	Mbps     float64
+	Stats    ThroughputResult // stats for the test so far
+
+	// Elapsed is the time that the measurement was taken over, which is
+	// the report interval unless we were too busy to take it on time
+	Elapsed time.Duration
+
+	// WarmUp is set for measurements taken during the warm-up period
+	WarmUp bool
+
+	// Stalled is set while no data has moved for the client's StallTime.
+	// The stall is the last of Stats.Stalls.
+	Stalled bool
+}
+
+// Stall is a stretch of a throughput test in which no data moved
+type Stall struct {
+	// At is when the stall began, in seconds since the start of the test
+	At float64 `json:"at_s"`
+
+	// Duration is how long it lasted, in seconds, or has lasted so far
+	Duration float64 `json:"duration_s"`
+}
+
+// update folds a new throughput measurement into our stats.  Measurements
+// taken during the warm-up period only count towards Current and RawAvg.
+func (tr *ThroughputResult) update(measurement float64, warmUp bool) {
+	tr.Current = measurement
+	tr.rawReadings++
+	tr.rawSum = tr.rawSum + measurement
+	tr.RawAvg = tr.rawSum / tr.rawReadings
+	if warmUp {
+		return
+	}
+
+	tr.readings++
+	tr.sum = tr.sum + measurement
+	tr.Avg = tr.sum / tr.readings
+	if measurement > tr.Max {
+		tr.Max = measurement
+	}
+	if measurement < tr.Min || tr.readings == 1 {
+		tr.Min = measurement
+	}
+
+	tr.samples = append(tr.samples, measurement)
+
+	sorted := append([]float64(nil), tr.samples...)
+	sort.Float64s(sorted)
+	tr.Median = percentile(sorted, 50)
+	tr.P5 = percentile(sorted, 5)
+	tr.P95 = percentile(sorted, 95)
+
+	var sqDevSum float64
+	for _, m := range tr.samples {
+		sqDevSum = sqDevSum + math.Pow(m-tr.Avg, 2)
+	}
+	tr.StdDev = math.Sqrt(sqDevSum / tr.readings)
+}
+
+// finishMeasuring folds the end of a throughput test into tr's stats: the
+// last stretch of it since the last report interval, which moved n bytes in
+// elapsed, as long as it's at least half an interval long, and if that still
+// leaves tr without a measurement after the warm-up, the test as a whole,
+// which moved total bytes in testElapsed.  Tests that were stopped early by
+// MaxBytes, or by the server, needn't last a report interval or outlast the
+// warm-up, and the data that they moved still counts.
+func (c *Client) finishMeasuring(tr *ThroughputResult, n int64, elapsed time.Duration, total int64, testElapsed time.Duration, warmUp bool) {
+	if n > 0 && elapsed >= c.reportInterval()/2 {
+		tr.update(mbps(n, elapsed), warmUp)
+	}
+	if tr.readings == 0 && total > 0 && testElapsed > 0 {
+		tr.update(mbps(total, testElapsed), false)
+	}
+}
+
+// mbps returns the throughput of n bytes moved in elapsed, in Mbit/s
+func mbps(n int64, elapsed time.Duration) float64 {
+	return float64(n*8) / 1024 / (float64(elapsed) / float64(time.Millisecond))
+}
+
+// percentile returns the pth percentile of sorted, interpolating between the
+// closest measurements
+func percentile(sorted []float64, p float64) float64 {
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
+
+// RunDownloadTest runs a server->client throughput test
+func (c *Client) RunDownloadTest(ctx context.Context) (ThroughputResult, error) {
+	return c.runThroughputTest(ctx, Inbound)
+}
+
+// RunUploadTest runs a client->server throughput test
+func (c *Client) RunUploadTest(ctx context.Context) (ThroughputResult, error) {
+	return c.runThroughputTest(ctx, Outbound)
+}
+
+// Kick off a throughput measurement test, and start it over if the
+// connection drops
+func (c *Client) runThroughputTest(ctx context.Context, testType TestType) (ThroughputResult, error) {
+	var tr ThroughputResult
+	err := c.retry(ctx, func() (err error) {
+		tr, err = c.throughputTest(ctx, testType)
+		return err
+	})
+	return tr, err
+}
+
+// errNoData fails a throughput test that ended without moving any data, which
+// we can't measure
+var errNoData = errors.New("no data was transferred")
+
+// throughputTest runs a single attempt at a throughput test
+func (c *Client) throughputTest(ctx context.Context, testType TestType) (ThroughputResult, error) {
+	var ds *DatagramStats
+	var report copyReport
+
+	err := c.checkThroughputSettings()
+	if err != nil {
+		return ThroughputResult{}, err
+	}
+
+	tr, err := c.measure(testType, func(meter *byteMeter, events chan<- Event) error {
+		var err error
+		switch testType {
+		case UDPInbound, UDPOutbound:
+			ds, err = c.udpTest(ctx, testType, meter)
+		default:
+			report, err = c.meteredCopy(ctx, testType, meter, events)
+		}
+		return err
+	})
+	tr.Datagrams = ds
+	tr.TCP = report.tcp
+	tr.Accounting = report.accounting
+	tr.ReceiverMeasured = report.receiverMeasured
+	tr.CappedBy = report.capped
+	tr.Stopped = report.stopped
+	if err != nil {
+		tr.Stopped = stopReason(err)
+	}
+	if err == nil && tr.Bytes == 0 {
+		err = errNoData
+	}
+
+	return tr, err
+}
+
+// measure launches a throughput measurer and then runs test, blocking until
+// it completes.  TCP tests add the bytes that they copy to meter, UDP tests
+// the size of each datagram.  Anything of note that happens along the way can
+// be emitted on events.
+func (c *Client) measure(testType TestType, test func(meter *byteMeter, events chan<- Event) error) (ThroughputResult, error) {
+	meter := newByteMeter()
+	events := make(chan Event, eventBuffer)
+
+	// Used to signal test completion to the throughput measurer
+	measurerDone := make(chan struct{})
+	result := make(chan ThroughputResult)
+
+	go c.measureThroughput(testType, meter, events, measurerDone, result)
+	err := test(meter, events)
+
+	close(measurerDone)
+
+	return <-result, err
+}
+
+// byteMeter counts the bytes that a throughput test moves, from as many
+// goroutines as are moving them, for measureThroughput to read at each report
+// interval.  At multi-gigabit rates, handing each chunk's size to the
+// measurer over a channel would hold up the copy.
+type byteMeter struct {
+	start time.Time
+	bytes int64 // accessed atomically
+	moved int64 // when bytes last moved, as nanoseconds since start; accessed atomically
+}
+
+func newByteMeter() *byteMeter {
+	return &byteMeter{start: time.Now()}
+}
+
+// add counts n more bytes moved
+func (m *byteMeter) add(n int64) {
+	if n <= 0 {
+		return
+	}
+	atomic.AddInt64(&m.bytes, n)
+	atomic.StoreInt64(&m.moved, int64(time.Since(m.start)))
+}
+
+// read returns the bytes moved so far, and when they last moved
+func (m *byteMeter) read() (int64, time.Time) {
+	return atomic.LoadInt64(&m.bytes), m.start.Add(time.Duration(atomic.LoadInt64(&m.moved)))
+}
+
+// copyReport is what meteredCopy found out about a test, besides its
+// throughput
+type copyReport struct {
+	tcp              *TCPStats
+	accounting       *ByteAccounting
+	receiverMeasured bool
+	capped           *ServerLimit
+	stopped          StopReason
+}
+
+// Kicks off a metered copy (throughput test) by sending a command to the server
+// and then performing the appropriate I/O copy, counting each block of data
+// on meter as it passes through.  The copy runs over c.Streams connections at
+// once, which all count on the same meter, so that their throughput adds up.  When the test is done, it reads the connections' TCP
+// stats before hanging up, and then compares notes with the server on how
+// much data was sent, if the server keeps count.
+func (c *Client) meteredCopy(ctx context.Context, testType TestType, meter *byteMeter, events chan<- Event) (copyReport, error) {
+	var report copyReport
+	streams := c.streams()
+
+	// Connect to the remote sparkyfish server, once for each stream
+	sessions := make([]*session, 0, streams)
+	defer func() {
+		for _, s := range sessions {
+			s.close()
+		}
+	}()
+	for len(sessions) < streams {
+		addr := c.addr
+		s, err := c.beginSession(ctx)
+		if err != nil {
+			return report, err
+		}
+
+		// If a busy server sent this stream elsewhere, the ones that we've
+		// already opened are at the wrong server, so we start again there
+		if c.addr != addr {
+			for _, s := range sessions {
+				s.close()
+			}
+			sessions = sessions[:0]
+		}
+		sessions = append(sessions, s)
+
+		if streams > 1 && !s.info.Supports(CapMultiStream) {
+			return report, fmt.Errorf("server doesn't support multi-stream tests")
+		}
+	}
+
+	// Send the appropriate command to the sparkyfish server to initiate our
+	// throughput test on each stream
+	for _, s := range sessions {
+		var err error
+		switch testType {
+		case Inbound:
+			// Send the SND command to the remote server, requesting a download test
+			// (remote sends).
+			err = c.beginDownload(s)
+		case Outbound:
+			// Send the RCV command to the remote server, requesting an upload test
+			// (remote receives).
+			err = s.writeCommand(c.progressCommand(s))
+		}
+		if err != nil {
+			return report, err
+		}
+	}
+
+	// The data cap and the rate limit are shared out between the streams
+	maxBytes := c.MaxBytes / int64(streams)
+	rateLimit := c.RateLimit / float64(streams)
+
+	var wg sync.WaitGroup
+	errs := make([]error, streams)
+	stats := make([]*TCPStats, streams)
+	for i, s := range sessions {
+		if streams > 1 {
+			s.stream = i + 1
+		}
+		wg.Add(1)
+		go func(i int, s *session) {
+			defer wg.Done()
+			errs[i] = c.copyData(ctx, s, testType, maxBytes, rateLimit, meter, events)
+			stats[i] = readTCPStats(s.tcp)
+
+			// A stream that stopped early leaves the others to carry on
+			if streams > 1 && (errs[i] != nil || s.stopped != "") {
+				reason := s.stopped
+				if errs[i] != nil {
+					reason = stopReason(errs[i])
+				}
+				detail := streamDetail(s)
+				if reason != "" {
+					detail += ": " + reason.String()
+				}
+				emit(events, Event{Kind: EventStreamLeft, Detail: detail})
+			}
+		}(i, s)
+	}
+	wg.Wait()
+
+	report.tcp = stats[0]
+	if streams > 1 {
+		report.tcp = combineTCPStats(stats)
+	}
+	report.receiverMeasured = sessions[0].progress
+
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		if streams > 1 {
+			err = fmt.Errorf("stream %v: %w", i+1, err)
+		}
+		return report, err
+	}
+
+	// Hang up before asking for the server's tally, so that it isn't left
+	// waiting to send us more
+	for _, s := range sessions {
+		s.close()
+	}
+	report.accounting, report.capped = c.accounting(ctx, sessions)
+	for _, s := range sessions {
+		if s.capped != nil {
+			report.capped = s.capped
+		}
+		if report.stopped == "" {
+			report.stopped = s.stopped
+		}
+	}
+	if report.capped != nil {
+		report.stopped = StopServerCap
+	}
+	sessions = nil
+
+	return report, nil
+}
+
+// copyData performs the I/O copy for a throughput test that the server has
+// been asked to start on s.  It copies at most maxBytes, if that's set, and
+// paces the copy to rateLimit Mbit/s, if that's set.  Bursts of retransmits,
+// and when the stream starts moving data if it's one of several, are emitted
+// on events.
+func (c *Client) copyData(ctx context.Context, s *session, testType TestType, maxBytes int64, rateLimit float64, meter *byteMeter, events chan<- Event) error {
+	var err error
+
+	// For inbound tests, we bump our timer by 2 seconds to account for the
+	// remote server's test startup time
+	tl := time.Second * time.Duration(throughputTestLength)
+	if testType == Inbound {
+		tl = time.Second * time.Duration(throughputTestLength+2)
+	}
+
+	// Blocks start small and grow as the data flows faster, unless the
+	// block size was fixed
+	bs := c.newBlockSizer()
+
+	// Pace the test, if it's rate-limited
+	var tb *tokenBucket
+	if rateLimit > 0 {
+		tb = newTokenBucket(rateLimit)
+	}
+
+	// Uploads send their own stream of test data, so that several can run
+	// at once
+	src := NewPayload(c.Compressible)
+
+	// If the server reports what it has received of our upload, we go by
+	// that instead of what we've sent
+	var stopProgress func() error
+	if testType == Outbound && s.progress {
+		stopProgress = s.watchProgress(meter)
+		defer stopProgress()
+	}
+
+	// finished winds up a test that ran its course, or that we stopped
+	// early.  Once our upload's time is up, the server goes on reading it
+	// for a while, so we wait for its reports of the rest of it.  If they
+	// broke off along the way, our measurements are no good.
+	finished := func(early bool) error {
+		s.endedCopy = early
+		if stopProgress != nil {
+			if !early {
+				s.awaitReceived(s.copied, progressDrainTime)
+			}
+			if err := stopProgress(); err != errCapped {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Make sure that the server actually started the download
+	if testType == Inbound {
+		err = s.checkRejection()
+		if err != nil {
+			return err
+		}
+	}
+
+	s.log.Debug("copying", "test", testType, "max_bytes", maxBytes, "rate_limit_mbps", rateLimit, "stream", s.stream)
+
+	stopWatching := c.watchRetransmits(s, events)
+	defer stopWatching()
+
+	// Set a timer for running the tests, and give up on a connection that
+	// stalls rather than waiting on it forever
+	start := time.Now()
+	timer := time.NewTimer(tl)
+	defer timer.Stop()
+	if testType == Inbound {
+		s.conn.SetReadDeadline(start.Add(tl + copyStallTimeout))
+	} else {
+		s.conn.SetWriteDeadline(start.Add(tl + copyStallTimeout))
+	}
+
+	for {
+		select {
+		case <-timer.C:
+			// Timer has elapsed and test is finished
+			return finished(false)
+		default:
+			block := bs.size
+			if maxBytes > 0 {
+				if s.copied >= maxBytes {
+					// We've used up our data allowance, so we end the test early
+					s.stopped = StopLocalCap
+					return finished(true)
+				}
+				if block > maxBytes-s.copied {
+					block = maxBytes - s.copied
+				}
+			}
+			if tb != nil {
+				if block > tb.maxBlock() {
+					block = tb.maxBlock()
+				}
+				err = tb.wait(ctx, block)
+				if err != nil {
+					return err
+				}
+			}
+			copyStart := time.Now()
+
+			var n int64
+			switch testType {
+			case Inbound:
+				// Receive, tally, and discard incoming data as fast as we can until the sender stops sending or the timer expires.
+				// Data is copied from the session to the rubbish bin in block-sized chunks.
+				n, err = io.CopyN(ioutil.Discard, s.reader, block)
+			case Outbound:
+				// Send and tally outgoing data as fast as we can until the receiver stops receiving or the timer expires.
+				// Data is generated and copied to the net.Conn in block-sized chunks.
+				n, err = src.CopyN(s.conn, block)
+			}
+
+			// With each chunk copied, we add its size to our meter,
+			// unless the server is counting for us.  What we got of a
+			// chunk that was cut short still counts.
+			if n > 0 && s.copied == 0 && s.stream > 0 {
+				emit(events, Event{Kind: EventStreamJoined, Detail: streamDetail(s)})
+			}
+			s.copied += n
+			if n > 0 && stopProgress == nil {
+				meter.add(n)
+			}
+
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				// If the server turned down our upload, or cut it short at
+				// one of its limits, it left us a note
+				switch {
+				case stopProgress != nil:
+					rerr := stopProgress()
+					if rerr == errCapped {
+						s.stopped = StopServerCap
+						return nil
+					}
+					if _, ok := rerr.(serverError); ok {
+						return rerr
+					}
+				case testType == Outbound:
+					s.conn.SetReadDeadline(time.Now().Add(time.Second))
+					if rerr := s.checkRejection(); rerr != nil {
+						return rerr
+					}
+					if s.checkCapped() {
+						s.stopped = StopServerCap
+						return nil
+					}
+				}
+				// If we get any of these errors, it probably just means that the server closed the connection
+				// because the test timer has expired at the remote end.  If it did so well before then, we
+				// note that it hung up early.
+				if err == io.EOF || err == io.ErrClosedPipe || neterr.IsBrokenPipe(err) {
+					if time.Since(start) < TestLength-serverCloseSlack {
+						s.stopped = StopServerClosed
+					}
+					return nil
+				}
+				return newCopyError(err)
+			}
+
+			bs.adjust(time.Since(copyStart))
+		}
+	}
+}
+
+// measureThroughput reads the bytes that the test has moved from meter at each report interval
+// and derives a throughput rate, which is passed to OnThroughput.  When the test is done, the
+// final stats are sent on result.  If no bytes are copied for our StallTime, we note a stall, which
+// lasts until they are again, to within a report interval.  Events are stamped with when they
+// come in and added to the test's timeline.
+func (c *Client) measureThroughput(testType TestType, meter *byteMeter, events <-chan Event, measurerDone <-chan struct{}, result chan<- ThroughputResult) {
+	var byteCount, prevByteCount int64
+	var throughput float64
+	var tr ThroughputResult
+
+	interval := c.reportInterval()
+	start := meter.start
+	warmUpEnds := start.Add(c.WarmUp)
+	lastTick := start
+
+	// lastMoved is when bytes were last copied, and stalled is set while
+	// the last of tr.Stalls is going on
+	stallTime := c.stallTime()
+	lastMoved := start
+	var stalled bool
+	updateStall := func() {
+		if stalled {
+			tr.Stalls[len(tr.Stalls)-1].Duration = time.Since(lastMoved).Seconds()
+		}
+	}
+
+	// readMeter brings our count up to date.  Bytes that moved since we
+	// last looked end any stall that was going on, which lasted until then.
+	readMeter := func() {
+		n, moved := meter.read()
+		if n > byteCount {
+			updateStall()
+			stalled = false
+		}
+		byteCount, lastMoved = n, moved
+	}
+
+	log := c.logger().With("test", testType)
+	addEvent := func(e Event) {
+		log.Debug("event", "kind", e.Kind, "at_s", e.At, "detail", e.Detail)
+		tr.Events = append(tr.Events, e)
+	}
+	received := func(e Event) {
+		e.At = time.Since(start).Seconds()
+		addEvent(e)
+	}
+
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case e := <-events:
+			received(e)
+		case <-measurerDone:
+			// The test has finished moving data, so the meter's count is
+			// final
+			readMeter()
+			for len(events) > 0 {
+				received(<-events)
+			}
+			updateStall()
+			c.finishMeasuring(&tr, byteCount-prevByteCount, time.Since(lastTick), byteCount, time.Since(start), time.Now().Before(warmUpEnds))
+			log.Debug("measured", "bytes", byteCount, "stalls", len(tr.Stalls), "events", len(tr.Events))
+
+			// Stalls are noted when they're found, after they began
+			sort.SliceStable(tr.Events, func(i, j int) bool {
+				return tr.Events[i].At < tr.Events[j].At
+			})
+			tr.Bytes = byteCount
+			result <- tr
+			return
+		case <-tick.C:
+			// Under load, the ticker drifts and drops ticks, so each
+			// measurement is over the time that actually went by since the
+			// last one, on the monotonic clock, rather than the interval
+			readMeter()
+			elapsed := time.Since(lastTick)
+			lastTick = lastTick.Add(elapsed)
+			throughput = mbps(byteCount-prevByteCount, elapsed)
+
+			if !stalled && time.Since(lastMoved) >= stallTime {
+				stalled = true
+				tr.Stalls = append(tr.Stalls, Stall{At: lastMoved.Sub(start).Seconds()})
+				addEvent(Event{At: lastMoved.Sub(start).Seconds(), Kind: EventStall})
+			}
+			updateStall()
+
+			warmUp := time.Now().Before(warmUpEnds)
+			tr.update(throughput, warmUp)
+			tr.Bytes = byteCount
+			log.Debug("interval", "bytes", byteCount, "interval_bytes", byteCount-prevByteCount, "elapsed", elapsed, "mbps", throughput, "warm_up", warmUp, "stalled", stalled)
+
+			if c.OnThroughput != nil {
+				// The stall that's going on goes on changing, and the
+				// events are sorted at the end, so the sample gets a copy
+				stats := tr
+				stats.Stalls = append([]Stall(nil), tr.Stalls...)
+				stats.Events = append([]Event(nil), tr.Events...)
+				c.OnThroughput(Sample{TestType: testType, Mbps: throughput, Stats: stats, Elapsed: elapsed, WarmUp: warmUp, Stalled: stalled})
+			}
+
+			// Update the current byte counter
+			prevByteCount = byteCount
+		}
+	}
+}
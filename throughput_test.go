@@ -0,0 +1,227 @@
+package sparkyfish
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+// approxEqual reports whether got is within a millionth of want
+func approxEqual(got, want float64) bool {
+	return math.Abs(got-want) <= 1e-6*math.Max(1, math.Abs(want))
+}
+
+func TestMbps(t *testing.T) {
+	tests := []struct {
+		name    string
+		n       int64
+		elapsed time.Duration
+		want    float64
+	}{
+		{"one second", 125 * 1024, time.Second, 1},
+		{"half a second", 125 * 1024, 500 * time.Millisecond, 2},
+		{"slow tick", 125 * 1024, 2 * time.Second, 0.5},
+		{"gigabit", 125 * 1024 * 1000, time.Second, 1000},
+		{"nothing moved", 0, time.Second, 0},
+	}
+	for _, tt := range tests {
+		if got := mbps(tt.n, tt.elapsed); !approxEqual(got, tt.want) {
+			t.Errorf("%v: mbps(%v, %v) = %v, want %v", tt.name, tt.n, tt.elapsed, got, tt.want)
+		}
+	}
+}
+
+func TestFinishMeasuring(t *testing.T) {
+	c := &Client{ReportInterval: 500 * time.Millisecond}
+
+	tests := []struct {
+		name        string
+		before      []float64 // measurements already taken, after the warm-up
+		n           int64
+		elapsed     time.Duration
+		total       int64
+		testElapsed time.Duration
+		warmUp      bool
+		wantCurrent float64
+		wantAvg     float64
+	}{
+		{"last stretch counts", []float64{4}, 125 * 1024, 500 * time.Millisecond, 0, 0, false, 2, 3},
+		{"half an interval counts", []float64{4}, 125 * 1024, 250 * time.Millisecond, 0, 0, false, 4, 4},
+		{"short stretch is left out", []float64{4}, 125 * 1024, 100 * time.Millisecond, 0, 0, false, 4, 4},
+		{"short test counts as a whole", nil, 125 * 1024, 100 * time.Millisecond, 1250 * 1024, 10 * time.Second, false, 1, 1},
+		{"test within the warm-up counts as a whole", nil, 125 * 1024, 500 * time.Millisecond, 1250 * 1024, 10 * time.Second, true, 1, 1},
+		{"nothing moved", nil, 0, 500 * time.Millisecond, 0, 10 * time.Second, false, 0, 0},
+	}
+	for _, tt := range tests {
+		var tr ThroughputResult
+		for _, m := range tt.before {
+			tr.update(m, false)
+		}
+		c.finishMeasuring(&tr, tt.n, tt.elapsed, tt.total, tt.testElapsed, tt.warmUp)
+		if !approxEqual(tr.Current, tt.wantCurrent) || !approxEqual(tr.Avg, tt.wantAvg) {
+			t.Errorf("%v: Current, Avg = %v, %v, want %v, %v", tt.name, tr.Current, tr.Avg, tt.wantCurrent, tt.wantAvg)
+		}
+	}
+}
+
+func TestByteMeter(t *testing.T) {
+	tests := []struct {
+		name      string
+		adds      []int64
+		wantBytes int64
+		wantMoved bool
+	}{
+		{"nothing", nil, 0, false},
+		{"one chunk", []int64{1024}, 1024, true},
+		{"several chunks", []int64{1024, 512, 1}, 1537, true},
+		{"empty reads", []int64{0, -1}, 0, false},
+		{"empty reads among chunks", []int64{1024, 0, 512, -1}, 1536, true},
+	}
+	for _, tt := range tests {
+		m := newByteMeter()
+		time.Sleep(time.Millisecond)
+		for _, n := range tt.adds {
+			m.add(n)
+		}
+		bytes, moved := m.read()
+		if bytes != tt.wantBytes {
+			t.Errorf("%v: read %v bytes, want %v", tt.name, bytes, tt.wantBytes)
+		}
+		if got := moved.After(m.start); got != tt.wantMoved {
+			t.Errorf("%v: moved after the start = %v, want %v", tt.name, got, tt.wantMoved)
+		}
+		if moved.After(time.Now()) {
+			t.Errorf("%v: moved at %v, in the future", tt.name, moved)
+		}
+	}
+}
+
+// meterPhase is a stretch of a simulated throughput test, which moves data
+// throughout, or none at all
+type meterPhase struct {
+	moving bool
+	length time.Duration
+}
+
+func TestMeasureThroughput(t *testing.T) {
+	const (
+		interval  = 20 * time.Millisecond
+		stallTime = 60 * time.Millisecond
+		chunk     = 1024
+		// slack is how late a tick may come, on a busy machine
+		slack = 100 * time.Millisecond
+	)
+	moving := func(d time.Duration) meterPhase { return meterPhase{true, d} }
+	idle := func(d time.Duration) meterPhase { return meterPhase{false, d} }
+
+	tests := []struct {
+		name       string
+		phases     []meterPhase
+		wantStalls int
+		// wantStalledAtEnd is set if the last measurement was taken while
+		// stalled
+		wantStalledAtEnd bool
+	}{
+		{"steady", []meterPhase{moving(200 * time.Millisecond)}, 0, false},
+		{"pause shorter than the stall time", []meterPhase{moving(60 * time.Millisecond), idle(30 * time.Millisecond), moving(60 * time.Millisecond)}, 0, false},
+		{"stall and resume", []meterPhase{moving(60 * time.Millisecond), idle(150 * time.Millisecond), moving(100 * time.Millisecond)}, 1, false},
+		{"two stalls", []meterPhase{moving(60 * time.Millisecond), idle(150 * time.Millisecond), moving(60 * time.Millisecond), idle(150 * time.Millisecond), moving(100 * time.Millisecond)}, 2, false},
+		{"stalled at the end", []meterPhase{moving(60 * time.Millisecond), idle(200 * time.Millisecond)}, 1, true},
+	}
+	for _, tt := range tests {
+		var mu sync.Mutex
+		var samples []Sample
+		c := &Client{ReportInterval: interval, StallTime: stallTime}
+		c.OnThroughput = func(s Sample) {
+			mu.Lock()
+			defer mu.Unlock()
+			samples = append(samples, s)
+		}
+
+		// pauses are when each idle phase began and ended, since the
+		// start of the test
+		var total int64
+		var pauses [][2]time.Duration
+		tr, err := c.measure(Inbound, func(meter *byteMeter, _ chan<- Event) error {
+			for _, p := range tt.phases {
+				end := time.Now().Add(p.length)
+				if !p.moving {
+					began := time.Since(meter.start)
+					time.Sleep(p.length)
+					pauses = append(pauses, [2]time.Duration{began, time.Since(meter.start)})
+					continue
+				}
+				for time.Now().Before(end) {
+					meter.add(chunk)
+					total += chunk
+					time.Sleep(2 * time.Millisecond)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+
+		if tr.Bytes != total {
+			t.Errorf("%v: measured %v bytes, want %v", tt.name, tr.Bytes, total)
+		}
+		if tr.Avg <= 0 {
+			t.Errorf("%v: average of %v Mbit/s, want more than none", tt.name, tr.Avg)
+		}
+
+		if len(tr.Stalls) != tt.wantStalls {
+			t.Errorf("%v: %v stalls, want %v: %+v", tt.name, len(tr.Stalls), tt.wantStalls, tr.Stalls)
+			continue
+		}
+		var stallEvents int
+		for _, e := range tr.Events {
+			if e.Kind == EventStall {
+				stallEvents++
+			}
+		}
+		if stallEvents != tt.wantStalls {
+			t.Errorf("%v: %v stall events, want %v", tt.name, stallEvents, tt.wantStalls)
+		}
+
+		// Each stall begins when data last moved, before its pause, and
+		// lasts at least until data moves again, or the test ends, and no
+		// more than a late tick after that
+		var stalled []time.Duration
+		for _, p := range pauses {
+			if p[1]-p[0] >= stallTime {
+				stalled = append(stalled, p[0], p[1])
+			}
+		}
+		if len(stalled) != 2*len(tr.Stalls) {
+			t.Errorf("%v: paused for the stall time %v times, want %v", tt.name, len(stalled)/2, len(tr.Stalls))
+			continue
+		}
+		for i, s := range tr.Stalls {
+			began, ended := stalled[2*i], stalled[2*i+1]
+			at := time.Duration(s.At * float64(time.Second))
+			if at > began || at < began-slack {
+				t.Errorf("%v: stall %v began at %v, want just before %v", tt.name, i, at, began)
+			}
+			length := time.Duration(s.Duration * float64(time.Second))
+			if length < ended-at || length > ended-at+interval+slack {
+				t.Errorf("%v: stall %v lasted %v, want at least %v", tt.name, i, length, ended-at)
+			}
+		}
+
+		mu.Lock()
+		if len(samples) == 0 {
+			t.Errorf("%v: no measurements", tt.name)
+		} else if last := samples[len(samples)-1]; last.Stalled != tt.wantStalledAtEnd {
+			t.Errorf("%v: last measurement stalled = %v, want %v", tt.name, last.Stalled, tt.wantStalledAtEnd)
+		}
+		for _, s := range samples {
+			if s.Stalled && len(s.Stats.Stalls) == 0 {
+				t.Errorf("%v: stalled measurement without a stall", tt.name)
+				break
+			}
+		}
+		mu.Unlock()
+	}
+}
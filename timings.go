@@ -0,0 +1,91 @@
+package sparkyfish
+
+import (
+	"context"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// ConnectTimings breaks down how long it took to connect to the server and
+// sign on, step by step, like curl's -w timings.  Each is in milliseconds,
+// and is zero for steps that didn't apply.
+type ConnectTimings struct {
+	// DNS is the time spent looking up the server's hostname
+	DNS float64 `json:"dns_ms"`
+
+	// Connect is the time that the TCP handshake took
+	Connect float64 `json:"connect_ms"`
+
+	// TLS and WebSocket are the times that the TLS handshake and the
+	// WebSocket upgrade took, for servers that we reach over wss:// or
+	// ws://
+	TLS       float64 `json:"tls_ms,omitempty"`
+	WebSocket float64 `json:"websocket_ms,omitempty"`
+
+	// QUIC is the time that the QUIC handshake, which includes TLS, took,
+	// for servers that we reach over quic://
+	QUIC float64 `json:"quic_ms,omitempty"`
+
+	// Hello is the time that the HELO exchange took, along with AUTH if
+	// we presented a token
+	Hello float64 `json:"hello_ms"`
+
+	// Total is the time from the start of the lookup to the end of the
+	// HELO exchange
+	Total float64 `json:"total_ms"`
+}
+
+// connectTrace notes how long the steps of dialing the server take.  The
+// standard library reports them to us through an httptrace.ClientTrace,
+// which net.Dialer heeds too.
+type connectTrace struct {
+	mu       sync.Mutex
+	dnsStart time.Time
+	dns      time.Duration
+	starts   map[string]time.Time // when we began connecting to each address
+	connect  time.Duration
+}
+
+// context returns a copy of ctx that dials made with report to t
+func (t *connectTrace) context(ctx context.Context) context.Context {
+	t.starts = make(map[string]time.Time)
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			t.dnsStart = time.Now()
+			t.mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			t.dns = time.Since(t.dnsStart)
+			t.mu.Unlock()
+		},
+		// With several addresses, we may try more than one, perhaps at
+		// once.  The one that we connect to first is the one that we use.
+		ConnectStart: func(network, addr string) {
+			t.mu.Lock()
+			t.starts[addr] = time.Now()
+			t.mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.mu.Lock()
+			if err == nil && t.connect == 0 {
+				t.connect = time.Since(t.starts[addr])
+			}
+			t.mu.Unlock()
+		},
+	})
+}
+
+// timings returns the times that t noted
+func (t *connectTrace) timings() ConnectTimings {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return ConnectTimings{DNS: milliseconds(t.dns), Connect: milliseconds(t.connect)}
+}
+
+// milliseconds converts d to fractional milliseconds
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
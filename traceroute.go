@@ -0,0 +1,357 @@
+package sparkyfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// MaxHops is the furthest that Traceroute looks for the server
+	MaxHops = 30
+
+	// TracerouteProbes is the number of probes that Traceroute sends to
+	// each hop
+	TracerouteProbes = 3
+)
+
+const (
+	// traceProbeGap is the time between the rounds of probes that we send
+	// to every hop, so that routers that rate-limit their ICMP errors
+	// answer as many as they can
+	traceProbeGap = 100 * time.Millisecond
+
+	// traceTimeout is how long we wait for answers after sending the last
+	// probe
+	traceTimeout = 2 * time.Second
+
+	// traceLookupTimeout is how long we spend looking up the hops' names
+	traceLookupTimeout = 2 * time.Second
+
+	// traceBasePort is the port that our first UDP probe is sent to.
+	// Nothing's meant to listen on it or the ports after it, so the server
+	// answers our probes with port unreachable errors.
+	traceBasePort = 33434
+)
+
+// Hop is a router along the path to the server, or the server itself, as
+// found by Traceroute
+type Hop struct {
+	// TTL is the hop's distance from us
+	TTL int `json:"ttl"`
+
+	// Address is the address that answered our probes, or "" if nothing
+	// did, and Name is its reverse DNS name, if it has one
+	Address string `json:"address,omitempty"`
+	Name    string `json:"name,omitempty"`
+
+	// Sent and Received count our probes to the hop and its answers
+	Sent     int `json:"sent"`
+	Received int `json:"received"`
+
+	// Min, Avg and Max are the round-trip times of the answered probes, in
+	// milliseconds
+	Min float64 `json:"min_ms"`
+	Avg float64 `json:"avg_ms"`
+	Max float64 `json:"max_ms"`
+}
+
+// LossPercent returns the percentage of the hop's probes that weren't
+// answered
+func (h Hop) LossPercent() float64 {
+	if h.Sent == 0 {
+		return 0
+	}
+	return float64(h.Sent-h.Received) / float64(h.Sent) * 100
+}
+
+// TracerouteResult is the path to the server, as found by Traceroute
+type TracerouteResult struct {
+	// Method is how the path was probed: "icmp", with ICMP echo requests,
+	// which needs privileges, or "udp", with UDP datagrams to unused ports
+	Method string `json:"method"`
+
+	// Hops lists the hops along the path, nearest first, up to the server
+	// or the last one that answered
+	Hops []Hop `json:"hops"`
+
+	// Reached is set if the server itself answered
+	Reached bool `json:"reached"`
+}
+
+// traceReply is the answer to one of our probes
+type traceReply struct {
+	ttl  int
+	from net.IP
+	rtt  time.Duration
+	end  bool // the path ends here, at the server or a router that won't let us past
+}
+
+// Traceroute finds the path to the server by sending it probes with
+// increasing TTLs, and noting the routers that tell us that they've run out.
+// It uses ICMP echo requests if it's allowed to open a raw socket, which
+// usually needs root or CAP_NET_RAW, and otherwise falls back to UDP
+// datagrams, which Linux lets anyone send and hear the errors for.  Our
+// Source, Interface and DSCP apply to the probes.
+func (c *Client) Traceroute(ctx context.Context) (TracerouteResult, error) {
+	var tr TracerouteResult
+
+	dst, err := net.ResolveIPAddr(strings.Replace(c.network(), "tcp", "ip", 1), hostOnly(c.addr))
+	if err != nil {
+		return tr, err
+	}
+
+	tr.Method = "icmp"
+	replies, err := c.traceICMP(ctx, dst.IP)
+	if errors.Is(err, os.ErrPermission) {
+		tr.Method = "udp"
+		replies, err = c.traceUDP(ctx, dst.IP)
+	}
+	if err != nil {
+		return tr, fmt.Errorf("unable to trace the route to %v: %v", dst, err)
+	}
+
+	tr.Hops, tr.Reached = traceHops(replies, dst.IP)
+	lookupHopNames(ctx, tr.Hops)
+	return tr, nil
+}
+
+// traceICMP probes the path to dst with ICMP echo requests over a raw
+// socket
+func (c *Client) traceICMP(ctx context.Context, dst net.IP) ([]traceReply, error) {
+	network, proto := "ip4:icmp", 1
+	if dst.To4() == nil {
+		network, proto = "ip6:ipv6-icmp", 58
+	}
+
+	var laddr string
+	if c.Source != nil {
+		laddr = c.Source.String()
+	}
+	lc := net.ListenConfig{Control: c.traceControl}
+	pc, err := lc.ListenPacket(ctx, network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+
+	// Other processes' pings may show up on a raw socket, so we tell ours
+	// apart by their ID
+	id := os.Getpid() & 0xffff
+	sent := make(map[int]time.Time)
+	var replies []traceReply
+
+	stop := context.AfterFunc(ctx, func() {
+		pc.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	// We send a round of probes to every hop, then read the answers
+	// until it's time for the next round, and then for a while longer
+	var deadline time.Time
+	buf := make([]byte, 1500)
+	for round := 0; round < TracerouteProbes; round++ {
+		for ttl := 1; ttl <= MaxHops; ttl++ {
+			seq := ttl*TracerouteProbes + round
+			msg := icmp.Message{Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("sparkyfish")}}
+			if proto == 1 {
+				msg.Type = ipv4.ICMPTypeEcho
+				err = ipv4.NewPacketConn(pc).SetTTL(ttl)
+			} else {
+				// The kernel fills in ICMPv6 checksums for us
+				msg.Type = ipv6.ICMPTypeEchoRequest
+				err = ipv6.NewPacketConn(pc).SetHopLimit(ttl)
+			}
+			if err != nil {
+				return nil, err
+			}
+			b, err := msg.Marshal(nil)
+			if err != nil {
+				return nil, err
+			}
+			sent[seq] = time.Now()
+			_, err = pc.WriteTo(b, &net.IPAddr{IP: dst})
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		deadline = time.Now().Add(traceProbeGap)
+		if round == TracerouteProbes-1 {
+			deadline = time.Now().Add(traceTimeout)
+		}
+		for ctx.Err() == nil {
+			pc.SetReadDeadline(deadline)
+			n, peer, err := pc.ReadFrom(buf)
+			if err != nil {
+				var ne net.Error
+				if errors.As(err, &ne) && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			from := peer.(*net.IPAddr).IP
+
+			seq, end, ok := parseICMPReply(proto, buf[:n], id)
+			if !ok {
+				continue
+			}
+			start, ok := sent[seq]
+			if !ok {
+				continue
+			}
+			delete(sent, seq)
+			replies = append(replies, traceReply{ttl: seq / TracerouteProbes, from: from, rtt: time.Since(start), end: end})
+		}
+	}
+	return replies, ctx.Err()
+}
+
+// parseICMPReply picks the sequence number of our echo request out of an
+// ICMP message, which is either the server's echo reply or an error quoting
+// our request.  It reports whether the path ends with the message's sender,
+// and whether the message was about one of our requests at all.
+func parseICMPReply(proto int, b []byte, id int) (seq int, end bool, ok bool) {
+	m, err := icmp.ParseMessage(proto, b)
+	if err != nil {
+		return 0, false, false
+	}
+
+	// Errors quote the IP header of our request, followed by the start of
+	// its ICMP header: type, code, checksum, ID and sequence number
+	var quoted []byte
+	switch body := m.Body.(type) {
+	case *icmp.Echo:
+		if m.Type != ipv4.ICMPTypeEchoReply && m.Type != ipv6.ICMPTypeEchoReply || body.ID != id {
+			return 0, false, false
+		}
+		return body.Seq, true, true
+	case *icmp.TimeExceeded:
+		quoted = body.Data
+	case *icmp.DstUnreach:
+		// The server, or a router in front of it, won't let us any
+		// further.  It's as far as we get either way.
+		quoted = body.Data
+		end = true
+	default:
+		return 0, false, false
+	}
+
+	hdrLen := 40
+	if proto == 1 {
+		if len(quoted) < 1 {
+			return 0, false, false
+		}
+		hdrLen = int(quoted[0]&0x0f) * 4
+	}
+	if len(quoted) < hdrLen+8 {
+		return 0, false, false
+	}
+	quoted = quoted[hdrLen:]
+	if int(quoted[4])<<8|int(quoted[5]) != id {
+		return 0, false, false
+	}
+	return int(quoted[6])<<8 | int(quoted[7]), end, true
+}
+
+// traceControl sets our socket options on the sockets that we send probes
+// from
+func (c *Client) traceControl(network, address string, rc syscall.RawConn) error {
+	// e.g. "ip6:ipv6-icmp", which we treat like any other IPv6 socket
+	network, _, _ = strings.Cut(network, ":")
+	return c.control(network, address, rc)
+}
+
+// traceHops gathers the replies to our probes into hops, up to where the
+// path ends, or the furthest hop that answered if we never found out, and
+// reports whether the server at dst answered
+func traceHops(replies []traceReply, dst net.IP) ([]Hop, bool) {
+	last, ended := 0, false
+	for _, r := range replies {
+		switch {
+		case r.end && (!ended || r.ttl < last):
+			last, ended = r.ttl, true
+		case !ended && r.ttl > last:
+			last = r.ttl
+		}
+	}
+
+	hops := make([]Hop, last)
+	for i := range hops {
+		hops[i] = Hop{TTL: i + 1, Sent: TracerouteProbes}
+	}
+	sort.Slice(replies, func(i, j int) bool { return replies[i].rtt < replies[j].rtt })
+	for _, r := range replies {
+		if r.ttl > last {
+			continue
+		}
+		h := &hops[r.ttl-1]
+		ms := r.rtt.Seconds() * 1000
+		if h.Address == "" {
+			h.Address, h.Min = r.from.String(), ms
+		}
+		h.Max = ms
+		h.Avg += ms
+		h.Received++
+	}
+	var reached bool
+	for i := range hops {
+		if hops[i].Received > 0 {
+			hops[i].Avg /= float64(hops[i].Received)
+		}
+		reached = reached || hops[i].Address == dst.String()
+	}
+	return hops, reached
+}
+
+// lookupHopNames fills in the names of hops, looking them up at once, as
+// long as it doesn't take too long
+func lookupHopNames(ctx context.Context, hops []Hop) {
+	ctx, cancel := context.WithTimeout(ctx, traceLookupTimeout)
+	defer cancel()
+
+	names := make(chan [2]string)
+	var lookups int
+	for _, h := range hops {
+		if h.Address == "" {
+			continue
+		}
+		lookups++
+		go func(addr string) {
+			var name string
+			found, err := net.DefaultResolver.LookupAddr(ctx, addr)
+			if err == nil && len(found) > 0 {
+				name = strings.TrimSuffix(found[0], ".")
+			}
+			names <- [2]string{addr, name}
+		}(h.Address)
+	}
+
+	found := make(map[string]string)
+	for ; lookups > 0; lookups-- {
+		n := <-names
+		found[n[0]] = n[1]
+	}
+	for i := range hops {
+		hops[i].Name = found[hops[i].Address]
+	}
+}
+
+// hostOnly returns the host part of addr, which may or may not have a port
+func hostOnly(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,196 @@
+package sparkyfish
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// sockExtendedErrLen is the size of the kernel's struct sock_extended_err,
+// which the sender of the ICMP error follows
+const sockExtendedErrLen = 16
+
+// traceUDP probes the path to dst with UDP datagrams to ports that nothing
+// should be listening on.  We hear about them on the sockets' error queues,
+// which, unlike raw sockets, anyone may use.
+func (c *Client) traceUDP(ctx context.Context, dst net.IP) ([]traceReply, error) {
+	network, laddr := "udp4", "0.0.0.0:0"
+	if dst.To4() == nil {
+		network, laddr = "udp6", "[::]:0"
+	}
+	if c.Source != nil {
+		laddr = net.JoinHostPort(c.Source.String(), "0")
+	}
+
+	// Each hop gets a socket of its own, with its own TTL and error queue
+	type hopReplies struct {
+		replies []traceReply
+		err     error
+	}
+	results := make(chan hopReplies, MaxHops)
+	for ttl := 1; ttl <= MaxHops; ttl++ {
+		go func(ttl int) {
+			replies, err := c.traceUDPHop(ctx, network, laddr, dst, ttl)
+			results <- hopReplies{replies, err}
+		}(ttl)
+	}
+
+	var replies []traceReply
+	var err error
+	for i := 0; i < MaxHops; i++ {
+		hr := <-results
+		replies = append(replies, hr.replies...)
+		if err == nil {
+			err = hr.err
+		}
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	return replies, err
+}
+
+// traceUDPHop sends our probes for the hop at ttl and waits for the errors
+// that they cause
+func (c *Client) traceUDPHop(ctx context.Context, network, laddr string, dst net.IP, ttl int) ([]traceReply, error) {
+	lc := net.ListenConfig{Control: c.traceControl}
+	pc, err := lc.ListenPacket(ctx, network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+	conn := pc.(*net.UDPConn)
+
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if network == "udp4" {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_RECVERR, 1)
+			if serr == nil {
+				serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+			}
+		} else {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVERR, 1)
+			if serr == nil {
+				serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, ttl)
+			}
+		}
+	})
+	if err == nil {
+		err = serr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	// Each probe goes to a port of its own, which the error queue hands
+	// back to us along with the error
+	firstPort := traceBasePort + ttl*TracerouteProbes
+	sent := make(map[int]time.Time)
+	var replies []traceReply
+	for probe := 0; probe < TracerouteProbes; probe++ {
+		port := firstPort + probe
+		sent[port] = time.Now()
+		err := traceSend(conn, &net.UDPAddr{IP: dst, Port: port})
+		if err != nil {
+			return replies, err
+		}
+
+		deadline := time.Now().Add(traceProbeGap)
+		if probe == TracerouteProbes-1 {
+			deadline = time.Now().Add(traceTimeout)
+		}
+		conn.SetReadDeadline(deadline)
+		for ctx.Err() == nil && len(sent) > 0 {
+			port, from, end, err := readTraceError(rc)
+			if errors.Is(err, syscall.EAGAIN) {
+				continue
+			}
+			if err != nil {
+				break
+			}
+			start, ok := sent[port]
+			if !ok {
+				continue
+			}
+			delete(sent, port)
+			replies = append(replies, traceReply{ttl: ttl, from: from, rtt: time.Since(start), end: end})
+		}
+	}
+	return replies, nil
+}
+
+// traceSend sends a probe to dst.  The kernel also reports the errors that
+// earlier probes caused on the next send, so we try again after one.
+func traceSend(conn *net.UDPConn, dst *net.UDPAddr) error {
+	_, err := conn.WriteTo([]byte("sparkyfish"), dst)
+	var errno syscall.Errno
+	if errors.As(err, &errno) && (errno == syscall.ECONNREFUSED || errno == syscall.EHOSTUNREACH || errno == syscall.ENETUNREACH) {
+		_, err = conn.WriteTo([]byte("sparkyfish"), dst)
+	}
+	return err
+}
+
+// readTraceError reads the next error from the socket's error queue, waiting
+// for one until its read deadline.  It returns the port of the probe that
+// caused it, who sent it and whether the path ends with them.  Errors that
+// weren't sent to us over ICMP are returned as EAGAIN.
+func readTraceError(rc syscall.RawConn) (port int, from net.IP, end bool, err error) {
+	buf := make([]byte, 64)
+	oob := make([]byte, 512)
+	var oobn int
+	var to syscall.Sockaddr
+	var rerr error
+	err = rc.Read(func(fd uintptr) bool {
+		_, oobn, _, to, rerr = syscall.Recvmsg(int(fd), buf, oob, syscall.MSG_ERRQUEUE)
+		return rerr != syscall.EAGAIN
+	})
+	if err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return 0, nil, false, err
+	}
+
+	switch sa := to.(type) {
+	case *syscall.SockaddrInet4:
+		port = sa.Port
+	case *syscall.SockaddrInet6:
+		port = sa.Port
+	}
+
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return 0, nil, false, err
+	}
+	for _, m := range msgs {
+		// struct sock_extended_err starts with the errno (4 bytes), then
+		// the origin, ICMP type and ICMP code
+		d := m.Data
+		if len(d) < sockExtendedErrLen {
+			continue
+		}
+		origin, typ := d[4], d[5]
+		switch {
+		case m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_RECVERR && origin == 2 && len(d) >= sockExtendedErrLen+8:
+			// A struct sockaddr_in follows, whose address starts 4 bytes in
+			from = net.IP(append([]byte(nil), d[sockExtendedErrLen+4:sockExtendedErrLen+8]...))
+			return port, from, typ != 11, nil // not time exceeded
+		case m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_RECVERR && origin == 3 && len(d) >= sockExtendedErrLen+24:
+			// A struct sockaddr_in6, whose address starts 8 bytes in
+			from = net.IP(append([]byte(nil), d[sockExtendedErrLen+8:sockExtendedErrLen+24]...))
+			return port, from, typ != 3, nil // not time exceeded
+		}
+	}
+	return 0, nil, false, syscall.EAGAIN
+}
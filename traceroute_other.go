@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package sparkyfish
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// traceUDP returns an error, as we only know how to hear about our probes
+// without a raw socket on Linux
+func (c *Client) traceUDP(ctx context.Context, dst net.IP) ([]traceReply, error) {
+	return nil, fmt.Errorf("tracing the route needs privileges to send ICMP on this platform; try running as root or administrator")
+}
@@ -0,0 +1,284 @@
+package sparkyfish
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// UDP tests and MTU probes exchange datagrams laid out like this:
+//
+//	type (1 byte) | session ID (8 bytes) | sequence number (8 bytes) | padding
+//
+// The session ID is handed out by the server over the TCP control connection.
+const (
+	DatagramSize           = 1200 // size of each datagram, small enough to avoid fragmentation on most paths
+	DatagramHeaderLen      = 17
+	DatagramHello     byte = 'H' // sent by the client during USND so the server knows where to send
+	DatagramData      byte = 'D'
+	DefaultUDPRate         = 10 // Mbit/s
+
+	udpHelloInterval = 200 * time.Millisecond
+	udpHelloTimeout  = 5 * time.Second
+	udpGracePeriod   = 250 * time.Millisecond // time allowed for stragglers to arrive after a USND test
+)
+
+// DatagramStats holds the datagram accounting for a UDP test
+type DatagramStats struct {
+	Sent        uint64  `json:"sent"`
+	Received    uint64  `json:"received"`
+	LossPercent float64 `json:"loss_percent"`
+}
+
+func newDatagramStats(sent, received uint64) *DatagramStats {
+	ds := &DatagramStats{Sent: sent, Received: received}
+	if sent > 0 && received < sent {
+		ds.LossPercent = float64(sent-received) / float64(sent) * 100
+	}
+	return ds
+}
+
+// RunUDPDownloadTest runs a server->client UDP test at c.UDPRate and reports
+// goodput and packet loss
+func (c *Client) RunUDPDownloadTest(ctx context.Context) (ThroughputResult, error) {
+	return c.runThroughputTest(ctx, UDPInbound)
+}
+
+// RunUDPUploadTest runs a client->server UDP test at c.UDPRate and reports
+// throughput and packet loss
+func (c *Client) RunUDPUploadTest(ctx context.Context) (ThroughputResult, error) {
+	return c.runThroughputTest(ctx, UDPOutbound)
+}
+
+// udpTest requests a UDP test over a new control connection and then sends or
+// receives datagrams, adding the size of each one to meter.
+func (c *Client) udpTest(ctx context.Context, testType TestType, meter *byteMeter) (*DatagramStats, error) {
+	rate := c.UDPRate
+	if rate == 0 {
+		rate = DefaultUDPRate
+	}
+
+	// Our datagrams wouldn't find their way through a WebSocket endpoint
+	if c.wsURL != nil {
+		return nil, fmt.Errorf("UDP tests can't be run over WebSocket")
+	}
+	// Nor would they over QUIC, which servers answer on a port of its own
+	if c.quic {
+		return nil, fmt.Errorf("UDP tests can't be run over QUIC")
+	}
+
+	s, err := c.beginSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer s.close()
+
+	if !s.info.Supports(CapUDP) {
+		return nil, fmt.Errorf("server doesn't support UDP tests")
+	}
+
+	if testType == UDPInbound {
+		err = s.writeCommand(fmt.Sprint("USND ", rate))
+	} else {
+		err = s.writeCommand("URCV")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The server responds with the session ID that our datagrams must carry
+	idLine, err := s.readLine()
+	if err != nil {
+		return nil, err
+	}
+	id, err := strconv.ParseUint(idLine, 16, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UDP session ID from server: %v", idLine)
+	}
+
+	// Datagrams go to the same address and port that we reached over TCP
+	network := strings.Replace(c.network(), "tcp", "udp", 1)
+	pc, err := c.dialer(network).Dial(network, s.conn.RemoteAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			pc.Close()
+		case <-s.done:
+		}
+	}()
+
+	var ds *DatagramStats
+	if testType == UDPInbound {
+		ds, err = c.udpReceive(s, pc, id, meter)
+	} else {
+		ds, err = c.udpSend(ctx, s, pc, id, rate, meter)
+	}
+
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return ds, err
+}
+
+// udpReceive counts the datagrams sent by the server until it reports how
+// many it sent
+func (c *Client) udpReceive(s *session, pc net.Conn, id uint64, meter *byteMeter) (*DatagramStats, error) {
+	var received uint64
+
+	flowing := make(chan struct{})
+	readerDone := make(chan struct{})
+
+	go func() {
+		defer close(readerDone)
+
+		buf := make([]byte, 65536)
+		for {
+			n, err := pc.Read(buf)
+			if err != nil {
+				return
+			}
+			if n < DatagramHeaderLen || buf[0] != DatagramData || binary.BigEndian.Uint64(buf[1:9]) != id {
+				continue
+			}
+
+			if atomic.AddUint64(&received, 1) == 1 {
+				close(flowing)
+			}
+
+			meter.add(DatagramSize)
+		}
+	}()
+
+	// Keep saying hello until the data starts flowing, in case our
+	// first hello gets lost
+	go func() {
+		hello := make([]byte, DatagramHeaderLen)
+		hello[0] = DatagramHello
+		binary.BigEndian.PutUint64(hello[1:9], id)
+
+		tick := time.NewTicker(udpHelloInterval)
+		defer tick.Stop()
+		timeout := time.NewTimer(udpHelloTimeout)
+		defer timeout.Stop()
+
+		for {
+			pc.Write(hello)
+			select {
+			case <-tick.C:
+			case <-flowing:
+				return
+			case <-readerDone:
+				return
+			case <-timeout.C:
+				return
+			}
+		}
+	}()
+
+	// When the server is done sending, it tells us how many datagrams it sent
+	s.conn.SetReadDeadline(time.Now().Add(time.Second*time.Duration(throughputTestLength) + udpHelloTimeout + udpHelloTimeout))
+	report, err := s.readLine()
+
+	if err == nil {
+		// Give any datagrams that are still in flight a chance to arrive
+		time.Sleep(udpGracePeriod)
+	}
+
+	pc.Close()
+	<-readerDone
+
+	if err != nil {
+		return nil, err
+	}
+
+	var sent, sentBytes uint64
+	_, err = fmt.Sscan(report, &sent, &sentBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UDP report from server: %v", report)
+	}
+
+	return newDatagramStats(sent, atomic.LoadUint64(&received)), nil
+}
+
+// udpSend sends sequence-numbered datagrams to the server at rate Mbit/s,
+// then asks the server how many it received
+func (c *Client) udpSend(ctx context.Context, s *session, pc net.Conn, id uint64, rate int, meter *byteMeter) (*DatagramStats, error) {
+	var sent uint64
+
+	datagram := make([]byte, DatagramSize)
+	datagram[0] = DatagramData
+	binary.BigEndian.PutUint64(datagram[1:9], id)
+
+	// Each datagram carries fresh data, so that none of them can be
+	// compressed
+	payload := NewPayload(false)
+
+	// Datagrams per second needed to hit the requested rate
+	perSecond := float64(rate) * 1000 * 1000 / 8 / float64(DatagramSize)
+
+	start := time.Now()
+	length := time.Second * time.Duration(throughputTestLength)
+
+	for {
+		elapsed := time.Since(start)
+		if elapsed >= length {
+			break
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		// Send as many datagrams as we need to catch up with our rate, then
+		// take a short nap.  A datagram that can't be sent is simply lost,
+		// so we don't care about errors here.
+		due := uint64(elapsed.Seconds() * perSecond)
+		if c.MaxBytes > 0 {
+			// Stop once we've used up our data allowance
+			allowed := uint64(c.MaxBytes / DatagramSize)
+			if sent >= allowed {
+				break
+			}
+			if due > allowed {
+				due = allowed
+			}
+		}
+
+		for ; sent < due; sent++ {
+			binary.BigEndian.PutUint64(datagram[9:17], sent)
+			payload.Read(datagram[DatagramHeaderLen:])
+			pc.Write(datagram)
+			meter.add(DatagramSize)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Tell the server that we're done and find out how much it received
+	err := s.writeCommand("FIN")
+	if err != nil {
+		return nil, err
+	}
+
+	s.conn.SetReadDeadline(time.Now().Add(udpHelloTimeout))
+	report, err := s.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	var received, receivedBytes uint64
+	_, err = fmt.Sscan(report, &received, &receivedBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UDP report from server: %v", report)
+	}
+
+	return newDatagramStats(sent, received), nil
+}
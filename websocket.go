@@ -0,0 +1,81 @@
+package sparkyfish
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// WebSocketPath is where servers answer speed tests over WebSocket
+const WebSocketPath = "/ws"
+
+// parseWebSocketURL parses the URL of a server's WebSocket endpoint.  The port
+// defaults to 80 for ws:// and 443 for wss://, and the path to WebSocketPath.
+func parseWebSocketURL(addr string) (*url.URL, error) {
+	u, err := url.Parse(addr)
+	if err != nil || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid WebSocket URL: %v", addr)
+	}
+
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "wss" {
+			port = "443"
+		}
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	if u.Path == "" {
+		u.Path = WebSocketPath
+	}
+
+	return u, nil
+}
+
+// upgrade performs the WebSocket handshake over conn, which is already
+// connected to the server, and returns the WebSocket.  Everything goes over
+// binary frames, as the test data isn't text.  The time that the TLS
+// handshake and the upgrade take is noted in timings.
+func (c *Client) upgrade(conn net.Conn, timings *ConnectTimings) (net.Conn, error) {
+	origin := "http://" + c.wsURL.Host
+	rwc := conn
+	if c.wsURL.Scheme == "wss" {
+		origin = "https://" + c.wsURL.Host
+		tc := &tls.Config{}
+		if c.TLSConfig != nil {
+			tc = c.TLSConfig.Clone()
+		}
+		if tc.ServerName == "" {
+			tc.ServerName = c.wsURL.Hostname()
+		}
+
+		// The handshake would happen with the upgrade anyway, but we
+		// do it first to time it by itself
+		tlsConn := tls.Client(conn, tc)
+		start := time.Now()
+		err := tlsConn.Handshake()
+		if err != nil {
+			return nil, fmt.Errorf("TLS handshake failed: %v", err)
+		}
+		timings.TLS = milliseconds(time.Since(start))
+		rwc = tlsConn
+	}
+
+	config, err := websocket.NewConfig(c.wsURL.String(), origin)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	ws, err := websocket.NewClient(config, rwc)
+	if err != nil {
+		return nil, fmt.Errorf("WebSocket handshake failed: %v", err)
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	timings.WebSocket = milliseconds(time.Since(start))
+
+	return ws, nil
+}